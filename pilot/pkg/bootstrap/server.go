@@ -174,7 +174,7 @@ type Server struct {
 // NewServer creates a new Server instance based on the provided arguments.
 func NewServer(args *PilotArgs) (*Server, error) {
 	e := &model.Environment{
-		ServiceDiscovery: aggregate.NewController(),
+		ServiceDiscovery: aggregate.NewController(aggregate.Options{}),
 		PushContext:      model.NewPushContext(),
 		DomainSuffix:     args.RegistryOptions.KubeOptions.DomainSuffix,
 	}
@@ -308,6 +308,11 @@ func NewServer(args *PilotArgs) (*Server, error) {
 		return s.EnvoyXdsServer.IsServerReady(), nil
 	})
 
+	s.addReadinessProbe("service registries", func() (bool, error) {
+		err := s.ServiceController().Readyz()
+		return err == nil, err
+	})
+
 	return s, nil
 }
 
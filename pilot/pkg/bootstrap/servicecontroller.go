@@ -70,6 +70,11 @@ func (s *Server) initServiceControllers(args *PilotArgs) error {
 		_ = s.serviceEntryStore.AppendWorkloadHandler(s.kubeRegistry.WorkloadInstanceHandler)
 	}
 
+	if features.EnableWorkloadAutoRegistration {
+		// Register the workloads of the sidecars unknown to the registries, e.g. VMs, as they connect
+		s.EnvoyXdsServer.WorkloadRegistry = serviceControllers
+	}
+
 	// Defer running of the service controllers.
 	s.addStartFunc(func(stop <-chan struct{}) error {
 		go serviceControllers.Run(stop)
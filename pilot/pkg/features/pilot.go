@@ -317,6 +317,10 @@ var (
 	EnableK8SServiceSelectWorkloadEntries = env.RegisterBoolVar("PILOT_ENABLE_K8S_SELECT_WORKLOAD_ENTRIES", true,
 		"If enabled, Kubernetes services with selectors will select workload entries with matching labels. "+
 			"It is safe to disable it if you are quite sure you don't need this feature").Get()
+	EnableWorkloadAutoRegistration = env.RegisterBoolVar("PILOT_ENABLE_WORKLOAD_AUTO_REGISTRATION", false,
+		"If enabled, the sidecars connecting without any service instance, e.g. VMs without a WorkloadEntry, "+
+			"are registered as workload instances selected by the service entries of their namespace "+
+			"until they disconnect. This feature is currently experimental, and is off by default.").Get()
 	InjectionWebhookConfigName = env.RegisterStringVar("INJECTION_WEBHOOK_CONFIG_NAME", "istio-sidecar-injector",
 		"Name of the mutatingwebhookconfiguration to patch, if istioctl is not used.")
 
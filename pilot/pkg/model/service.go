@@ -232,16 +232,21 @@ type ServiceInstance struct {
 }
 
 // DeepCopy creates a copy of ServiceInstance.
+// The service port is nil in the copy of an instance without one, such as the instance carrying
+// only the locality and labels of a proxy backing no service.
 func (instance *ServiceInstance) DeepCopy() *ServiceInstance {
-	return &ServiceInstance{
+	out := &ServiceInstance{
 		Service:  instance.Service.DeepCopy(),
 		Endpoint: instance.Endpoint.DeepCopy(),
-		ServicePort: &Port{
+	}
+	if instance.ServicePort != nil {
+		out.ServicePort = &Port{
 			Name:     instance.ServicePort.Name,
 			Port:     instance.ServicePort.Port,
 			Protocol: instance.ServicePort.Protocol,
-		},
+		}
 	}
+	return out
 }
 
 type WorkloadInstance struct {
@@ -428,6 +433,12 @@ type ServiceAttributes struct {
 	// The port that the user provides in the meshNetworks config is the service port.
 	// We translate that to the appropriate node port here.
 	ClusterExternalPorts map[string]map[uint32]uint32
+
+	// ClusterNetworks is a mapping between a cluster name and the networks the endpoints of
+	// the service in the cluster are on, sorted. Used by the aggregator to aggregate the networks
+	// advertised by the registries of the clusters where the service resides, so that split
+	// horizon EDS can tell which network gateways lead to the service.
+	ClusterNetworks map[string][]string
 }
 
 // ServiceDiscovery enumerates Istio service instances.
@@ -286,3 +286,17 @@ func BenchmarkBuildSubsetKey(b *testing.B) {
 		_ = BuildSubsetKey(TrafficDirectionInbound, "v1", "someHost", 80)
 	}
 }
+
+func TestServiceInstanceDeepCopyWithoutPort(t *testing.T) {
+	instance := &ServiceInstance{
+		Service:  &Service{Attributes: ServiceAttributes{Namespace: "legacy"}},
+		Endpoint: &IstioEndpoint{Address: "10.0.0.1", Locality: Locality{Label: "region1/zone1"}},
+	}
+	cp := instance.DeepCopy()
+	if cp.ServicePort != nil {
+		t.Fatalf("expected no service port, got %v", cp.ServicePort)
+	}
+	if cp.Endpoint == instance.Endpoint || cp.Endpoint.Address != "10.0.0.1" {
+		t.Fatalf("expected a copy of the endpoint, got %v", cp.Endpoint)
+	}
+}
@@ -287,6 +287,10 @@ func (configgen *ConfigGeneratorImpl) buildInboundClusters(cb *ClusterBuilder, i
 
 		have := make(map[*model.Port]bool)
 		for _, instance := range instances {
+			if instance.ServicePort == nil {
+				// The instance only carries the locality of a proxy backing no service.
+				continue
+			}
 			// Filter out service instances with the same port as we are going to mark them as duplicates any way
 			// in normalizeClusters method.
 			if !have[instance.ServicePort] {
@@ -62,7 +62,7 @@ func (configgen *ConfigGeneratorImpl) buildGatewayListeners(builder *ListenerBui
 		var si *model.ServiceInstance
 		services := make(map[host.Name]struct{}, len(builder.node.ServiceInstances))
 		for _, w := range builder.node.ServiceInstances {
-			if w.ServicePort.Port == int(portNumber) {
+			if w.ServicePort != nil && w.ServicePort.Port == int(portNumber) {
 				if si == nil {
 					si = w
 				}
@@ -506,6 +506,10 @@ func (configgen *ConfigGeneratorImpl) buildSidecarInboundListeners(
 		//	The pilot will generate three listeners, the last one will use protocol sniffing.
 		//
 		for _, instance := range node.ServiceInstances {
+			if instance.ServicePort == nil {
+				// The instance only carries the locality of a proxy backing no service.
+				continue
+			}
 			endpoint := instance.Endpoint
 			// Inbound listeners will be aggregated into a single virtual listener (port 15006)
 			// As a result, we don't need to worry about binding to the endpoint IP; we already know
@@ -0,0 +1,70 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"istio.io/pkg/log"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/labels"
+)
+
+// defaultCircuitBreakerCooldown is the cooldown of Options.CircuitBreakerThreshold when
+// Options.CircuitBreakerCooldown is not set.
+const defaultCircuitBreakerCooldown = 30 * time.Second
+
+// cooldown returns the time the circuit of the registry stays open.
+func (r *registryEntry) cooldown() time.Duration {
+	if r.breakerCooldown > 0 {
+		return r.breakerCooldown
+	}
+	return defaultCircuitBreakerCooldown
+}
+
+// circuitOpened reports the opening of the circuit of the registry after the given failure.
+func (r *registryEntry) circuitOpened(err error) {
+	circuitOpens.With(clusterTag.Value(r.Cluster())).Increment()
+	log.Warnf("Registry %s/%s failed %d consecutive times, skipping it for %v: %v",
+		r.Provider(), r.Cluster(), r.breakerThreshold, r.cooldown(), err)
+}
+
+// circuitOpen returns true if the registry must be skipped, its circuit being open.
+func (r *registryEntry) circuitOpen() bool {
+	until := atomic.LoadInt64(&r.openUntil)
+	return until != 0 && time.Now().UnixNano() < until
+}
+
+// circuitError returns an error wrapping ErrCircuitOpen if the circuit of the registry is open,
+// nil if the registry can be called.
+func (r *registryEntry) circuitError() error {
+	if !r.circuitOpen() {
+		return nil
+	}
+	return fmt.Errorf("%w: %s/%s", ErrCircuitOpen, r.Provider(), r.Cluster())
+}
+
+// registryInstances retrieves the instances of a service from the registry, unless its circuit
+// is open.
+func registryInstances(r *registryEntry, svc *model.Service, port int,
+	labels labels.Collection) ([]*model.ServiceInstance, error) {
+	if err := r.circuitError(); err != nil {
+		return nil, err
+	}
+	return r.InstancesByPort(svc, port, labels)
+}
@@ -0,0 +1,129 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
+)
+
+// unreachableDiscovery counts the calls to the registry, failing them with err when set.
+type unreachableDiscovery struct {
+	*mock.ServiceDiscovery
+	err   error
+	calls int
+}
+
+func (d *unreachableDiscovery) Services() ([]*model.Service, error) {
+	d.calls++
+	if d.err != nil {
+		return nil, d.err
+	}
+	return d.ServiceDiscovery.Services()
+}
+
+func (d *unreachableDiscovery) GetService(hostname host.Name) (*model.Service, error) {
+	d.calls++
+	if d.err != nil {
+		return nil, d.err
+	}
+	return d.ServiceDiscovery.GetService(hostname)
+}
+
+func (d *unreachableDiscovery) InstancesByPort(svc *model.Service, port int, labels labels.Collection) ([]*model.ServiceInstance, error) {
+	d.calls++
+	if d.err != nil {
+		return nil, d.err
+	}
+	return d.ServiceDiscovery.InstancesByPort(svc, port, labels)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	unreachable := &unreachableDiscovery{
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{
+			mock.WorldService.Hostname: mock.MakeService("world.default.svc.cluster.local", "10.2.0.2"),
+		}, 1),
+		err: errors.New("mock API server unreachable"),
+	}
+	ctl := NewController(Options{CircuitBreakerThreshold: 2, CircuitBreakerCooldown: 50 * time.Millisecond})
+	ctl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-1",
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{mock.HelloService.Hostname: mock.HelloService}, 1),
+		Controller:       &mock.Controller{},
+	})
+	ctl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-2",
+		ServiceDiscovery: unreachable,
+		Controller:       &mock.Controller{},
+	})
+
+	// The failures are reported until the threshold is reached.
+	for i := 0; i < 2; i++ {
+		if _, err := ctl.Services(); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("Services() error = %v, expected the error of cluster-2", err)
+		}
+	}
+	if unreachable.calls != 2 {
+		t.Fatalf("expected 2 calls to cluster-2, got %d", unreachable.calls)
+	}
+
+	// The open circuit skips the registry, the other registries still being served.
+	services, err := ctl.Services()
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Services() error = %v, expected ErrCircuitOpen", err)
+	}
+	if len(services) != 1 || services[0].Hostname != mock.HelloService.Hostname {
+		t.Fatalf("expected the services of cluster-1, got %v", services)
+	}
+	if _, err := ctl.GetService(mock.WorldService.Hostname); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("GetService() error = %v, expected ErrCircuitOpen", err)
+	}
+	if _, err := ctl.InstancesByPort(mock.WorldService, 80, nil); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("InstancesByPort() error = %v, expected ErrCircuitOpen", err)
+	}
+	if unreachable.calls != 2 {
+		t.Fatalf("expected cluster-2 not to be called while its circuit is open, got %d calls", unreachable.calls)
+	}
+	if health := ctl.HealthStatus(); health[0].CircuitOpen || !health[1].CircuitOpen {
+		t.Fatalf("expected the circuit of cluster-2 only to be open, got %+v", health)
+	}
+	if unreachable.calls != 2 {
+		t.Fatalf("expected the health of cluster-2 to be read without calling it, got %d calls", unreachable.calls)
+	}
+	// The skipped calls do not replace the error of the registry.
+	if err := ctl.registries[1].lastError(); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected the last error of cluster-2 to be its own, got %v", err)
+	}
+
+	// Once the cooldown elapsed, a successful call closes the circuit.
+	unreachable.err = nil
+	time.Sleep(60 * time.Millisecond)
+	services, err = ctl.Services()
+	if err != nil || len(services) != 2 {
+		t.Fatalf("Services() = %v, %v, expected the services of both clusters", services, err)
+	}
+	if _, err := ctl.GetService(mock.WorldService.Hostname); err != nil {
+		t.Fatalf("GetService() error = %v, expected the circuit of cluster-2 to be closed", err)
+	}
+}
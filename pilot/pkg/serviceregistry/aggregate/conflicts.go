@@ -0,0 +1,506 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+)
+
+// VIPConflictKind is the kind of inconsistency reported by ValidateClusterVIPs.
+type VIPConflictKind string
+
+const (
+	// AddressConflict is reported when clusters assign the same VIP to different hostnames.
+	AddressConflict VIPConflictKind = "address"
+	// PortConflict is reported when clusters expose different ports for the same hostname.
+	PortConflict VIPConflictKind = "port"
+)
+
+// VIPConflict is an inconsistency between the copies of services reported by different clusters.
+type VIPConflict struct {
+	Kind VIPConflictKind
+	// Address is the VIP shared by different hostnames, only set for address conflicts.
+	Address string
+	// Hostnames are the hostnames involved in the conflict, sorted.
+	Hostnames []host.Name
+	// Clusters are the clusters involved in the conflict, sorted.
+	Clusters []string
+}
+
+// ValidateClusterVIPs audits the services of the cluster registries, reporting the VIPs assigned
+// to different hostnames by different clusters and the hostnames exposing inconsistent ports
+// across clusters. Registries whose services are not merged by cluster are not audited, and
+// registries failing to list their services are skipped. Conflicts are sorted by kind, address
+// and hostname.
+func (c *Controller) ValidateClusterVIPs() []VIPConflict {
+	return vipConflicts(c.listRegistryServices())
+}
+
+// registryServices are the services listed from a registry, for the conflict audits.
+type registryServices struct {
+	// name is the cluster ID of the registry, its provider if it has no cluster ID.
+	name string
+	// merged is set if the services of the registry are merged by cluster.
+	merged   bool
+	services []*model.Service
+}
+
+// listRegistryServices lists the services of each registry, skipping the registries failing to
+// list them, so that the audits share a single snapshot of the registries.
+func (c *Controller) listRegistryServices() []registryServices {
+	registries := c.registryEntries()
+	out := make([]registryServices, 0, len(registries))
+	for _, r := range registries {
+		svcs, err := r.Services()
+		if err != nil {
+			continue
+		}
+		name := c.normalizeClusterID(r.Cluster())
+		if name == "" {
+			name = string(r.Provider())
+		}
+		out = append(out, registryServices{name: name, merged: mergedByCluster(r), services: svcs})
+	}
+	return out
+}
+
+// vipConflicts reports the VIP and port conflicts among the services of the cluster registries.
+func vipConflicts(listing []registryServices) []VIPConflict {
+	// clustersByAddress holds, by VIP, the clusters reporting each hostname with the VIP.
+	clustersByAddress := make(map[string]map[host.Name][]string)
+	// portsByHostname holds, by hostname, the clusters reporting each port signature.
+	portsByHostname := make(map[host.Name]map[string][]string)
+
+	for _, l := range listing {
+		if !l.merged {
+			continue
+		}
+		cluster := l.name
+		for _, s := range l.services {
+			s.Mutex.RLock()
+			address, hostname, signature := s.Address, s.Hostname, portSignature(s.Ports)
+			s.Mutex.RUnlock()
+			if address != "" {
+				byHostname := clustersByAddress[address]
+				if byHostname == nil {
+					byHostname = make(map[host.Name][]string)
+					clustersByAddress[address] = byHostname
+				}
+				byHostname[hostname] = append(byHostname[hostname], cluster)
+			}
+			byPorts := portsByHostname[hostname]
+			if byPorts == nil {
+				byPorts = make(map[string][]string)
+				portsByHostname[hostname] = byPorts
+			}
+			byPorts[signature] = append(byPorts[signature], cluster)
+		}
+	}
+
+	var conflicts []VIPConflict
+	for address, byHostname := range clustersByAddress {
+		if len(byHostname) < 2 {
+			continue
+		}
+		conflict := VIPConflict{Kind: AddressConflict, Address: address}
+		clusters := make(map[string]struct{})
+		for hostname, hostClusters := range byHostname {
+			conflict.Hostnames = append(conflict.Hostnames, hostname)
+			for _, cluster := range hostClusters {
+				clusters[cluster] = struct{}{}
+			}
+		}
+		// Hostnames sharing a VIP within a single cluster are left to the cluster itself.
+		if len(clusters) < 2 {
+			continue
+		}
+		conflict.Clusters = sortedKeys(clusters)
+		sort.Slice(conflict.Hostnames, func(i, j int) bool { return conflict.Hostnames[i] < conflict.Hostnames[j] })
+		conflicts = append(conflicts, conflict)
+	}
+	for hostname, byPorts := range portsByHostname {
+		if len(byPorts) < 2 {
+			continue
+		}
+		clusters := make(map[string]struct{})
+		for _, portClusters := range byPorts {
+			for _, cluster := range portClusters {
+				clusters[cluster] = struct{}{}
+			}
+		}
+		conflicts = append(conflicts, VIPConflict{
+			Kind:      PortConflict,
+			Hostnames: []host.Name{hostname},
+			Clusters:  sortedKeys(clusters),
+		})
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool {
+		if conflicts[i].Kind != conflicts[j].Kind {
+			return conflicts[i].Kind < conflicts[j].Kind
+		}
+		if conflicts[i].Address != conflicts[j].Address {
+			return conflicts[i].Address < conflicts[j].Address
+		}
+		return conflicts[i].Hostnames[0] < conflicts[j].Hostnames[0]
+	})
+	return conflicts
+}
+
+// portSignature returns a key identifying the name, number and protocol of the ports, regardless of their order.
+func portSignature(ports model.PortList) string {
+	keys := make([]string, 0, len(ports))
+	for _, p := range ports {
+		keys = append(keys, fmt.Sprintf("%s/%d/%s", p.Name, p.Port, p.Protocol))
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// defaultResolutionPrecedence orders the resolutions from the most specific.
+var defaultResolutionPrecedence = []model.Resolution{model.ClientSideLB, model.DNSLB, model.Passthrough}
+
+// ServiceConflict is a disagreement between clusters on an attribute of a service.
+type ServiceConflict struct {
+	Hostname host.Name
+	// Attribute is the attribute of the service the clusters disagree on, e.g. "resolution".
+	Attribute string
+	// Values holds the values of the attribute by cluster, registries without cluster ID being
+	// identified by provider.
+	Values map[string]string
+}
+
+type serviceConflictKey struct {
+	hostname  host.Name
+	attribute string
+}
+
+// GetServiceResolution returns the resolution of the service across the registries, and whether
+// all the registries having the service agree on it. When they disagree, the resolution with the
+// highest Options.ResolutionPrecedence is returned and the disagreement is recorded, reported by
+// ServiceConflicts until a later lookup finds the registries agreeing. False is also returned
+// when no registry has the service.
+func (c *Controller) GetServiceResolution(hostname host.Name) (model.Resolution, bool, error) {
+	defer c.notifyConflicts()
+	var errs error
+	failed := 0
+	values := make(map[string]string)
+	resolutions := make(map[model.Resolution]struct{})
+	registries := c.registryEntries()
+	for _, r := range registries {
+		service, err := c.registryService(r, hostname)
+		r.recordResult(err)
+		if err != nil {
+			errs = appendRegistryError(errs, r, err)
+			failed++
+			continue
+		}
+		if service == nil || c.namespaceExcluded(service.Attributes.Namespace) {
+			continue
+		}
+		name := c.normalizeClusterID(r.Cluster())
+		if name == "" {
+			name = string(r.Provider())
+		}
+		service.Mutex.RLock()
+		resolution := service.Resolution
+		service.Mutex.RUnlock()
+		values[name] = resolution.String()
+		resolutions[resolution] = struct{}{}
+	}
+	err := registriesError(len(registries), failed, errs)
+	if len(resolutions) == 0 {
+		return model.ClientSideLB, false, err
+	}
+
+	key := serviceConflictKey{hostname: hostname, attribute: "resolution"}
+	if len(resolutions) == 1 {
+		c.clearServiceConflict(key)
+		for resolution := range resolutions {
+			return resolution, true, err
+		}
+	}
+	c.recordServiceConflict(key, values)
+	return c.preferredResolution(resolutions), false, err
+}
+
+// preferredResolution returns the resolution with the highest precedence, the lowest one if
+// none is ordered by the precedence.
+func (c *Controller) preferredResolution(resolutions map[model.Resolution]struct{}) model.Resolution {
+	precedence := c.opts.ResolutionPrecedence
+	if len(precedence) == 0 {
+		precedence = defaultResolutionPrecedence
+	}
+	for _, resolution := range precedence {
+		if _, ok := resolutions[resolution]; ok {
+			return resolution
+		}
+	}
+	first := true
+	var out model.Resolution
+	for resolution := range resolutions {
+		if first || resolution < out {
+			out, first = resolution, false
+		}
+	}
+	return out
+}
+
+// recordServiceConflict records a disagreement between clusters, queuing its notification to the
+// Options.ConflictHandler if the disagreement was not already recorded with the same values. The
+// lookups may detect the disagreements while holding mergeLock: they call notifyConflicts once
+// they released it.
+func (c *Controller) recordServiceConflict(key serviceConflictKey, values map[string]string) {
+	conflict := ServiceConflict{Hostname: key.hostname, Attribute: key.attribute, Values: values}
+	c.conflictLock.Lock()
+	defer c.conflictLock.Unlock()
+	if c.serviceConflicts == nil {
+		c.serviceConflicts = make(map[serviceConflictKey]ServiceConflict)
+	}
+	previous, found := c.serviceConflicts[key]
+	c.serviceConflicts[key] = conflict
+
+	if c.opts.ConflictHandler == nil || (found && sameValues(previous.Values, values)) {
+		return
+	}
+	notified := make(map[string]string, len(values))
+	for cluster, value := range values {
+		notified[cluster] = value
+	}
+	conflict.Values = notified
+	c.pendingConflicts = append(c.pendingConflicts, conflict)
+}
+
+// notifyConflicts delivers the queued disagreements to the Options.ConflictHandler. It must not be
+// called with mergeLock held.
+func (c *Controller) notifyConflicts() {
+	if c.opts.ConflictHandler == nil {
+		return
+	}
+	c.conflictLock.Lock()
+	pending := c.pendingConflicts
+	c.pendingConflicts = nil
+	c.conflictLock.Unlock()
+	for _, conflict := range pending {
+		c.opts.ConflictHandler(conflict)
+	}
+}
+
+func sameValues(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// mergePorts records a disagreement if the copies of a service, by cluster, expose different ports.
+func (c *Controller) mergePorts(hostname host.Name, signatures map[string]string) {
+	key := serviceConflictKey{hostname: hostname, attribute: "ports"}
+	first := ""
+	for _, signature := range signatures {
+		if first == "" {
+			first = signature
+		} else if signature != first {
+			c.recordServiceConflict(key, signatures)
+			return
+		}
+	}
+	c.clearServiceConflict(key)
+}
+
+func (c *Controller) clearServiceConflict(key serviceConflictKey) {
+	c.conflictLock.Lock()
+	defer c.conflictLock.Unlock()
+	delete(c.serviceConflicts, key)
+}
+
+// clearHostnameConflicts drops the disagreements recorded for the hostname, once its service is
+// deleted from a cluster: the next lookup detects them again if the copies left still disagree.
+func (c *Controller) clearHostnameConflicts(hostname host.Name) {
+	hostname = c.hostnameKey(hostname)
+	c.conflictLock.Lock()
+	defer c.conflictLock.Unlock()
+	for key := range c.serviceConflicts {
+		if c.hostnameKey(key.hostname) == hostname {
+			delete(c.serviceConflicts, key)
+		}
+	}
+}
+
+// ServiceConflicts returns the disagreements between clusters on the attributes of services, as
+// last detected by the service lookups, sorted by hostname and attribute.
+func (c *Controller) ServiceConflicts() []ServiceConflict {
+	c.conflictLock.Lock()
+	out := make([]ServiceConflict, 0, len(c.serviceConflicts))
+	for _, conflict := range c.serviceConflicts {
+		values := make(map[string]string, len(conflict.Values))
+		for cluster, value := range conflict.Values {
+			values[cluster] = value
+		}
+		conflict.Values = values
+		out = append(out, conflict)
+	}
+	c.conflictLock.Unlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Hostname != out[j].Hostname {
+			return out[i].Hostname < out[j].Hostname
+		}
+		return out[i].Attribute < out[j].Attribute
+	})
+	return out
+}
+
+// ConflictReportEntry is a disagreement between registries reported by ConflictReport.
+type ConflictReportEntry struct {
+	// Hostname is the service the registries disagree on, empty for address conflicts.
+	Hostname host.Name `json:"hostname,omitempty"`
+	// Field is the attribute the registries disagree on: "address", "ports", "resolution" or
+	// "meshExternal".
+	Field string `json:"field"`
+	// Address is the VIP assigned to different hostnames, only set for address conflicts.
+	Address string `json:"address,omitempty"`
+	// Values holds the differing values by cluster, the registries without cluster ID being
+	// identified by provider. For address conflicts, the values are the hostnames of the VIP.
+	Values map[string]string `json:"values"`
+}
+
+// ConflictReport audits the services of the registries and reports, as indented JSON, the
+// conflicts detected by ValidateClusterVIPs along with the disagreements of the copies of the
+// services on their resolution and MeshExternal flag, sorted by field, address and hostname.
+// Ports, addresses and MeshExternal flags are compared across the cluster registries only, the
+// resolutions across all the registries, as by GetServiceResolution.
+//
+// The report is computed from a single listing of the services of each registry, the registries
+// failing to list them being skipped, rather than from the conflicts recorded by the lookups,
+// which may each come from a different state of the registries. It does not record the conflicts
+// found, and can run concurrently with the pushes.
+func (c *Controller) ConflictReport() ([]byte, error) {
+	listing := c.listRegistryServices()
+
+	entries := make([]ConflictReportEntry, 0)
+	for _, conflict := range vipConflicts(listing) {
+		if conflict.Kind != AddressConflict {
+			continue
+		}
+		entries = append(entries, ConflictReportEntry{
+			Field:   string(AddressConflict),
+			Address: conflict.Address,
+			Values:  addressHostnames(listing, conflict.Address),
+		})
+	}
+
+	// values holds, by hostname and field, the values of the copies by registry.
+	values := make(map[host.Name]map[string]map[string]string)
+	add := func(hostname host.Name, field, name, value string) {
+		byField := values[hostname]
+		if byField == nil {
+			byField = make(map[string]map[string]string)
+			values[hostname] = byField
+		}
+		if byField[field] == nil {
+			byField[field] = make(map[string]string)
+		}
+		byField[field][name] = value
+	}
+	for _, l := range listing {
+		for _, s := range l.services {
+			s.Mutex.RLock()
+			add(s.Hostname, "resolution", l.name, s.Resolution.String())
+			if l.merged {
+				add(s.Hostname, "ports", l.name, portSignature(s.Ports))
+				add(s.Hostname, "meshExternal", l.name, strconv.FormatBool(s.MeshExternal))
+			}
+			s.Mutex.RUnlock()
+		}
+	}
+	for hostname, byField := range values {
+		for field, byName := range byField {
+			if !differ(byName) {
+				continue
+			}
+			entries = append(entries, ConflictReportEntry{Hostname: hostname, Field: field, Values: byName})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Field != entries[j].Field {
+			return entries[i].Field < entries[j].Field
+		}
+		if entries[i].Address != entries[j].Address {
+			return entries[i].Address < entries[j].Address
+		}
+		return entries[i].Hostname < entries[j].Hostname
+	})
+	return json.MarshalIndent(entries, "", "  ")
+}
+
+// addressHostnames returns, by cluster, the sorted hostnames the cluster assigns the VIP to, joined by commas.
+func addressHostnames(listing []registryServices, address string) map[string]string {
+	out := make(map[string]string)
+	for _, l := range listing {
+		if !l.merged {
+			continue
+		}
+		var hostnames []string
+		for _, s := range l.services {
+			s.Mutex.RLock()
+			matches := s.Address == address
+			s.Mutex.RUnlock()
+			if matches {
+				hostnames = append(hostnames, string(s.Hostname))
+			}
+		}
+		if len(hostnames) > 0 {
+			sort.Strings(hostnames)
+			out[l.name] = strings.Join(hostnames, ",")
+		}
+	}
+	return out
+}
+
+// differ returns true if the values are not all the same.
+func differ(values map[string]string) bool {
+	first, seen := "", false
+	for _, v := range values {
+		if !seen {
+			first, seen = v, true
+		} else if v != first {
+			return true
+		}
+	}
+	return false
+}
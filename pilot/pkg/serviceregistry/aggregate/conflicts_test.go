@@ -0,0 +1,399 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/protocol"
+)
+
+func TestValidateClusterVIPs(t *testing.T) {
+	hello1 := mock.MakeService("hello.default.svc.cluster.local", "10.0.0.1")
+	hello2 := mock.MakeService("hello.default.svc.cluster.local", "10.0.0.2")
+	// world reuses the VIP of hello in cluster-1, and exposes a single port in cluster-3.
+	world2 := mock.MakeService("world.default.svc.cluster.local", "10.0.0.1")
+	world3 := mock.MakeService("world.default.svc.cluster.local", "10.0.0.3")
+	world3.Ports = world3.Ports[:1]
+	// An external service sharing the VIP is not audited.
+	external := mock.MakeService("external.example.com", "10.0.0.1")
+
+	aggregateCtl := NewController(Options{})
+	for cluster, svcs := range map[string][]*model.Service{
+		"cluster-1": {hello1},
+		"cluster-2": {hello2, world2},
+		"cluster-3": {world3},
+		"":          {external},
+	} {
+		services := make(map[host.Name]*model.Service)
+		for _, s := range svcs {
+			services[s.Hostname] = s
+		}
+		aggregateCtl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        cluster,
+			ServiceDiscovery: mock.NewDiscovery(services, 1),
+			Controller:       &mock.Controller{},
+		})
+	}
+
+	expected := []VIPConflict{
+		{
+			Kind:      AddressConflict,
+			Address:   "10.0.0.1",
+			Hostnames: []host.Name{hello1.Hostname, world2.Hostname},
+			Clusters:  []string{"cluster-1", "cluster-2"},
+		},
+		{
+			Kind:      PortConflict,
+			Hostnames: []host.Name{world2.Hostname},
+			Clusters:  []string{"cluster-2", "cluster-3"},
+		},
+	}
+	if got := aggregateCtl.ValidateClusterVIPs(); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("ValidateClusterVIPs() = %+v, expected %+v", got, expected)
+	}
+}
+
+func TestGetServiceResolution(t *testing.T) {
+	hello1 := mock.MakeService("hello.default.svc.cluster.local", "10.0.0.1")
+	hello2 := mock.MakeService("hello.default.svc.cluster.local", "10.0.0.2")
+	hello2.Resolution = model.Passthrough
+	world1 := mock.MakeService("world.default.svc.cluster.local", "10.0.1.1")
+	world2 := mock.MakeService("world.default.svc.cluster.local", "10.0.1.2")
+
+	discovery2 := mock.NewDiscovery(map[host.Name]*model.Service{hello2.Hostname: hello2, world2.Hostname: world2}, 1)
+	newController := func(opts Options) *Controller {
+		ctl := NewController(opts)
+		ctl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        "cluster-1",
+			ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{hello1.Hostname: hello1, world1.Hostname: world1}, 1),
+			Controller:       &mock.Controller{},
+		})
+		ctl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        "cluster-2",
+			ServiceDiscovery: discovery2,
+			Controller:       &mock.Controller{},
+		})
+		return ctl
+	}
+
+	ctl := newController(Options{})
+	resolution, agree, err := ctl.GetServiceResolution(world1.Hostname)
+	if err != nil || !agree || resolution != model.ClientSideLB {
+		t.Fatalf("GetServiceResolution(%s) = %v, %v, %v", world1.Hostname, resolution, agree, err)
+	}
+	if _, agree, _ := ctl.GetServiceResolution("unknown.default.svc.cluster.local"); agree {
+		t.Fatal("expected an unknown service not to be agreed on")
+	}
+	if conflicts := ctl.ServiceConflicts(); len(conflicts) != 0 {
+		t.Fatalf("expected no conflict, got %v", conflicts)
+	}
+
+	// The most specific resolution is returned when the clusters disagree.
+	resolution, agree, err = ctl.GetServiceResolution(hello1.Hostname)
+	if err != nil || agree || resolution != model.ClientSideLB {
+		t.Fatalf("GetServiceResolution(%s) = %v, %v, %v", hello1.Hostname, resolution, agree, err)
+	}
+	expected := []ServiceConflict{{
+		Hostname:  hello1.Hostname,
+		Attribute: "resolution",
+		Values:    map[string]string{"cluster-1": "ClientSide", "cluster-2": "Passthrough"},
+	}}
+	if conflicts := ctl.ServiceConflicts(); !reflect.DeepEqual(conflicts, expected) {
+		t.Fatalf("expected conflicts %v, got %v", expected, conflicts)
+	}
+
+	// The conflict is cleared once the clusters agree.
+	hello2.Resolution = model.ClientSideLB
+	if _, agree, _ := ctl.GetServiceResolution(hello1.Hostname); !agree {
+		t.Fatal("expected the clusters to agree")
+	}
+	if conflicts := ctl.ServiceConflicts(); len(conflicts) != 0 {
+		t.Fatalf("expected no conflict, got %v", conflicts)
+	}
+
+	// The precedence is configurable.
+	hello2.Resolution = model.Passthrough
+	ctl = newController(Options{ResolutionPrecedence: []model.Resolution{model.Passthrough}})
+	if resolution, agree, _ := ctl.GetServiceResolution(hello1.Hostname); agree || resolution != model.Passthrough {
+		t.Fatalf("expected the configured precedence to pick Passthrough, got %v, %v", resolution, agree)
+	}
+}
+
+func TestMeshExternalMerge(t *testing.T) {
+	internal := mock.MakeService("hello.default.svc.cluster.local", "10.0.0.1")
+	external := mock.MakeService("hello.default.svc.cluster.local", "10.0.0.2")
+	external.MeshExternal = true
+
+	for _, policy := range []MeshExternalPolicy{ExternalWins, InternalWins} {
+		for _, externalFirst := range []bool{true, false} {
+			copies := []*model.Service{internal, external}
+			if externalFirst {
+				copies = []*model.Service{external, internal}
+			}
+			ctl := NewController(Options{MeshExternalPolicy: policy})
+			for i, svc := range copies {
+				ctl.AddRegistry(serviceregistry.Simple{
+					ProviderID:       serviceregistry.Kubernetes,
+					ClusterID:        fmt.Sprintf("cluster-%d", i+1),
+					ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{svc.Hostname: svc}, 1),
+					Controller:       &mock.Controller{},
+				})
+			}
+			expected := policy == ExternalWins
+
+			svcs, err := ctl.Services()
+			if err != nil || len(svcs) != 1 {
+				t.Fatalf("Services() = %v, %v", svcs, err)
+			}
+			if svcs[0].MeshExternal != expected {
+				t.Errorf("policy %v, external first %v: expected Services() MeshExternal %v", policy, externalFirst, expected)
+			}
+			svc, err := ctl.GetService(internal.Hostname)
+			if err != nil || svc == nil {
+				t.Fatalf("GetService() = %v, %v", svc, err)
+			}
+			if svc.MeshExternal != expected {
+				t.Errorf("policy %v, external first %v: expected GetService() MeshExternal %v", policy, externalFirst, expected)
+			}
+
+			conflicts := ctl.ServiceConflicts()
+			if len(conflicts) != 1 || conflicts[0].Attribute != "meshExternal" {
+				t.Fatalf("expected the meshExternal conflict, got %v", conflicts)
+			}
+			externalCluster := "cluster-2"
+			if externalFirst {
+				externalCluster = "cluster-1"
+			}
+			if conflicts[0].Values[externalCluster] != "true" {
+				t.Fatalf("expected %s to be reported mesh external, got %v", externalCluster, conflicts[0].Values)
+			}
+			// The registry copies are not modified.
+			if internal.MeshExternal || !external.MeshExternal {
+				t.Fatal("expected the registry services to be unmodified")
+			}
+		}
+	}
+}
+
+func TestConflictHandler(t *testing.T) {
+	hello1 := mock.MakeService("hello.default.svc.cluster.local", "10.0.0.1")
+	hello2 := mock.MakeService("hello.default.svc.cluster.local", "10.0.0.2")
+	hello2.Ports = append(model.PortList{&model.Port{Name: "grpc", Port: 90, Protocol: protocol.GRPC}}, hello2.Ports...)
+
+	var conflicts []ServiceConflict
+	ctl := NewController(Options{ConflictHandler: func(conflict ServiceConflict) {
+		conflicts = append(conflicts, conflict)
+	}})
+	for i, svc := range []*model.Service{hello1, hello2} {
+		ctl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        fmt.Sprintf("cluster-%d", i+1),
+			ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{svc.Hostname: svc}, 1),
+			Controller:       &mock.Controller{},
+		})
+	}
+
+	if _, err := ctl.Services(); err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 || conflicts[0].Hostname != hello1.Hostname || conflicts[0].Attribute != "ports" {
+		t.Fatalf("expected the ports conflict, got %v", conflicts)
+	}
+	if _, ok := conflicts[0].Values["cluster-2"]; !ok || len(conflicts[0].Values) != 2 {
+		t.Fatalf("expected the values of both clusters, got %v", conflicts[0].Values)
+	}
+
+	// The persistent conflict is not notified again.
+	if _, err := ctl.GetService(hello1.Hostname); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctl.Services(); err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 {
+		t.Fatalf("expected a single notification, got %v", conflicts)
+	}
+
+	// A conflict arising again after being resolved is notified.
+	ports := hello2.Ports
+	hello2.Ports = hello1.Ports
+	if _, err := ctl.GetService(hello1.Hostname); err != nil {
+		t.Fatal(err)
+	}
+	if got := ctl.ServiceConflicts(); len(got) != 0 {
+		t.Fatalf("expected no conflict, got %v", got)
+	}
+	hello2.Ports = ports
+	if _, err := ctl.GetService(hello1.Hostname); err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 2 {
+		t.Fatalf("expected the conflict to be notified again, got %v", conflicts)
+	}
+}
+
+func TestConflictHandlerCallingBack(t *testing.T) {
+	hello1 := mock.MakeService("hello.default.svc.cluster.local", "10.0.0.1")
+	hello2 := mock.MakeService("hello.default.svc.cluster.local", "10.0.0.2")
+	hello2.Ports = append(model.PortList{&model.Port{Name: "grpc", Port: 90, Protocol: protocol.GRPC}}, hello2.Ports...)
+
+	var ctl *Controller
+	notified := 0
+	ctl = NewController(Options{ConflictHandler: func(conflict ServiceConflict) {
+		notified++
+		// The handler runs once the listing released its locks, looking the service up again.
+		if _, err := ctl.Services(); err != nil {
+			t.Error(err)
+		}
+		if _, err := ctl.GetService(conflict.Hostname); err != nil {
+			t.Error(err)
+		}
+	}})
+	for i, svc := range []*model.Service{hello1, hello2} {
+		ctl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        fmt.Sprintf("cluster-%d", i+1),
+			ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{svc.Hostname: svc}, 1),
+			Controller:       &mock.Controller{},
+		})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := ctl.Services(); err != nil {
+			t.Error(err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the conflict handler calling back into the aggregate deadlocked")
+	}
+	if notified != 1 {
+		t.Fatalf("expected a single notification, got %d", notified)
+	}
+}
+
+func TestServiceConflictsClearedOnDelete(t *testing.T) {
+	hello1 := mock.MakeService("hello.default.svc.cluster.local", "10.0.0.1")
+	hello2 := mock.MakeService("hello.default.svc.cluster.local", "10.0.0.2")
+	hello2.Ports = append(model.PortList{&model.Port{Name: "grpc", Port: 90, Protocol: protocol.GRPC}}, hello2.Ports...)
+
+	ctl := NewController(Options{})
+	controllers := []*fakeController{{}, {}}
+	for i, svc := range []*model.Service{hello1, hello2} {
+		ctl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        fmt.Sprintf("cluster-%d", i+1),
+			ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{svc.Hostname: svc}, 1),
+			Controller:       controllers[i],
+		})
+	}
+	if err := ctl.AppendServiceHandler(func(*model.Service, model.Event) {}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctl.Services(); err != nil {
+		t.Fatal(err)
+	}
+	if conflicts := ctl.ServiceConflicts(); len(conflicts) != 1 {
+		t.Fatalf("expected the ports conflict, got %v", conflicts)
+	}
+
+	controllers[1].serviceEvent(hello2, model.EventDelete)
+	if conflicts := ctl.ServiceConflicts(); len(conflicts) != 0 {
+		t.Fatalf("expected the conflicts of the deleted service to be cleared, got %v", conflicts)
+	}
+}
+
+func TestConflictReport(t *testing.T) {
+	hello1 := mock.MakeService("hello.default.svc.cluster.local", "10.0.0.1")
+	hello2 := mock.MakeService("hello.default.svc.cluster.local", "10.0.0.2")
+	hello2.Resolution = model.DNSLB
+	// world reuses the VIP of hello in cluster-1, exposes a single port in cluster-3 where it is
+	// also mesh external.
+	world2 := mock.MakeService("world.default.svc.cluster.local", "10.0.0.1")
+	world3 := mock.MakeService("world.default.svc.cluster.local", "10.0.0.3")
+	world3.Ports = world3.Ports[:1]
+	world3.MeshExternal = true
+
+	aggregateCtl := NewController(Options{})
+	for cluster, svcs := range map[string][]*model.Service{
+		"cluster-1": {hello1},
+		"cluster-2": {hello2, world2},
+		"cluster-3": {world3},
+	} {
+		services := make(map[host.Name]*model.Service)
+		for _, s := range svcs {
+			services[s.Hostname] = s
+		}
+		aggregateCtl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        cluster,
+			ServiceDiscovery: mock.NewDiscovery(services, 1),
+			Controller:       &mock.Controller{},
+		})
+	}
+
+	out, err := aggregateCtl.ConflictReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []ConflictReportEntry
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("failed to unmarshal the report: %v", err)
+	}
+	expected := []ConflictReportEntry{
+		{
+			Field:   "address",
+			Address: "10.0.0.1",
+			Values:  map[string]string{"cluster-1": string(hello1.Hostname), "cluster-2": string(world2.Hostname)},
+		},
+		{
+			Hostname: world2.Hostname,
+			Field:    "meshExternal",
+			Values:   map[string]string{"cluster-2": "false", "cluster-3": "true"},
+		},
+		{
+			Hostname: world2.Hostname,
+			Field:    "ports",
+			Values:   map[string]string{"cluster-2": portSignature(world2.Ports), "cluster-3": portSignature(world3.Ports)},
+		},
+		{
+			Hostname: hello1.Hostname,
+			Field:    "resolution",
+			Values:   map[string]string{"cluster-1": "ClientSide", "cluster-2": "DNS"},
+		},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("ConflictReport() = %+v, expected %+v", got, expected)
+	}
+	// The report does not record the conflicts.
+	if conflicts := aggregateCtl.ServiceConflicts(); len(conflicts) != 0 {
+		t.Fatalf("expected no recorded conflicts, got %v", conflicts)
+	}
+}
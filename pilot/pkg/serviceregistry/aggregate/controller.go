@@ -15,22 +15,30 @@
 package aggregate
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"istio.io/istio/pilot/pkg/features"
 
 	"github.com/hashicorp/go-multierror"
+	"golang.org/x/time/rate"
 
 	"istio.io/pkg/log"
 
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pkg/config/constants"
 	"istio.io/istio/pkg/config/host"
 	"istio.io/istio/pkg/config/labels"
-)
-
-var (
-	clusterAddressesMutex sync.Mutex
+	"istio.io/istio/pkg/config/protocol"
 )
 
 // The aggregate controller does not implement serviceregistry.Instance since it may be comprised of various
@@ -38,189 +46,2265 @@ var (
 var _ model.ServiceDiscovery = &Controller{}
 var _ model.Controller = &Controller{}
 
+var (
+	// ErrNoRegistries is returned by the service discovery lookups, such as GetService and
+	// InstancesByPort, when no registry is configured. The service listings return no service
+	// without error instead.
+	ErrNoRegistries = errors.New("no registries configured")
+	// ErrAllRegistriesFailed is returned by the service discovery operations when every registry
+	// queried returned an error. It is wrapped with the errors of the registries.
+	ErrAllRegistriesFailed = errors.New("all registries failed")
+	// ErrRegistryTimeout is the error of a registry which did not answer before the deadline.
+	ErrRegistryTimeout = errors.New("registry timed out")
+	// ErrCircuitOpen is the error of a registry skipped after too many consecutive failures, see
+	// Options.CircuitBreakerThreshold.
+	ErrCircuitOpen = errors.New("registry circuit open")
+	// ErrNoWorkloadRegistry is returned by RegisterWorkload when no registry can register the
+	// workload of the proxy.
+	ErrNoWorkloadRegistry = errors.New("no registry to register the workload")
+)
+
 // Controller aggregates data across different registries and monitors for changes
 type Controller struct {
-	registries []serviceregistry.Instance
-	storeLock  sync.RWMutex
+	// registries is the registry list of the writers, protected by storeLock. The readers load it
+	// from snapshot instead, without locking.
+	registries []*registryEntry
+	// storeLock serializes the changes to the registries, e.g. AddRegistry and DeleteRegistry.
+	storeLock sync.Mutex
+	// snapshot holds the *registrySnapshot published by the last change to the registries, nil
+	// until the first one.
+	snapshot atomic.Value
+	// runStop is the stop channel Run was called with, nil until then, for AddRegistryAndWait to
+	// start the registries added while running.
+	runStop <-chan struct{}
+
+	opts Options
+
+	// excludedNamespaces is the set of Options.ExcludedNamespaces.
+	excludedNamespaces map[string]struct{}
+
+	// handlerSem bounds the number of handlers executing concurrently, nil if unbounded.
+	handlerSem chan struct{}
+
+	// limiter is shared by the Services and InstancesByPort calls made to the registries, nil if
+	// unbounded. Waiting on it is cancelled by limiterCtx once the controller is stopped.
+	limiter       *rate.Limiter
+	limiterCtx    context.Context
+	limiterCancel context.CancelFunc
+
+	// handlersLock protects serviceHandlers
+	handlersLock sync.RWMutex
+	// serviceHandlers are the service handlers appended through the aggregate.
+	serviceHandlers []serviceHandler
+
+	// pauseLock protects paused and the events buffered while paused
+	pauseLock    sync.Mutex
+	paused       int
+	pending      map[pendingEvent]func()
+	pendingOrder []pendingEvent
+
+	// mergeRuns is the number of service listings, used to sample the merge metrics.
+	mergeRuns uint32
+
+	// rotation is the number of rotated first hit lookups, used to pick the starting registry.
+	rotation uint32
+
+	// selfClusterID holds the cluster ID of this instance when overridden by SetSelfCluster.
+	selfClusterID atomic.Value
+
+	// proxyLookupFailures records the recent proxy lookups which found no instance.
+	proxyLookupFailures proxyLookupFailures
+
+	// workloadLock protects workloadOwners
+	workloadLock sync.Mutex
+	// workloadOwners holds, by proxy ID, the registration of the workload of the proxy.
+	workloadOwners map[string]workloadRegistration
+
+	// indexLock protects hostIndex
+	indexLock sync.RWMutex
+	hostIndex hostIndex
+
+	// running tracks the registries started by Run, waited for by Close.
+	running sync.WaitGroup
+
+	// restartBackoff and maxRestartBackoff override the backoff of the registry restarts.
+	restartBackoff    time.Duration
+	maxRestartBackoff time.Duration
+
+	// conflictLock protects serviceConflicts
+	conflictLock sync.Mutex
+	// serviceConflicts holds the disagreements between clusters detected by the service lookups.
+	serviceConflicts map[serviceConflictKey]ServiceConflict
+	// pendingConflicts holds the disagreements to notify to Options.ConflictHandler, delivered by
+	// notifyConflicts once the lookup detecting them released its locks.
+	pendingConflicts []ServiceConflict
+
+	// mergeLock protects mergedServices
+	mergeLock sync.Mutex
+	// mergedServices caches, by hostname, the services built by merging the copies of a service
+	// found in multiple clusters. A merged service is reused by subsequent Services() calls as
+	// long as the services contributing to it are unchanged, so that the merge does not need to
+	// copy every multi-cluster service on every invocation.
+	mergedServices map[host.Name]*mergedService
+
+	// warmer recomputes mergedServices in the background if Options.WarmServicesDelay is set.
+	warmer servicesWarmer
+
+	// lastServices holds the last services listed successfully, if Options.ServeStaleOnError is set.
+	lastServices lastServices
+
+	// emptyClusters numbers the cluster IDs synthesized for the Kubernetes registries without
+	// cluster ID.
+	emptyClusters uint32
+
+	// grouped is set once the controller is wrapped by NewGroup, its registry count then not being
+	// the fan-out of the top level aggregate.
+	grouped int32
+}
+
+// registryEntry is a registry of the aggregate controller along with the state tracked for it.
+type registryEntry struct {
+	// lastEvent is the time, in unix nanoseconds, of the last event received from the registry.
+	// It is first in the struct to be 64-bit aligned for atomic operations.
+	lastEvent int64
+	// openUntil is the time, in unix nanoseconds, until which the circuit of the registry is open,
+	// zero while closed. It is 64-bit aligned, following lastEvent.
+	openUntil int64
+	// serviceCount is the number of services of the last listing of the registry, -1 until listed.
+	// It is 64-bit aligned, following openUntil.
+	serviceCount int64
+
+	serviceregistry.Instance
+
+	// indexed is set once the registry delivered a service event to the hostname index.
+	indexed int32
+	// seeded is set once the services of a full listing of the registry were indexed.
+	seeded int32
+	// running is set while the Run method of the registry, started by the aggregate, executes.
+	running int32
+	// synced is set once the registry was first seen synced.
+	synced int32
+
+	// added is the time the registry was added to the aggregate.
+	added time.Time
+
+	// watched is set once the service handler of Options.IncrementalServices is appended to the
+	// registry, its services being then served from serviceCache.
+	watched int32
+	// cacheLock protects serviceCache, serializing its refreshes.
+	cacheLock    sync.Mutex
+	serviceCache *serviceListCache
+	// dirtyLock protects dirty, the last event of each service received since the last refresh
+	// of serviceCache.
+	dirtyLock sync.Mutex
+	dirty     map[serviceListKey]model.Event
+
+	// clusterID holds the cluster ID the aggregate last saw the registry report, a string, to
+	// detect the registries changing it at runtime.
+	clusterID atomic.Value
+
+	// emptyClusterOnce guards syntheticClusterID, the cluster ID the services of a Kubernetes
+	// registry without cluster ID are merged under with SynthesizeEmptyClusterID.
+	emptyClusterOnce   sync.Once
+	syntheticClusterID string
+
+	// tags are the key/value pairs attached to the registry when it was added.
+	tags map[string]string
+	// authoritative is set if the registry is authoritative for the existence of services.
+	authoritative bool
+	// weight orders the registry in the first-hit lookups, higher weights being probed first.
+	weight int
+	// restartOnExit is set if the registry is restarted when its Run returns before it is stopped.
+	restartOnExit bool
+
+	// stop is closed when the registry is deleted or the aggregate closed, stopping the registry.
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// errLock protects lastErr and failures
+	errLock sync.Mutex
+	// lastErr is the error returned by the last failing call to the registry, cleared on success.
+	lastErr error
+	// failures counts the consecutive failed calls to the registry, for the circuit breaker.
+	failures int
+	// breakerThreshold and breakerCooldown are Options.CircuitBreakerThreshold and
+	// Options.CircuitBreakerCooldown, copied when the registry was added.
+	breakerThreshold int
+	breakerCooldown  time.Duration
+}
+
+// matchesTags returns true if the registry carries all the given tags.
+func (r *registryEntry) matchesTags(tags map[string]string) bool {
+	for k, v := range tags {
+		if tv, ok := r.tags[k]; !ok || tv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// recordEvent records that an event was received from the registry.
+func (r *registryEntry) recordEvent() {
+	atomic.StoreInt64(&r.lastEvent, time.Now().UnixNano())
+}
+
+// recordResult records the result of a call to the registry: the error if it failed, clearing
+// the recorded error otherwise. The consecutive failures open the circuit of the registry, a
+// success closes it. The calls skipped while the circuit is open are not recorded.
+func (r *registryEntry) recordResult(err error) {
+	if errors.Is(err, ErrCircuitOpen) {
+		return
+	}
+	r.errLock.Lock()
+	r.lastErr = err
+	if err == nil {
+		r.failures = 0
+		atomic.StoreInt64(&r.openUntil, 0)
+		r.errLock.Unlock()
+		return
+	}
+	r.failures++
+	trip := r.breakerThreshold > 0 && r.failures >= r.breakerThreshold
+	if trip {
+		atomic.StoreInt64(&r.openUntil, time.Now().Add(r.cooldown()).UnixNano())
+	}
+	r.errLock.Unlock()
+	if trip {
+		r.circuitOpened(err)
+	}
+}
+
+// lastError returns the error of the last failing call to the registry, nil if the call since succeeded.
+func (r *registryEntry) lastError() error {
+	r.errLock.Lock()
+	defer r.errLock.Unlock()
+	return r.lastErr
+}
+
+// lastEventTime returns the time of the last event received from the registry, if any.
+func (r *registryEntry) lastEventTime() time.Time {
+	if t := atomic.LoadInt64(&r.lastEvent); t != 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
+}
+
+// mergedService is a service built from the copies of a hostname found in cluster registries.
+type mergedService struct {
+	sources []serviceSource
+	service *model.Service
+}
+
+// serviceSource is a service contributed to a merged service by the registry of a cluster.
+type serviceSource struct {
+	cluster string
+	service *model.Service
+	address string
+	// networks are the networks advertised by the registry for the cluster, joined by commas.
+	networks string
+	// externalAddresses is the fingerprint of the external addresses of the service, which the
+	// registries update in place (e.g. Kubernetes on node events), so that the cached merge is
+	// rebuilt when they change although the service copy is the same.
+	externalAddresses string
+}
+
+// WeightReconciliation is how the load balancing weights of the copies of an instance reported
+// by several registries are reconciled when deduplicating it.
+type WeightReconciliation int
+
+const (
+	// FirstWeight keeps the weight of the copy found first, in registry order.
+	FirstWeight WeightReconciliation = iota
+	// SumWeights sums the weights of the copies, e.g. when each registry reports a share of the
+	// traffic of the endpoint.
+	SumWeights
+	// MaxWeights keeps the highest weight of the copies.
+	MaxWeights
+)
+
+// MeshExternalPolicy is how the copies of a service disagreeing on MeshExternal across clusters
+// are merged.
+type MeshExternalPolicy int
+
+const (
+	// ExternalWins marks the merged service mesh external if any copy is.
+	ExternalWins MeshExternalPolicy = iota
+	// InternalWins marks the merged service mesh internal if any copy is.
+	InternalWins
+)
+
+// EmptyClusterIDPolicy is how the services of the Kubernetes registries without cluster ID, a
+// misconfiguration, are merged.
+type EmptyClusterIDPolicy int
+
+const (
+	// UnmergedEmptyClusterID handles the registries as the registries without cluster ID, such as
+	// ServiceEntry: their services are returned as is, each registry adding its own copy of a
+	// hostname, and GetService returns the first copy found.
+	UnmergedEmptyClusterID EmptyClusterIDPolicy = iota
+	// SynthesizeEmptyClusterID merges the services of each registry under a cluster ID unique to
+	// the registry, made of its provider and a sequence number (e.g. "Kubernetes-1"), stable for
+	// the lifetime of the registry, so that they do not collide.
+	SynthesizeEmptyClusterID
+	// SkipEmptyClusterID logs the registries and skips their services.
+	SkipEmptyClusterID
+)
+
+// Options stores the configurable attributes of an aggregate Controller.
+type Options struct {
+	// ServiceEntryPrecedence lets a service provided by a ServiceEntry registry take precedence
+	// over Kubernetes services with the same hostname in GetService. The ServiceEntry definition
+	// is returned, with the ClusterVIPs and external addresses of the Kubernetes copies merged in.
+	ServiceEntryPrecedence bool
+
+	// ClusterIDNormalizer normalizes cluster IDs (e.g. case or prefixes) before they are compared or
+	// stored by the aggregate: when matching proxies to registries, looking registries up by cluster
+	// and keying ClusterVIPs and external addresses. The literal Kubernetes cluster ID, a placeholder
+	// for the local cluster, is never normalized. Defaults to the identity.
+	ClusterIDNormalizer func(string) string
+
+	// MaxConcurrentHandlers limits the number of handlers, appended through the aggregate, executing
+	// concurrently. Events from multiple clusters firing at once are serialized past the limit, so
+	// that handlers calling back into Services() do not stampede during churn. Zero means no limit.
+	MaxConcurrentHandlers int
+
+	// ValidateRegistries checks the registries when they are added, rejecting the registries
+	// panicking on benign calls such as Cluster() or Provider().
+	ValidateRegistries bool
+
+	// SortRegistries keeps the registries sorted by provider and cluster ID instead of in the
+	// order they were added, so that the first hit lookups (e.g. GetService) and the order of the
+	// merged results do not depend on the add/delete history, which differs across restarts.
+	SortRegistries bool
+
+	// SortServices sorts the services listed by Services by hostname, then by cluster ID, then by
+	// namespace, instead of returning them in registry order, and in the order of each registry, so
+	// that the listings, and the pushes or golden files derived from them, are identical whatever
+	// the order the registries were added in and list their services. The services sharing a
+	// hostname without being merged are ordered by the lowest cluster ID of their ClusterVIPs, those
+	// without any coming first.
+	SortServices bool
+
+	// ExcludedNamespaces are the namespaces never exposed through the aggregate, whatever the
+	// registry reporting them (e.g. kube-system): their services are filtered out of the service
+	// listings and lookups, and their instances out of the instance lookups.
+	ExcludedNamespaces []string
+
+	// ResolutionPrecedence orders the resolutions, from the highest precedence, to pick the
+	// resolution returned by GetServiceResolution when the clusters disagree. Resolutions not
+	// listed come last. Defaults to the most specific first: ClientSideLB, DNSLB, Passthrough.
+	ResolutionPrecedence []model.Resolution
+
+	// DrainGracePeriod is the time Close waits after draining the registries before stopping them.
+	DrainGracePeriod time.Duration
+
+	// HostnameRewriter rewrites the hostnames of the services of a cluster before they enter the
+	// merged view, e.g. appending a cluster suffix to keep the services of federated clusters from
+	// colliding. It is called with the cluster ID as reported by the registry, and must always
+	// rewrite a hostname the same way. The services listed by Services, and found by GetService
+	// under their rewritten hostname, are copies carrying the rewritten hostname; the services of
+	// the other registries, and those delivered to the handlers, are left as is. Finding a
+	// rewritten hostname requires listing the services of the registries.
+	HostnameRewriter func(clusterID string, h host.Name) host.Name
+
+	// MeshExternalPolicy decides whether a service marked mesh external in some clusters and mesh
+	// internal in others is merged as mesh external, rather than taking the flag of whichever
+	// copy comes first. The disagreement is reported by ServiceConflicts.
+	MeshExternalPolicy MeshExternalPolicy
+
+	// EmptyClusterIDPolicy decides how the services of the Kubernetes registries reporting an
+	// empty cluster ID, which would otherwise all be keyed by the same empty cluster, are merged
+	// by Services and GetService.
+	EmptyClusterIDPolicy EmptyClusterIDPolicy
+
+	// StrictMode makes Services, GetService and InstancesByPort fail fast: the first registry
+	// failure is returned, as a *RegistryError, with no partial result, rather than the results of
+	// the other registries, so that a partial view of the mesh is never published. By default the
+	// results of the failed registries are dropped and the errors returned along with the others.
+	StrictMode bool
+
+	// ConflictHandler, if set, is called when a disagreement between clusters on an attribute of a
+	// service is detected (ports and mesh external by Services and GetService, resolution by
+	// GetServiceResolution), e.g. to raise an alert. It is called once per disagreement, again only
+	// if the values of the clusters change, by the lookup detecting it once the lookup released its
+	// locks: it may call back into the aggregate, but should not block, delaying the lookup.
+	ConflictHandler func(ServiceConflict)
+
+	// ProxyInstanceDecorator, if set, is applied to the instances returned by GetProxyServiceInstances,
+	// e.g. to enrich their endpoints with network topology metadata. It is given copies of the
+	// instances of the registries, which it may modify.
+	ProxyInstanceDecorator func(proxy *model.Proxy, inst *model.ServiceInstance)
+
+	// InstanceFilter, if set, is applied to the instances returned by each registry to
+	// InstancesByPort (and its variants) and GetProxyServiceInstances, before they are unioned:
+	// the instances it returns false for are dropped, e.g. the endpoints of terminating pods or of
+	// some CIDRs. The instances are filtered into a new slice, the slices of the registries are
+	// never modified; the filter must not modify the instances either. A proxy whose instances
+	// in a registry are all dropped is looked up in the next registries.
+	InstanceFilter func(*model.ServiceInstance) bool
+
+	// AllowedClusters, if set, returns the clusters a proxy may be resolved against, e.g. the
+	// clusters of its tenant: GetProxyServiceInstances never searches the registries of the other
+	// clusters, on top of the heuristics skipping registries. A nil result allows all the clusters,
+	// an empty one none of them.
+	AllowedClusters func(proxy *model.Proxy) []string
+
+	// RotateFirstHitLookups rotates the registry the proxy lookups (GetProxyServiceInstances,
+	// GetProxyRegistry and GetProxyWorkloadLabels) start from on each call, spreading their load
+	// instead of always querying the first registries first. The first match found still wins.
+	// GetService is not rotated, the order of the registries deciding the defaults of merged services.
+	RotateFirstHitLookups bool
+
+	// MergeMetricsSampleRate records the merge metrics (merged hostnames, clusters per hostname)
+	// on one in every MergeMetricsSampleRate service listings, limiting their overhead. Zero
+	// disables them.
+	MergeMetricsSampleRate int
+
+	// GetServiceTimeout bounds the time GetService waits for the registries, so that a hung
+	// registry does not block gateway programming. The registries are then queried concurrently,
+	// and the answer is built from those which answered before the deadline, the others failing
+	// with ErrRegistryTimeout. Zero means no deadline, the registries being queried in order.
+	GetServiceTimeout time.Duration
+
+	// CircuitBreakerThreshold is the number of consecutive failed calls after which a registry is
+	// skipped by the lookups for CircuitBreakerCooldown, failing with ErrCircuitOpen without being
+	// called, so that an unreachable cluster does not slow down every lookup. After the cooldown,
+	// the registry is called again: a success closes the circuit, a failure opens it again.
+	// Zero disables the circuit breaker.
+	CircuitBreakerThreshold int
+	// CircuitBreakerCooldown is the time a registry is skipped once its circuit opened. Defaults
+	// to 30 seconds.
+	CircuitBreakerCooldown time.Duration
+
+	// FanOutConcurrency is the number of registries Services and InstancesByPort call
+	// concurrently, so that the latency of the lookups does not grow with the number of remote
+	// clusters. The results are merged in registry order once all the registries answered, as
+	// when they are called in order, with the same errors reported; in StrictMode, the registries
+	// are all called even if one fails. The registries are called in order when it is 0 or 1, or
+	// when Options.RegistryQPS rate limits the calls.
+	FanOutConcurrency int
+
+	// LocalityFallback lets GetProxyServiceInstances locate a proxy found in no registry, e.g. a
+	// VM outside of the mesh backing no service, through the registries implementing
+	// serviceregistry.WorkloadLocator, all of them being asked by the IPs of the proxy regardless
+	// of its cluster. A single instance carrying the labels and locality of the workload is then
+	// returned, without service port, so that the proxy still gets locality aware configuration.
+	LocalityFallback bool
+
+	// SuppressUnchangedServiceEvents drops the service events carrying a service identical to the
+	// one last delivered to a handler for the hostname by the same registry (e.g. label churn not
+	// affecting the service), avoiding no-op pushes. Each event then costs the hashing of its
+	// service, the registries are not called.
+	SuppressUnchangedServiceEvents bool
+
+	// IncrementalServices maintains the services of each registry from its service events rather
+	// than listing them on each Services() call: a registry is listed once, then only the
+	// hostnames of the events received since the previous call are looked up again. The merge of
+	// the hostnames whose copies did not change is reused, as without the option. It requires
+	// the registries to deliver an event for every change of their services; the registries
+	// failing to append the handler are listed on each call.
+	IncrementalServices bool
+
+	// InstanceEqual decides whether an instance reported again by a registry is unchanged when
+	// diffing the instances for the endpoint delta handlers (see AppendEndpointDeltaHandler), an
+	// instance found equal to the one last delivered not being reported as updated. It allows
+	// tuning the sensitivity of the incremental endpoint pushes, e.g. ignoring metadata-only
+	// updates. It is called with the instance last delivered and the current one, for the same
+	// service port, address and endpoint port. By default, the endpoints are compared as a whole,
+	// ignoring their cached Envoy representation.
+	InstanceEqual func(a, b *model.ServiceInstance) bool
+
+	// CaseInsensitiveHostnames compares hostnames case-insensitively, for registries which do not
+	// normalize the DNS case of their hostnames: the copies of a service reported with different
+	// casings are merged by Services, and GetService finds a service whatever the casing of the
+	// hostname it is reported with. Hostnames are compared exactly by default.
+	CaseInsensitiveHostnames bool
+
+	// DedupInstances makes the instance lookups return the instances reported by several
+	// registries for the same endpoint address and port only once, with the load balancing
+	// weight reconciled as per DedupWeights, instead of returning every copy and so counting the
+	// endpoint several times in weighted load balancing. RangeInstancesByPort, which streams the
+	// instances, only calls its callback with the first copy, the weights not being reconciled.
+	DedupInstances bool
+
+	// DedupWeights is how the load balancing weights of the copies of a deduplicated instance
+	// are reconciled.
+	DedupWeights WeightReconciliation
+
+	// ServiceDedupKey, if set, computes the key identifying the copies of a service that Services
+	// merges across clusters, e.g. to include the network or trust domain of the service in its
+	// identity. It is called with the read lock of the service held. The copies are merged by
+	// hostname (as per CaseInsensitiveHostnames) by default. GetService, looking services up by
+	// hostname, is not affected.
+	ServiceDedupKey func(*model.Service) string
+
+	// InstanceDedupKey, if set, computes the key identifying the copies of an instance that
+	// DedupInstances deduplicates. The copies are identified by endpoint address and port by default.
+	InstanceDedupKey func(*model.ServiceInstance) string
+
+	// RegistryQPS limits the rate of the Services and InstancesByPort calls made by the aggregate
+	// to the registries, shared across all registries, protecting remote API servers from
+	// concurrent pushes. Zero means no limit.
+	RegistryQPS float64
+	// RegistryBurst is the burst allowed above RegistryQPS. Defaults to 1.
+	RegistryBurst int
+
+	// WarmServicesDelay, if set, makes the aggregate merge the services again in the background
+	// this long after they are invalidated (by a service event delivered to a handler appended
+	// through the aggregate, or a registry being added, deleted or updated), so that the first
+	// Services() call afterwards, typically on a push, finds them already merged instead of paying
+	// the merge inline. The invalidations within the delay are coalesced into a single merge. No
+	// merge runs once the controller is stopped or closed.
+	WarmServicesDelay time.Duration
+
+	// SkipUnknownClusters makes InstancesByPortInClusters skip the clusters without registry,
+	// with a warning, instead of failing.
+	SkipUnknownClusters bool
+
+	// RegistrySoftLimit is the number of registries above which a warning is logged, as the
+	// lookups querying every registry then dominate the CPU usage of the control plane. Grouping
+	// the registries with NewGroup reduces the fan-out. Zero means no limit. The number of
+	// registries is reported by the pilot_aggregate_fanout_registries metric regardless.
+	RegistrySoftLimit int
+
+	// ServeStaleOnError makes Services return the services of its last call during which no
+	// registry failed, without error, when all the registries fail, rather than no service: a
+	// transient failure of the whole control plane then does not wipe the configuration of the
+	// mesh. The staleness is logged, counted by a metric and reported by ServingStale. The
+	// failures of StrictMode, returning on the first registry failure, are not served stale.
+	ServeStaleOnError bool
 }
 
 // NewController creates a new Aggregate controller
-func NewController() *Controller {
-	return &Controller{
-		registries: make([]serviceregistry.Instance, 0),
+func NewController(opt Options) *Controller {
+	c := &Controller{
+		registries: make([]*registryEntry, 0),
+		opts:       opt,
 	}
+	if len(opt.ExcludedNamespaces) > 0 {
+		c.excludedNamespaces = make(map[string]struct{}, len(opt.ExcludedNamespaces))
+		for _, ns := range opt.ExcludedNamespaces {
+			c.excludedNamespaces[ns] = struct{}{}
+		}
+	}
+	if opt.MaxConcurrentHandlers > 0 {
+		c.handlerSem = make(chan struct{}, opt.MaxConcurrentHandlers)
+	}
+	if opt.RegistryQPS > 0 {
+		burst := opt.RegistryBurst
+		if burst <= 0 {
+			burst = 1
+		}
+		c.limiter = rate.NewLimiter(rate.Limit(opt.RegistryQPS), burst)
+		c.limiterCtx, c.limiterCancel = context.WithCancel(context.Background())
+	}
+	return c
+}
+
+// RegistryOptions stores the attributes of a registry added to the aggregate controller.
+type RegistryOptions struct {
+	// Tags are arbitrary key/value pairs attached to the registry, e.g. the region of its cluster.
+	// They allow queries such as InstancesByPortInRegions to only reach a subset of the registries.
+	Tags map[string]string
+
+	// Authoritative makes the registry authoritative for the existence of services: GetService
+	// does not find a hostname none of the authoritative registries has, even if other registries,
+	// which merely augment the authoritative ones, have it. This prevents e.g. a stray ServiceEntry
+	// from resurrecting a deleted Kubernetes service.
+	Authoritative bool
+
+	// Weight is a hint to probe the registry before the registries of lower weight in the lookups
+	// returning the first match: GetService, and thus the defaults of the services merged across
+	// clusters, and the proxy lookups. Registries of equal weight, by default all of them, are
+	// probed in the order they were added. It is also the priority of the registry when several
+	// have the same hostname: GetService returns the copy of the registry of highest weight, a
+	// registry without cluster ID (e.g. ServiceEntry) no longer overriding the merged copy of
+	// Kubernetes registries of higher weight. ResolutionOrder reports the resulting order. It
+	// should be set on the registries most likely to have the hostnames and proxies looked up,
+	// e.g. the local cluster, to reduce the average number of registries probed per lookup, on
+	// top of the hostname index.
+	Weight int
+
+	// RestartOnExit restarts the registry, with a capped exponential backoff, when its Run returns
+	// before the registry is stopped. It should be set on the registries whose Run is expected to
+	// block while watching their cluster, e.g. Kubernetes, so that a crashed watch does not leave
+	// the cluster silently unwatched. Registries whose Run merely starts them and returns, e.g.
+	// ServiceEntry or memory registries, must not set it.
+	RestartOnExit bool
+}
+
+// SetSelfCluster overrides the ID of the cluster this instance belongs to, used instead of
+// features.ClusterName when matching proxies to registries, e.g. after a failover in an embedding
+// changing the local cluster. An empty ID restores features.ClusterName.
+func (c *Controller) SetSelfCluster(clusterID string) {
+	c.selfClusterID.Store(clusterID)
+}
+
+// selfCluster returns the ID of the cluster this instance belongs to.
+func (c *Controller) selfCluster() string {
+	if id, _ := c.selfClusterID.Load().(string); id != "" {
+		return id
+	}
+	return features.ClusterName
+}
+
+// normalizeClusterID applies the configured ClusterIDNormalizer to a cluster ID.
+func (c *Controller) normalizeClusterID(clusterID string) string {
+	if c.opts.ClusterIDNormalizer == nil || clusterID == "" || clusterID == string(serviceregistry.Kubernetes) {
+		return clusterID
+	}
+	return c.opts.ClusterIDNormalizer(clusterID)
 }
 
 // AddRegistry adds registries into the aggregated controller
 func (c *Controller) AddRegistry(registry serviceregistry.Instance) {
+	if err := c.AddRegistryWithOptions(registry, RegistryOptions{}); err != nil {
+		log.Errorf("Failed to add registry: %v", err)
+	}
+}
+
+// AddRegistryWithOptions adds a registry with the given options into the aggregated controller.
+// An error is returned, and the registry is not added, if Options.ValidateRegistries is set and
+// the registry fails the validation.
+//
+// The cluster ID of a registry must be stable, or changed through UpdateRegistryMetadata: the
+// merged services are keyed by cluster ID. A change made behind the back of the aggregate is
+// detected by the next Services() call, which re-keys the merged services (see
+// detectClusterIDChanges).
+func (c *Controller) AddRegistryWithOptions(registry serviceregistry.Instance, opts RegistryOptions) error {
+	_, _, err := c.addRegistry(registry, opts)
+	return err
+}
+
+// addRegistry adds the registry, returning its entry along with the stop channel of Run, nil if
+// the aggregate is not running, both read under the same lock as the registry is added: the
+// registry is started by Run only if it was added before Run started.
+func (c *Controller) addRegistry(registry serviceregistry.Instance, opts RegistryOptions) (*registryEntry, <-chan struct{}, error) {
+	if c.opts.ValidateRegistries {
+		if err := validateRegistry(registry); err != nil {
+			return nil, nil, err
+		}
+	}
+
 	c.storeLock.Lock()
-	defer c.storeLock.Unlock()
 
-	registries := c.registries
-	registries = append(registries, registry)
-	c.registries = registries
+	// Registries are copied on write, so that snapshots handed out to readers are never modified.
+	registries := make([]*registryEntry, 0, len(c.registries)+1)
+	registries = append(registries, c.registries...)
+	entry := &registryEntry{
+		Instance:      registry,
+		tags:          opts.Tags,
+		authoritative: opts.Authoritative,
+		weight:        opts.Weight,
+		restartOnExit: opts.RestartOnExit,
+		serviceCount:  -1,
+		added:         time.Now(),
+		stop:          make(chan struct{}),
+
+		breakerThreshold: c.opts.CircuitBreakerThreshold,
+		breakerCooldown:  c.opts.CircuitBreakerCooldown,
+	}
+	registries = append(registries, entry)
+	if c.opts.SortRegistries {
+		sortRegistries(registries)
+	}
+	c.setRegistries(registries)
+	c.scheduleWarm()
+	stop := c.runStop
+	c.storeLock.Unlock()
+
+	c.watchServices(entry)
+	return entry, stop, nil
+}
+
+// sortRegistries sorts the registries by provider and cluster ID, keeping the registries with
+// the same provider and cluster ID in the order they were added.
+func sortRegistries(registries []*registryEntry) {
+	sort.SliceStable(registries, func(i, j int) bool {
+		if registries[i].Provider() != registries[j].Provider() {
+			return registries[i].Provider() < registries[j].Provider()
+		}
+		return registries[i].Cluster() < registries[j].Cluster()
+	})
+}
+
+// sortServices sorts the services by hostname, lowest cluster ID of their ClusterVIPs and
+// namespace, keeping the services equal on all three in order.
+func sortServices(services []*model.Service) {
+	type serviceOrder struct {
+		service   *model.Service
+		cluster   string
+		namespace string
+	}
+	order := make([]serviceOrder, len(services))
+	for i, s := range services {
+		o := serviceOrder{service: s, namespace: s.Attributes.Namespace}
+		s.Mutex.RLock()
+		first := true
+		for cluster := range s.ClusterVIPs {
+			if first || cluster < o.cluster {
+				o.cluster = cluster
+				first = false
+			}
+		}
+		s.Mutex.RUnlock()
+		order[i] = o
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		if order[i].service.Hostname != order[j].service.Hostname {
+			return order[i].service.Hostname < order[j].service.Hostname
+		}
+		if order[i].cluster != order[j].cluster {
+			return order[i].cluster < order[j].cluster
+		}
+		return order[i].namespace < order[j].namespace
+	})
+	for i, o := range order {
+		services[i] = o.service
+	}
+}
+
+// recordRegistryCount reports the number of registries, warning when it goes above
+// Options.RegistrySoftLimit.
+func (c *Controller) recordRegistryCount(previous, current int) {
+	if atomic.LoadInt32(&c.grouped) == 0 {
+		fanoutRegistries.Record(float64(current))
+	}
+	if softLimitCrossed(previous, current, c.opts.RegistrySoftLimit) {
+		log.Warnf("%d registries exceed the soft limit of %d: every lookup querying all the registries "+
+			"is getting expensive, consider grouping the registries, e.g. by region, with NewGroup",
+			current, c.opts.RegistrySoftLimit)
+	}
+}
+
+// softLimitCrossed returns true if the registry count went from within the limit to above it.
+func softLimitCrossed(previous, current, limit int) bool {
+	return limit > 0 && previous <= limit && current > limit
+}
+
+// validateRegistry calls the benign methods of the registry, catching the broken implementations
+// panicking on them (e.g. wrappers around a nil registry) before they panic deep in a push.
+func validateRegistry(registry serviceregistry.Instance) (err error) {
+	if registry == nil {
+		return errors.New("invalid registry: nil")
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid registry %T: %v", registry, r)
+		}
+	}()
+	registry.Provider()
+	registry.Cluster()
+	return nil
 }
 
 // DeleteRegistry deletes specified registry from the aggregated controller
+//
+// Deprecated: the first registry of the cluster is deleted, whatever its provider, which is not
+// the intended one when registries of several providers share the cluster ID. Use
+// DeleteProviderRegistry instead.
 func (c *Controller) DeleteRegistry(clusterID string) {
+	c.deleteRegistry(clusterID, "")
+}
+
+// DeleteProviderRegistry deletes the registry of the given cluster and provider from the
+// aggregated controller, leaving the registries of the other providers for the cluster in place.
+func (c *Controller) DeleteProviderRegistry(clusterID string, providerID serviceregistry.ProviderID) {
+	c.deleteRegistry(clusterID, providerID)
+}
+
+// deleteRegistry deletes the first registry of the cluster with the given provider, of any
+// provider if empty.
+func (c *Controller) deleteRegistry(clusterID string, providerID serviceregistry.ProviderID) {
+	c.storeLock.Lock()
+	defer c.storeLock.Unlock()
+
+	if len(c.registries) == 0 {
+		log.Warnf("Registry list is empty, nothing to delete")
+		return
+	}
+	index, ok := c.registryIndex(clusterID, providerID)
+	if !ok {
+		log.Warnf("Registry is not found in the registries list, nothing to delete")
+		return
+	}
+	entry := c.registries[index]
+	registries := make([]*registryEntry, 0, len(c.registries)-1)
+	registries = append(registries, c.registries[:index]...)
+	registries = append(registries, c.registries[index+1:]...)
+	c.setRegistries(registries)
+	c.unindexRegistry(entry)
+	c.forgetWorkloads(entry)
+	resetRegistryServiceCounts(registries)
+	c.scheduleWarm()
+	entry.stopOnce.Do(func() { close(entry.stop) })
+	log.Infof("Registry %s for the cluster %s has been deleted.", entry.Provider(), clusterID)
+}
+
+// UpdateRegistryMetadata applies update to the registry of the cluster under the registries write
+// lock, so that metadata-only changes (e.g. of the cluster ID or network) do not require deleting
+// and re-adding the registry, tearing down its watches. If the cluster ID changed, the merged
+// services cached for the previous ID are dropped.
+//
+// An error is returned if there is no registry for the cluster, or if the update changed the
+// cluster ID to the one of another registry: as the update has already been applied to the
+// registry, the caller must then revert it.
+func (c *Controller) UpdateRegistryMetadata(clusterID string, update func(serviceregistry.Instance)) error {
+	c.storeLock.Lock()
+	defer c.storeLock.Unlock()
+
+	index, ok := c.GetRegistryIndex(clusterID)
+	if !ok {
+		return fmt.Errorf("no registry for cluster %s", clusterID)
+	}
+	entry := c.registries[index]
+	update(entry.Instance)
+	entry.clusterID.Store(entry.Cluster())
+
+	newClusterID := c.normalizeClusterID(entry.Cluster())
+	if newClusterID == c.normalizeClusterID(clusterID) {
+		return nil
+	}
+	for i, r := range c.registries {
+		if i != index && c.normalizeClusterID(r.Cluster()) == newClusterID {
+			return fmt.Errorf("registry for cluster %s updated to the cluster ID %s of another registry", clusterID, newClusterID)
+		}
+	}
+	if c.opts.SortRegistries {
+		registries := make([]*registryEntry, len(c.registries))
+		copy(registries, c.registries)
+		sortRegistries(registries)
+		c.setRegistries(registries)
+	}
+	c.mergeLock.Lock()
+	c.mergedServices = nil
+	c.mergeLock.Unlock()
+	c.scheduleWarm()
+	log.Infof("Registry for the cluster %s has been updated to the cluster %s.", clusterID, newClusterID)
+	return nil
+}
+
+// detectClusterIDChanges guards against the registries changing their cluster ID at runtime
+// without UpdateRegistryMetadata: the merged services keyed by the previous cluster ID are
+// dropped, and the registries sorted again if Options.SortRegistries is set, so that the
+// services are merged again under the new cluster ID.
+func (c *Controller) detectClusterIDChanges(registries []*registryEntry) {
+	for _, r := range registries {
+		known, ok := r.clusterID.Load().(string)
+		if !ok {
+			// First seen, the registries are not queried when added as they may be invalid.
+			r.clusterID.Store(r.Cluster())
+			continue
+		}
+		if r.Cluster() != known {
+			c.clusterIDChanged(r)
+		}
+	}
+}
+
+func (c *Controller) clusterIDChanged(r *registryEntry) {
 	c.storeLock.Lock()
 	defer c.storeLock.Unlock()
 
-	if len(c.registries) == 0 {
-		log.Warnf("Registry list is empty, nothing to delete")
-		return
+	previous, _ := r.clusterID.Load().(string)
+	current := r.Cluster()
+	if current == previous {
+		// Handled concurrently.
+		return
+	}
+	r.clusterID.Store(current)
+	log.Warnf("Registry of the cluster %s changed its cluster ID to %s at runtime, re-keying its services: "+
+		"cluster IDs should be stable or changed through UpdateRegistryMetadata", previous, current)
+	for _, other := range c.registries {
+		if other != r && c.normalizeClusterID(other.Cluster()) == c.normalizeClusterID(current) {
+			log.Errorf("Registry of the cluster %s changed its cluster ID to the one of another registry", previous)
+			break
+		}
+	}
+	if c.opts.SortRegistries {
+		registries := make([]*registryEntry, len(c.registries))
+		copy(registries, c.registries)
+		sortRegistries(registries)
+		c.setRegistries(registries)
+	}
+	c.mergeLock.Lock()
+	c.mergedServices = nil
+	c.mergeLock.Unlock()
+}
+
+// LastError returns the error of the last failing call made by the aggregate to the registry of
+// the cluster, or nil if a later call succeeded or the cluster has no registry.
+func (c *Controller) LastError(clusterID string) error {
+	clusterID = c.normalizeClusterID(clusterID)
+	for _, r := range c.registryEntries() {
+		if c.normalizeClusterID(r.Cluster()) == clusterID {
+			return r.lastError()
+		}
+	}
+	return nil
+}
+
+// RegistryTrustDomains returns the trust domains of the registries, keyed by cluster ID, as
+// reported by the registries implementing serviceregistry.TrustDomainProvider. The registries
+// not implementing it report an empty trust domain.
+func (c *Controller) RegistryTrustDomains() map[string]string {
+	registries := c.registryEntries()
+	out := make(map[string]string, len(registries))
+	for _, r := range registries {
+		trustDomain := ""
+		if provider, ok := r.Instance.(serviceregistry.TrustDomainProvider); ok {
+			trustDomain = provider.TrustDomain()
+		}
+		out[c.normalizeClusterID(r.Cluster())] = trustDomain
+	}
+	return out
+}
+
+// GetRegistries returns a copy of all registries
+func (c *Controller) GetRegistries() []serviceregistry.Instance {
+	registries := c.registryEntries()
+	out := make([]serviceregistry.Instance, len(registries))
+	for i, r := range registries {
+		out[i] = r.Instance
+	}
+	return out
+}
+
+// firstHitRegistries returns a snapshot of the registries for a lookup returning the first match,
+// ordered by descending weight, or rotated to start from the next registry on each call if
+// Options.RotateFirstHitLookups is set, the weights being then ignored.
+func (c *Controller) firstHitRegistries() []*registryEntry {
+	if !c.opts.RotateFirstHitLookups {
+		return c.weightedRegistries()
+	}
+	registries := c.registryEntries()
+	if len(registries) < 2 {
+		return registries
+	}
+	start := int((atomic.AddUint32(&c.rotation, 1) - 1) % uint32(len(registries)))
+	rotated := make([]*registryEntry, 0, len(registries))
+	rotated = append(rotated, registries[start:]...)
+	return append(rotated, registries[:start]...)
+}
+
+// weightedRegistries returns a snapshot of the registries ordered by descending weight.
+func (c *Controller) weightedRegistries() []*registryEntry {
+	snapshot := c.loadSnapshot()
+	if snapshot.weighted == nil {
+		return snapshot.registries
+	}
+	return snapshot.weighted
+}
+
+// registryEntries returns a snapshot of the registries along with their tracked state.
+func (c *Controller) registryEntries() []*registryEntry {
+	return c.loadSnapshot().registries
+}
+
+// GetRegistryIndex returns the index of a registry
+func (c *Controller) GetRegistryIndex(clusterID string) (int, bool) {
+	return c.registryIndex(clusterID, "")
+}
+
+// registryIndex returns the index of the first registry of the cluster with the given provider,
+// of any provider if empty.
+func (c *Controller) registryIndex(clusterID string, providerID serviceregistry.ProviderID) (int, bool) {
+	clusterID = c.normalizeClusterID(clusterID)
+	for i, r := range c.registries {
+		if c.normalizeClusterID(r.Cluster()) == clusterID && (providerID == "" || r.Provider() == providerID) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Services lists services from all platforms
+//
+// There is no single cluster fast path: the services of cluster registries always have their
+// ClusterVIPs populated, even when a single cluster is configured, so that the shape of the
+// output does not change, and trigger a large push, when a second cluster joins or leaves.
+// Only a single registry without cluster ID (e.g. ServiceEntry) is listed directly.
+//
+// With Options.ServeStaleOnError, the services of the last listing during which no registry
+// failed are returned, without error, when all the registries fail (see ServingStale).
+func (c *Controller) Services() ([]*model.Service, error) {
+	var services []*model.Service
+	var err error
+	if r := c.directRegistry(); r != nil && !mergedByCluster(r) {
+		services, err = c.directServices(r)
+	} else {
+		services, err = c.services(nil)
+	}
+	if c.opts.SortServices {
+		sortServices(services)
+	}
+	if c.opts.ServeStaleOnError {
+		return c.serveStale(services, err)
+	}
+	return services, err
+}
+
+// ServicesByProvider lists the services of all the registries grouped by provider, without
+// merging them: a diagnostic view of what each provider (e.g. Kubernetes vs Consul) sees.
+// The services are deep copies, which callers may modify.
+func (c *Controller) ServicesByProvider() (map[serviceregistry.ProviderID][]*model.Service, error) {
+	out := make(map[serviceregistry.ProviderID][]*model.Service)
+	var errs error
+	failed := 0
+	registries := c.registryEntries()
+	for _, r := range registries {
+		svcs, err := r.Services()
+		r.recordResult(err)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			failed++
+			continue
+		}
+		for _, s := range svcs {
+			s.Mutex.RLock()
+			out[r.Provider()] = append(out[r.Provider()], s.DeepCopy())
+			s.Mutex.RUnlock()
+		}
+	}
+	return out, registriesError(len(registries), failed, errs)
+}
+
+// UsesMergePath returns true if Services may merge the copies of a service from several clusters,
+// i.e. if more than one registry has its services merged by cluster. There is no fast path
+// switched on a count of Kubernetes registries (numK8SRegistries): the merge always runs for
+// cluster registries and populates ClusterVIPs, so this only tells whether hostnames may
+// combine several clusters, not a change in the shape of the output.
+func (c *Controller) UsesMergePath() bool {
+	n := 0
+	for _, r := range c.registryEntries() {
+		if cluster, ok := c.mergeCluster(r); ok && cluster != "" {
+			n++
+		}
+	}
+	return n > 1
+}
+
+// ServicesByProtocol lists services from all platforms having at least one port of the given
+// protocol. An empty protocol lists all services, like Services().
+func (c *Controller) ServicesByProtocol(proto protocol.Instance) ([]*model.Service, error) {
+	if proto == "" {
+		return c.services(nil)
+	}
+	return c.services(func(s *model.Service) bool {
+		for _, port := range s.Ports {
+			if port.Protocol == proto {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// ServiceCount returns the number of services in all the registries, without listing, merging or
+// copying them: a cheap check for readiness probes. Registries implementing
+// serviceregistry.ServiceCounter are asked for their count, the services of the others are listed.
+// Unlike Services, a service installed in several clusters is counted once per cluster.
+func (c *Controller) ServiceCount() (int, error) {
+	count := 0
+	var errs error
+	failed := 0
+	registries := c.registryEntries()
+	for _, r := range registries {
+		n, err := registryServiceCount(r)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			failed++
+			continue
+		}
+		count += n
+	}
+	return count, registriesError(len(registries), failed, errs)
+}
+
+// Hostnames returns the sorted hostnames of the services of all the registries, each listed once
+// even if the service is installed in several clusters, without building or merging the services.
+// Registries implementing serviceregistry.HostnameLister are asked for their hostnames, the
+// services of the others are listed. All the services are listed if Options.ExcludedNamespaces
+// is set, the hostnames not telling their namespace.
+func (c *Controller) Hostnames() ([]host.Name, error) {
+	seen := make(map[host.Name]struct{})
+	var out []host.Name
+	add := func(r *registryEntry, hostname host.Name) {
+		hostname = c.rewriteHostname(r, hostname)
+		key := c.hostnameKey(hostname)
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			out = append(out, hostname)
+		}
+	}
+
+	var errs error
+	failed := 0
+	registries := c.registryEntries()
+	for _, r := range registries {
+		if lister, ok := r.Instance.(serviceregistry.HostnameLister); ok && c.excludedNamespaces == nil {
+			hostnames, err := lister.Hostnames()
+			r.recordResult(err)
+			if err != nil {
+				errs = appendRegistryError(errs, r, err)
+				failed++
+				continue
+			}
+			for _, hostname := range hostnames {
+				add(r, hostname)
+			}
+			continue
+		}
+		svcs, err := r.Services()
+		r.recordResult(err)
+		if err != nil {
+			errs = appendRegistryError(errs, r, err)
+			failed++
+			continue
+		}
+		for _, s := range svcs {
+			if !c.namespaceExcluded(s.Attributes.Namespace) {
+				add(r, s.Hostname)
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out, registriesError(len(registries), failed, errs)
+}
+
+// registryServiceCount returns the number of services in the registry, asking registries
+// implementing serviceregistry.ServiceCounter for their count and listing the others.
+func registryServiceCount(r *registryEntry) (int, error) {
+	var n int
+	var err error
+	if counter, ok := r.Instance.(serviceregistry.ServiceCounter); ok {
+		n, err = counter.ServiceCount()
+	} else {
+		var svcs []*model.Service
+		svcs, err = r.Services()
+		n = len(svcs)
+	}
+	r.recordResult(err)
+	return n, err
+}
+
+// services lists the services from all platforms accepted by the filter, merging the services
+// installed in multiple clusters. A nil filter accepts all services.
+func (c *Controller) services(filter func(*model.Service) bool) ([]*model.Service, error) {
+	return c.visitServices(filter, nil)
+}
+
+// visitServices is services, calling visit with each registry whose services were listed, so
+// that callers can gather more from the registries in the same traversal.
+func (c *Controller) visitServices(filter func(*model.Service) bool, visit func(r *registryEntry)) ([]*model.Service, error) {
+	defer func(start time.Time) {
+		mergeDuration.Record(time.Since(start).Seconds())
+	}(time.Now())
+	c.detectClusterIDChanges(c.registryEntries())
+
+	// smap is a map of hostname (string), or of the key computed by Options.ServiceDedupKey, to
+	// the position of the merged service in the result, used to identify services that are
+	// installed in multiple clusters.
+	smap := make(map[host.Name]int)
+	// sources holds, by key, the per cluster copies of a service in registry order.
+	sources := make(map[host.Name][]serviceSource)
+
+	services := make([]*model.Service, 0)
+	var errs error
+	failed := 0
+	// Walk the published snapshot of the registries, without locking storeLock: the changes to
+	// the registries made meanwhile are seen by the next call.
+	registries := c.registryEntries()
+	listed := c.fanOut(registries, func(r *registryEntry) fanOutResult {
+		svcs, err := c.registryServices(r)
+		return fanOutResult{services: svcs, err: err}
+	})
+	for i, r := range registries {
+		var svcs []*model.Service
+		var err error
+		if listed != nil {
+			svcs, err = listed[i].services, listed[i].err
+		} else {
+			if err := c.waitLimiter(); err != nil {
+				if c.opts.StrictMode {
+					return nil, err
+				}
+				errs = multierror.Append(errs, err)
+				failed = len(registries)
+				break
+			}
+			svcs, err = c.registryServices(r)
+		}
+		r.recordResult(err)
+		if err != nil {
+			if c.opts.StrictMode {
+				return nil, registryError(r, err)
+			}
+			errs = appendRegistryError(errs, r, err)
+			failed++
+			continue
+		}
+		recordRegistryServiceCount(r, len(svcs))
+		c.seedHostIndex(r, svcs)
+		if visit != nil {
+			visit(r)
+		}
+		cluster, ok := c.mergeCluster(r)
+		if !ok {
+			continue
+		}
+		if cluster == "" {
+			// If the service does not have a cluster ID (ServiceEntries, CloudFoundry, etc.)
+			// Do not bother checking for the cluster ID.
+			// DO NOT ASSIGN CLUSTER ID to non-k8s registries. This will prevent service entries with multiple
+			// VIPs or CIDR ranges in the address field
+			if filter == nil && c.excludedNamespaces == nil && c.opts.HostnameRewriter == nil {
+				services = append(services, svcs...)
+				continue
+			}
+			for _, s := range svcs {
+				s = c.rewriteService(r, s)
+				if c.includeService(s, filter) {
+					services = append(services, s)
+				}
+			}
+		} else {
+			// This is K8S typically
+			networks := registryNetworks(r)
+			for _, s := range svcs {
+				s = c.rewriteService(r, s)
+				if !c.includeService(s, filter) {
+					continue
+				}
+				var groupSources []serviceSource
+				if isGroup(r) {
+					// Services of a group are merged already, their sources are the clusters of the group.
+					// Those without cluster VIPs come from the registries without a cluster ID.
+					if groupSources = groupServiceSources(s); len(groupSources) == 0 {
+						services = append(services, s)
+						continue
+					}
+				}
+				key := c.serviceKey(s)
+				if _, ok := smap[key]; !ok {
+					// First time we see a service. The result will have a single service per hostname
+					// The first cluster will be listed first, so the services in the primary cluster
+					// will be used for default settings. If a service appears in multiple clusters,
+					// the order is less clear.
+					smap[key] = len(services)
+					services = append(services, nil)
+				}
+				if groupSources != nil {
+					sources[key] = append(sources[key], groupSources...)
+					continue
+				}
+				// If the registry has a cluster ID, keep track of the cluster and the
+				// local address inside the cluster.
+				s.Mutex.RLock()
+				sources[key] = append(sources[key], serviceSource{
+					cluster:           cluster,
+					service:           s,
+					address:           clusterVIP(s),
+					networks:          networks,
+					externalAddresses: externalAddressesFingerprint(s),
+				})
+				s.Mutex.RUnlock()
+			}
+		}
+	}
+
+	if len(smap) > 0 || (filter == nil && errs == nil) {
+		c.mergeLock.Lock()
+		// A filtered listing, or one missing the services of a failed registry, only sees part of
+		// the services: keep the others cached.
+		merged := c.mergedServices
+		if (filter == nil && errs == nil) || merged == nil {
+			merged = make(map[host.Name]*mergedService, len(smap))
+		}
+		for hostname, i := range smap {
+			ms := c.mergedServices[hostname]
+			if ms == nil || !sameServiceSources(ms.sources, sources[hostname]) {
+				ms = c.newMergedService(sources[hostname])
+			}
+			merged[hostname] = ms
+			services[i] = ms.service
+		}
+		c.mergedServices = merged
+		c.mergeLock.Unlock()
+		c.notifyConflicts()
+		servicesMerged.Record(float64(len(smap)))
+		c.recordMergeMetrics(sources)
+	}
+	if len(registries) == 0 {
+		// Listing no registry is not an error: the push context fails on any error of Services.
+		return services, nil
+	}
+	return services, registriesError(len(registries), failed, errs)
+}
+
+// includeService returns true if the service is not in an excluded namespace and passes the filter.
+func (c *Controller) includeService(s *model.Service, filter func(*model.Service) bool) bool {
+	return !c.namespaceExcluded(s.Attributes.Namespace) && (filter == nil || filter(s))
+}
+
+// namespaceExcluded returns true if the namespace is one of Options.ExcludedNamespaces.
+func (c *Controller) namespaceExcluded(namespace string) bool {
+	if c.excludedNamespaces == nil {
+		return false
+	}
+	_, ok := c.excludedNamespaces[namespace]
+	return ok
+}
+
+// recordMergeMetrics records the size of a merge, on a sample of the service listings.
+func (c *Controller) recordMergeMetrics(sources map[host.Name][]serviceSource) {
+	rate := c.opts.MergeMetricsSampleRate
+	if rate <= 0 || (atomic.AddUint32(&c.mergeRuns, 1)-1)%uint32(rate) != 0 {
+		return
+	}
+	mergeHostnames.Record(float64(len(sources)))
+	for _, src := range sources {
+		mergeClustersPerHostname.Record(float64(len(src)))
+	}
+}
+
+// newMergedService builds a merged service from the per cluster copies of a service. The
+// service of the first cluster is copied and used for default settings, the copies are
+// not modified. Headless copies keep the unspecified address in ClusterVIPs, so that the VIP
+// of another cluster is never used in a cluster where the service is headless.
+// The networks advertised for each cluster are recorded into Attributes.ClusterNetworks.
+// The copies disagreeing on MeshExternal are merged as per Options.MeshExternalPolicy, and
+// the copies exposing different ports are reported as conflicting.
+// The merged service is fully built, on freshly allocated maps, before it is published: the
+// services returned to callers are never written afterwards and can be read without locking.
+func (c *Controller) newMergedService(sources []serviceSource) *mergedService {
+	first := sources[0].service
+	first.Mutex.RLock()
+	sp := first.DeepCopy()
+	first.Mutex.RUnlock()
+
+	sp.ClusterVIPs = make(map[string]string, len(sources))
+	external := make(map[string]bool, len(sources))
+	ports := make(map[string]string, len(sources))
+	for _, src := range sources {
+		sp.ClusterVIPs[src.cluster] = src.address
+		setClusterNetworks(sp, src.cluster, src.networks)
+		src.service.Mutex.RLock()
+		external[src.cluster] = src.service.MeshExternal
+		ports[src.cluster] = portSignature(src.service.Ports)
+		src.service.Mutex.RUnlock()
+	}
+	sp.MeshExternal = c.mergeMeshExternal(sp.Hostname, external)
+	c.mergePorts(sp.Hostname, ports)
+	return &mergedService{
+		sources: sources,
+		service: sp,
+	}
+}
+
+// mergeMeshExternal merges the MeshExternal flags of the copies of a service, by cluster, as per
+// Options.MeshExternalPolicy, recording the disagreement if the copies disagree.
+func (c *Controller) mergeMeshExternal(hostname host.Name, external map[string]bool) bool {
+	key := serviceConflictKey{hostname: hostname, attribute: "meshExternal"}
+	anyExternal, anyInternal := false, false
+	for _, e := range external {
+		if e {
+			anyExternal = true
+		} else {
+			anyInternal = true
+		}
+	}
+	if !anyExternal || !anyInternal {
+		c.clearServiceConflict(key)
+		return anyExternal
+	}
+	values := make(map[string]string, len(external))
+	for cluster, e := range external {
+		values[cluster] = strconv.FormatBool(e)
+	}
+	c.recordServiceConflict(key, values)
+	return c.opts.MeshExternalPolicy != InternalWins
+}
+
+// registryNetworks returns the networks advertised by a registry implementing
+// serviceregistry.NetworkProvider, sorted, deduplicated and joined by commas.
+func registryNetworks(r *registryEntry) string {
+	provider, ok := r.Instance.(serviceregistry.NetworkProvider)
+	if !ok {
+		return ""
+	}
+	networks := provider.Networks()
+	if len(networks) == 0 {
+		return ""
+	}
+	set := make(map[string]struct{}, len(networks))
+	for _, network := range networks {
+		if network != "" {
+			set[network] = struct{}{}
+		}
+	}
+	return strings.Join(sortedKeys(set), ",")
+}
+
+// setClusterNetworks records the networks, joined by commas, of the copy of the service in the
+// cluster into the Attributes.ClusterNetworks of the service, which must not be shared.
+func setClusterNetworks(s *model.Service, cluster, networks string) {
+	if networks == "" {
+		return
+	}
+	if s.Attributes.ClusterNetworks == nil {
+		s.Attributes.ClusterNetworks = make(map[string][]string)
+	}
+	s.Attributes.ClusterNetworks[cluster] = strings.Split(networks, ",")
+}
+
+// clusterVIP returns the address of the copy of a service in a cluster. Headless copies without
+// an address are given the unspecified address: an empty VIP would let proxies of the cluster
+// fall back to the address of the merged service, i.e. the VIP of another cluster.
+// The caller must hold the read lock of the service.
+func clusterVIP(s *model.Service) string {
+	if s.Address == "" && s.Resolution == model.Passthrough {
+		return constants.UnspecifiedIP
+	}
+	return s.Address
+}
+
+// externalAddressesFingerprint returns the external addresses of the service by cluster, sorted by
+// cluster and flattened into a string comparable across listings. The caller must hold the read
+// lock of the service.
+func externalAddressesFingerprint(s *model.Service) string {
+	if len(s.Attributes.ClusterExternalAddresses) == 0 {
+		return ""
+	}
+	clusters := make([]string, 0, len(s.Attributes.ClusterExternalAddresses))
+	for cluster := range s.Attributes.ClusterExternalAddresses {
+		clusters = append(clusters, cluster)
+	}
+	sort.Strings(clusters)
+	var b strings.Builder
+	for _, cluster := range clusters {
+		b.WriteString(cluster)
+		b.WriteByte('=')
+		b.WriteString(strings.Join(s.Attributes.ClusterExternalAddresses[cluster], ","))
+		b.WriteByte(';')
+	}
+	return b.String()
+}
+
+// sameServiceSources returns true if both lists hold the same service copies with the same
+// addresses, including the external addresses updated in place by the registries.
+func sameServiceSources(a, b []serviceSource) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// GetService retrieves a service by hostname if exists
+// Currently only used to get get gateway service
+// TODO: merge with Services()
+//
+// The first service found in a registry without a cluster ID is returned as is. If
+// Options.ServiceEntryPrecedence is set, a service provided by a ServiceEntry registry
+// takes precedence instead: it is returned with the VIPs of the Kubernetes copies of
+// the hostname merged into its ClusterVIPs, so that both the ServiceEntry overrides and
+// the per cluster addresses are honored. Endpoints of both are already unioned by InstancesByPort.
+//
+// Only the registries indexed for the hostname are queried, all registries are queried if the
+// hostname is not indexed or none of the indexed registries returns it.
+//
+// A hostname found in none of the registries is not an error: nil is returned, with the errors
+// of the registries which failed if any.
+//
+// When a single registry is configured, the lookup is delegated to it directly (see directRegistry).
+func (c *Controller) GetService(hostname host.Name) (*model.Service, error) {
+	if r := c.directRegistry(); r != nil {
+		return c.directGetService(r, hostname)
+	}
+	return c.getIndexedService(c.weightedRegistries(), hostname)
+}
+
+// getIndexedService retrieves a service by hostname from the registries indexed for the
+// hostname, falling back to all the given registries.
+func (c *Controller) getIndexedService(all []*registryEntry, hostname host.Name) (*model.Service, error) {
+	defer c.notifyConflicts()
+	registries := c.registriesForHostname(all, hostname)
+	service, err := c.getService(registries, hostname)
+	if service == nil && len(registries) != len(all) {
+		// The index is stale, fallback to a full scan.
+		service, err = c.getService(all, hostname)
+	}
+	if service != nil && (c.namespaceExcluded(service.Attributes.Namespace) || !c.authoritativelyExists(all, hostname)) {
+		return nil, nil
+	}
+	return service, err
+}
+
+// authoritativelyExists returns false if there are authoritative registries and none of them has
+// the hostname. A failing authoritative registry can't tell, the hostname is then assumed to exist.
+func (c *Controller) authoritativelyExists(registries []*registryEntry, hostname host.Name) bool {
+	hasAuthoritative := false
+	for _, r := range registries {
+		if !r.authoritative {
+			continue
+		}
+		hasAuthoritative = true
+		if service, err := c.registryService(r, hostname); err != nil || service != nil {
+			return true
+		}
+	}
+	return !hasAuthoritative
+}
+
+// getService retrieves a service by hostname from the given registries.
+func (c *Controller) getService(registries []*registryEntry, hostname host.Name) (*model.Service, error) {
+	var errs error
+	failed := 0
+	var out, seService *model.Service
+	var clusterVIPs map[string]string
+	// outWeight is the weight of the registry the merged service was first found in.
+	outWeight := 0
+	// external and ports hold the MeshExternal flags and port signatures of the merged copies, by cluster.
+	external := make(map[string]bool)
+	ports := make(map[string]string)
+	lookup := c.serviceLookup(registries, hostname)
+	for i, r := range registries {
+		service, err := lookup(i)
+		r.recordResult(err)
+		if err != nil {
+			if c.opts.StrictMode {
+				return nil, registryError(r, err)
+			}
+			errs = multierror.Append(errs, err)
+			failed++
+			continue
+		}
+		if service == nil {
+			continue
+		}
+		clusterID, ok := c.mergeCluster(r)
+		if !ok {
+			continue
+		}
+		if clusterID == "" {
+			if c.opts.ServiceEntryPrecedence {
+				// Keep looking so the VIPs of the Kubernetes services can be merged in.
+				if seService == nil && isServiceEntryRegistry(r) {
+					seService = service
+				}
+				continue
+			}
+			if out != nil && outWeight > r.weight {
+				// A registry of higher weight has the service already.
+				continue
+			}
+			// If the service does not have a cluster ID (ServiceEntries, CloudFoundry, etc.)
+			// Do not bother checking for the cluster ID.
+			// DO NOT ASSIGN CLUSTER ID to non-k8s registries. This will prevent service entries with multiple
+			// VIPs or CIDR ranges in the address field
+			return service, nil
+		}
+
+		if isGroup(r) {
+			// The external addresses of the clusters of a group are keyed by cluster already.
+			service.Mutex.RLock()
+			external[r.Cluster()] = service.MeshExternal
+			if c.opts.ServiceEntryPrecedence && len(service.ClusterVIPs) > 0 {
+				if clusterVIPs == nil {
+					clusterVIPs = make(map[string]string)
+				}
+				for cluster, vip := range service.ClusterVIPs {
+					clusterVIPs[cluster] = vip
+				}
+			}
+			if out == nil {
+				out, outWeight = service.DeepCopy(), r.weight
+			} else {
+				mergeExternalAddresses(out, service)
+			}
+			service.Mutex.RUnlock()
+			continue
+		}
+
+		// This is K8S typically
+		networks := registryNetworks(r)
+		if c.opts.ServiceEntryPrecedence {
+			if clusterVIPs == nil {
+				clusterVIPs = make(map[string]string)
+			}
+			service.Mutex.RLock()
+			clusterVIPs[clusterID] = clusterVIP(service)
+			service.Mutex.RUnlock()
+		}
+		if out == nil {
+			out, outWeight = service.DeepCopy(), r.weight
+			if clusterID != r.Cluster() {
+				// Registries key the external addresses by their own cluster ID.
+				out.Attributes.ClusterExternalAddresses = nil
+				out.Attributes.ClusterExternalPorts = nil
+			}
+		}
+		service.Mutex.RLock()
+		external[clusterID] = service.MeshExternal
+		ports[clusterID] = portSignature(service.Ports)
+		// ClusterExternalAddresses and ClusterExternalPorts are only used for getting gateway address
+		externalAddrs := service.Attributes.ClusterExternalAddresses[r.Cluster()]
+		if len(externalAddrs) > 0 {
+			if out.Attributes.ClusterExternalAddresses == nil {
+				out.Attributes.ClusterExternalAddresses = make(map[string][]string)
+			}
+			out.Attributes.ClusterExternalAddresses[clusterID] = externalAddrs
+		}
+		externalPorts := service.Attributes.ClusterExternalPorts[r.Cluster()]
+		if len(externalPorts) > 0 {
+			if out.Attributes.ClusterExternalPorts == nil {
+				out.Attributes.ClusterExternalPorts = make(map[string]map[uint32]uint32)
+			}
+			out.Attributes.ClusterExternalPorts[clusterID] = externalPorts
+		}
+		service.Mutex.RUnlock()
+		setClusterNetworks(out, clusterID, networks)
+	}
+	if out != nil {
+		out.MeshExternal = c.mergeMeshExternal(out.Hostname, external)
+		c.mergePorts(out.Hostname, ports)
+	}
+	if seService != nil {
+		return mergeServiceEntryOverride(seService, out, clusterVIPs), nil
+	}
+	return out, registriesError(len(registries), failed, errs)
+}
+
+// mergedByCluster returns true if the services of the registry are merged with the copies from
+// other clusters, their address becoming the VIP of the cluster. The services of registries
+// without a cluster ID, and of ServiceEntry registries even if they were given one, are returned
+// as is: ServiceEntries may hold several VIPs or CIDR ranges as address, which must not be
+// clobbered by the merge.
+func mergedByCluster(r serviceregistry.Instance) bool {
+	return r.Cluster() != "" && !isServiceEntryRegistry(r)
+}
+
+// mergeCluster returns the cluster ID the services of the registry are merged under, empty if
+// they are not merged by cluster, applying Options.EmptyClusterIDPolicy to the Kubernetes
+// registries without cluster ID. It returns false if the services of the registry are skipped.
+func (c *Controller) mergeCluster(r *registryEntry) (string, bool) {
+	if isServiceEntryRegistry(r) {
+		return "", true
+	}
+	if cluster := c.normalizeClusterID(r.Cluster()); cluster != "" || r.Provider() != serviceregistry.Kubernetes {
+		return cluster, true
+	}
+	switch c.opts.EmptyClusterIDPolicy {
+	case SynthesizeEmptyClusterID:
+		r.emptyClusterOnce.Do(func() {
+			r.syntheticClusterID = fmt.Sprintf("%s-%d", r.Provider(), atomic.AddUint32(&c.emptyClusters, 1))
+			log.Warnf("Kubernetes registry without cluster ID, merging its services under cluster %s", r.syntheticClusterID)
+		})
+		return r.syntheticClusterID, true
+	case SkipEmptyClusterID:
+		r.emptyClusterOnce.Do(func() {
+			log.Warnf("Kubernetes registry without cluster ID, skipping its services")
+		})
+		return "", false
+	}
+	return "", true
+}
+
+// serviceLookup returns a function looking up the hostname in the i-th registry. Without
+// GetServiceTimeout the registries are queried on demand. Otherwise they are all queried
+// concurrently, waiting at most until the deadline, and the registries which did not answer
+// in time fail with ErrRegistryTimeout.
+func (c *Controller) serviceLookup(registries []*registryEntry, hostname host.Name) func(int) (*model.Service, error) {
+	if c.opts.GetServiceTimeout <= 0 {
+		return func(i int) (*model.Service, error) {
+			return c.registryService(registries[i], hostname)
+		}
+	}
+
+	type result struct {
+		service *model.Service
+		err     error
+		done    bool
+	}
+	var mu sync.Mutex
+	results := make([]result, len(registries))
+	var wg sync.WaitGroup
+	for i, r := range registries {
+		wg.Add(1)
+		go func(i int, r *registryEntry) {
+			defer wg.Done()
+			service, err := c.registryService(r, hostname)
+			mu.Lock()
+			results[i] = result{service: service, err: err, done: true}
+			mu.Unlock()
+		}(i, r)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(c.opts.GetServiceTimeout)
+	select {
+	case <-done:
+	case <-timer.C:
+	}
+	timer.Stop()
+
+	mu.Lock()
+	answered := make([]result, len(results))
+	copy(answered, results)
+	mu.Unlock()
+	return func(i int) (*model.Service, error) {
+		if !answered[i].done {
+			r := registries[i]
+			return nil, fmt.Errorf("%w: %s/%s after %v", ErrRegistryTimeout, r.Provider(), r.Cluster(), c.opts.GetServiceTimeout)
+		}
+		return answered[i].service, answered[i].err
+	}
+}
+
+// registryService retrieves a service by hostname from the registry. With
+// Options.CaseInsensitiveHostnames or Options.HostnameRewriter, a service not found with the exact
+// hostname is looked up in the services of the registry, comparing the hostnames
+// case-insensitively or as rewritten.
+func (c *Controller) registryService(r *registryEntry, hostname host.Name) (*model.Service, error) {
+	if err := r.circuitError(); err != nil {
+		return nil, err
+	}
+	service, err := r.GetService(hostname)
+	if err != nil {
+		return nil, err
+	}
+	if service != nil && c.rewriteHostname(r, service.Hostname) == service.Hostname {
+		return service, nil
+	}
+	if !c.opts.CaseInsensitiveHostnames && c.opts.HostnameRewriter == nil {
+		return nil, nil
+	}
+	// The service may be known to the registry under another casing or hostname.
+	svcs, err := r.Services()
+	if err != nil {
+		return nil, err
+	}
+	key := c.hostnameKey(hostname)
+	for _, s := range svcs {
+		if c.hostnameKey(c.rewriteHostname(r, s.Hostname)) == key {
+			return c.rewriteService(r, s), nil
+		}
+	}
+	return nil, nil
+}
+
+// rewriteHostname returns the hostname of a service of the registry as rewritten by
+// Options.HostnameRewriter.
+func (c *Controller) rewriteHostname(r *registryEntry, hostname host.Name) host.Name {
+	if c.opts.HostnameRewriter == nil {
+		return hostname
+	}
+	return c.opts.HostnameRewriter(r.Cluster(), hostname)
+}
+
+// rewriteService returns the service of the registry, or a copy of it carrying its hostname as
+// rewritten by Options.HostnameRewriter.
+func (c *Controller) rewriteService(r *registryEntry, s *model.Service) *model.Service {
+	hostname := c.rewriteHostname(r, s.Hostname)
+	if hostname == s.Hostname {
+		return s
+	}
+	s.Mutex.RLock()
+	out := s.DeepCopy()
+	s.Mutex.RUnlock()
+	out.Hostname = hostname
+	return out
+}
+
+// serviceKey returns the key identifying the copies of a service to merge across clusters: the
+// one computed by Options.ServiceDedupKey if set, the hostname key otherwise.
+func (c *Controller) serviceKey(s *model.Service) host.Name {
+	if c.opts.ServiceDedupKey == nil {
+		return c.hostnameKey(s.Hostname)
 	}
-	index, ok := c.GetRegistryIndex(clusterID)
-	if !ok {
-		log.Warnf("Registry is not found in the registries list, nothing to delete")
-		return
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+	return host.Name(c.opts.ServiceDedupKey(s))
+}
+
+// hostnameKey returns the key identifying the hostname in the maps of the aggregate: the
+// hostname itself, or its lowercase form with Options.CaseInsensitiveHostnames.
+func (c *Controller) hostnameKey(hostname host.Name) host.Name {
+	if c.opts.CaseInsensitiveHostnames {
+		return host.Name(strings.ToLower(string(hostname)))
 	}
-	registries := c.registries
-	registries = append(registries[:index], registries[index+1:]...)
-	c.registries = registries
-	log.Infof("Registry for the cluster %s has been deleted.", clusterID)
+	return hostname
 }
 
-// GetRegistries returns a copy of all registries
-func (c *Controller) GetRegistries() []serviceregistry.Instance {
-	c.storeLock.RLock()
-	defer c.storeLock.RUnlock()
+// isServiceEntryRegistry returns true if the registry is backed by ServiceEntries.
+func isServiceEntryRegistry(r serviceregistry.Instance) bool {
+	return r.Provider() == serviceregistry.External || r.Provider() == serviceregistry.MCP
+}
 
-	return c.registries
+// mergeServiceEntryOverride returns a copy of the ServiceEntry provided service, with the
+// per cluster VIPs and external addresses of the Kubernetes service merged in.
+func mergeServiceEntryOverride(seService, k8sService *model.Service, clusterVIPs map[string]string) *model.Service {
+	seService.Mutex.RLock()
+	out := seService.DeepCopy()
+	seService.Mutex.RUnlock()
+	if len(clusterVIPs) > 0 {
+		if out.ClusterVIPs == nil {
+			out.ClusterVIPs = make(map[string]string, len(clusterVIPs))
+		}
+		for cluster, vip := range clusterVIPs {
+			out.ClusterVIPs[cluster] = vip
+		}
+	}
+	if k8sService != nil {
+		if out.Attributes.ClusterExternalAddresses == nil {
+			out.Attributes.ClusterExternalAddresses = k8sService.Attributes.ClusterExternalAddresses
+		}
+		if out.Attributes.ClusterExternalPorts == nil {
+			out.Attributes.ClusterExternalPorts = k8sService.Attributes.ClusterExternalPorts
+		}
+	}
+	return out
 }
 
-// GetRegistryIndex returns the index of a registry
-func (c *Controller) GetRegistryIndex(clusterID string) (int, bool) {
-	for i, r := range c.registries {
-		if r.Cluster() == clusterID {
-			return i, true
+// InstancesByPort retrieves instances for a service on a given port that match
+// any of the supplied labels. All instances match an empty label list.
+//
+// Only the registries indexed for the hostname of the service are queried, plus the unindexed
+// ones, so that the instances of a service living in a single cluster, the common case even in a
+// multi-cluster mesh, are not looked up in every cluster. All the registries are queried if the
+// hostname is not indexed, or if the indexed registries have no instance as the index may be stale.
+// When a single registry is configured, the lookup is delegated to it directly (see directRegistry).
+func (c *Controller) InstancesByPort(svc *model.Service, port int,
+	labels labels.Collection) ([]*model.ServiceInstance, error) {
+	if r := c.directRegistry(); r != nil {
+		return c.directInstancesByPort(r, svc, port, labels)
+	}
+	all := c.registryEntries()
+	if registries := c.registriesForHostname(all, svc.Hostname); len(registries) < len(all) {
+		instances, err := c.instancesByPort(registries, svc, port, labels)
+		if len(instances) > 0 {
+			return instances, err
 		}
 	}
-	return 0, false
+	return c.instancesByPort(all, svc, port, labels)
 }
 
-// Services lists services from all platforms
-func (c *Controller) Services() ([]*model.Service, error) {
-	// smap is a map of hostname (string) to service, used to identify services that
-	// are installed in multiple clusters.
-	smap := make(map[host.Name]*model.Service)
+// InstancesByPortWithSubsets retrieves the instances for a service on a given port matching each
+// of the subsets, keyed by the position of the subset. The instances are fetched once from the
+// registries and partitioned locally, instead of fanning out to the registries for each subset,
+// an instance matching a subset as it matches the labels passed to InstancesByPort: if its labels
+// are a superset of any of the label sets of the subset. An empty subset matches all instances.
+func (c *Controller) InstancesByPortWithSubsets(svc *model.Service, port int,
+	subsets []labels.Collection) (map[int][]*model.ServiceInstance, error) {
+	instances, err := c.InstancesByPort(svc, port, nil)
+	if len(instances) == 0 {
+		return nil, err
+	}
+	out := make(map[int][]*model.ServiceInstance, len(subsets))
+	for i, subset := range subsets {
+		var matching []*model.ServiceInstance
+		for _, si := range instances {
+			if subset.HasSubsetOf(si.Endpoint.Labels) {
+				matching = append(matching, si)
+			}
+		}
+		out[i] = matching
+	}
+	return out, err
+}
 
-	services := make([]*model.Service, 0)
+// RangeInstancesByPort calls fn for each instance of the service on the given port matching any
+// of the labels, as each registry returns them, instead of building the whole list as
+// InstancesByPort does. The iteration stops early when fn returns false. Errors are reported as
+// by InstancesByPort: ignored if any instance was found. With Options.DedupInstances, the copies
+// of an instance reported by several registries are skipped after the first one, whose weight is
+// kept as is: it was handed to fn before the others were seen.
+func (c *Controller) RangeInstancesByPort(svc *model.Service, port int, labels labels.Collection,
+	fn func(*model.ServiceInstance) bool) error {
+	if c.namespaceExcluded(svc.Attributes.Namespace) {
+		return nil
+	}
 	var errs error
-	// Locking Registries list while walking it to prevent inconsistent results
-	for _, r := range c.GetRegistries() {
-		svcs, err := r.Services()
-		if err != nil {
+	failed := 0
+	found := false
+	var seen map[string]struct{}
+	if c.opts.DedupInstances {
+		seen = make(map[string]struct{})
+	}
+	registries := c.registryEntries()
+	for _, r := range registries {
+		if err := c.waitLimiter(); err != nil {
 			errs = multierror.Append(errs, err)
+			failed = len(registries)
+			break
+		}
+		instances, err := registryInstances(r, svc, port, labels)
+		r.recordResult(err)
+		if err != nil {
+			log.Warnf("get service %s instance from registry %s/%s failed: %v", svc.Hostname, r.Provider(), r.Cluster(), err)
+			errs = appendRegistryError(errs, r, err)
+			failed++
 			continue
 		}
-		// Race condition: multiple threads may call Services, and multiple services
-		// may modify one of the service's cluster ID
-		clusterAddressesMutex.Lock()
-		if r.Cluster() == "" { // Should we instead check for registry name to be on safe side?
-			// If the service does not have a cluster ID (ServiceEntries, CloudFoundry, etc.)
-			// Do not bother checking for the cluster ID.
-			// DO NOT ASSIGN CLUSTER ID to non-k8s registries. This will prevent service entries with multiple
-			// VIPs or CIDR ranges in the address field
-			services = append(services, svcs...)
-		} else {
-			// This is K8S typically
-			for _, s := range svcs {
-				sp, ok := smap[s.Hostname]
-				if !ok {
-					// First time we see a service. The result will have a single service per hostname
-					// The first cluster will be listed first, so the services in the primary cluster
-					// will be used for default settings. If a service appears in multiple clusters,
-					// the order is less clear.
-					sp = s
-					smap[s.Hostname] = sp
-					services = append(services, sp)
-				}
-
-				sp.Mutex.Lock()
-				// If the registry has a cluster ID, keep track of the cluster and the
-				// local address inside the cluster.
-				if sp.ClusterVIPs == nil {
-					sp.ClusterVIPs = make(map[string]string)
+		for _, si := range c.stampClusterID(r, c.filterInstances(instances)) {
+			if c.namespaceExcluded(si.Service.Attributes.Namespace) {
+				continue
+			}
+			if seen != nil {
+				key := c.instanceKey(si)
+				if _, ok := seen[key]; ok {
+					continue
 				}
-				sp.ClusterVIPs[r.Cluster()] = s.Address
-				sp.Mutex.Unlock()
+				seen[key] = struct{}{}
+			}
+			found = true
+			if !fn(si) {
+				return nil
 			}
 		}
-		clusterAddressesMutex.Unlock()
 	}
-	return services, errs
+	if found {
+		return nil
+	}
+	return registriesError(len(registries), failed, errs)
 }
 
-// GetService retrieves a service by hostname if exists
-// Currently only used to get get gateway service
-// TODO: merge with Services()
-func (c *Controller) GetService(hostname host.Name) (*model.Service, error) {
-	var errs error
-	var out *model.Service
-	for _, r := range c.GetRegistries() {
-		service, err := r.GetService(hostname)
-		if err != nil {
-			errs = multierror.Append(errs, err)
-			continue
+// InstancesByPortInRegions retrieves instances for a service on a given port that match any of
+// the supplied labels, only querying the registries carrying all the given tags. Registries
+// without matching tags are skipped entirely.
+func (c *Controller) InstancesByPortInRegions(svc *model.Service, port int,
+	labels labels.Collection, regionTags map[string]string) ([]*model.ServiceInstance, error) {
+	var registries []*registryEntry
+	for _, r := range c.registryEntries() {
+		if r.matchesTags(regionTags) {
+			registries = append(registries, r)
 		}
-		if service == nil {
+	}
+	if len(registries) == 0 {
+		// No registry in the regions is not a misconfiguration of the aggregate.
+		return nil, nil
+	}
+	return c.instancesByPort(registries, svc, port, labels)
+}
+
+// InstancesByPortInClusters retrieves instances for a service on a given port that match any of
+// the supplied labels, only querying the registries of the given clusters, e.g. to simulate the
+// failure of the other clusters. An error is returned, and no registry queried, if a cluster has
+// no registry, unless Options.SkipUnknownClusters is set: the unknown clusters are then skipped.
+func (c *Controller) InstancesByPortInClusters(svc *model.Service, port int,
+	labels labels.Collection, clusterIDs []string) ([]*model.ServiceInstance, error) {
+	byCluster := make(map[string]*registryEntry)
+	for _, r := range c.registryEntries() {
+		byCluster[c.normalizeClusterID(r.Cluster())] = r
+	}
+	var registries []*registryEntry
+	var unknown []string
+	for _, clusterID := range clusterIDs {
+		r, ok := byCluster[c.normalizeClusterID(clusterID)]
+		if !ok {
+			unknown = append(unknown, clusterID)
 			continue
 		}
-		if r.Cluster() == "" { // Should we instead check for registry name to be on safe side?
-			// If the service does not have a cluster ID (ServiceEntries, CloudFoundry, etc.)
-			// Do not bother checking for the cluster ID.
-			// DO NOT ASSIGN CLUSTER ID to non-k8s registries. This will prevent service entries with multiple
-			// VIPs or CIDR ranges in the address field
-			return service, nil
+		registries = append(registries, r)
+	}
+	if len(unknown) > 0 {
+		if !c.opts.SkipUnknownClusters {
+			return nil, fmt.Errorf("no registry for clusters %v", unknown)
 		}
+		log.Warnf("InstancesByPortInClusters(): skipping the clusters %v without registry", unknown)
+	}
+	if len(registries) == 0 {
+		return nil, nil
+	}
+	return c.instancesByPort(registries, svc, port, labels)
+}
 
-		// This is K8S typically
-		if out == nil {
-			out = service.DeepCopy()
+// InstancesByPortClusterLocal returns the instances for a service on a given port in the registry
+// of the cluster of the proxy, falling back to the instances in the other registries only if the
+// cluster of the proxy has none. This is the building block of cluster local or closest first
+// traffic policies. All registries are queried if the proxy has no cluster.
+func (c *Controller) InstancesByPortClusterLocal(proxy *model.Proxy, svc *model.Service, port int,
+	labels labels.Collection) ([]*model.ServiceInstance, error) {
+	clusterID := c.normalizeClusterID(nodeClusterID(proxy))
+	registries := c.registryEntries()
+	if clusterID == "" {
+		return c.instancesByPort(registries, svc, port, labels)
+	}
+
+	var local, remote []*registryEntry
+	for _, r := range registries {
+		if c.normalizeClusterID(r.Cluster()) == clusterID {
+			local = append(local, r)
 		} else {
-			service.Mutex.RLock()
-			// ClusterExternalAddresses and ClusterExternalPorts are only used for getting gateway address
-			externalAddrs := service.Attributes.ClusterExternalAddresses[r.Cluster()]
-			if len(externalAddrs) > 0 {
-				if out.Attributes.ClusterExternalAddresses == nil {
-					out.Attributes.ClusterExternalAddresses = make(map[string][]string)
-				}
-				out.Attributes.ClusterExternalAddresses[r.Cluster()] = externalAddrs
-			}
-			externalPorts := service.Attributes.ClusterExternalPorts[r.Cluster()]
-			if len(externalPorts) > 0 {
-				if out.Attributes.ClusterExternalPorts == nil {
-					out.Attributes.ClusterExternalPorts = make(map[string]map[uint32]uint32)
-				}
-				out.Attributes.ClusterExternalPorts[r.Cluster()] = externalPorts
+			remote = append(remote, r)
+		}
+	}
+	if len(local) > 0 {
+		instances, err := c.instancesByPort(local, svc, port, labels)
+		if len(instances) > 0 || len(remote) == 0 {
+			return instances, err
+		}
+	}
+	return c.instancesByPort(remote, svc, port, labels)
+}
+
+// GetServiceWithInstances retrieves a service by hostname along with its instances on the given
+// port in all the registries, reading both from the same snapshot of the registries. The service
+// is merged as by GetService; instances reported by several registries for the same endpoint
+// address and port are only returned once, as with Options.DedupInstances. Nil is returned if the
+// hostname is not found.
+//
+// This costs a GetService call plus an InstancesByPort call on every registry, and is only
+// cheaper than calling both when the caller always needs the instances.
+func (c *Controller) GetServiceWithInstances(hostname host.Name, port int) (*model.Service, []*model.ServiceInstance, error) {
+	registries := c.registryEntries()
+	svc, err := c.getIndexedService(registries, hostname)
+	if svc == nil {
+		return nil, nil, err
+	}
+	instances, err := c.instancesByPort(registries, svc, port, nil)
+	if err != nil {
+		return svc, nil, err
+	}
+	return svc, c.dedupInstances(instances), nil
+}
+
+// dedupInstances removes the instances with the same endpoint address and port as a previous one,
+// reconciling their weights into the previous one as per Options.DedupWeights. An instance whose
+// weight changes is copied, the registries' instances are not modified.
+func (c *Controller) dedupInstances(instances []*model.ServiceInstance) []*model.ServiceInstance {
+	seen := make(map[string]int, len(instances))
+	// copied holds the positions of the instances already copied to reconcile their weight.
+	copied := make(map[int]struct{})
+	out := instances[:0:0]
+	for _, si := range instances {
+		key := c.instanceKey(si)
+		i, ok := seen[key]
+		if !ok {
+			seen[key] = len(out)
+			out = append(out, si)
+			continue
+		}
+		prev := lbWeight(out[i])
+		weight := prev
+		switch c.opts.DedupWeights {
+		case SumWeights:
+			weight += lbWeight(si)
+		case MaxWeights:
+			if w := lbWeight(si); w > weight {
+				weight = w
 			}
-			service.Mutex.RUnlock()
 		}
+		if weight == prev {
+			continue
+		}
+		if _, ok := copied[i]; !ok {
+			out[i] = out[i].DeepCopy()
+			copied[i] = struct{}{}
+		}
+		out[i].Endpoint.LbWeight = weight
 	}
-	return out, errs
+	return out
 }
 
-// InstancesByPort retrieves instances for a service on a given port that match
-// any of the supplied labels. All instances match an empty label list.
-func (c *Controller) InstancesByPort(svc *model.Service, port int,
+// instanceKey returns the key identifying the copies of an instance to deduplicate: the one
+// computed by Options.InstanceDedupKey if set, the endpoint address and port otherwise.
+func (c *Controller) instanceKey(si *model.ServiceInstance) string {
+	if c.opts.InstanceDedupKey != nil {
+		return c.opts.InstanceDedupKey(si)
+	}
+	return net.JoinHostPort(si.Endpoint.Address, strconv.FormatUint(uint64(si.Endpoint.EndpointPort), 10))
+}
+
+// lbWeight returns the load balancing weight of the instance, an unset weight counting as 1.
+func lbWeight(si *model.ServiceInstance) uint32 {
+	if si.Endpoint.LbWeight == 0 {
+		return 1
+	}
+	return si.Endpoint.LbWeight
+}
+
+// instancesByPort unions the instances for a service on a given port found in the given registries.
+func (c *Controller) instancesByPort(registries []*registryEntry, svc *model.Service, port int,
 	labels labels.Collection) ([]*model.ServiceInstance, error) {
+	if c.namespaceExcluded(svc.Attributes.Namespace) {
+		return nil, nil
+	}
 	var instances, tmpInstances []*model.ServiceInstance
 	var errs error
-	for _, r := range c.GetRegistries() {
+	failed := 0
+	listed := c.fanOut(registries, func(r *registryEntry) fanOutResult {
+		found, err := registryInstances(r, svc, port, labels)
+		return fanOutResult{instances: found, err: err}
+	})
+	for i, r := range registries {
 		var err error
-		tmpInstances, err = r.InstancesByPort(svc, port, labels)
+		if listed != nil {
+			tmpInstances, err = listed[i].instances, listed[i].err
+		} else {
+			if err := c.waitLimiter(); err != nil {
+				if c.opts.StrictMode {
+					return nil, err
+				}
+				errs = multierror.Append(errs, err)
+				failed = len(registries)
+				break
+			}
+			tmpInstances, err = registryInstances(r, svc, port, labels)
+		}
+		r.recordResult(err)
+		if err != nil && c.opts.StrictMode {
+			return nil, registryError(r, err)
+		}
 		if err != nil {
 			log.Warnf("get service %s instance from registry %s/%s failed: %v", svc.Hostname, r.Provider(), r.Cluster(), err)
-			errs = multierror.Append(errs, err)
-		} else if len(tmpInstances) > 0 {
-			instances = append(instances, tmpInstances...)
+			errs = appendRegistryError(errs, r, err)
+			failed++
+		} else if tmpInstances = c.filterInstances(tmpInstances); len(tmpInstances) > 0 {
+			if c.excludedNamespaces != nil {
+				tmpInstances = c.filterExcludedInstances(tmpInstances)
+			}
+			instances = append(instances, c.stampClusterID(r, tmpInstances)...)
 		}
 	}
 	if len(instances) > 0 {
-		errs = nil
+		if c.opts.DedupInstances {
+			instances = c.dedupInstances(instances)
+		}
+		return instances, nil
+	}
+	return instances, registriesError(len(registries), failed, errs)
+}
+
+// stampClusterID sets the cluster ID of the registry on the locality of the endpoints lacking
+// one, so that locality based routing works for the registries not reporting the cluster of
+// their endpoints. The instances stamped are copies, endpoint included; the others, and the
+// slice if no instance lacks a cluster ID, are returned as is.
+func (c *Controller) stampClusterID(r *registryEntry, instances []*model.ServiceInstance) []*model.ServiceInstance {
+	clusterID := c.normalizeClusterID(r.Cluster())
+	if clusterID == "" {
+		return instances
+	}
+	var out []*model.ServiceInstance
+	for i, si := range instances {
+		if si.Endpoint == nil || si.Endpoint.Locality.ClusterID != "" {
+			if out != nil {
+				out = append(out, si)
+			}
+			continue
+		}
+		if out == nil {
+			out = make([]*model.ServiceInstance, i, len(instances))
+			copy(out, instances[:i])
+		}
+		cp := *si
+		ep := *si.Endpoint
+		ep.Locality.ClusterID = clusterID
+		cp.Endpoint = &ep
+		out = append(out, &cp)
+	}
+	if out == nil {
+		return instances
+	}
+	return out
+}
+
+// filterInstances drops the instances rejected by Options.InstanceFilter, returning them in a
+// new slice if any is dropped.
+func (c *Controller) filterInstances(instances []*model.ServiceInstance) []*model.ServiceInstance {
+	if c.opts.InstanceFilter == nil {
+		return instances
+	}
+	var out []*model.ServiceInstance
+	for i, si := range instances {
+		if c.opts.InstanceFilter(si) {
+			if out != nil {
+				out = append(out, si)
+			}
+			continue
+		}
+		if out == nil {
+			out = make([]*model.ServiceInstance, i, len(instances))
+			copy(out, instances[:i])
+		}
+	}
+	if out == nil {
+		return instances
+	}
+	return out
+}
+
+// filterExcludedInstances removes the instances of the services in excluded namespaces.
+func (c *Controller) filterExcludedInstances(instances []*model.ServiceInstance) []*model.ServiceInstance {
+	out := instances[:0:0]
+	for _, si := range instances {
+		if !c.namespaceExcluded(si.Service.Attributes.Namespace) {
+			out = append(out, si)
+		}
+	}
+	return out
+}
+
+// registriesError builds the error of an operation which queried the given number of registries,
+// returning a sentinel error when there were no registries or all of them failed.
+func registriesError(registries, failed int, errs error) error {
+	if registries == 0 {
+		return ErrNoRegistries
+	}
+	if errs != nil && failed >= registries {
+		return fmt.Errorf("%w: %v", ErrAllRegistriesFailed, errs)
+	}
+	return errs
+}
+
+// allowedRegistries returns the registries of the clusters allowed for the proxy by
+// Options.AllowedClusters, and the number of registries dropped.
+func (c *Controller) allowedRegistries(node *model.Proxy, registries []*registryEntry) ([]*registryEntry, int) {
+	if c.opts.AllowedClusters == nil {
+		return registries, 0
+	}
+	clusters := c.opts.AllowedClusters(node)
+	if clusters == nil {
+		return registries, 0
+	}
+	allowed := make(map[string]struct{}, len(clusters))
+	for _, cluster := range clusters {
+		allowed[c.normalizeClusterID(cluster)] = struct{}{}
+	}
+	out := make([]*registryEntry, 0, len(registries))
+	for _, r := range registries {
+		if _, ok := allowed[c.normalizeClusterID(r.Cluster())]; ok {
+			out = append(out, r)
+		} else {
+			log.Debugf("GetProxyServiceInstances(): not searching registry %v: cluster not allowed for proxy %v",
+				r.Cluster(), node.ID)
+		}
+	}
+	return out, len(registries) - len(out)
+}
+
+// boundRegistry returns the registry of the cluster the proxy is bound to by its CLUSTER_ID
+// metadata, nil if the proxy is not bound to a cluster or the cluster has no registry.
+func (c *Controller) boundRegistry(registries []*registryEntry, node *model.Proxy) *registryEntry {
+	clusterID := nodeClusterID(node)
+	if clusterID == "" {
+		return nil
+	}
+	clusterID = c.normalizeClusterID(clusterID)
+	for _, r := range registries {
+		if c.normalizeClusterID(r.Cluster()) == clusterID {
+			return r
+		}
 	}
-	return instances, errs
+	return nil
 }
 
 func nodeClusterID(node *model.Proxy) string {
@@ -249,46 +2333,204 @@ func skipSearchingRegistryForProxy(nodeClusterID, registryClusterID, selfCluster
 	return registryClusterID != nodeClusterID
 }
 
+// skipRegistryForProxy returns true if the registry can't hold the proxy because the proxy is in a different cluster.
+func (c *Controller) skipRegistryForProxy(node *model.Proxy, r serviceregistry.Instance) bool {
+	if isGroup(r) {
+		// The group matches the proxy against its own clusters.
+		return false
+	}
+	return skipSearchingRegistryForProxy(c.normalizeClusterID(nodeClusterID(node)),
+		c.normalizeClusterID(r.Cluster()), c.normalizeClusterID(c.selfCluster()))
+}
+
+// GetProxyRegistry returns the first registry recognizing the proxy, applying the same cluster
+// matching as GetProxyServiceInstances. Registries implementing serviceregistry.ProxyRecognizer
+// are asked through that cheap existence check, other registries by listing the proxy instances.
+// This is cheaper than GetProxyServiceInstances when only the cluster of a proxy is needed.
+func (c *Controller) GetProxyRegistry(node *model.Proxy) (serviceregistry.Instance, bool) {
+	for _, r := range c.firstHitRegistries() {
+		if c.skipRegistryForProxy(node, r) {
+			continue
+		}
+		if recognizer, ok := r.Instance.(serviceregistry.ProxyRecognizer); ok {
+			if recognizer.HasProxy(node) {
+				return r.Instance, true
+			}
+			continue
+		}
+		if instances, err := r.GetProxyServiceInstances(node); err == nil && len(instances) > 0 {
+			return r.Instance, true
+		}
+	}
+	return nil, false
+}
+
 // GetProxyServiceInstances lists service instances co-located with a given proxy
+//
+// A proxy bound to a registered cluster through its CLUSTER_ID metadata is looked up in the
+// registry of that cluster first, and the heuristics skipping the registries of other clusters
+// are bypassed: the other registries are only scanned if the bound one does not find the proxy.
+// A proxy whose workload was registered with RegisterWorkload is bound to the registry which
+// registered it instead.
+// The registries of the clusters not allowed for the proxy by Options.AllowedClusters are never
+// searched, bound or not.
 func (c *Controller) GetProxyServiceInstances(node *model.Proxy) ([]*model.ServiceInstance, error) {
+	registries, disallowed := c.allowedRegistries(node, c.firstHitRegistries())
+	bound := c.workloadOwner(registries, node)
+	if bound == nil {
+		bound = c.boundRegistry(registries, node)
+	}
+	if bound != nil {
+		ordered := make([]*registryEntry, 0, len(registries))
+		ordered = append(ordered, bound)
+		for _, r := range registries {
+			if r != bound {
+				ordered = append(ordered, r)
+			}
+		}
+		registries = ordered
+	}
+
 	out := make([]*model.ServiceInstance, 0)
 	var errs error
+	// resolvedIPs holds the addresses of a proxy with multiple IPs that were resolved individually.
+	var resolvedIPs map[string]bool
+	// searched and skipped count the registries searched and skipped, for the lookup metrics.
+	searched, skipped := 0, disallowed
 	// It doesn't make sense for a single proxy to be found in more than one registry.
 	// TODO: if otherwise, warning or else what to do about it.
-	for _, r := range c.GetRegistries() {
-		nodeClusterID := nodeClusterID(node)
-		if skipSearchingRegistryForProxy(nodeClusterID, r.Cluster(), features.ClusterName) {
+	for _, r := range registries {
+		if bound == nil && c.skipRegistryForProxy(node, r) {
 			log.Debugf("GetProxyServiceInstances(): not searching registry %v: proxy %v CLUSTER_ID is %v",
-				r.Cluster(), node.ID, nodeClusterID)
+				r.Cluster(), node.ID, nodeClusterID(node))
+			skipped++
 			continue
 		}
+		searched++
 
 		instances, err := r.GetProxyServiceInstances(node)
+		r.recordResult(err)
 		if err != nil {
 			errs = multierror.Append(errs, err)
-		} else if len(instances) > 0 {
-			out = append(out, instances...)
+		} else if instances = c.filterInstances(instances); len(instances) > 0 {
+			out = append(out, c.stampClusterID(r, instances)...)
 			break
 		}
+
+		// Registries indexing workloads by a single IP may not recognize a proxy with several
+		// addresses (dual stack or multi-interface pods), each address possibly being known to
+		// a different registry. Resolve the addresses one at a time and union the results.
+		if lookup, ok := r.Instance.(serviceregistry.ProxyIPLookup); ok && len(node.IPAddresses) > 1 {
+			if resolvedIPs == nil {
+				resolvedIPs = make(map[string]bool, len(node.IPAddresses))
+			}
+			for _, ip := range node.IPAddresses {
+				if resolvedIPs[ip] {
+					continue
+				}
+				instances, err := lookup.GetProxyServiceInstancesByIP(ip)
+				if err != nil {
+					errs = multierror.Append(errs, err)
+				} else if instances = c.filterInstances(instances); len(instances) > 0 {
+					out = append(out, c.stampClusterID(r, instances)...)
+					resolvedIPs[ip] = true
+				}
+			}
+			if len(resolvedIPs) == len(node.IPAddresses) {
+				break
+			}
+		}
 	}
 
 	if len(out) > 0 {
+		switch {
+		case skipped > 0:
+			proxyLookupSkipped.Increment()
+		case searched == 1:
+			proxyLookupFirst.Increment()
+		default:
+			proxyLookupLater.Increment()
+		}
 		if errs != nil {
 			log.Debugf("GetProxyServiceInstances() found match but encountered an error: %v", errs)
 		}
+		if c.opts.ProxyInstanceDecorator != nil {
+			out = c.decorateProxyInstances(node, out)
+		}
 		return out, nil
 	}
 
+	if c.opts.LocalityFallback {
+		if si := c.locateProxy(registries, node); si != nil {
+			proxyLookupFallback.Increment()
+			if errs != nil {
+				log.Debugf("GetProxyServiceInstances() located the proxy but encountered an error: %v", errs)
+			}
+			return []*model.ServiceInstance{si}, nil
+		}
+	}
+
+	if errs != nil {
+		proxyLookupError.Increment()
+	} else {
+		proxyLookupEmpty.Increment()
+	}
+	c.proxyLookupFailures.record(node, errs)
 	return out, errs
 }
 
+// GetInstancesByIP returns the instances of all the registries whose endpoint has the given IP,
+// e.g. to attribute telemetry only carrying an endpoint address to a service. Registries
+// implementing serviceregistry.ProxyIPLookup are asked directly, the others are asked for the
+// instances of a proxy with the IP.
+func (c *Controller) GetInstancesByIP(ip string) ([]*model.ServiceInstance, error) {
+	var out []*model.ServiceInstance
+	var errs error
+	failed := 0
+	registries := c.registryEntries()
+	for _, r := range registries {
+		var instances []*model.ServiceInstance
+		var err error
+		if lookup, ok := r.Instance.(serviceregistry.ProxyIPLookup); ok {
+			instances, err = lookup.GetProxyServiceInstancesByIP(ip)
+		} else {
+			instances, err = r.GetProxyServiceInstances(&model.Proxy{IPAddresses: []string{ip}})
+		}
+		r.recordResult(err)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			failed++
+			continue
+		}
+		out = append(out, c.stampClusterID(r, instances)...)
+	}
+	if len(out) > 0 {
+		return out, nil
+	}
+	return out, registriesError(len(registries), failed, errs)
+}
+
+// decorateProxyInstances applies the ProxyInstanceDecorator to copies of the instances.
+func (c *Controller) decorateProxyInstances(node *model.Proxy, instances []*model.ServiceInstance) []*model.ServiceInstance {
+	out := make([]*model.ServiceInstance, 0, len(instances))
+	for _, si := range instances {
+		si.Service.Mutex.RLock()
+		cp := si.DeepCopy()
+		si.Service.Mutex.RUnlock()
+		c.opts.ProxyInstanceDecorator(node, cp)
+		out = append(out, cp)
+	}
+	return out
+}
+
 func (c *Controller) GetProxyWorkloadLabels(proxy *model.Proxy) (labels.Collection, error) {
 	var out labels.Collection
 	var errs error
 	// It doesn't make sense for a single proxy to be found in more than one registry.
 	// TODO: if otherwise, warning or else what to do about it.
-	for _, r := range c.GetRegistries() {
+	for _, r := range c.firstHitRegistries() {
 		wlLabels, err := r.GetProxyWorkloadLabels(proxy)
+		r.recordResult(err)
 		if err != nil {
 			errs = multierror.Append(errs, err)
 		} else if len(wlLabels) > 0 {
@@ -307,20 +2549,33 @@ func (c *Controller) GetProxyWorkloadLabels(proxy *model.Proxy) (labels.Collecti
 	return out, errs
 }
 
-// Run starts all the controllers
+// Run starts all the controllers, restarting the ones returning from their Run before stop is
+// closed or they are deleted.
 func (c *Controller) Run(stop <-chan struct{}) {
+	c.storeLock.Lock()
+	c.runStop = stop
+	registries := c.registries
+	c.storeLock.Unlock()
 
-	for _, r := range c.GetRegistries() {
-		go r.Run(stop)
+	for _, r := range registries {
+		c.running.Add(1)
+		go func(r *registryEntry) {
+			defer c.running.Done()
+			c.runRegistry(r, stop)
+		}(r)
 	}
 
 	<-stop
+	c.stopWarm()
+	if c.limiterCancel != nil {
+		c.limiterCancel()
+	}
 	log.Info("Registry Aggregator terminated")
 }
 
 // HasSynced returns true when all registries have synced
 func (c *Controller) HasSynced() bool {
-	for _, r := range c.GetRegistries() {
+	for _, r := range c.registryEntries() {
 		if !r.HasSynced() {
 			return false
 		}
@@ -328,44 +2583,115 @@ func (c *Controller) HasSynced() bool {
 	return true
 }
 
-// AppendServiceHandler implements a service catalog operation
-func (c *Controller) AppendServiceHandler(f func(*model.Service, model.Event)) error {
-	for _, r := range c.GetRegistries() {
-		if err := r.AppendServiceHandler(f); err != nil {
-			log.Infof("Fail to append service handler to adapter %s", r.Provider())
-			return err
+// UnsyncedRegistries returns the cluster IDs of the registries which have not synced since they
+// were added, in registry order, the registries without cluster ID being identified by provider,
+// e.g. to pinpoint the clusters stuck in their initial sync along with the time they were added,
+// reported by DebugDump. A registry is no longer reported once seen synced, even if it later
+// reports not being synced: unlike Readyz, this is about the initial sync. The registries seen
+// synced are not queried again, keeping the calls from a probe loop cheap.
+func (c *Controller) UnsyncedRegistries() []string {
+	var out []string
+	for _, r := range c.registryEntries() {
+		if r.initiallySynced() {
+			continue
 		}
+		name := r.Cluster()
+		if name == "" {
+			name = string(r.Provider())
+		}
+		out = append(out, name)
 	}
-	return nil
+	return out
 }
 
-// AppendInstanceHandler implements a service instance catalog operation
-func (c *Controller) AppendInstanceHandler(f func(*model.ServiceInstance, model.Event)) error {
-	for _, r := range c.GetRegistries() {
-		if err := r.AppendInstanceHandler(f); err != nil {
-			log.Infof("Fail to append instance handler to adapter %s", r.Provider())
-			return err
-		}
+// initiallySynced returns true if the registry has synced since it was added.
+func (r *registryEntry) initiallySynced() bool {
+	if atomic.LoadInt32(&r.synced) == 1 {
+		return true
 	}
-	return nil
+	if !r.HasSynced() {
+		return false
+	}
+	atomic.StoreInt32(&r.synced, 1)
+	return true
 }
 
-func (c *Controller) AppendWorkloadHandler(f func(*model.WorkloadInstance, model.Event)) error {
-	for _, r := range c.GetRegistries() {
-		if err := r.AppendWorkloadHandler(f); err != nil {
-			log.Infof("Fail to append workload handler to adapter %s", r.Provider())
-			return err
+// Readyz returns nil when all registries have synced and none has its circuit open, or an error
+// naming the clusters of the registries which have not synced, and of those whose circuit is open
+// (wrapping ErrCircuitOpen), identified by provider when they have no cluster ID. It backs the
+// readiness probe of the control plane, so that it does not report ready while a cluster is
+// still syncing, or is skipped by the lookups as unreachable.
+func (c *Controller) Readyz() error {
+	var notReady, open []string
+	for _, r := range c.registryEntries() {
+		name := r.Cluster()
+		if name == "" {
+			name = string(r.Provider())
+		}
+		if !r.HasSynced() {
+			notReady = append(notReady, name)
+		}
+		if r.circuitOpen() {
+			open = append(open, name)
 		}
 	}
-	return nil
+	var errs error
+	if len(notReady) > 0 {
+		errs = multierror.Append(errs, fmt.Errorf("registries not synced for clusters: %s", strings.Join(notReady, ", ")))
+	}
+	if len(open) > 0 {
+		errs = multierror.Append(errs, fmt.Errorf("%w for clusters: %s", ErrCircuitOpen, strings.Join(open, ", ")))
+	}
+	return errs
 }
 
-// GetIstioServiceAccounts implements model.ServiceAccounts operation
+// GetIstioServiceAccounts implements model.ServiceAccounts operation.
+// The ports filter is passed to every registry, and the accounts they return are unioned, sorted
+// and without duplicates: a service may run under different accounts, or on different ports, in
+// each cluster. Sorting keeps the order from leaking the registry order, or the order of each
+// registry, into the generated configuration, where it would cause churn.
 func (c *Controller) GetIstioServiceAccounts(svc *model.Service, ports []int) []string {
-	for _, r := range c.GetRegistries() {
-		if svcAccounts := r.GetIstioServiceAccounts(svc, ports); svcAccounts != nil {
-			return svcAccounts
+	return unionServiceAccounts(c.registryEntries(), svc, ports)
+}
+
+// GetIstioServiceAccountsInCluster returns the service accounts of the service, as seen by the
+// registry of the given cluster only, sorted and without duplicates like GetIstioServiceAccounts.
+// Nil is returned if the cluster has no registry.
+func (c *Controller) GetIstioServiceAccountsInCluster(svc *model.Service, ports []int, clusterID string) []string {
+	clusterID = c.normalizeClusterID(clusterID)
+	var registries []*registryEntry
+	for _, r := range c.registryEntries() {
+		if c.normalizeClusterID(r.Cluster()) == clusterID {
+			registries = append(registries, r)
 		}
 	}
-	return nil
+	return unionServiceAccounts(registries, svc, ports)
+}
+
+// unionServiceAccounts returns the union of the service accounts of the service in the registries, sorted.
+func unionServiceAccounts(registries []*registryEntry, svc *model.Service, ports []int) []string {
+	var out []string
+	seen := make(map[string]struct{})
+	for _, r := range registries {
+		svcAccounts := r.GetIstioServiceAccounts(svc, ports)
+		if svcAccounts != nil && out == nil {
+			out = make([]string, 0, len(svcAccounts))
+		}
+		for _, account := range svcAccounts {
+			if _, ok := seen[account]; !ok {
+				seen[account] = struct{}{}
+				out = append(out, account)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// waitLimiter blocks until the shared registry rate limiter allows a call, or the controller is stopped.
+func (c *Controller) waitLimiter() error {
+	if c.limiter == nil {
+		return nil
+	}
+	return c.limiter.Wait(c.limiterCtx)
 }
@@ -18,13 +18,20 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/serviceregistry"
 	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pkg/config/constants"
 	"istio.io/istio/pkg/config/host"
 	"istio.io/istio/pkg/config/labels"
+	"istio.io/istio/pkg/config/protocol"
 )
 
 var discovery1 *mock.ServiceDiscovery
@@ -55,7 +62,7 @@ func buildMockController() *Controller {
 		Controller:       &mock.Controller{},
 	}
 
-	ctls := NewController()
+	ctls := NewController(Options{})
 	ctls.AddRegistry(registry1)
 	ctls.AddRegistry(registry2)
 
@@ -88,7 +95,7 @@ func buildMockControllerForMultiCluster() *Controller {
 		Controller:       &mock.Controller{},
 	}
 
-	ctls := NewController()
+	ctls := NewController(Options{})
 	ctls.AddRegistry(registry1)
 	ctls.AddRegistry(registry2)
 
@@ -151,6 +158,113 @@ func TestServicesForMultiCluster(t *testing.T) {
 	t.Logf("Return service ClusterVIPs match ground truth")
 }
 
+func TestServicesReusesMergedServices(t *testing.T) {
+	services2 := map[host.Name]*model.Service{
+		mock.HelloService.Hostname: mock.MakeService("hello.default.svc.cluster.local", "10.1.2.0"),
+	}
+	hello1 := mock.MakeService("hello.default.svc.cluster.local", "10.1.1.0")
+	aggregateCtl := NewController(Options{})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID: serviceregistry.Kubernetes,
+		ClusterID:  "cluster-1",
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{
+			mock.HelloService.Hostname: hello1,
+		}, 2),
+		Controller: &mock.Controller{},
+	})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-2",
+		ServiceDiscovery: mock.NewDiscovery(services2, 2),
+		Controller:       &mock.Controller{},
+	})
+
+	first, err := aggregateCtl.Services()
+	if err != nil {
+		t.Fatalf("Services() encountered unexpected error: %v", err)
+	}
+	second, err := aggregateCtl.Services()
+	if err != nil {
+		t.Fatalf("Services() encountered unexpected error: %v", err)
+	}
+	if len(first) != 1 || len(second) != 1 {
+		t.Fatalf("expected a single merged service, got %d and %d", len(first), len(second))
+	}
+	if first[0] != second[0] {
+		t.Fatal("expected the merged service to be reused when the underlying services are unchanged")
+	}
+	if services2[mock.HelloService.Hostname].ClusterVIPs != nil {
+		t.Fatal("the merge must not modify the services of the registries")
+	}
+
+	// Replacing the service in one cluster rebuilds the merged service.
+	services2[mock.HelloService.Hostname] = mock.MakeService("hello.default.svc.cluster.local", "10.1.3.0")
+	third, err := aggregateCtl.Services()
+	if err != nil {
+		t.Fatalf("Services() encountered unexpected error: %v", err)
+	}
+	if third[0] == second[0] {
+		t.Fatal("expected a new merged service after the underlying service changed")
+	}
+	expected := map[string]string{"cluster-1": "10.1.1.0", "cluster-2": "10.1.3.0"}
+	if !reflect.DeepEqual(third[0].ClusterVIPs, expected) {
+		t.Fatalf("ClusterVIPs actual %v, expected %v", third[0].ClusterVIPs, expected)
+	}
+	if !reflect.DeepEqual(second[0].ClusterVIPs, map[string]string{"cluster-1": "10.1.1.0", "cluster-2": "10.1.2.0"}) {
+		t.Fatalf("previously returned service must not be modified, got %v", second[0].ClusterVIPs)
+	}
+
+	// Updating the external addresses of a service in place, as Kubernetes does on node events,
+	// rebuilds the merged service too.
+	hello1.Mutex.Lock()
+	hello1.Attributes.ClusterExternalAddresses = map[string][]string{"cluster-1": {"1.2.3.4"}}
+	hello1.Mutex.Unlock()
+	fourth, err := aggregateCtl.Services()
+	if err != nil {
+		t.Fatalf("Services() encountered unexpected error: %v", err)
+	}
+	if fourth[0] == third[0] {
+		t.Fatal("expected a new merged service after the external addresses changed in place")
+	}
+	expectedExternal := map[string][]string{"cluster-1": {"1.2.3.4"}}
+	if !reflect.DeepEqual(fourth[0].Attributes.ClusterExternalAddresses, expectedExternal) {
+		t.Fatalf("ClusterExternalAddresses actual %v, expected %v", fourth[0].Attributes.ClusterExternalAddresses, expectedExternal)
+	}
+}
+
+func BenchmarkServicesMultiCluster(b *testing.B) {
+	aggregateCtl := NewController(Options{})
+	for c := 0; c < 5; c++ {
+		services := make(map[host.Name]*model.Service)
+		for i := 0; i < 100; i++ {
+			hostname := host.Name(fmt.Sprintf("svc-%d.default.svc.cluster.local", i))
+			services[hostname] = mock.MakeService(hostname, fmt.Sprintf("10.%d.%d.1", c, i))
+		}
+		aggregateCtl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        fmt.Sprintf("cluster-%d", c),
+			ServiceDiscovery: mock.NewDiscovery(services, 2),
+			Controller:       &mock.Controller{},
+		})
+	}
+
+	// Reusing merged services across calls, the common case.
+	b.Run("reuse", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			_, _ = aggregateCtl.Services()
+		}
+	})
+	// Copying every merged service on every call.
+	b.Run("copy", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			aggregateCtl.mergedServices = nil
+			_, _ = aggregateCtl.Services()
+		}
+	})
+}
+
 func TestServices(t *testing.T) {
 	aggregateCtl := buildMockController()
 	// List Services from aggregate controller
@@ -182,6 +296,50 @@ func TestServices(t *testing.T) {
 	}
 }
 
+func TestServicesByProtocol(t *testing.T) {
+	aggregateCtl := buildMockController()
+
+	services, err := aggregateCtl.ServicesByProtocol(protocol.HTTPS)
+	if err != nil {
+		t.Fatalf("ServicesByProtocol() encountered unexpected error: %v", err)
+	}
+	if len(services) != 1 || services[0].Hostname != mock.ExtHTTPSService.Hostname {
+		t.Fatalf("expected only %s, got %v", mock.ExtHTTPSService.Hostname, services)
+	}
+
+	services, err = aggregateCtl.ServicesByProtocol(protocol.Mongo)
+	if err != nil {
+		t.Fatalf("ServicesByProtocol() encountered unexpected error: %v", err)
+	}
+	if len(services) != 2 {
+		t.Fatalf("expected the hello and world services, got %v", services)
+	}
+
+	services, err = aggregateCtl.ServicesByProtocol("")
+	if err != nil {
+		t.Fatalf("ServicesByProtocol() encountered unexpected error: %v", err)
+	}
+	if len(services) != 4 {
+		t.Fatalf("expected all services for an empty protocol, got %v", services)
+	}
+}
+
+func TestServicesByProtocolForMultiCluster(t *testing.T) {
+	aggregateCtl := buildMockControllerForMultiCluster()
+
+	services, err := aggregateCtl.ServicesByProtocol(protocol.HTTP)
+	if err != nil {
+		t.Fatalf("ServicesByProtocol() encountered unexpected error: %v", err)
+	}
+	if len(services) != 2 {
+		t.Fatalf("expected the hello and world services, got %v", services)
+	}
+	services, err = aggregateCtl.ServicesByProtocol(protocol.GRPC)
+	if err != nil || len(services) != 0 {
+		t.Fatalf("expected no services, got %v, %v", services, err)
+	}
+}
+
 func TestGetService(t *testing.T) {
 	aggregateCtl := buildMockController()
 
@@ -210,6 +368,56 @@ func TestGetService(t *testing.T) {
 	}
 }
 
+func buildMockControllerWithServiceEntry(opts Options) *Controller {
+	k8s := serviceregistry.Simple{
+		ProviderID: serviceregistry.Kubernetes,
+		ClusterID:  "cluster-1",
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{
+			mock.HelloService.Hostname: mock.MakeService(mock.HelloService.Hostname, "10.1.1.0"),
+		}, 2),
+		Controller: &mock.Controller{},
+	}
+	se := serviceregistry.Simple{
+		ProviderID: serviceregistry.External,
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{
+			mock.HelloService.Hostname: mock.MakeExternalHTTPService(mock.HelloService.Hostname, false, "240.240.0.1"),
+		}, 2),
+		Controller: &mock.Controller{},
+	}
+
+	ctls := NewController(opts)
+	ctls.AddRegistry(k8s)
+	ctls.AddRegistry(se)
+	return ctls
+}
+
+func TestGetServiceServiceEntryPrecedence(t *testing.T) {
+	// Without the option, the ServiceEntry is returned as is.
+	svc, err := buildMockControllerWithServiceEntry(Options{}).GetService(mock.HelloService.Hostname)
+	if err != nil {
+		t.Fatalf("GetService() encountered unexpected error: %v", err)
+	}
+	if svc.Address != "240.240.0.1" || len(svc.ClusterVIPs) != 0 {
+		t.Fatalf("expected the plain ServiceEntry service, got address %s and ClusterVIPs %v", svc.Address, svc.ClusterVIPs)
+	}
+
+	// With the option, the ServiceEntry takes precedence and the k8s VIPs are merged in.
+	svc, err = buildMockControllerWithServiceEntry(Options{ServiceEntryPrecedence: true}).GetService(mock.HelloService.Hostname)
+	if err != nil {
+		t.Fatalf("GetService() encountered unexpected error: %v", err)
+	}
+	if svc.Address != "240.240.0.1" {
+		t.Fatalf("expected the ServiceEntry address to take precedence, got %s", svc.Address)
+	}
+	if len(svc.Ports) != 1 || svc.Ports[0].Name != "http" {
+		t.Fatalf("expected the ServiceEntry ports to take precedence, got %v", svc.Ports)
+	}
+	expected := map[string]string{"cluster-1": "10.1.1.0"}
+	if !reflect.DeepEqual(svc.ClusterVIPs, expected) {
+		t.Fatalf("ClusterVIPs actual %v, expected %v", svc.ClusterVIPs, expected)
+	}
+}
+
 func TestGetServiceError(t *testing.T) {
 	aggregateCtl := buildMockController()
 
@@ -271,6 +479,109 @@ func TestGetProxyServiceInstances(t *testing.T) {
 	}
 }
 
+// ipIndexedRegistry is a registry resolving proxies by a single IP address only.
+type ipIndexedRegistry struct {
+	serviceregistry.Simple
+	instances map[string][]*model.ServiceInstance
+}
+
+func (r ipIndexedRegistry) GetProxyServiceInstances(*model.Proxy) ([]*model.ServiceInstance, error) {
+	return nil, nil
+}
+
+func (r ipIndexedRegistry) GetProxyServiceInstancesByIP(ip string) ([]*model.ServiceInstance, error) {
+	return r.instances[ip], nil
+}
+
+func TestGetProxyServiceInstancesMultipleIPs(t *testing.T) {
+	helloInstance := &model.ServiceInstance{
+		Service:  mock.HelloService,
+		Endpoint: &model.IstioEndpoint{Address: "10.1.1.1"},
+	}
+	worldInstance := &model.ServiceInstance{
+		Service:  mock.WorldService,
+		Endpoint: &model.IstioEndpoint{Address: "fd00::1"},
+	}
+	aggregateCtl := NewController(Options{})
+	aggregateCtl.AddRegistry(ipIndexedRegistry{
+		Simple: serviceregistry.Simple{
+			ProviderID: "mockAdapter1",
+			Controller: &mock.Controller{},
+		},
+		instances: map[string][]*model.ServiceInstance{"10.1.1.1": {helloInstance}},
+	})
+	aggregateCtl.AddRegistry(ipIndexedRegistry{
+		Simple: serviceregistry.Simple{
+			ProviderID: "mockAdapter2",
+			Controller: &mock.Controller{},
+		},
+		instances: map[string][]*model.ServiceInstance{"fd00::1": {worldInstance}},
+	})
+
+	instances, err := aggregateCtl.GetProxyServiceInstances(&model.Proxy{IPAddresses: []string{"10.1.1.1", "fd00::1"}})
+	if err != nil {
+		t.Fatalf("GetProxyServiceInstances() encountered unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(instances, []*model.ServiceInstance{helloInstance, worldInstance}) {
+		t.Fatalf("expected the instances of both IP addresses, got %v", instances)
+	}
+}
+
+// recognizingRegistry is a registry recognizing proxies without listing their instances.
+type recognizingRegistry struct {
+	serviceregistry.Simple
+	proxyIP string
+}
+
+func (r recognizingRegistry) GetProxyServiceInstances(*model.Proxy) ([]*model.ServiceInstance, error) {
+	return nil, errors.New("GetProxyServiceInstances() should not be called")
+}
+
+func (r recognizingRegistry) HasProxy(proxy *model.Proxy) bool {
+	return proxy.IPAddresses[0] == r.proxyIP
+}
+
+func TestGetProxyRegistry(t *testing.T) {
+	aggregateCtl := buildMockControllerForMultiCluster()
+	aggregateCtl.AddRegistry(recognizingRegistry{
+		Simple: serviceregistry.Simple{
+			ProviderID: "mockAdapter3",
+			ClusterID:  "cluster-3",
+			Controller: &mock.Controller{},
+		},
+		proxyIP: "10.3.0.1",
+	})
+
+	cases := []struct {
+		name    string
+		proxy   *model.Proxy
+		cluster string
+	}{
+		{"first registry", &model.Proxy{IPAddresses: []string{mock.MakeIP(mock.HelloService, 0)}}, "cluster-1"},
+		{"second registry", &model.Proxy{IPAddresses: []string{mock.MakeIP(mock.WorldService, 1)}}, "cluster-2"},
+		{"recognizer", &model.Proxy{IPAddresses: []string{"10.3.0.1"}}, "cluster-3"},
+		{"other cluster", &model.Proxy{
+			IPAddresses: []string{mock.MakeIP(mock.WorldService, 1)},
+			Metadata:    &model.NodeMetadata{ClusterID: "cluster-1"},
+		}, ""},
+		{"unknown", &model.Proxy{IPAddresses: []string{"10.9.9.9"}}, ""},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r, ok := aggregateCtl.GetProxyRegistry(tt.proxy)
+			if tt.cluster == "" {
+				if ok {
+					t.Fatalf("expected no registry, got %s", r.Cluster())
+				}
+				return
+			}
+			if !ok || r.Cluster() != tt.cluster {
+				t.Fatalf("expected the registry of %s, got %v", tt.cluster, r)
+			}
+		})
+	}
+}
+
 func TestGetProxyWorkloadLabels(t *testing.T) {
 	// If no registries return workload labels, we must return nil, rather than an empty list.
 	// This ensures callers can distinguish between no labels, and labels not found.
@@ -394,6 +705,51 @@ func TestInstancesError(t *testing.T) {
 	}
 }
 
+func TestInstancesByPortInRegions(t *testing.T) {
+	discovery1 = mock.NewDiscovery(map[host.Name]*model.Service{
+		mock.HelloService.Hostname: mock.HelloService,
+	}, 2)
+	discovery2 = mock.NewDiscovery(map[host.Name]*model.Service{
+		mock.HelloService.Hostname: mock.HelloService,
+	}, 2)
+	aggregateCtl := NewController(Options{})
+	aggregateCtl.AddRegistryWithOptions(serviceregistry.Simple{
+		ProviderID:       "mockAdapter1",
+		ClusterID:        "cluster-1",
+		ServiceDiscovery: discovery1,
+		Controller:       &mock.Controller{},
+	}, RegistryOptions{Tags: map[string]string{"region": "us-east"}})
+	aggregateCtl.AddRegistryWithOptions(serviceregistry.Simple{
+		ProviderID:       "mockAdapter2",
+		ClusterID:        "cluster-2",
+		ServiceDiscovery: discovery2,
+		Controller:       &mock.Controller{},
+	}, RegistryOptions{Tags: map[string]string{"region": "us-west"}})
+
+	// Errors in the registries of other regions are not seen since they are never queried.
+	discovery2.InstancesError = errors.New("mock Instances() error")
+
+	instances, err := aggregateCtl.InstancesByPortInRegions(mock.HelloService, 80, labels.Collection{},
+		map[string]string{"region": "us-east"})
+	if err != nil {
+		t.Fatalf("InstancesByPortInRegions() encountered unexpected error: %v", err)
+	}
+	if len(instances) != 2 {
+		t.Fatalf("expected the 2 instances of cluster-1, got %d", len(instances))
+	}
+
+	instances, err = aggregateCtl.InstancesByPortInRegions(mock.HelloService, 80, labels.Collection{},
+		map[string]string{"region": "eu-west"})
+	if err != nil || len(instances) != 0 {
+		t.Fatalf("expected no instances and no error for a region without registries, got %v, %v", instances, err)
+	}
+
+	if _, err = aggregateCtl.InstancesByPortInRegions(mock.HelloService, 80, labels.Collection{},
+		map[string]string{"region": "us-west"}); err == nil {
+		t.Fatal("expected the error of the us-west registry")
+	}
+}
+
 func TestGetIstioServiceAccounts(t *testing.T) {
 	aggregateCtl := buildMockController()
 
@@ -441,7 +797,7 @@ func TestAddRegistry(t *testing.T) {
 			ClusterID:  "cluster2",
 		},
 	}
-	ctrl := NewController()
+	ctrl := NewController(Options{})
 	for _, r := range registries {
 		ctrl.AddRegistry(r)
 	}
@@ -461,7 +817,7 @@ func TestDeleteRegistry(t *testing.T) {
 			ClusterID:  "cluster2",
 		},
 	}
-	ctrl := NewController()
+	ctrl := NewController(Options{})
 	for _, r := range registries {
 		ctrl.AddRegistry(r)
 	}
@@ -471,6 +827,21 @@ func TestDeleteRegistry(t *testing.T) {
 	}
 }
 
+func TestDeleteProviderRegistry(t *testing.T) {
+	ctrl := NewController(Options{})
+	ctrl.AddRegistry(serviceregistry.Simple{ProviderID: serviceregistry.External, ClusterID: "cluster1"})
+	ctrl.AddRegistry(serviceregistry.Simple{ProviderID: serviceregistry.Kubernetes, ClusterID: "cluster1"})
+
+	ctrl.DeleteProviderRegistry("cluster1", serviceregistry.Mock)
+	if l := len(ctrl.registries); l != 2 {
+		t.Fatalf("expected no registry to be deleted for another provider, got %d registries", l)
+	}
+	ctrl.DeleteProviderRegistry("cluster1", serviceregistry.Kubernetes)
+	if l := len(ctrl.registries); l != 1 || ctrl.registries[0].Provider() != serviceregistry.External {
+		t.Fatalf("expected the External registry of cluster1 to be kept, got %d registries", l)
+	}
+}
+
 func TestGetRegistries(t *testing.T) {
 	registries := []serviceregistry.Simple{
 		{
@@ -482,7 +853,7 @@ func TestGetRegistries(t *testing.T) {
 			ClusterID:  "cluster2",
 		},
 	}
-	ctrl := NewController()
+	ctrl := NewController(Options{})
 	for _, r := range registries {
 		ctrl.AddRegistry(r)
 	}
@@ -492,12 +863,58 @@ func TestGetRegistries(t *testing.T) {
 	}
 
 	for i := range result {
-		if !reflect.DeepEqual(result[i], ctrl.registries[i]) {
+		if !reflect.DeepEqual(result[i], ctrl.registries[i].Instance) {
 			t.Fatal("The original registries slice and resulting slice supposed to be identical.")
 		}
 	}
 }
 
+func TestClusterIDNormalizer(t *testing.T) {
+	aggregateCtl := NewController(Options{ClusterIDNormalizer: strings.ToLower})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID: "mockAdapter1",
+		ClusterID:  "Cluster-1",
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{
+			mock.HelloService.Hostname: mock.MakeService("hello.default.svc.cluster.local", "10.1.1.0"),
+		}, 2),
+		Controller: &mock.Controller{},
+	})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID: "mockAdapter2",
+		ClusterID:  "cluster-2",
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{
+			mock.WorldService.Hostname: mock.WorldService,
+		}, 2),
+		Controller: &mock.Controller{},
+	})
+
+	services, err := aggregateCtl.Services()
+	if err != nil {
+		t.Fatalf("Services() encountered unexpected error: %v", err)
+	}
+	for _, svc := range services {
+		if svc.Hostname == mock.HelloService.Hostname && svc.ClusterVIPs["cluster-1"] != "10.1.1.0" {
+			t.Fatalf("expected ClusterVIPs to be keyed by the normalized cluster ID, got %v", svc.ClusterVIPs)
+		}
+	}
+
+	if index, ok := aggregateCtl.GetRegistryIndex("CLUSTER-1"); !ok || index != 0 {
+		t.Fatalf("expected to find the registry of cluster-1 at index 0, got %d, %v", index, ok)
+	}
+
+	// The proxy is matched to the registry of its cluster despite the different case.
+	instances, err := aggregateCtl.GetProxyServiceInstances(&model.Proxy{
+		IPAddresses: []string{mock.MakeIP(mock.WorldService, 1)},
+		Metadata:    &model.NodeMetadata{ClusterID: "CLUSTER-2"},
+	})
+	if err != nil {
+		t.Fatalf("GetProxyServiceInstances() encountered unexpected error: %v", err)
+	}
+	if len(instances) == 0 {
+		t.Fatal("expected the instances of the proxy in cluster-2")
+	}
+}
+
 func TestSkipSearchingRegistryForProxy(t *testing.T) {
 	cases := []struct {
 		node     string
@@ -527,3 +944,2300 @@ func TestSkipSearchingRegistryForProxy(t *testing.T) {
 		}
 	}
 }
+
+func TestRegistryRateLimiterStop(t *testing.T) {
+	aggregateCtl := NewController(Options{RegistryQPS: 100, RegistryBurst: 10})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-1",
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{mock.HelloService.Hostname: mock.HelloService}, 2),
+		Controller:       &mock.Controller{},
+	})
+
+	svcs, err := aggregateCtl.Services()
+	if err != nil || len(svcs) != 1 {
+		t.Fatalf("Services() = %v, %v", svcs, err)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		aggregateCtl.Run(stop)
+		close(done)
+	}()
+	close(stop)
+	<-done
+
+	// Once stopped, waiting on the limiter no longer blocks and the calls fail.
+	if _, err := aggregateCtl.Services(); err == nil {
+		t.Fatal("expected Services to fail once the controller is stopped")
+	}
+	if _, err := aggregateCtl.InstancesByPort(mock.HelloService, 80, nil); err == nil {
+		t.Fatal("expected InstancesByPort to fail once the controller is stopped")
+	}
+}
+
+// failingDiscovery is a service discovery where all the operations fail.
+type failingDiscovery struct {
+	model.ServiceDiscovery
+}
+
+func (failingDiscovery) Services() ([]*model.Service, error) {
+	return nil, errors.New("mock Services error")
+}
+
+func (failingDiscovery) GetService(host.Name) (*model.Service, error) {
+	return nil, errors.New("mock GetService error")
+}
+
+func (failingDiscovery) InstancesByPort(*model.Service, int, labels.Collection) ([]*model.ServiceInstance, error) {
+	return nil, errors.New("mock InstancesByPort error")
+}
+
+func TestErrorSentinels(t *testing.T) {
+	empty := NewController(Options{})
+	// Listing the services of no registry is not an error.
+	if svcs, err := empty.Services(); err != nil || len(svcs) != 0 {
+		t.Errorf("Services() = %v, %v, expected no service and no error", svcs, err)
+	}
+	if _, err := empty.GetService(mock.HelloService.Hostname); !errors.Is(err, ErrNoRegistries) {
+		t.Errorf("GetService() error = %v, expected ErrNoRegistries", err)
+	}
+	if _, err := empty.InstancesByPort(mock.HelloService, 80, nil); !errors.Is(err, ErrNoRegistries) {
+		t.Errorf("InstancesByPort() error = %v, expected ErrNoRegistries", err)
+	}
+
+	failing := NewController(Options{})
+	for _, cluster := range []string{"cluster-1", "cluster-2"} {
+		failing.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        cluster,
+			ServiceDiscovery: failingDiscovery{},
+			Controller:       &mock.Controller{},
+		})
+	}
+	if _, err := failing.Services(); !errors.Is(err, ErrAllRegistriesFailed) || !strings.Contains(err.Error(), "mock Services error") {
+		t.Errorf("Services() error = %v, expected wrapped ErrAllRegistriesFailed", err)
+	}
+	if _, err := failing.GetService(mock.HelloService.Hostname); !errors.Is(err, ErrAllRegistriesFailed) {
+		t.Errorf("GetService() error = %v, expected ErrAllRegistriesFailed", err)
+	}
+	if _, err := failing.InstancesByPort(mock.HelloService, 80, nil); !errors.Is(err, ErrAllRegistriesFailed) {
+		t.Errorf("InstancesByPort() error = %v, expected ErrAllRegistriesFailed", err)
+	}
+
+	// Partial failures are not reported with a sentinel, and a missing hostname is not an error.
+	failing.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-3",
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{mock.HelloService.Hostname: mock.HelloService}, 2),
+		Controller:       &mock.Controller{},
+	})
+	svcs, err := failing.Services()
+	if len(svcs) != 1 || err == nil || errors.Is(err, ErrAllRegistriesFailed) || errors.Is(err, ErrNoRegistries) {
+		t.Errorf("Services() = %v, %v, expected a partial failure", svcs, err)
+	}
+	if svc, err := failing.GetService(mock.HelloService.Hostname); svc == nil || errors.Is(err, ErrAllRegistriesFailed) {
+		t.Errorf("GetService() = %v, %v, expected a partial failure", svc, err)
+	}
+	if svc, err := failing.GetService("unknown.default.svc.cluster.local"); svc != nil || errors.Is(err, ErrAllRegistriesFailed) {
+		t.Errorf("GetService() = %v, %v, expected a partial failure", svc, err)
+	}
+}
+
+// portAccountsDiscovery is a service discovery returning service accounts by port.
+type portAccountsDiscovery struct {
+	model.ServiceDiscovery
+	accounts map[int][]string
+}
+
+func (d portAccountsDiscovery) GetIstioServiceAccounts(_ *model.Service, ports []int) []string {
+	out := make([]string, 0)
+	for _, port := range ports {
+		out = append(out, d.accounts[port]...)
+	}
+	return out
+}
+
+func TestGetIstioServiceAccountsPortFilter(t *testing.T) {
+	accountA := "spiffe://cluster.local/ns/default/sa/a"
+	accountB := "spiffe://cluster.local/ns/default/sa/b"
+	aggregateCtl := NewController(Options{})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-a",
+		ServiceDiscovery: portAccountsDiscovery{accounts: map[int][]string{80: {accountA}}},
+		Controller:       &mock.Controller{},
+	})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-b",
+		ServiceDiscovery: portAccountsDiscovery{accounts: map[int][]string{443: {accountB}}},
+		Controller:       &mock.Controller{},
+	})
+
+	cases := []struct {
+		ports    []int
+		expected []string
+	}{
+		{[]int{80}, []string{accountA}},
+		{[]int{443}, []string{accountB}},
+		{[]int{80, 443}, []string{accountA, accountB}},
+		{[]int{8080}, []string{}},
+	}
+	for _, c := range cases {
+		if got := aggregateCtl.GetIstioServiceAccounts(mock.HelloService, c.ports); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("GetIstioServiceAccounts(%v) = %v, expected %v", c.ports, got, c.expected)
+		}
+	}
+}
+
+func TestGetIstioServiceAccountsSorted(t *testing.T) {
+	accountA := "spiffe://cluster.local/ns/default/sa/a"
+	accountB := "spiffe://cluster.local/ns/default/sa/b"
+	accountC := "spiffe://cluster.local/ns/default/sa/c"
+	aggregateCtl := NewController(Options{})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-a",
+		ServiceDiscovery: portAccountsDiscovery{accounts: map[int][]string{80: {accountC, accountA}}},
+		Controller:       &mock.Controller{},
+	})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-b",
+		ServiceDiscovery: portAccountsDiscovery{accounts: map[int][]string{80: {accountB, accountC}}},
+		Controller:       &mock.Controller{},
+	})
+
+	expected := []string{accountA, accountB, accountC}
+	if got := aggregateCtl.GetIstioServiceAccounts(mock.HelloService, []int{80}); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("GetIstioServiceAccounts() = %v, expected %v", got, expected)
+	}
+}
+
+func TestGetServiceWithInstances(t *testing.T) {
+	aggregateCtl := NewController(Options{})
+	// Both clusters report the same endpoints for the service.
+	for _, cluster := range []string{"cluster-1", "cluster-2"} {
+		aggregateCtl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        cluster,
+			ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{mock.HelloService.Hostname: mock.HelloService}, 2),
+			Controller:       &mock.Controller{},
+		})
+	}
+
+	svc, instances, err := aggregateCtl.GetServiceWithInstances(mock.HelloService.Hostname, 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svc == nil || svc.Hostname != mock.HelloService.Hostname {
+		t.Fatalf("expected service %s, got %v", mock.HelloService.Hostname, svc)
+	}
+	if len(instances) != 2 {
+		t.Fatalf("expected the 2 distinct endpoints, got %d", len(instances))
+	}
+
+	svc, instances, err = aggregateCtl.GetServiceWithInstances("unknown.default.svc.cluster.local", 80)
+	if svc != nil || instances != nil || err != nil {
+		t.Fatalf("GetServiceWithInstances() = %v, %v, %v, expected nothing", svc, instances, err)
+	}
+}
+
+func TestLastError(t *testing.T) {
+	discovery := mock.NewDiscovery(map[host.Name]*model.Service{mock.HelloService.Hostname: mock.HelloService}, 2)
+	aggregateCtl := NewController(Options{})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-1",
+		ServiceDiscovery: discovery,
+		Controller:       &mock.Controller{},
+	})
+
+	if err := aggregateCtl.LastError("cluster-1"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	discovery.ServicesError = errors.New("mock Services error")
+	_, _ = aggregateCtl.Services()
+	if err := aggregateCtl.LastError("cluster-1"); err != discovery.ServicesError {
+		t.Fatalf("expected %v, got %v", discovery.ServicesError, err)
+	}
+	// Calls to other methods update the error too.
+	discovery.GetServiceError = errors.New("mock GetService error")
+	_, _ = aggregateCtl.GetService(mock.HelloService.Hostname)
+	if err := aggregateCtl.LastError("cluster-1"); err != discovery.GetServiceError {
+		t.Fatalf("expected %v, got %v", discovery.GetServiceError, err)
+	}
+	// A successful call clears the error.
+	discovery.ServicesError = nil
+	_, _ = aggregateCtl.Services()
+	if err := aggregateCtl.LastError("cluster-1"); err != nil {
+		t.Fatalf("expected the error to be cleared, got %v", err)
+	}
+	if err := aggregateCtl.LastError("unknown"); err != nil {
+		t.Fatalf("expected no error for an unknown cluster, got %v", err)
+	}
+}
+
+func TestInstancesByPortClusterLocal(t *testing.T) {
+	hello := mock.HelloService
+	aggregateCtl := NewController(Options{})
+	// The mock registries are told apart by their number of instances.
+	for cluster, versions := range map[string]int{"cluster-1": 1, "cluster-2": 3} {
+		aggregateCtl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        cluster,
+			ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{hello.Hostname: hello}, versions),
+			Controller:       &mock.Controller{},
+		})
+	}
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-3",
+		ServiceDiscovery: mock.NewDiscovery(nil, 2),
+		Controller:       &mock.Controller{},
+	})
+
+	cases := []struct {
+		name     string
+		cluster  string
+		expected int
+	}{
+		{"local hit", "cluster-1", 1},
+		{"other local hit", "cluster-2", 3},
+		{"fallback", "cluster-3", 4},
+		{"no cluster", "", 4},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			proxy := &model.Proxy{Metadata: &model.NodeMetadata{ClusterID: c.cluster}}
+			instances, err := aggregateCtl.InstancesByPortClusterLocal(proxy, hello, 80, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(instances) != c.expected {
+				t.Fatalf("expected %d instances, got %d", c.expected, len(instances))
+			}
+		})
+	}
+}
+
+// panickingRegistry is a broken registry implementation panicking on all calls.
+type panickingRegistry struct {
+	serviceregistry.Instance
+}
+
+func TestValidateRegistries(t *testing.T) {
+	valid := serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-1",
+		ServiceDiscovery: mock.NewDiscovery(nil, 1),
+		Controller:       &mock.Controller{},
+	}
+
+	aggregateCtl := NewController(Options{ValidateRegistries: true})
+	if err := aggregateCtl.AddRegistryWithOptions(panickingRegistry{}, RegistryOptions{}); err == nil {
+		t.Fatal("expected the panicking registry to be rejected")
+	}
+	if err := aggregateCtl.AddRegistryWithOptions(nil, RegistryOptions{}); err == nil {
+		t.Fatal("expected the nil registry to be rejected")
+	}
+	aggregateCtl.AddRegistry(panickingRegistry{})
+	if err := aggregateCtl.AddRegistryWithOptions(valid, RegistryOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(aggregateCtl.GetRegistries()) != 1 {
+		t.Fatalf("expected only the valid registry, got %d registries", len(aggregateCtl.GetRegistries()))
+	}
+
+	// Registries are not validated by default.
+	aggregateCtl = NewController(Options{})
+	if err := aggregateCtl.AddRegistryWithOptions(panickingRegistry{}, RegistryOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countingRegistry is a registry counting its services without listing them.
+type countingRegistry struct {
+	serviceregistry.Simple
+	count int
+}
+
+func (r countingRegistry) ServiceCount() (int, error) {
+	return r.count, nil
+}
+
+func (r countingRegistry) Services() ([]*model.Service, error) {
+	return nil, errors.New("services should not be listed")
+}
+
+func TestServiceCount(t *testing.T) {
+	aggregateCtl := buildMockController()
+	aggregateCtl.AddRegistry(countingRegistry{
+		Simple: serviceregistry.Simple{
+			ProviderID: serviceregistry.Kubernetes,
+			ClusterID:  "cluster-3",
+			Controller: &mock.Controller{},
+		},
+		count: 5,
+	})
+
+	count, err := aggregateCtl.ServiceCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2 services in each mock registry and 5 in the counting registry.
+	if count != 9 {
+		t.Fatalf("expected 9 services, got %d", count)
+	}
+
+	if _, err := NewController(Options{}).ServiceCount(); !errors.Is(err, ErrNoRegistries) {
+		t.Fatalf("expected ErrNoRegistries, got %v", err)
+	}
+}
+
+func TestSetSelfCluster(t *testing.T) {
+	aggregateCtl := NewController(Options{})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        string(serviceregistry.Kubernetes),
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{mock.HelloService.Hostname: mock.HelloService}, 2),
+		Controller:       &mock.Controller{},
+	})
+	node := &model.Proxy{
+		IPAddresses: []string{mock.HelloInstanceV0},
+		Metadata:    &model.NodeMetadata{ClusterID: "failover"},
+	}
+
+	// The local registry is skipped for proxies of another cluster than features.ClusterName.
+	if instances, _ := aggregateCtl.GetProxyServiceInstances(node); len(instances) != 0 {
+		t.Fatalf("expected no instances, got %v", instances)
+	}
+	aggregateCtl.SetSelfCluster("failover")
+	if instances, _ := aggregateCtl.GetProxyServiceInstances(node); len(instances) == 0 {
+		t.Fatal("expected the proxy to be found in the local registry")
+	}
+	aggregateCtl.SetSelfCluster("")
+	if instances, _ := aggregateCtl.GetProxyServiceInstances(node); len(instances) != 0 {
+		t.Fatalf("expected no instances once features.ClusterName is restored, got %v", instances)
+	}
+}
+
+func TestServicesMixedHeadless(t *testing.T) {
+	hostname := host.Name("hello.default.svc.cluster.local")
+	clusterIP := mock.MakeService(hostname, "10.1.0.0")
+	// A headless copy without address, and one with the unspecified address as set by Kubernetes.
+	headless := mock.MakeService(hostname, "")
+	headless.Resolution = model.Passthrough
+	unspecified := mock.MakeService(hostname, constants.UnspecifiedIP)
+	unspecified.Resolution = model.Passthrough
+
+	cases := []struct {
+		name     string
+		copies   []*model.Service
+		expected map[string]string
+	}{
+		{
+			name:   "clusterIP first",
+			copies: []*model.Service{clusterIP, headless, unspecified},
+			expected: map[string]string{
+				"cluster-0": "10.1.0.0",
+				"cluster-1": constants.UnspecifiedIP,
+				"cluster-2": constants.UnspecifiedIP,
+			},
+		},
+		{
+			name:   "headless first",
+			copies: []*model.Service{headless, clusterIP},
+			expected: map[string]string{
+				"cluster-0": constants.UnspecifiedIP,
+				"cluster-1": "10.1.0.0",
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			aggregateCtl := NewController(Options{})
+			for i, svc := range c.copies {
+				aggregateCtl.AddRegistry(serviceregistry.Simple{
+					ProviderID:       serviceregistry.Kubernetes,
+					ClusterID:        fmt.Sprintf("cluster-%d", i),
+					ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{hostname: svc}, 1),
+					Controller:       &mock.Controller{},
+				})
+			}
+			svcs, err := aggregateCtl.Services()
+			if err != nil || len(svcs) != 1 {
+				t.Fatalf("Services() = %v, %v", svcs, err)
+			}
+			if !reflect.DeepEqual(svcs[0].ClusterVIPs, c.expected) {
+				t.Fatalf("expected ClusterVIPs %v, got %v", c.expected, svcs[0].ClusterVIPs)
+			}
+			// No proxy gets the VIP of another cluster.
+			for cluster, vip := range c.expected {
+				proxy := &model.Proxy{Metadata: &model.NodeMetadata{ClusterID: cluster}}
+				if got := svcs[0].GetServiceAddressForProxy(proxy); got != vip {
+					t.Errorf("expected address %q for a proxy in %s, got %q", vip, cluster, got)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyInstanceDecorator(t *testing.T) {
+	discovery := mock.NewDiscovery(map[host.Name]*model.Service{mock.HelloService.Hostname: mock.HelloService}, 2)
+	original, _ := discovery.GetProxyServiceInstances(&model.Proxy{IPAddresses: []string{mock.HelloInstanceV0}})
+	discovery.WantGetProxyServiceInstances = original
+
+	aggregateCtl := NewController(Options{
+		ProxyInstanceDecorator: func(proxy *model.Proxy, inst *model.ServiceInstance) {
+			inst.Endpoint.Network = proxy.Metadata.Network
+		},
+	})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-1",
+		ServiceDiscovery: discovery,
+		Controller:       &mock.Controller{},
+	})
+
+	node := &model.Proxy{
+		IPAddresses: []string{mock.HelloInstanceV0},
+		Metadata:    &model.NodeMetadata{Network: "network-1"},
+	}
+	instances, err := aggregateCtl.GetProxyServiceInstances(node)
+	if err != nil || len(instances) != len(original) {
+		t.Fatalf("GetProxyServiceInstances() = %v, %v", instances, err)
+	}
+	for i, si := range instances {
+		if si.Endpoint.Network != "network-1" {
+			t.Errorf("expected the instance to be decorated with network-1, got %q", si.Endpoint.Network)
+		}
+		if si == original[i] || original[i].Endpoint.Network != "" {
+			t.Errorf("expected the registry instances to be left untouched")
+		}
+	}
+}
+
+// labelsRegistry is a registry recording the GetProxyWorkloadLabels calls it receives.
+type labelsRegistry struct {
+	serviceregistry.Simple
+	calls *[]string
+}
+
+func (r labelsRegistry) GetProxyWorkloadLabels(*model.Proxy) (labels.Collection, error) {
+	*r.calls = append(*r.calls, r.ClusterID)
+	return labels.Collection{{"cluster": r.ClusterID}}, nil
+}
+
+func TestRotateFirstHitLookups(t *testing.T) {
+	var calls []string
+	aggregateCtl := NewController(Options{RotateFirstHitLookups: true})
+	for _, cluster := range []string{"cluster-1", "cluster-2", "cluster-3"} {
+		aggregateCtl.AddRegistry(labelsRegistry{
+			Simple: serviceregistry.Simple{ProviderID: serviceregistry.Kubernetes, ClusterID: cluster},
+			calls:  &calls,
+		})
+	}
+
+	for i := 0; i < 4; i++ {
+		out, err := aggregateCtl.GetProxyWorkloadLabels(&model.Proxy{})
+		if err != nil || len(out) != 1 {
+			t.Fatalf("GetProxyWorkloadLabels() = %v, %v", out, err)
+		}
+	}
+	// Each call starts from the next registry, and stops at the first match.
+	expected := []string{"cluster-1", "cluster-2", "cluster-3", "cluster-1"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected registries %v to be queried, got %v", expected, calls)
+	}
+
+	// Without rotation the first registry is always queried first.
+	calls = nil
+	aggregateCtl.opts.RotateFirstHitLookups = false
+	for i := 0; i < 2; i++ {
+		_, _ = aggregateCtl.GetProxyWorkloadLabels(&model.Proxy{})
+	}
+	if !reflect.DeepEqual(calls, []string{"cluster-1", "cluster-1"}) {
+		t.Fatalf("expected cluster-1 to be queried first, got %v", calls)
+	}
+}
+
+func TestServiceEntryCIDRPreserved(t *testing.T) {
+	hostname := host.Name("hello.default.svc.cluster.local")
+	cidr := mock.MakeService(hostname, "10.10.0.0/16")
+	cidr.Resolution = model.Passthrough
+
+	for _, seCluster := range []string{"", "se-cluster"} {
+		aggregateCtl := NewController(Options{})
+		for i, address := range []string{"10.1.0.0", "10.2.0.0"} {
+			aggregateCtl.AddRegistry(serviceregistry.Simple{
+				ProviderID:       serviceregistry.Kubernetes,
+				ClusterID:        fmt.Sprintf("cluster-%d", i),
+				ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{hostname: mock.MakeService(hostname, address)}, 1),
+				Controller:       &mock.Controller{},
+			})
+		}
+		// ServiceEntry registries are never merged, even when given a cluster ID.
+		aggregateCtl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.External,
+			ClusterID:        seCluster,
+			ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{hostname: cidr}, 1),
+			Controller:       &mock.Controller{},
+		})
+
+		svcs, err := aggregateCtl.Services()
+		if err != nil || len(svcs) != 2 {
+			t.Fatalf("Services() = %v, %v", svcs, err)
+		}
+		if svcs[0].Address != "10.1.0.0" || len(svcs[0].ClusterVIPs) != 2 {
+			t.Errorf("expected the Kubernetes service merged across 2 clusters, got %v", svcs[0])
+		}
+		if svcs[1] != cidr || cidr.Address != "10.10.0.0/16" || len(cidr.ClusterVIPs) != 0 {
+			t.Errorf("expected the ServiceEntry CIDR service untouched, got %v", svcs[1])
+		}
+
+		aggregateCtl.opts.ServiceEntryPrecedence = true
+		svc, err := aggregateCtl.GetService(hostname)
+		if err != nil || svc == nil || svc.Address != "10.10.0.0/16" {
+			t.Fatalf("expected the ServiceEntry CIDR to take precedence, got %v, %v", svc, err)
+		}
+	}
+}
+
+func TestGetInstancesByIP(t *testing.T) {
+	worldInstance := &model.ServiceInstance{
+		Service:  mock.WorldService,
+		Endpoint: &model.IstioEndpoint{Address: mock.HelloInstanceV0},
+	}
+	aggregateCtl := NewController(Options{})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-1",
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{mock.HelloService.Hostname: mock.HelloService}, 2),
+		Controller:       &mock.Controller{},
+	})
+	aggregateCtl.AddRegistry(ipIndexedRegistry{
+		Simple: serviceregistry.Simple{
+			ProviderID: serviceregistry.Kubernetes,
+			ClusterID:  "cluster-2",
+			Controller: &mock.Controller{},
+		},
+		instances: map[string][]*model.ServiceInstance{mock.HelloInstanceV0: {worldInstance}},
+	})
+
+	instances, err := aggregateCtl.GetInstancesByIP(mock.HelloInstanceV0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The instances of hello on each of its ports in cluster-1, and the world instance of cluster-2.
+	hostnames := make(map[host.Name]int)
+	for _, si := range instances {
+		hostnames[si.Service.Hostname]++
+	}
+	expected := map[host.Name]int{mock.HelloService.Hostname: len(mock.HelloService.Ports), mock.WorldService.Hostname: 1}
+	if !reflect.DeepEqual(hostnames, expected) {
+		t.Fatalf("expected instances %v, got %v", expected, hostnames)
+	}
+
+	if instances, err := aggregateCtl.GetInstancesByIP("1.1.1.1"); err != nil || len(instances) != 0 {
+		t.Fatalf("expected no instances, got %v, %v", instances, err)
+	}
+}
+
+func TestServicesShapeStableAcrossClusterCount(t *testing.T) {
+	hello1 := mock.MakeService(mock.HelloService.Hostname, "10.1.0.0")
+	hello2 := mock.MakeService(mock.HelloService.Hostname, "10.2.0.0")
+	aggregateCtl := NewController(Options{})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-1",
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{hello1.Hostname: hello1}, 1),
+		Controller:       &mock.Controller{},
+	})
+
+	expectClusterVIPs := func(expected map[string]string) {
+		t.Helper()
+		svcs, err := aggregateCtl.Services()
+		if err != nil || len(svcs) != 1 {
+			t.Fatalf("Services() = %v, %v", svcs, err)
+		}
+		if svcs[0].Address != "10.1.0.0" || !reflect.DeepEqual(svcs[0].ClusterVIPs, expected) {
+			t.Fatalf("expected ClusterVIPs %v, got %v", expected, svcs[0].ClusterVIPs)
+		}
+	}
+
+	// A single cluster already populates ClusterVIPs.
+	expectClusterVIPs(map[string]string{"cluster-1": "10.1.0.0"})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-2",
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{hello2.Hostname: hello2}, 1),
+		Controller:       &mock.Controller{},
+	})
+	expectClusterVIPs(map[string]string{"cluster-1": "10.1.0.0", "cluster-2": "10.2.0.0"})
+	aggregateCtl.DeleteRegistry("cluster-2")
+	expectClusterVIPs(map[string]string{"cluster-1": "10.1.0.0"})
+}
+
+func TestMergeMetricsSampling(t *testing.T) {
+	for _, rate := range []int{0, 2} {
+		aggregateCtl := NewController(Options{MergeMetricsSampleRate: rate})
+		aggregateCtl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        "cluster-1",
+			ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{mock.HelloService.Hostname: mock.HelloService}, 1),
+			Controller:       &mock.Controller{},
+		})
+		for i := 0; i < 3; i++ {
+			if _, err := aggregateCtl.Services(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Merge runs are only counted when sampling is enabled.
+		expected := uint32(0)
+		if rate > 0 {
+			expected = 3
+		}
+		if runs := atomic.LoadUint32(&aggregateCtl.mergeRuns); runs != expected {
+			t.Errorf("rate %d: expected %d merge runs, got %d", rate, expected, runs)
+		}
+	}
+}
+
+// blockingDiscovery is a service discovery whose GetService blocks until released.
+type blockingDiscovery struct {
+	model.ServiceDiscovery
+	release chan struct{}
+}
+
+func (d blockingDiscovery) GetService(hostname host.Name) (*model.Service, error) {
+	<-d.release
+	return d.ServiceDiscovery.GetService(hostname)
+}
+
+func TestGetServiceTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	hello2 := mock.MakeService(mock.HelloService.Hostname, "10.2.0.0")
+
+	aggregateCtl := NewController(Options{GetServiceTimeout: 50 * time.Millisecond})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID: serviceregistry.Kubernetes,
+		ClusterID:  "cluster-1",
+		ServiceDiscovery: blockingDiscovery{
+			ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{mock.HelloService.Hostname: mock.HelloService}, 1),
+			release:          release,
+		},
+		Controller: &mock.Controller{},
+	})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-2",
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{hello2.Hostname: hello2}, 1),
+		Controller:       &mock.Controller{},
+	})
+
+	start := time.Now()
+	svc, err := aggregateCtl.GetService(mock.HelloService.Hostname)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("GetService blocked for %v", elapsed)
+	}
+	// The answer of cluster-2 is returned, along with the timeout of cluster-1.
+	if svc == nil || svc.Address != hello2.Address {
+		t.Fatalf("expected the service of cluster-2, got %v", svc)
+	}
+	if !errors.Is(err, ErrRegistryTimeout) {
+		t.Fatalf("expected ErrRegistryTimeout, got %v", err)
+	}
+	if !errors.Is(aggregateCtl.LastError("cluster-1"), ErrRegistryTimeout) {
+		t.Fatalf("expected the timeout to be recorded for cluster-1, got %v", aggregateCtl.LastError("cluster-1"))
+	}
+
+	// All registries timing out is a failure.
+	aggregateCtl.DeleteRegistry("cluster-2")
+	if svc, err := aggregateCtl.GetService(mock.HelloService.Hostname); svc != nil || !errors.Is(err, ErrAllRegistriesFailed) {
+		t.Fatalf("GetService() = %v, %v, expected all registries to fail", svc, err)
+	}
+}
+
+func TestAuthoritativeRegistry(t *testing.T) {
+	k8sServices := map[host.Name]*model.Service{mock.HelloService.Hostname: mock.HelloService}
+	k8sDiscovery := mock.NewDiscovery(k8sServices, 1)
+	aggregateCtl := NewController(Options{})
+	if err := aggregateCtl.AddRegistryWithOptions(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-1",
+		ServiceDiscovery: k8sDiscovery,
+		Controller:       &mock.Controller{},
+	}, RegistryOptions{Authoritative: true}); err != nil {
+		t.Fatal(err)
+	}
+	// A ServiceEntry augmenting the Kubernetes services.
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID: serviceregistry.External,
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{
+			mock.HelloService.Hostname: mock.MakeService(mock.HelloService.Hostname, "10.10.0.0"),
+		}, 1),
+		Controller: &mock.Controller{},
+	})
+
+	// Present in the authoritative registry.
+	if svc, err := aggregateCtl.GetService(mock.HelloService.Hostname); svc == nil || err != nil {
+		t.Fatalf("GetService() = %v, %v", svc, err)
+	}
+
+	// Absent from the authoritative registry: the ServiceEntry does not resurrect it.
+	delete(k8sServices, mock.HelloService.Hostname)
+	if svc, err := aggregateCtl.GetService(mock.HelloService.Hostname); svc != nil || err != nil {
+		t.Fatalf("expected the service not to be found, got %v, %v", svc, err)
+	}
+
+	// The authoritative registry failing can't tell, the augmenting registry answers.
+	k8sDiscovery.GetServiceError = errors.New("mock GetService error")
+	if svc, _ := aggregateCtl.GetService(mock.HelloService.Hostname); svc == nil || svc.Address != "10.10.0.0" {
+		t.Fatalf("expected the ServiceEntry service, got %v", svc)
+	}
+}
+
+func TestRangeInstancesByPort(t *testing.T) {
+	aggregateCtl := buildMockController()
+
+	var all []*model.ServiceInstance
+	if err := aggregateCtl.RangeInstancesByPort(mock.HelloService, 80, nil, func(si *model.ServiceInstance) bool {
+		all = append(all, si)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := aggregateCtl.InstancesByPort(mock.HelloService, 80, nil)
+	if !reflect.DeepEqual(all, expected) {
+		t.Fatalf("expected the instances of InstancesByPort %v, got %v", expected, all)
+	}
+
+	// The iteration stops when the callback returns false.
+	calls := 0
+	if err := aggregateCtl.RangeInstancesByPort(mock.HelloService, 80, nil, func(*model.ServiceInstance) bool {
+		calls++
+		return false
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected a single call, got %d", calls)
+	}
+
+	discovery1.InstancesError = errors.New("mock InstancesByPort error")
+	discovery2.InstancesError = errors.New("mock InstancesByPort error")
+	if err := aggregateCtl.RangeInstancesByPort(mock.HelloService, 80, nil, func(*model.ServiceInstance) bool {
+		return true
+	}); !errors.Is(err, ErrAllRegistriesFailed) {
+		t.Fatalf("expected ErrAllRegistriesFailed, got %v", err)
+	}
+}
+
+func TestRangeInstancesByPortDedup(t *testing.T) {
+	newInstance := func(address string, weight uint32) *model.ServiceInstance {
+		return &model.ServiceInstance{
+			Service:     mock.HelloService,
+			ServicePort: mock.HelloService.Ports[0],
+			Endpoint:    &model.IstioEndpoint{Address: address, EndpointPort: 80, LbWeight: weight},
+		}
+	}
+	for _, dedup := range []bool{false, true} {
+		ctl := NewController(Options{DedupInstances: dedup})
+		ctl.AddRegistry(instancesRegistry{
+			Simple:    serviceregistry.Simple{ClusterID: "cluster-1", Controller: &mock.Controller{}},
+			instances: []*model.ServiceInstance{newInstance("10.0.0.1", 2), newInstance("10.0.0.2", 1)},
+		})
+		ctl.AddRegistry(instancesRegistry{
+			Simple:    serviceregistry.Simple{ClusterID: "cluster-2", Controller: &mock.Controller{}},
+			instances: []*model.ServiceInstance{newInstance("10.0.0.1", 5)},
+		})
+
+		weights := make(map[string][]uint32)
+		if err := ctl.RangeInstancesByPort(mock.HelloService, 80, nil, func(si *model.ServiceInstance) bool {
+			weights[si.Endpoint.Address] = append(weights[si.Endpoint.Address], si.Endpoint.LbWeight)
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string][]uint32{"10.0.0.1": {2, 5}, "10.0.0.2": {1}}
+		if dedup {
+			// The first copy is streamed, the others are skipped.
+			expected = map[string][]uint32{"10.0.0.1": {2}, "10.0.0.2": {1}}
+		}
+		if !reflect.DeepEqual(weights, expected) {
+			t.Fatalf("DedupInstances=%v: expected weights %v, got %v", dedup, expected, weights)
+		}
+	}
+}
+
+func TestUsesMergePath(t *testing.T) {
+	aggregateCtl := buildMockController()
+	if aggregateCtl.UsesMergePath() {
+		t.Fatal("expected registries without cluster ID not to use the merge path")
+	}
+	for i, cluster := range []string{"cluster-1", "cluster-2"} {
+		aggregateCtl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        cluster,
+			ServiceDiscovery: mock.NewDiscovery(nil, 1),
+			Controller:       &mock.Controller{},
+		})
+		if got, expected := aggregateCtl.UsesMergePath(), i > 0; got != expected {
+			t.Fatalf("with %d cluster registries, expected UsesMergePath() = %v", i+1, expected)
+		}
+	}
+	aggregateCtl.DeleteRegistry("cluster-2")
+	if aggregateCtl.UsesMergePath() {
+		t.Fatal("expected a single cluster registry not to use the merge path")
+	}
+}
+
+// TestServicesConcurrentReaders checks, with -race, that the merged services are never written
+// once returned: the merge builds the ClusterVIPs and external addresses on fresh copies.
+func TestServicesConcurrentReaders(t *testing.T) {
+	aggregateCtl := NewController(Options{})
+	for i := 0; i < 3; i++ {
+		hello := mock.MakeService(mock.HelloService.Hostname, fmt.Sprintf("10.%d.0.0", i+1))
+		hello.Attributes.ClusterExternalAddresses = map[string][]string{
+			fmt.Sprintf("cluster-%d", i): {fmt.Sprintf("1.1.1.%d", i)},
+		}
+		aggregateCtl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        fmt.Sprintf("cluster-%d", i),
+			ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{hello.Hostname: hello}, 1),
+			Controller:       &mock.Controller{},
+		})
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	read := func(svc *model.Service) {
+		for cluster, vip := range svc.ClusterVIPs {
+			_ = cluster + vip
+		}
+		for cluster, addrs := range svc.Attributes.ClusterExternalAddresses {
+			_ = cluster + strings.Join(addrs, ",")
+		}
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				svcs, _ := aggregateCtl.Services()
+				for _, svc := range svcs {
+					read(svc)
+				}
+				if svc, _ := aggregateCtl.GetService(mock.HelloService.Hostname); svc != nil {
+					read(svc)
+				}
+			}
+		}()
+	}
+
+	// Change the topology while the readers run, so that services are merged again.
+	for i := 0; i < 50; i++ {
+		extra := mock.MakeService(mock.HelloService.Hostname, "10.9.0.0")
+		aggregateCtl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        "cluster-extra",
+			ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{extra.Hostname: extra}, 1),
+			Controller:       &mock.Controller{},
+		})
+		aggregateCtl.DeleteRegistry("cluster-extra")
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestServicesByProvider(t *testing.T) {
+	aggregateCtl := buildMockController()
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       "mockAdapter1",
+		ClusterID:        "cluster-1",
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{mock.HelloService.Hostname: mock.HelloService}, 1),
+		Controller:       &mock.Controller{},
+	})
+
+	byProvider, err := aggregateCtl.ServicesByProvider()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[serviceregistry.ProviderID]int)
+	for provider, svcs := range byProvider {
+		counts[provider] = len(svcs)
+	}
+	// The services of the registries of a provider are not merged.
+	expected := map[serviceregistry.ProviderID]int{"mockAdapter1": 3, "mockAdapter2": 2}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("expected services by provider %v, got %v", expected, counts)
+	}
+
+	// The services are copies.
+	for _, svc := range byProvider["mockAdapter1"] {
+		if svc == mock.HelloService {
+			t.Fatal("expected a copy of the registry service")
+		}
+	}
+}
+
+func TestCaseInsensitiveHostnames(t *testing.T) {
+	lower := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	mixed := mock.MakeService("Hello.Default.svc.cluster.local", "10.2.0.0")
+	newController := func(opts Options) *Controller {
+		ctl := NewController(opts)
+		ctl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        "cluster-1",
+			ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{lower.Hostname: lower}, 1),
+			Controller:       &mock.Controller{},
+		})
+		ctl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        "cluster-2",
+			ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{mixed.Hostname: mixed}, 1),
+			Controller:       &mock.Controller{},
+		})
+		return ctl
+	}
+
+	// Hostnames are compared exactly by default.
+	ctl := newController(Options{})
+	svcs, err := ctl.Services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(svcs) != 2 {
+		t.Fatalf("expected 2 services, got %d", len(svcs))
+	}
+	if svc, _ := ctl.GetService("HELLO.default.svc.cluster.local"); svc != nil {
+		t.Fatalf("expected no service, got %v", svc.Hostname)
+	}
+
+	ctl = newController(Options{CaseInsensitiveHostnames: true})
+	svcs, err = ctl.Services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(svcs) != 1 {
+		t.Fatalf("expected the services to be merged, got %d services", len(svcs))
+	}
+	expectedVIPs := map[string]string{"cluster-1": "10.1.0.0", "cluster-2": "10.2.0.0"}
+	if !reflect.DeepEqual(svcs[0].ClusterVIPs, expectedVIPs) {
+		t.Fatalf("expected cluster VIPs %v, got %v", expectedVIPs, svcs[0].ClusterVIPs)
+	}
+	svc, err := ctl.GetService("HELLO.default.svc.cluster.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svc == nil {
+		t.Fatal("expected the service to be found")
+	}
+	if svc.Hostname != lower.Hostname || svc.Address != "10.1.0.0" {
+		t.Fatalf("expected the service of the first cluster, got %s/%s", svc.Hostname, svc.Address)
+	}
+}
+
+// instancesRegistry is a registry returning the given instances for every service and port.
+type instancesRegistry struct {
+	serviceregistry.Simple
+	instances []*model.ServiceInstance
+}
+
+func (r instancesRegistry) InstancesByPort(*model.Service, int, labels.Collection) ([]*model.ServiceInstance, error) {
+	return r.instances, nil
+}
+
+func TestInstancesByPortDedupWeights(t *testing.T) {
+	newInstance := func(address string, weight uint32) *model.ServiceInstance {
+		return &model.ServiceInstance{
+			Service:     mock.HelloService,
+			ServicePort: mock.HelloService.Ports[0],
+			Endpoint:    &model.IstioEndpoint{Address: address, EndpointPort: 80, LbWeight: weight},
+		}
+	}
+	shared1 := newInstance("10.0.0.1", 2)
+	shared2 := newInstance("10.0.0.1", 5)
+	unset := newInstance("10.0.0.2", 0)
+	unset2 := newInstance("10.0.0.2", 0)
+	other := newInstance("10.0.0.3", 3)
+
+	cases := []struct {
+		name     string
+		opts     Options
+		expected map[string][]uint32
+	}{
+		{
+			name:     "no dedup",
+			opts:     Options{},
+			expected: map[string][]uint32{"10.0.0.1": {2, 5}, "10.0.0.2": {0, 0}, "10.0.0.3": {3}},
+		},
+		{
+			name:     "first",
+			opts:     Options{DedupInstances: true},
+			expected: map[string][]uint32{"10.0.0.1": {2}, "10.0.0.2": {0}, "10.0.0.3": {3}},
+		},
+		{
+			name:     "sum",
+			opts:     Options{DedupInstances: true, DedupWeights: SumWeights},
+			expected: map[string][]uint32{"10.0.0.1": {7}, "10.0.0.2": {2}, "10.0.0.3": {3}},
+		},
+		{
+			name:     "max",
+			opts:     Options{DedupInstances: true, DedupWeights: MaxWeights},
+			expected: map[string][]uint32{"10.0.0.1": {5}, "10.0.0.2": {0}, "10.0.0.3": {3}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctl := NewController(c.opts)
+			ctl.AddRegistry(instancesRegistry{
+				Simple:    serviceregistry.Simple{ClusterID: "cluster-1", Controller: &mock.Controller{}},
+				instances: []*model.ServiceInstance{shared1, unset, other},
+			})
+			ctl.AddRegistry(instancesRegistry{
+				Simple:    serviceregistry.Simple{ClusterID: "cluster-2", Controller: &mock.Controller{}},
+				instances: []*model.ServiceInstance{shared2, unset2},
+			})
+
+			instances, err := ctl.InstancesByPort(mock.HelloService, 80, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			weights := make(map[string][]uint32)
+			for _, si := range instances {
+				weights[si.Endpoint.Address] = append(weights[si.Endpoint.Address], si.Endpoint.LbWeight)
+			}
+			if !reflect.DeepEqual(weights, c.expected) {
+				t.Fatalf("expected weights %v, got %v", c.expected, weights)
+			}
+
+			// The instances of the registries are not modified.
+			if shared1.Endpoint.LbWeight != 2 || shared2.Endpoint.LbWeight != 5 || unset.Endpoint.LbWeight != 0 {
+				t.Fatal("expected the registry instances to be unmodified")
+			}
+		})
+	}
+}
+
+// syncingRegistry is a registry which has not synced yet.
+type syncingRegistry struct {
+	serviceregistry.Simple
+}
+
+func (syncingRegistry) HasSynced() bool {
+	return false
+}
+
+func TestReadyz(t *testing.T) {
+	ctl := buildMockController()
+	if err := ctl.Readyz(); err != nil {
+		t.Fatalf("expected the synced registries to be ready, got %v", err)
+	}
+
+	ctl.AddRegistry(syncingRegistry{serviceregistry.Simple{ClusterID: "cluster-3", Controller: &mock.Controller{}}})
+	ctl.AddRegistry(syncingRegistry{serviceregistry.Simple{ProviderID: serviceregistry.External, Controller: &mock.Controller{}}})
+	err := ctl.Readyz()
+	if err == nil {
+		t.Fatal("expected an error while registries are syncing")
+	}
+	if !strings.Contains(err.Error(), "cluster-3, External") {
+		t.Fatalf("expected the error to name the syncing registries, got %v", err)
+	}
+}
+
+func TestReadyzCircuitOpen(t *testing.T) {
+	ctl := buildMockControllerForMultiCluster()
+	atomic.StoreInt64(&ctl.registryEntries()[1].openUntil, time.Now().Add(time.Hour).UnixNano())
+	err := ctl.Readyz()
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "for clusters: cluster-2") {
+		t.Fatalf("expected the error to name the cluster of the open circuit, got %v", err)
+	}
+
+	// A cooldown elapsed no longer fails the probe.
+	atomic.StoreInt64(&ctl.registryEntries()[1].openUntil, time.Now().Add(-time.Second).UnixNano())
+	if err := ctl.Readyz(); err != nil {
+		t.Fatalf("expected the registries to be ready, got %v", err)
+	}
+}
+
+// mutableClusterRegistry is a registry whose cluster ID can be updated in place.
+type mutableClusterRegistry struct {
+	serviceregistry.Simple
+}
+
+func (r *mutableClusterRegistry) Cluster() string {
+	return r.ClusterID
+}
+
+func TestUpdateRegistryMetadata(t *testing.T) {
+	ctl := NewController(Options{})
+	ctl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-b",
+		ServiceDiscovery: mock.NewDiscovery(nil, 1),
+		Controller:       &mock.Controller{},
+	})
+	registry := &mutableClusterRegistry{serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-a",
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{mock.HelloService.Hostname: mock.HelloService}, 1),
+		Controller:       &mock.Controller{},
+	}}
+	ctl.AddRegistry(registry)
+	if _, err := ctl.Services(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ctl.UpdateRegistryMetadata("unknown", func(serviceregistry.Instance) {}); err == nil {
+		t.Fatal("expected an error for an unknown cluster")
+	}
+
+	err := ctl.UpdateRegistryMetadata("cluster-a", func(r serviceregistry.Instance) {
+		r.(*mutableClusterRegistry).ClusterID = "cluster-c"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ctl.GetRegistryIndex("cluster-a"); ok {
+		t.Fatal("expected no registry for the previous cluster ID")
+	}
+	if i, ok := ctl.GetRegistryIndex("cluster-c"); !ok || ctl.GetRegistries()[i] != registry {
+		t.Fatal("expected the registry to be found by its new cluster ID")
+	}
+	svc, err := ctl.GetService(mock.HelloService.Hostname)
+	if err != nil || svc == nil {
+		t.Fatalf("GetService() = %v, %v", svc, err)
+	}
+	svcs, err := ctl.Services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range svcs {
+		if s.Hostname != mock.HelloService.Hostname {
+			continue
+		}
+		if _, ok := s.ClusterVIPs["cluster-a"]; ok {
+			t.Fatalf("expected the VIPs to be keyed by the new cluster ID, got %v", s.ClusterVIPs)
+		}
+		if _, ok := s.ClusterVIPs["cluster-c"]; !ok {
+			t.Fatalf("expected a VIP for the new cluster ID, got %v", s.ClusterVIPs)
+		}
+	}
+
+	// The cluster ID of another registry is rejected.
+	err = ctl.UpdateRegistryMetadata("cluster-c", func(r serviceregistry.Instance) {
+		r.(*mutableClusterRegistry).ClusterID = "cluster-b"
+	})
+	if err == nil {
+		t.Fatal("expected an error when updating to the cluster ID of another registry")
+	}
+}
+
+func TestSortRegistries(t *testing.T) {
+	newRegistries := func() []serviceregistry.Instance {
+		return []serviceregistry.Instance{
+			serviceregistry.Simple{
+				ProviderID:       serviceregistry.Kubernetes,
+				ClusterID:        "cluster-2",
+				ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{mock.HelloService.Hostname: mock.HelloService}, 2),
+				Controller:       &mock.Controller{},
+			},
+			serviceregistry.Simple{
+				ProviderID:       serviceregistry.Kubernetes,
+				ClusterID:        "cluster-1",
+				ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{mock.HelloService.Hostname: mock.HelloService}, 1),
+				Controller:       &mock.Controller{},
+			},
+			serviceregistry.Simple{
+				ProviderID:       serviceregistry.External,
+				ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{mock.WorldService.Hostname: mock.WorldService}, 1),
+				Controller:       &mock.Controller{},
+			},
+		}
+	}
+	describe := func(ctl *Controller) string {
+		var out []string
+		for _, r := range ctl.GetRegistries() {
+			out = append(out, fmt.Sprintf("%s/%s", r.Provider(), r.Cluster()))
+		}
+		svcs, err := ctl.Services()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range svcs {
+			out = append(out, string(s.Hostname))
+		}
+		instances, err := ctl.InstancesByPort(mock.HelloService, 80, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, fmt.Sprintf("%d instances", len(instances)))
+		return strings.Join(out, ",")
+	}
+
+	var expected string
+	for _, order := range [][]int{{0, 1, 2}, {2, 1, 0}, {1, 2, 0}} {
+		ctl := NewController(Options{SortRegistries: true})
+		registries := newRegistries()
+		for _, i := range order {
+			ctl.AddRegistry(registries[i])
+		}
+		got := describe(ctl)
+		if expected == "" {
+			expected = got
+			if !strings.HasPrefix(got, "External/,Kubernetes/cluster-1,Kubernetes/cluster-2,") {
+				t.Fatalf("expected the registries to be sorted by provider and cluster, got %s", got)
+			}
+		} else if got != expected {
+			t.Fatalf("expected %s regardless of the add order, got %s for %v", expected, got, order)
+		}
+
+		// Deleting a registry keeps the sort.
+		ctl.DeleteRegistry("cluster-1")
+		if got := describe(ctl); !strings.HasPrefix(got, "External/,Kubernetes/cluster-2,") {
+			t.Fatalf("expected the registries to stay sorted, got %s", got)
+		}
+	}
+}
+
+func TestSortServices(t *testing.T) {
+	newRegistries := func() []serviceregistry.Instance {
+		external := func(namespace string) serviceregistry.Instance {
+			s := mock.MakeService("db.example.com", "10.3.0.0")
+			s.Attributes.Namespace = namespace
+			return serviceregistry.Simple{
+				ProviderID:       serviceregistry.External,
+				ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{s.Hostname: s}, 1),
+				Controller:       &mock.Controller{},
+			}
+		}
+		return []serviceregistry.Instance{
+			serviceregistry.Simple{
+				ProviderID: serviceregistry.Kubernetes,
+				ClusterID:  "cluster-2",
+				ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{
+					mock.WorldService.Hostname: mock.MakeService(mock.WorldService.Hostname, "10.2.0.2"),
+					mock.HelloService.Hostname: mock.MakeService(mock.HelloService.Hostname, "10.1.0.2"),
+				}, 1),
+				Controller: &mock.Controller{},
+			},
+			external("ns-b"),
+			serviceregistry.Simple{
+				ProviderID: serviceregistry.Kubernetes,
+				ClusterID:  "cluster-1",
+				ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{
+					mock.HelloService.Hostname: mock.MakeService(mock.HelloService.Hostname, "10.1.0.1"),
+				}, 1),
+				Controller: &mock.Controller{},
+			},
+			external("ns-a"),
+		}
+	}
+	expected := strings.Join([]string{
+		"db.example.com/ns-a",
+		"db.example.com/ns-b",
+		string(mock.HelloService.Hostname) + "/",
+		string(mock.WorldService.Hostname) + "/",
+	}, ",")
+
+	for _, order := range [][]int{{0, 1, 2, 3}, {3, 2, 1, 0}, {2, 0, 3, 1}} {
+		ctl := NewController(Options{SortServices: true})
+		registries := newRegistries()
+		for _, i := range order {
+			ctl.AddRegistry(registries[i])
+		}
+		svcs, err := ctl.Services()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, s := range svcs {
+			got = append(got, fmt.Sprintf("%s/%s", s.Hostname, s.Attributes.Namespace))
+		}
+		if strings.Join(got, ",") != expected {
+			t.Fatalf("expected %s regardless of the add order, got %v for %v", expected, got, order)
+		}
+	}
+}
+
+func TestExcludedNamespaces(t *testing.T) {
+	system := mock.MakeService("dns.kube-system.svc.cluster.local", "10.1.0.0")
+	system.Attributes.Namespace = "kube-system"
+	app := mock.MakeService("app.default.svc.cluster.local", "10.2.0.0")
+	app.Attributes.Namespace = "default"
+	external := mock.MakeService("metrics.kube-system.example.com", "10.3.0.0")
+	external.Attributes.Namespace = "kube-system"
+
+	ctl := NewController(Options{ExcludedNamespaces: []string{"kube-system"}})
+	ctl.AddRegistry(serviceregistry.Simple{
+		ProviderID: serviceregistry.Kubernetes,
+		ClusterID:  "cluster-1",
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{
+			system.Hostname: system,
+			app.Hostname:    app,
+		}, 1),
+		Controller: &mock.Controller{},
+	})
+	ctl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.External,
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{external.Hostname: external}, 1),
+		Controller:       &mock.Controller{},
+	})
+
+	svcs, err := ctl.Services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(svcs) != 1 || svcs[0].Hostname != app.Hostname {
+		var hostnames []host.Name
+		for _, s := range svcs {
+			hostnames = append(hostnames, s.Hostname)
+		}
+		t.Fatalf("expected only %s, got %v", app.Hostname, hostnames)
+	}
+	svcs, err = ctl.ServicesByProtocol(protocol.HTTP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range svcs {
+		if s.Attributes.Namespace == "kube-system" {
+			t.Fatalf("expected %s to be excluded", s.Hostname)
+		}
+	}
+
+	for _, hostname := range []host.Name{system.Hostname, external.Hostname} {
+		if svc, err := ctl.GetService(hostname); err != nil || svc != nil {
+			t.Fatalf("GetService(%s) = %v, %v, expected no service", hostname, svc, err)
+		}
+	}
+	if svc, err := ctl.GetService(app.Hostname); err != nil || svc == nil {
+		t.Fatalf("GetService(%s) = %v, %v", app.Hostname, svc, err)
+	}
+
+	instances, err := ctl.InstancesByPort(system, 80, nil)
+	if err != nil || len(instances) != 0 {
+		t.Fatalf("InstancesByPort() = %v, %v, expected no instance", instances, err)
+	}
+	if instances, err := ctl.InstancesByPort(app, 80, nil); err != nil || len(instances) == 0 {
+		t.Fatalf("InstancesByPort() = %v, %v", instances, err)
+	}
+	_ = ctl.RangeInstancesByPort(system, 80, nil, func(si *model.ServiceInstance) bool {
+		t.Fatalf("expected no instance, got %v", si.Endpoint.Address)
+		return false
+	})
+}
+
+func TestHostnameRewriter(t *testing.T) {
+	hello1 := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	hello2 := mock.MakeService("hello.default.svc.cluster.local", "10.2.0.0")
+	// Federated clusters get their hostnames suffixed by their cluster ID.
+	rewriter := func(clusterID string, h host.Name) host.Name {
+		if clusterID == "federated" {
+			return h + ".federated"
+		}
+		return h
+	}
+	ctl := NewController(Options{HostnameRewriter: rewriter})
+	ctl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-1",
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{hello1.Hostname: hello1}, 1),
+		Controller:       &mock.Controller{},
+	})
+	ctl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "federated",
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{hello2.Hostname: hello2}, 1),
+		Controller:       &mock.Controller{},
+	})
+
+	svcs, err := ctl.Services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vips := make(map[host.Name]map[string]string)
+	for _, s := range svcs {
+		vips[s.Hostname] = s.ClusterVIPs
+	}
+	// The services with the same name are kept distinct, their VIPs keyed by their own cluster.
+	expected := map[host.Name]map[string]string{
+		"hello.default.svc.cluster.local":           {"cluster-1": "10.1.0.0"},
+		"hello.default.svc.cluster.local.federated": {"federated": "10.2.0.0"},
+	}
+	if !reflect.DeepEqual(vips, expected) {
+		t.Fatalf("expected services %v, got %v", expected, vips)
+	}
+
+	svc, err := ctl.GetService("hello.default.svc.cluster.local")
+	if err != nil || svc == nil || svc.Address != "10.1.0.0" {
+		t.Fatalf("GetService() = %v, %v, expected the service of cluster-1", svc, err)
+	}
+	svc, err = ctl.GetService("hello.default.svc.cluster.local.federated")
+	if err != nil || svc == nil || svc.Address != "10.2.0.0" || svc.Hostname != "hello.default.svc.cluster.local.federated" {
+		t.Fatalf("GetService() = %v, %v, expected the rewritten service of the federated cluster", svc, err)
+	}
+
+	// The services of the registries are not modified.
+	if hello2.Hostname != "hello.default.svc.cluster.local" {
+		t.Fatalf("expected the registry service to be unmodified, got %s", hello2.Hostname)
+	}
+}
+
+// hostnamesRegistry is a registry listing its hostnames without listing its services.
+type hostnamesRegistry struct {
+	serviceregistry.Simple
+	hostnames []host.Name
+}
+
+func (r hostnamesRegistry) Hostnames() ([]host.Name, error) {
+	return r.hostnames, nil
+}
+
+func (r hostnamesRegistry) Services() ([]*model.Service, error) {
+	return nil, errors.New("services should not be listed")
+}
+
+func TestHostnames(t *testing.T) {
+	aggregateCtl := buildMockController()
+	aggregateCtl.AddRegistry(hostnamesRegistry{
+		Simple: serviceregistry.Simple{
+			ProviderID: serviceregistry.Kubernetes,
+			ClusterID:  "cluster-3",
+			Controller: &mock.Controller{},
+		},
+		hostnames: []host.Name{"alpha.default.svc.cluster.local", mock.HelloService.Hostname},
+	})
+
+	hostnames, err := aggregateCtl.Hostnames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []host.Name{
+		"alpha.default.svc.cluster.local",
+		mock.ExtHTTPService.Hostname,
+		mock.ExtHTTPSService.Hostname,
+		mock.HelloService.Hostname,
+		mock.WorldService.Hostname,
+	}
+	sort.Slice(expected, func(i, j int) bool { return expected[i] < expected[j] })
+	if !reflect.DeepEqual(hostnames, expected) {
+		t.Fatalf("expected hostnames %v, got %v", expected, hostnames)
+	}
+}
+
+func TestInstancesByPortWithSubsets(t *testing.T) {
+	aggregateCtl := buildMockController()
+	subsets := []labels.Collection{
+		{{"version": "v0"}},
+		{{"version": "v1"}},
+		{{"version": "v0"}, {"version": "v1"}},
+		{{"version": "v2"}},
+		nil,
+	}
+
+	bySubset, err := aggregateCtl.InstancesByPortWithSubsets(mock.HelloService, 80, subsets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The subsets match as the labels of InstancesByPort do.
+	for i, subset := range subsets {
+		expected, err := aggregateCtl.InstancesByPort(mock.HelloService, 80, subset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, si := range bySubset[i] {
+			got = append(got, si.Endpoint.Address)
+		}
+		var want []string
+		for _, si := range expected {
+			want = append(want, si.Endpoint.Address)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("subset %v: expected instances %v, got %v", subset, want, got)
+		}
+	}
+	if len(bySubset[0]) == 0 || len(bySubset[2]) != len(bySubset[0])+len(bySubset[1]) {
+		t.Fatalf("expected the instances to be partitioned by version, got %v", bySubset)
+	}
+	if len(bySubset[3]) != 0 {
+		t.Fatalf("expected no instance for an unknown version, got %d", len(bySubset[3]))
+	}
+}
+
+// trustDomainRegistry is a registry reporting its trust domain.
+type trustDomainRegistry struct {
+	serviceregistry.Simple
+	trustDomain string
+}
+
+func (r trustDomainRegistry) TrustDomain() string {
+	return r.trustDomain
+}
+
+func TestRegistryTrustDomains(t *testing.T) {
+	aggregateCtl := NewController(Options{})
+	aggregateCtl.AddRegistry(trustDomainRegistry{
+		Simple:      serviceregistry.Simple{ClusterID: "cluster-1", Controller: &mock.Controller{}},
+		trustDomain: "cluster-1.example.com",
+	})
+	aggregateCtl.AddRegistry(trustDomainRegistry{
+		Simple:      serviceregistry.Simple{ClusterID: "cluster-2", Controller: &mock.Controller{}},
+		trustDomain: "cluster-2.example.com",
+	})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{ClusterID: "cluster-3", Controller: &mock.Controller{}})
+
+	expected := map[string]string{
+		"cluster-1": "cluster-1.example.com",
+		"cluster-2": "cluster-2.example.com",
+		"cluster-3": "",
+	}
+	if got := aggregateCtl.RegistryTrustDomains(); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected trust domains %v, got %v", expected, got)
+	}
+}
+
+// proxyCountingDiscovery counts the GetProxyServiceInstances calls made to a service discovery.
+type proxyCountingDiscovery struct {
+	*mock.ServiceDiscovery
+	calls int32
+}
+
+func (d *proxyCountingDiscovery) GetProxyServiceInstances(node *model.Proxy) ([]*model.ServiceInstance, error) {
+	atomic.AddInt32(&d.calls, 1)
+	return d.ServiceDiscovery.GetProxyServiceInstances(node)
+}
+
+func TestGetProxyServiceInstancesBoundCluster(t *testing.T) {
+	instance := &model.ServiceInstance{
+		Service:     mock.HelloService,
+		ServicePort: mock.HelloService.Ports[0],
+		Endpoint:    &model.IstioEndpoint{Address: "10.3.0.1", EndpointPort: 80},
+	}
+	var discoveries []*proxyCountingDiscovery
+	aggregateCtl := NewController(Options{})
+	for _, cluster := range []string{"cluster-1", "cluster-2", "cluster-3"} {
+		d := &proxyCountingDiscovery{ServiceDiscovery: mock.NewDiscovery(nil, 1)}
+		discoveries = append(discoveries, d)
+		aggregateCtl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        cluster,
+			ServiceDiscovery: d,
+			Controller:       &mock.Controller{},
+		})
+	}
+	discoveries[2].WantGetProxyServiceInstances = []*model.ServiceInstance{instance}
+	expectCalls := func(expected ...int32) {
+		t.Helper()
+		for i, d := range discoveries {
+			if calls := atomic.SwapInt32(&d.calls, 0); calls != expected[i] {
+				t.Fatalf("expected %d calls to cluster-%d, got %d", expected[i], i+1, calls)
+			}
+		}
+	}
+
+	// The proxy bound to cluster-3 is only looked up in cluster-3.
+	node := &model.Proxy{IPAddresses: []string{"10.3.0.1"}, Metadata: &model.NodeMetadata{ClusterID: "cluster-3"}}
+	instances, err := aggregateCtl.GetProxyServiceInstances(node)
+	if err != nil || len(instances) != 1 {
+		t.Fatalf("GetProxyServiceInstances() = %v, %v", instances, err)
+	}
+	expectCalls(0, 0, 1)
+
+	// The registries of other clusters are skipped for a proxy of an unregistered cluster.
+	node.Metadata.ClusterID = "unknown"
+	if _, err := aggregateCtl.GetProxyServiceInstances(node); err != nil {
+		t.Fatal(err)
+	}
+	expectCalls(0, 0, 0)
+
+	// The registries of other clusters are scanned when the bound cluster does not find the proxy.
+	node.Metadata.ClusterID = "cluster-1"
+	instances, err = aggregateCtl.GetProxyServiceInstances(node)
+	if err != nil || len(instances) != 1 {
+		t.Fatalf("GetProxyServiceInstances() = %v, %v", instances, err)
+	}
+	expectCalls(1, 1, 1)
+}
+
+func TestGetProxyServiceInstancesAllowedClusters(t *testing.T) {
+	var discoveries []*proxyCountingDiscovery
+	tenants := map[string][]string{
+		"tenant-a": {"cluster-1", "cluster-2"},
+		"tenant-b": {},
+	}
+	aggregateCtl := NewController(Options{AllowedClusters: func(proxy *model.Proxy) []string {
+		if clusters, ok := tenants[proxy.ConfigNamespace]; ok {
+			return clusters
+		}
+		return nil
+	}})
+	for _, cluster := range []string{"cluster-1", "cluster-2", "cluster-3"} {
+		d := &proxyCountingDiscovery{ServiceDiscovery: mock.NewDiscovery(nil, 1)}
+		d.WantGetProxyServiceInstances = []*model.ServiceInstance{{
+			Service:     mock.HelloService,
+			ServicePort: mock.HelloService.Ports[0],
+			Endpoint:    &model.IstioEndpoint{Address: "10.0.0.1", EndpointPort: 80, Locality: model.Locality{ClusterID: cluster}},
+		}}
+		discoveries = append(discoveries, d)
+		aggregateCtl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        cluster,
+			ServiceDiscovery: d,
+			Controller:       &mock.Controller{},
+		})
+	}
+	// Only cluster-3 knows the proxy.
+	discoveries[0].WantGetProxyServiceInstances = nil
+	discoveries[1].WantGetProxyServiceInstances = nil
+
+	cases := []struct {
+		namespace string
+		clusterID string
+		found     bool
+	}{
+		// The disallowed cluster-3 is never searched, even when the proxy is bound to it.
+		{namespace: "tenant-a", found: false},
+		{namespace: "tenant-a", clusterID: "cluster-3", found: false},
+		{namespace: "tenant-b", found: false},
+		// Proxies without restriction are resolved against all the clusters.
+		{namespace: "other", found: true},
+	}
+	for _, tc := range cases {
+		node := &model.Proxy{
+			ConfigNamespace: tc.namespace,
+			IPAddresses:     []string{"10.0.0.1"},
+			Metadata:        &model.NodeMetadata{ClusterID: tc.clusterID},
+		}
+		instances, err := aggregateCtl.GetProxyServiceInstances(node)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found := len(instances) > 0; found != tc.found {
+			t.Errorf("proxy in %s bound to %q: expected found %v, got %v", tc.namespace, tc.clusterID, tc.found, instances)
+		}
+		if tc.namespace != "other" && atomic.SwapInt32(&discoveries[2].calls, 0) != 0 {
+			t.Errorf("proxy in %s bound to %q: expected the disallowed cluster not to be searched", tc.namespace, tc.clusterID)
+		}
+		atomic.StoreInt32(&discoveries[2].calls, 0)
+	}
+}
+
+func TestInstancesStampedWithClusterID(t *testing.T) {
+	discovery := mock.NewDiscovery(map[host.Name]*model.Service{mock.HelloService.Hostname: mock.HelloService}, 2)
+	reported := &model.ServiceInstance{
+		Service:     mock.HelloService,
+		ServicePort: mock.HelloService.Ports[0],
+		Endpoint:    &model.IstioEndpoint{Address: "10.1.0.1", EndpointPort: 80, Locality: model.Locality{ClusterID: "reported"}},
+	}
+	unreported := &model.ServiceInstance{
+		Service:     mock.HelloService,
+		ServicePort: mock.HelloService.Ports[0],
+		Endpoint:    &model.IstioEndpoint{Address: "10.1.0.2", EndpointPort: 80, Locality: model.Locality{Label: "region/zone"}},
+	}
+	discovery.WantGetProxyServiceInstances = []*model.ServiceInstance{reported, unreported}
+
+	for _, registries := range []int{1, 2} {
+		aggregateCtl := NewController(Options{})
+		aggregateCtl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        "cluster-1",
+			ServiceDiscovery: discovery,
+			Controller:       &mock.Controller{},
+		})
+		if registries == 2 {
+			aggregateCtl.AddRegistry(serviceregistry.Simple{
+				ProviderID:       serviceregistry.External,
+				ServiceDiscovery: mock.NewDiscovery(nil, 1),
+				Controller:       &mock.Controller{},
+			})
+		}
+
+		instances, err := aggregateCtl.InstancesByPort(mock.HelloService, 80, nil)
+		if err != nil || len(instances) == 0 {
+			t.Fatalf("InstancesByPort() = %v, %v", instances, err)
+		}
+		for _, si := range instances {
+			if si.Endpoint.Locality.ClusterID != "cluster-1" {
+				t.Fatalf("%d registries: expected InstancesByPort() endpoint %s in cluster-1, got %q",
+					registries, si.Endpoint.Address, si.Endpoint.Locality.ClusterID)
+			}
+		}
+
+		instances, err = aggregateCtl.GetProxyServiceInstances(&model.Proxy{IPAddresses: []string{"10.1.0.1"}})
+		if err != nil || len(instances) != 2 {
+			t.Fatalf("GetProxyServiceInstances() = %v, %v", instances, err)
+		}
+		if got := instances[0].Endpoint.Locality.ClusterID; got != "reported" {
+			t.Fatalf("expected the reported cluster ID to be kept, got %q", got)
+		}
+		if got := instances[1].Endpoint.Locality; got.ClusterID != "cluster-1" || got.Label != "region/zone" {
+			t.Fatalf("expected the locality to be stamped with cluster-1, got %v", got)
+		}
+	}
+	// The registry instances are not modified.
+	if unreported.Endpoint.Locality.ClusterID != "" {
+		t.Fatalf("expected the registry instance to be unmodified, got %v", unreported.Endpoint.Locality)
+	}
+}
+
+func TestInstancesByPortInClusters(t *testing.T) {
+	newController := func(opts Options) *Controller {
+		ctl := NewController(opts)
+		for i, address := range []string{"10.1.0.1", "10.2.0.1", "10.3.0.1"} {
+			svc := mock.MakeService(mock.HelloService.Hostname, address)
+			ctl.AddRegistry(serviceregistry.Simple{
+				ProviderID:       serviceregistry.Kubernetes,
+				ClusterID:        fmt.Sprintf("cluster-%d", i+1),
+				ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{svc.Hostname: svc}, 1),
+				Controller:       &mock.Controller{},
+			})
+		}
+		return ctl
+	}
+	clustersOf := func(instances []*model.ServiceInstance) []string {
+		var clusters []string
+		for _, si := range instances {
+			clusters = append(clusters, si.Endpoint.Locality.ClusterID)
+		}
+		sort.Strings(clusters)
+		return clusters
+	}
+
+	ctl := newController(Options{})
+	instances, err := ctl.InstancesByPortInClusters(mock.HelloService, 80, nil, []string{"cluster-3", "cluster-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, expected := clustersOf(instances), []string{"cluster-1", "cluster-3"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected instances of %v, got %v", expected, got)
+	}
+	if instances, err := ctl.InstancesByPortInClusters(mock.HelloService, 80, nil, nil); err != nil || len(instances) != 0 {
+		t.Fatalf("expected no instance without cluster, got %v, %v", instances, err)
+	}
+
+	// Unknown clusters fail the lookup...
+	if _, err := ctl.InstancesByPortInClusters(mock.HelloService, 80, nil, []string{"cluster-2", "unknown"}); err == nil {
+		t.Fatal("expected an unknown cluster to fail the lookup")
+	}
+	// ... unless skipped.
+	ctl = newController(Options{SkipUnknownClusters: true})
+	instances, err = ctl.InstancesByPortInClusters(mock.HelloService, 80, nil, []string{"cluster-2", "unknown"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, expected := clustersOf(instances), []string{"cluster-2"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected instances of %v, got %v", expected, got)
+	}
+}
+
+func TestDedupKeys(t *testing.T) {
+	// The networks of the copies of the service, by VIP.
+	networks := map[string]string{"10.1.0.1": "net-1", "10.2.0.1": "net-1", "10.3.0.1": "net-2"}
+	networkKey := func(s *model.Service) string {
+		return string(s.Hostname) + "/" + networks[s.Address]
+	}
+	instance := func(address string, network string) *model.ServiceInstance {
+		return &model.ServiceInstance{
+			Service:     mock.HelloService,
+			ServicePort: mock.HelloService.Ports[0],
+			Endpoint:    &model.IstioEndpoint{Address: address, EndpointPort: 80, Network: network},
+		}
+	}
+	services := []*model.Service{
+		mock.MakeService(mock.HelloService.Hostname, "10.1.0.1"),
+		mock.MakeService(mock.HelloService.Hostname, "10.2.0.1"),
+		mock.MakeService(mock.HelloService.Hostname, "10.3.0.1"),
+	}
+	instances := [][]*model.ServiceInstance{
+		{instance("10.0.0.1", "net-1")},
+		{instance("10.0.0.1", "net-1")},
+		{instance("10.0.0.1", "net-2")},
+	}
+
+	newController := func(opts Options) *Controller {
+		ctl := NewController(opts)
+		for i := range services {
+			ctl.AddRegistry(instancesRegistry{
+				Simple: serviceregistry.Simple{
+					ProviderID:       serviceregistry.Kubernetes,
+					ClusterID:        fmt.Sprintf("cluster-%d", i+1),
+					ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{mock.HelloService.Hostname: services[i]}, 1),
+					Controller:       &mock.Controller{},
+				},
+				instances: instances[i],
+			})
+		}
+		return ctl
+	}
+
+	// By default, the copies are merged by hostname and the instances deduplicated by address.
+	ctl := newController(Options{DedupInstances: true})
+	if svcs, err := ctl.Services(); err != nil || len(svcs) != 1 {
+		t.Fatalf("expected the services to be merged by hostname, got %v, %v", svcs, err)
+	}
+	if got, err := ctl.InstancesByPort(mock.HelloService, 80, nil); err != nil || len(got) != 1 {
+		t.Fatalf("expected the instances to be deduplicated by address, got %v, %v", got, err)
+	}
+
+	ctl = newController(Options{
+		DedupInstances:  true,
+		ServiceDedupKey: networkKey,
+		InstanceDedupKey: func(si *model.ServiceInstance) string {
+			return si.Endpoint.Address + "/" + si.Endpoint.Network
+		},
+	})
+	svcs, err := ctl.Services()
+	if err != nil || len(svcs) != 2 {
+		t.Fatalf("expected the services to be merged by network, got %v, %v", svcs, err)
+	}
+	expectedVIPs := map[string]string{"cluster-1": "10.1.0.1", "cluster-2": "10.2.0.1"}
+	if !reflect.DeepEqual(svcs[0].ClusterVIPs, expectedVIPs) {
+		t.Fatalf("expected the services of net-1 to be merged, got %v", svcs[0].ClusterVIPs)
+	}
+	got, err := ctl.InstancesByPort(mock.HelloService, 80, nil)
+	if err != nil || len(got) != 2 {
+		t.Fatalf("expected the instances to be deduplicated by network, got %v, %v", got, err)
+	}
+}
+
+// networkRegistry is a registry advertising the networks of its cluster.
+type networkRegistry struct {
+	serviceregistry.Simple
+	networks []string
+}
+
+func (r networkRegistry) Networks() []string {
+	return r.networks
+}
+
+func TestMergedServiceNetworks(t *testing.T) {
+	ctl := NewController(Options{})
+	for i, networks := range [][]string{{"network-1"}, {"network-2", "network-1", "network-2"}, nil} {
+		svc := mock.MakeService(mock.HelloService.Hostname, fmt.Sprintf("10.%d.0.1", i+1))
+		ctl.AddRegistry(networkRegistry{
+			Simple: serviceregistry.Simple{
+				ProviderID:       serviceregistry.Kubernetes,
+				ClusterID:        fmt.Sprintf("cluster-%d", i+1),
+				ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{svc.Hostname: svc}, 1),
+				Controller:       &mock.Controller{},
+			},
+			networks: networks,
+		})
+	}
+	expected := map[string][]string{
+		"cluster-1": {"network-1"},
+		"cluster-2": {"network-1", "network-2"},
+	}
+
+	svcs, err := ctl.Services()
+	if err != nil || len(svcs) != 1 {
+		t.Fatalf("Services() = %v, %v", svcs, err)
+	}
+	if got := svcs[0].Attributes.ClusterNetworks; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected Services() networks %v, got %v", expected, got)
+	}
+	svc, err := ctl.GetService(mock.HelloService.Hostname)
+	if err != nil || svc == nil {
+		t.Fatalf("GetService() = %v, %v", svc, err)
+	}
+	if got := svc.Attributes.ClusterNetworks; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected GetService() networks %v, got %v", expected, got)
+	}
+
+	// The networks of a group of clusters are kept by the parent.
+	parent := NewController(Options{})
+	parent.AddRegistry(NewGroup("group", ctl))
+	svc, err = parent.GetService(mock.HelloService.Hostname)
+	if err != nil || svc == nil {
+		t.Fatalf("GetService() = %v, %v", svc, err)
+	}
+	if got := svc.Attributes.ClusterNetworks; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected the group networks %v, got %v", expected, got)
+	}
+}
+
+func TestSoftLimitCrossed(t *testing.T) {
+	cases := []struct {
+		previous, current, limit int
+		expected                 bool
+	}{
+		{previous: 2, current: 3, limit: 0, expected: false},
+		{previous: 2, current: 3, limit: 3, expected: false},
+		{previous: 3, current: 4, limit: 3, expected: true},
+		{previous: 4, current: 5, limit: 3, expected: false},
+		{previous: 5, current: 4, limit: 3, expected: false},
+	}
+	for _, c := range cases {
+		if got := softLimitCrossed(c.previous, c.current, c.limit); got != c.expected {
+			t.Errorf("softLimitCrossed(%d, %d, %d) = %v, expected %v", c.previous, c.current, c.limit, got, c.expected)
+		}
+	}
+}
+
+func TestClusterIDChangedAtRuntime(t *testing.T) {
+	ctl := NewController(Options{SortRegistries: true})
+	registries := make(map[string]*mutableClusterRegistry)
+	for i, cluster := range []string{"cluster-a", "cluster-b"} {
+		svc := mock.MakeService(mock.HelloService.Hostname, fmt.Sprintf("10.%d.0.1", i+1))
+		r := &mutableClusterRegistry{Simple: serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        cluster,
+			ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{svc.Hostname: svc}, 1),
+			Controller:       &mock.Controller{},
+		}}
+		registries[cluster] = r
+		ctl.AddRegistry(r)
+	}
+	svcs, err := ctl.Services()
+	if err != nil || len(svcs) != 1 {
+		t.Fatalf("Services() = %v, %v", svcs, err)
+	}
+	if expected := map[string]string{"cluster-a": "10.1.0.1", "cluster-b": "10.2.0.1"}; !reflect.DeepEqual(svcs[0].ClusterVIPs, expected) {
+		t.Fatalf("expected ClusterVIPs %v, got %v", expected, svcs[0].ClusterVIPs)
+	}
+
+	// The registry changes its cluster ID behind the back of the aggregate.
+	registries["cluster-a"].ClusterID = "cluster-c"
+	svcs, err = ctl.Services()
+	if err != nil || len(svcs) != 1 {
+		t.Fatalf("Services() = %v, %v", svcs, err)
+	}
+	if expected := map[string]string{"cluster-b": "10.2.0.1", "cluster-c": "10.1.0.1"}; !reflect.DeepEqual(svcs[0].ClusterVIPs, expected) {
+		t.Fatalf("expected the ClusterVIPs to be re-keyed to %v, got %v", expected, svcs[0].ClusterVIPs)
+	}
+	// The registries are sorted again.
+	var clusters []string
+	for _, d := range ctl.TopologySnapshot() {
+		clusters = append(clusters, d.ClusterID)
+	}
+	if expected := []string{"cluster-b", "cluster-c"}; !reflect.DeepEqual(clusters, expected) {
+		t.Fatalf("expected the registries %v, got %v", expected, clusters)
+	}
+}
+
+func TestGetIstioServiceAccountsInCluster(t *testing.T) {
+	accountA := "spiffe://cluster.local/ns/default/sa/a"
+	accountB := "spiffe://cluster.local/ns/default/sa/b"
+	accountC := "spiffe://cluster.local/ns/default/sa/c"
+	aggregateCtl := NewController(Options{})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-a",
+		ServiceDiscovery: portAccountsDiscovery{accounts: map[int][]string{80: {accountC, accountA}, 443: {accountA}}},
+		Controller:       &mock.Controller{},
+	})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-b",
+		ServiceDiscovery: portAccountsDiscovery{accounts: map[int][]string{80: {accountB}}},
+		Controller:       &mock.Controller{},
+	})
+
+	cases := []struct {
+		cluster  string
+		ports    []int
+		expected []string
+	}{
+		{"cluster-a", []int{80, 443}, []string{accountA, accountC}},
+		{"cluster-b", []int{80}, []string{accountB}},
+		{"cluster-b", []int{443}, []string{}},
+		{"unknown", []int{80}, nil},
+	}
+	for _, c := range cases {
+		got := aggregateCtl.GetIstioServiceAccountsInCluster(mock.HelloService, c.ports, c.cluster)
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("GetIstioServiceAccountsInCluster(%v, %s) = %#v, expected %#v", c.ports, c.cluster, got, c.expected)
+		}
+	}
+	// The union spans all the clusters.
+	if got, expected := aggregateCtl.GetIstioServiceAccounts(mock.HelloService, []int{80}), []string{accountA, accountB, accountC}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("GetIstioServiceAccounts() = %v, expected %v", got, expected)
+	}
+}
+
+// probeRecordingDiscovery records the cluster of each registry probed by GetService and
+// GetProxyServiceInstances.
+type probeRecordingDiscovery struct {
+	model.ServiceDiscovery
+	cluster string
+	probes  *[]string
+}
+
+func (d *probeRecordingDiscovery) GetService(hostname host.Name) (*model.Service, error) {
+	*d.probes = append(*d.probes, d.cluster)
+	return d.ServiceDiscovery.GetService(hostname)
+}
+
+func (d *probeRecordingDiscovery) GetProxyServiceInstances(node *model.Proxy) ([]*model.ServiceInstance, error) {
+	*d.probes = append(*d.probes, d.cluster)
+	return d.ServiceDiscovery.GetProxyServiceInstances(node)
+}
+
+func TestRegistryWeights(t *testing.T) {
+	var probes []string
+	ctl := NewController(Options{})
+	for _, r := range []struct {
+		cluster string
+		weight  int
+	}{{"low", 0}, {"high", 10}, {"medium", 5}, {"low2", 0}} {
+		svc := mock.MakeService("hello.default.svc.cluster.local", "10.1.0."+fmt.Sprint(r.weight))
+		discovery := mock.NewDiscovery(map[host.Name]*model.Service{svc.Hostname: svc}, 1)
+		if err := ctl.AddRegistryWithOptions(serviceregistry.Simple{
+			ProviderID:       serviceregistry.External,
+			ClusterID:        r.cluster,
+			ServiceDiscovery: &probeRecordingDiscovery{ServiceDiscovery: discovery, cluster: r.cluster, probes: &probes},
+			Controller:       &mock.Controller{},
+		}, RegistryOptions{Weight: r.weight}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	svc, err := ctl.GetService("hello.default.svc.cluster.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svc.Address != "10.1.0.10" {
+		t.Errorf("GetService() address = %s, want the one of the highest weight registry", svc.Address)
+	}
+	if want := []string{"high"}; !reflect.DeepEqual(probes, want) {
+		t.Errorf("GetService() probed %v, want %v", probes, want)
+	}
+
+	probes = nil
+	if _, err := ctl.GetProxyServiceInstances(&model.Proxy{IPAddresses: []string{"10.9.9.9"}, Metadata: &model.NodeMetadata{}}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"high", "medium", "low", "low2"}; !reflect.DeepEqual(probes, want) {
+		t.Errorf("GetProxyServiceInstances() probed %v, want %v", probes, want)
+	}
+
+	// The registries are still listed in the order they were added.
+	var clusters []string
+	for _, r := range ctl.GetRegistries() {
+		clusters = append(clusters, r.Cluster())
+	}
+	if want := []string{"low", "high", "medium", "low2"}; !reflect.DeepEqual(clusters, want) {
+		t.Errorf("GetRegistries() = %v, want %v", clusters, want)
+	}
+}
+
+func TestEmptyClusterIDPolicy(t *testing.T) {
+	newController := func(policy EmptyClusterIDPolicy) *Controller {
+		ctl := NewController(Options{EmptyClusterIDPolicy: policy})
+		for _, address := range []string{"10.1.0.1", "10.1.0.2"} {
+			ctl.AddRegistry(serviceregistry.Simple{
+				ProviderID: serviceregistry.Kubernetes,
+				ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{
+					mock.HelloService.Hostname: mock.MakeService("hello.default.svc.cluster.local", address),
+				}, 1),
+				Controller: &mock.Controller{},
+			})
+		}
+		return ctl
+	}
+
+	t.Run("unmerged", func(t *testing.T) {
+		ctl := newController(UnmergedEmptyClusterID)
+		services, err := ctl.Services()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(services) != 2 || services[0].Address != "10.1.0.1" || services[1].Address != "10.1.0.2" {
+			t.Fatalf("expected each registry to add its copy, got %v", services)
+		}
+	})
+
+	t.Run("synthesize", func(t *testing.T) {
+		ctl := newController(SynthesizeEmptyClusterID)
+		want := map[string]string{"Kubernetes-1": "10.1.0.1", "Kubernetes-2": "10.1.0.2"}
+		for i := 0; i < 2; i++ {
+			// The synthesized cluster IDs are stable across listings.
+			services, err := ctl.Services()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(services) != 1 {
+				t.Fatalf("expected the copies to be merged, got %d services", len(services))
+			}
+			if !reflect.DeepEqual(services[0].ClusterVIPs, want) {
+				t.Fatalf("expected ClusterVIPs %v, got %v", want, services[0].ClusterVIPs)
+			}
+		}
+		svc, err := ctl.GetService(mock.HelloService.Hostname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if svc == nil || svc.Address != "10.1.0.1" {
+			t.Fatalf("expected the merged service, got %v", svc)
+		}
+		if !ctl.UsesMergePath() {
+			t.Error("expected the registries to be merged by cluster")
+		}
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		ctl := newController(SkipEmptyClusterID)
+		services, err := ctl.Services()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(services) != 0 {
+			t.Fatalf("expected the registries to be skipped, got %v", services)
+		}
+		if svc, _ := ctl.GetService(mock.HelloService.Hostname); svc != nil {
+			t.Fatalf("expected the registries to be skipped, got %v", svc)
+		}
+	})
+}
+
+// toggledSyncRegistry is a registry whose sync state is set by the test.
+type toggledSyncRegistry struct {
+	serviceregistry.Simple
+	synced int32
+}
+
+func (r *toggledSyncRegistry) HasSynced() bool {
+	return atomic.LoadInt32(&r.synced) == 1
+}
+
+func TestUnsyncedRegistries(t *testing.T) {
+	ctl := buildMockController()
+	if unsynced := ctl.UnsyncedRegistries(); len(unsynced) != 0 {
+		t.Fatalf("expected the synced registries not to be reported, got %v", unsynced)
+	}
+
+	syncing := &toggledSyncRegistry{Simple: serviceregistry.Simple{ClusterID: "cluster-3", Controller: &mock.Controller{}}}
+	ctl.AddRegistry(syncing)
+	ctl.AddRegistry(syncingRegistry{serviceregistry.Simple{ProviderID: serviceregistry.External, Controller: &mock.Controller{}}})
+	if unsynced, want := ctl.UnsyncedRegistries(), []string{"cluster-3", "External"}; !reflect.DeepEqual(unsynced, want) {
+		t.Fatalf("UnsyncedRegistries() = %v, want %v", unsynced, want)
+	}
+
+	// Once synced, a registry is no longer reported, even if it later reports not being synced.
+	atomic.StoreInt32(&syncing.synced, 1)
+	if unsynced, want := ctl.UnsyncedRegistries(), []string{"External"}; !reflect.DeepEqual(unsynced, want) {
+		t.Fatalf("UnsyncedRegistries() = %v, want %v", unsynced, want)
+	}
+	atomic.StoreInt32(&syncing.synced, 0)
+	if unsynced, want := ctl.UnsyncedRegistries(), []string{"External"}; !reflect.DeepEqual(unsynced, want) {
+		t.Fatalf("UnsyncedRegistries() = %v, want %v", unsynced, want)
+	}
+}
+
+func TestInstanceFilter(t *testing.T) {
+	newInstance := func(address string) *model.ServiceInstance {
+		return &model.ServiceInstance{
+			Service:     mock.HelloService,
+			ServicePort: mock.HelloService.Ports[0],
+			Endpoint:    &model.IstioEndpoint{Address: address, EndpointPort: 80},
+		}
+	}
+	// The endpoints of 10.9.0.0/16 are excluded.
+	ctl := NewController(Options{InstanceFilter: func(si *model.ServiceInstance) bool {
+		return !strings.HasPrefix(si.Endpoint.Address, "10.9.")
+	}})
+	cluster1 := []*model.ServiceInstance{newInstance("10.9.0.1"), newInstance("10.0.0.1"), newInstance("10.9.0.2")}
+	cluster2 := []*model.ServiceInstance{newInstance("10.0.0.2")}
+	for i, instances := range [][]*model.ServiceInstance{cluster1, cluster2} {
+		discovery := mock.NewDiscovery(nil, 1)
+		discovery.WantGetProxyServiceInstances = instances[:1]
+		ctl.AddRegistry(instancesRegistry{
+			Simple: serviceregistry.Simple{
+				ProviderID:       serviceregistry.Kubernetes,
+				ClusterID:        fmt.Sprintf("cluster-%d", i+1),
+				ServiceDiscovery: discovery,
+				Controller:       &mock.Controller{},
+			},
+			instances: instances,
+		})
+	}
+
+	instances, err := ctl.InstancesByPort(mock.HelloService, 80, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addresses []string
+	for _, si := range instances {
+		addresses = append(addresses, si.Endpoint.Address)
+	}
+	if want := []string{"10.0.0.1", "10.0.0.2"}; !reflect.DeepEqual(addresses, want) {
+		t.Fatalf("InstancesByPort() = %v, want %v", addresses, want)
+	}
+	if len(cluster1) != 3 || cluster1[0].Endpoint.Address != "10.9.0.1" || cluster1[2].Endpoint.Address != "10.9.0.2" {
+		t.Fatal("expected the instances of the registry not to be modified")
+	}
+
+	// The instances of the proxy in cluster-1 are all dropped, it is found in cluster-2.
+	proxyInstances, err := ctl.GetProxyServiceInstances(&model.Proxy{IPAddresses: []string{"10.0.0.2"}, Metadata: &model.NodeMetadata{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proxyInstances) != 1 || proxyInstances[0].Endpoint.Address != "10.0.0.2" {
+		t.Fatalf("expected the instance of cluster-2, got %v", proxyInstances)
+	}
+}
+
+func TestRegistryPriority(t *testing.T) {
+	newController := func(kubeWeight, seWeight int) *Controller {
+		ctl := NewController(Options{})
+		kube := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.1")
+		se := mock.MakeService("hello.default.svc.cluster.local", "10.2.0.1")
+		_ = ctl.AddRegistryWithOptions(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        "cluster-1",
+			ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{kube.Hostname: kube}, 1),
+			Controller:       &mock.Controller{},
+		}, RegistryOptions{Weight: kubeWeight})
+		_ = ctl.AddRegistryWithOptions(serviceregistry.Simple{
+			ProviderID:       serviceregistry.External,
+			ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{se.Hostname: se}, 1),
+			Controller:       &mock.Controller{},
+		}, RegistryOptions{Weight: seWeight})
+		return ctl
+	}
+
+	cases := []struct {
+		name                 string
+		kubeWeight, seWeight int
+		address              string
+		order                []string
+	}{
+		// Without weights, the ServiceEntry overrides the Kubernetes service.
+		{"equal", 0, 0, "10.2.0.1", []string{"cluster-1", ""}},
+		{"kubernetes first", 10, 0, "10.1.0.1", []string{"cluster-1", ""}},
+		{"service entry first", 0, 10, "10.2.0.1", []string{"", "cluster-1"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctl := newController(tc.kubeWeight, tc.seWeight)
+			svc, err := ctl.GetService("hello.default.svc.cluster.local")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if svc == nil || svc.Address != tc.address {
+				t.Fatalf("GetService() = %v, want the service with address %s", svc, tc.address)
+			}
+			var order []string
+			for _, d := range ctl.ResolutionOrder() {
+				order = append(order, d.ClusterID)
+			}
+			if !reflect.DeepEqual(order, tc.order) {
+				t.Fatalf("ResolutionOrder() = %v, want %v", order, tc.order)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"istio.io/pkg/log"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pkg/config/host"
+)
+
+// EndpointCounts holds the number of endpoints of the services, by hostname and cluster, the
+// registries without cluster ID being identified by provider.
+type EndpointCounts map[host.Name]map[string]int
+
+// ServicesWithEndpointCounts lists the services as Services does, along with the number of
+// endpoints of each service in each cluster, e.g. for service topology views.
+//
+// The counts are gathered while listing the services, from the registries implementing
+// serviceregistry.EndpointCounter: each of them costs a single EndpointCounts call on top of the
+// listing, the instances of the services are never listed. The services of the other registries
+// have no count, which is not the same as a count of zero. A registry failing to count its
+// endpoints is logged and has no count. The services are not served from the stale copy of
+// Options.ServeStaleOnError.
+func (c *Controller) ServicesWithEndpointCounts() ([]*model.Service, EndpointCounts, error) {
+	counts := make(EndpointCounts)
+	services, err := c.visitServices(nil, func(r *registryEntry) {
+		c.countEndpoints(r, counts)
+	})
+	return services, counts, err
+}
+
+// countEndpoints adds the endpoint counts of the registry, or of the clusters of a group, to counts.
+func (c *Controller) countEndpoints(r *registryEntry, counts EndpointCounts) {
+	if group := groupController(r.Instance); group != nil {
+		for _, nested := range group.registryEntries() {
+			group.countEndpoints(nested, counts)
+		}
+		return
+	}
+	counter, ok := r.Instance.(serviceregistry.EndpointCounter)
+	if !ok {
+		return
+	}
+	byHostname, err := counter.EndpointCounts()
+	if err != nil {
+		log.Warnf("Failed to count the endpoints of registry %s/%s: %v", r.Provider(), r.Cluster(), err)
+		return
+	}
+	cluster := c.normalizeClusterID(r.Cluster())
+	if cluster == "" {
+		cluster = string(r.Provider())
+	}
+	for hostname, count := range byHostname {
+		hostname = c.rewriteHostname(r, hostname)
+		if counts[hostname] == nil {
+			counts[hostname] = make(map[string]int)
+		}
+		counts[hostname][cluster] += count
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
+)
+
+// endpointCountingRegistry is a registry counting its endpoints, and recording the instance lookups.
+type endpointCountingRegistry struct {
+	serviceregistry.Simple
+	counts         map[host.Name]int
+	countErr       error
+	instancesCalls int
+}
+
+func (r *endpointCountingRegistry) EndpointCounts() (map[host.Name]int, error) {
+	return r.counts, r.countErr
+}
+
+func (r *endpointCountingRegistry) InstancesByPort(svc *model.Service, port int, labels labels.Collection) ([]*model.ServiceInstance, error) {
+	r.instancesCalls++
+	return r.Simple.InstancesByPort(svc, port, labels)
+}
+
+func TestServicesWithEndpointCounts(t *testing.T) {
+	newRegistry := func(cluster string, counts map[host.Name]int) *endpointCountingRegistry {
+		return &endpointCountingRegistry{
+			Simple: serviceregistry.Simple{
+				ProviderID: serviceregistry.Kubernetes,
+				ClusterID:  cluster,
+				ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{
+					mock.HelloService.Hostname: mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0"),
+				}, 2),
+				Controller: &mock.Controller{},
+			},
+			counts: counts,
+		}
+	}
+	cluster1 := newRegistry("cluster-1", map[host.Name]int{mock.HelloService.Hostname: 3})
+	cluster2 := newRegistry("cluster-2", map[host.Name]int{mock.HelloService.Hostname: 2})
+	failing := newRegistry("cluster-3", nil)
+	failing.countErr = errors.New("mock EndpointCounts() error")
+
+	aggregateCtl := NewController(Options{})
+	aggregateCtl.AddRegistry(cluster1)
+	aggregateCtl.AddRegistry(cluster2)
+	aggregateCtl.AddRegistry(failing)
+	// A registry unable to count its endpoints.
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-4",
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{mock.WorldService.Hostname: mock.WorldService}, 2),
+		Controller:       &mock.Controller{},
+	})
+
+	services, counts, err := aggregateCtl.ServicesWithEndpointCounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := aggregateCtl.Services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != len(plain) || len(services) != 2 {
+		t.Fatalf("expected the 2 services listed by Services(), got %d", len(services))
+	}
+	want := EndpointCounts{mock.HelloService.Hostname: {"cluster-1": 3, "cluster-2": 2}}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("ServicesWithEndpointCounts() counts = %v, want %v", counts, want)
+	}
+	if cluster1.instancesCalls != 0 || cluster2.instancesCalls != 0 {
+		t.Error("expected the endpoints to be counted without listing the instances")
+	}
+}
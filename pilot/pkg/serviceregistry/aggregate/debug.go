@@ -0,0 +1,411 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pkg/config/host"
+)
+
+// RegistryDump is the debug representation of a registry of the aggregate controller.
+type RegistryDump struct {
+	ClusterID     string                     `json:"clusterID"`
+	Provider      serviceregistry.ProviderID `json:"provider"`
+	Synced        bool                       `json:"synced"`
+	AddedTime     time.Time                  `json:"addedTime"`
+	LastEventTime *time.Time                 `json:"lastEventTime,omitempty"`
+	Services      int                        `json:"services"`
+	Instances     int                        `json:"instances"`
+	// InstancesTruncated is set if the instances were not all counted, see DebugDump.
+	InstancesTruncated bool   `json:"instancesTruncated,omitempty"`
+	Error              string `json:"error,omitempty"`
+}
+
+// RegistryStat is an overview of a registry of the aggregate controller.
+type RegistryStat struct {
+	ClusterID    string
+	Provider     serviceregistry.ProviderID
+	ServiceCount int
+	Synced       bool
+	// Error is the error counting the services of the registry, if any.
+	Error error
+}
+
+// RegistryHealth is the health of a registry of the aggregate controller.
+type RegistryHealth struct {
+	ClusterID string                     `json:"clusterID"`
+	Provider  serviceregistry.ProviderID `json:"provider"`
+	Synced    bool                       `json:"synced"`
+	// LastError is the error of the last failing call to the registry, cleared by the next
+	// successful call, or else the error counting the services of the registry.
+	LastError     string     `json:"lastError,omitempty"`
+	LastEventTime *time.Time `json:"lastEventTime,omitempty"`
+	ServiceCount  int        `json:"serviceCount"`
+	// CircuitOpen is set while the registry is skipped by the lookups, see
+	// Options.CircuitBreakerThreshold.
+	CircuitOpen bool `json:"circuitOpen,omitempty"`
+}
+
+// ServiceClusterAddresses holds the per cluster addresses of a service merged across clusters.
+type ServiceClusterAddresses struct {
+	Hostname host.Name `json:"hostname"`
+	// ClusterVIPs is the address of the service in each cluster.
+	ClusterVIPs map[string]string `json:"clusterVIPs,omitempty"`
+	// ClusterExternalAddresses are the external addresses of the service in each cluster.
+	ClusterExternalAddresses map[string][]string `json:"clusterExternalAddresses,omitempty"`
+}
+
+// RegistryDescriptor describes a registry of the aggregate controller, without its state.
+type RegistryDescriptor struct {
+	ClusterID     string
+	Provider      serviceregistry.ProviderID
+	Tags          map[string]string
+	Authoritative bool
+	Weight        int
+}
+
+// TopologySnapshot returns the descriptors of the registries, in registry order, e.g. for tests
+// to assert the clusters of a multi-cluster mesh.
+func (c *Controller) TopologySnapshot() []RegistryDescriptor {
+	registries := c.registryEntries()
+	out := make([]RegistryDescriptor, 0, len(registries))
+	for _, r := range registries {
+		out = append(out, describeRegistry(r))
+	}
+	return out
+}
+
+// ResolutionOrder returns the descriptors of the registries in the order GetService and the proxy
+// lookups probe them: by descending weight, then in registry order. When several registries have
+// a hostname, GetService prefers the copy of the first one.
+func (c *Controller) ResolutionOrder() []RegistryDescriptor {
+	registries := c.weightedRegistries()
+	out := make([]RegistryDescriptor, 0, len(registries))
+	for _, r := range registries {
+		out = append(out, describeRegistry(r))
+	}
+	return out
+}
+
+func describeRegistry(r *registryEntry) RegistryDescriptor {
+	var tags map[string]string
+	if len(r.tags) > 0 {
+		tags = make(map[string]string, len(r.tags))
+		for k, v := range r.tags {
+			tags[k] = v
+		}
+	}
+	return RegistryDescriptor{
+		ClusterID:     r.Cluster(),
+		Provider:      r.Provider(),
+		Tags:          tags,
+		Authoritative: r.authoritative,
+		Weight:        r.weight,
+	}
+}
+
+// ContributingClusters returns the sorted IDs of the clusters having a service for the hostname,
+// the registries without cluster ID being identified by provider, e.g. to tell where a merged
+// service comes from. The clusters of a group are reported individually. The registries are
+// scanned again rather than the merged service being inspected, so the result reflects the
+// current state of the registries. The registries failing are reported in the error, along with
+// the clusters of the others.
+func (c *Controller) ContributingClusters(hostname host.Name) ([]string, error) {
+	var errs error
+	failed := 0
+	clusters := make(map[string]struct{})
+	registries := c.registryEntries()
+	for _, r := range registries {
+		if group := groupController(r.Instance); group != nil {
+			// The services of a group are looked up without their per cluster VIPs, ask the
+			// group for its own clusters.
+			nested, err := group.ContributingClusters(hostname)
+			if err != nil {
+				errs = appendRegistryError(errs, r, err)
+				if errors.Is(err, ErrAllRegistriesFailed) {
+					failed++
+				}
+			}
+			for _, cluster := range nested {
+				clusters[cluster] = struct{}{}
+			}
+			continue
+		}
+		service, err := c.registryService(r, hostname)
+		r.recordResult(err)
+		if err != nil {
+			errs = appendRegistryError(errs, r, err)
+			failed++
+			continue
+		}
+		if service == nil || c.namespaceExcluded(service.Attributes.Namespace) {
+			continue
+		}
+		name := c.normalizeClusterID(r.Cluster())
+		if name == "" {
+			name = string(r.Provider())
+		}
+		clusters[name] = struct{}{}
+	}
+	var out []string
+	if len(clusters) > 0 {
+		out = sortedKeys(clusters)
+	}
+	return out, registriesError(len(registries), failed, errs)
+}
+
+// RegistryStats returns an overview of the registries, in registry order. Unlike DebugDump, the
+// instances are not counted, and the services are counted as by peekServiceCount, without changing
+// the circuit or last error of the registries. The registries are queried from a snapshot of the
+// registry list, without blocking the changes to it.
+func (c *Controller) RegistryStats() []RegistryStat {
+	registries := c.registryEntries()
+
+	out := make([]RegistryStat, 0, len(registries))
+	for _, r := range registries {
+		count, err := peekServiceCount(r)
+		out = append(out, RegistryStat{
+			ClusterID:    r.Cluster(),
+			Provider:     r.Provider(),
+			ServiceCount: count,
+			Synced:       r.HasSynced(),
+			Error:        err,
+		})
+	}
+	return out
+}
+
+// ClusterAddresses returns the per cluster VIPs and external addresses of the services merged
+// across clusters, sorted by hostname, e.g. to verify the split horizon EDS data of a multi-cluster
+// mesh. They are gathered from the copy of the service of every registry, as GetService merges
+// them, rather than from the merged services cached by Services, so that the external addresses
+// updated in place by the registries are current. The services without per cluster address, such
+// as those of the registries without cluster ID, are left out. The registries failing are
+// reported in the error, along with the addresses of the services of the others.
+func (c *Controller) ClusterAddresses() ([]ServiceClusterAddresses, error) {
+	byKey := make(map[host.Name]*ServiceClusterAddresses)
+	var errs error
+	failed := 0
+	registries := c.registryEntries()
+	for _, r := range registries {
+		svcs, err := c.registryServices(r)
+		r.recordResult(err)
+		if err != nil {
+			errs = appendRegistryError(errs, r, err)
+			failed++
+			continue
+		}
+		cluster, ok := c.mergeCluster(r)
+		if !ok || cluster == "" {
+			continue
+		}
+		for _, s := range svcs {
+			s = c.rewriteService(r, s)
+			if !c.includeService(s, nil) {
+				continue
+			}
+			key := c.serviceKey(s)
+			addresses := byKey[key]
+			if addresses == nil {
+				addresses = &ServiceClusterAddresses{Hostname: s.Hostname}
+				byKey[key] = addresses
+			}
+			s.Mutex.RLock()
+			if isGroup(r) {
+				// The addresses of the clusters of a group are keyed by cluster already.
+				for groupCluster, vip := range s.ClusterVIPs {
+					addresses.addClusterVIP(groupCluster, vip)
+				}
+				for groupCluster, external := range s.Attributes.ClusterExternalAddresses {
+					addresses.addExternalAddresses(groupCluster, external)
+				}
+			} else {
+				addresses.addClusterVIP(cluster, clusterVIP(s))
+				// Registries key the external addresses by their own cluster ID.
+				addresses.addExternalAddresses(cluster, s.Attributes.ClusterExternalAddresses[r.Cluster()])
+			}
+			s.Mutex.RUnlock()
+		}
+	}
+
+	out := make([]ServiceClusterAddresses, 0, len(byKey))
+	for _, addresses := range byKey {
+		if addresses.ClusterVIPs != nil || addresses.ClusterExternalAddresses != nil {
+			out = append(out, *addresses)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Hostname < out[j].Hostname })
+	return out, registriesError(len(registries), failed, errs)
+}
+
+// addClusterVIP records the VIP of the service in the cluster, the first copy found winning.
+func (a *ServiceClusterAddresses) addClusterVIP(cluster, vip string) {
+	if a.ClusterVIPs == nil {
+		a.ClusterVIPs = make(map[string]string)
+	}
+	if _, ok := a.ClusterVIPs[cluster]; !ok {
+		a.ClusterVIPs[cluster] = vip
+	}
+}
+
+// addExternalAddresses records a copy of the external addresses of the service in the cluster.
+func (a *ServiceClusterAddresses) addExternalAddresses(cluster string, external []string) {
+	if len(external) == 0 {
+		return
+	}
+	if a.ClusterExternalAddresses == nil {
+		a.ClusterExternalAddresses = make(map[string][]string)
+	}
+	if _, ok := a.ClusterExternalAddresses[cluster]; !ok {
+		a.ClusterExternalAddresses[cluster] = append([]string(nil), external...)
+	}
+}
+
+// HealthStatus returns the health of the registries, in registry order, to tell which cluster is
+// lagging (no recent event, not synced) or disconnected (failing). It reports the circuit and last
+// error recorded by the lookups, without changing them: the services are counted as by
+// peekServiceCount; the instances are not. The registries are queried outside of the lock.
+func (c *Controller) HealthStatus() []RegistryHealth {
+	registries := c.registryEntries()
+
+	out := make([]RegistryHealth, 0, len(registries))
+	for _, r := range registries {
+		health := RegistryHealth{
+			ClusterID:   r.Cluster(),
+			Provider:    r.Provider(),
+			Synced:      r.HasSynced(),
+			CircuitOpen: r.circuitOpen(),
+		}
+		if t := r.lastEventTime(); !t.IsZero() {
+			health.LastEventTime = &t
+		}
+		lastErr := r.lastError()
+		count, err := peekServiceCount(r)
+		if lastErr == nil {
+			lastErr = err
+		}
+		if lastErr != nil {
+			health.LastError = lastErr.Error()
+		}
+		health.ServiceCount = count
+		out = append(out, health)
+	}
+	return out
+}
+
+// peekServiceCount returns the number of services of the registry without changing its circuit or
+// last error, for the debug and health reads. Registries implementing serviceregistry.ServiceCounter
+// are asked for their count; the others report the count of their last listing, being listed only
+// if never listed yet. The registry is not called while its circuit is open, the count of its last
+// listing being returned along with the error.
+func peekServiceCount(r *registryEntry) (int, error) {
+	listed := atomic.LoadInt64(&r.serviceCount)
+	if err := r.circuitError(); err != nil {
+		if listed < 0 {
+			listed = 0
+		}
+		return int(listed), err
+	}
+	if counter, ok := r.Instance.(serviceregistry.ServiceCounter); ok {
+		return counter.ServiceCount()
+	}
+	if listed >= 0 {
+		return int(listed), nil
+	}
+	svcs, err := r.Services()
+	return len(svcs), err
+}
+
+// maxDumpInstanceLookups bounds the InstancesByPort calls made by DebugDump to each registry
+// counting its instances, so that a debug request does not fan out into thousands of calls.
+const maxDumpInstanceLookups = 1000
+
+// DebugDump serializes the registries of the aggregate controller, along with the number of
+// services and instances they hold, to JSON. The registries are queried from a snapshot of the
+// registry list, without blocking the changes to it. The registries whose circuit is open are not
+// called. The instances are counted through serviceregistry.EndpointCounter when the registry
+// implements it, otherwise by up to maxDumpInstanceLookups InstancesByPort calls, as per
+// Options.RegistryQPS, the count being marked truncated beyond.
+func (c *Controller) DebugDump() ([]byte, error) {
+	registries := c.registryEntries()
+
+	dump := make([]RegistryDump, 0, len(registries))
+	for _, r := range registries {
+		dump = append(dump, c.dumpRegistry(r))
+	}
+	return json.MarshalIndent(dump, "", "  ")
+}
+
+func (c *Controller) dumpRegistry(r *registryEntry) RegistryDump {
+	out := RegistryDump{
+		ClusterID: r.Cluster(),
+		Provider:  r.Provider(),
+		Synced:    r.HasSynced(),
+		AddedTime: r.added,
+	}
+	if t := r.lastEventTime(); !t.IsZero() {
+		out.LastEventTime = &t
+	}
+	if err := r.circuitError(); err != nil {
+		out.Error = err.Error()
+		return out
+	}
+
+	svcs, err := r.Services()
+	if err != nil {
+		out.Error = err.Error()
+		return out
+	}
+	out.Services = len(svcs)
+	if counter, ok := r.Instance.(serviceregistry.EndpointCounter); ok {
+		counts, err := counter.EndpointCounts()
+		if err != nil {
+			out.Error = err.Error()
+			return out
+		}
+		for _, count := range counts {
+			out.Instances += count
+		}
+		return out
+	}
+	lookups := 0
+	for _, svc := range svcs {
+		for _, port := range svc.Ports {
+			if lookups == maxDumpInstanceLookups {
+				out.InstancesTruncated = true
+				return out
+			}
+			lookups++
+			if err := c.waitLimiter(); err != nil {
+				out.Error = err.Error()
+				return out
+			}
+			instances, err := r.InstancesByPort(svc, port.Port, nil)
+			if err != nil {
+				// The registry is failing, do not insist.
+				out.Error = err.Error()
+				return out
+			}
+			out.Instances += len(instances)
+		}
+	}
+	return out
+}
@@ -0,0 +1,340 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
+)
+
+func TestDebugDump(t *testing.T) {
+	aggregateCtl := buildMockControllerForMultiCluster()
+	discovery2.ServicesError = errors.New("mock Services() error")
+	aggregateCtl.registries[0].recordEvent()
+
+	out, err := aggregateCtl.DebugDump()
+	if err != nil {
+		t.Fatalf("DebugDump() encountered unexpected error: %v", err)
+	}
+	var dump []RegistryDump
+	if err := json.Unmarshal(out, &dump); err != nil {
+		t.Fatalf("failed to unmarshal dump: %v", err)
+	}
+	if len(dump) != 2 {
+		t.Fatalf("expected 2 registries in the dump, got %d", len(dump))
+	}
+
+	// cluster-1 has the hello service, with 2 instances for each of its 6 ports.
+	if dump[0].ClusterID != "cluster-1" || dump[0].Provider != "mockAdapter1" || !dump[0].Synced {
+		t.Fatalf("unexpected registry dump %+v", dump[0])
+	}
+	if dump[0].Services != 1 || dump[0].Instances != 12 {
+		t.Fatalf("expected 1 service and 12 instances for cluster-1, got %+v", dump[0])
+	}
+	if dump[0].LastEventTime == nil {
+		t.Fatal("expected the last event time of cluster-1 to be set")
+	}
+	if dump[0].AddedTime.IsZero() {
+		t.Fatal("expected the time cluster-1 was added to be set")
+	}
+
+	if dump[1].ClusterID != "cluster-2" || dump[1].Error == "" || dump[1].LastEventTime != nil {
+		t.Fatalf("unexpected registry dump %+v", dump[1])
+	}
+}
+
+// instanceLookupRegistry counts the InstancesByPort calls.
+type instanceLookupRegistry struct {
+	serviceregistry.Simple
+	instancesCalls int
+}
+
+func (r *instanceLookupRegistry) InstancesByPort(svc *model.Service, port int, labels labels.Collection) ([]*model.ServiceInstance, error) {
+	r.instancesCalls++
+	return r.Simple.InstancesByPort(svc, port, labels)
+}
+
+func TestDebugDumpBounded(t *testing.T) {
+	services := make(map[host.Name]*model.Service)
+	for i := 0; i < 200; i++ {
+		hostname := host.Name(fmt.Sprintf("svc-%d.default.svc.cluster.local", i))
+		services[hostname] = mock.MakeService(hostname, fmt.Sprintf("10.0.%d.%d", i/250, i%250))
+	}
+	large := &instanceLookupRegistry{Simple: serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-1",
+		ServiceDiscovery: mock.NewDiscovery(services, 1),
+		Controller:       &mock.Controller{},
+	}}
+	counting := &endpointCountingRegistry{
+		Simple: serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        "cluster-2",
+			ServiceDiscovery: mock.NewDiscovery(services, 1),
+			Controller:       &mock.Controller{},
+		},
+		counts: map[host.Name]int{"svc-0.default.svc.cluster.local": 3, "svc-1.default.svc.cluster.local": 4},
+	}
+	open := &instanceLookupRegistry{Simple: serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-3",
+		ServiceDiscovery: mock.NewDiscovery(services, 1),
+		Controller:       &mock.Controller{},
+	}}
+	ctl := NewController(Options{})
+	ctl.AddRegistry(large)
+	ctl.AddRegistry(counting)
+	ctl.AddRegistry(open)
+	atomic.StoreInt64(&ctl.registryEntries()[2].openUntil, time.Now().Add(time.Hour).UnixNano())
+
+	out, err := ctl.DebugDump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dump []RegistryDump
+	if err := json.Unmarshal(out, &dump); err != nil {
+		t.Fatalf("failed to unmarshal dump: %v", err)
+	}
+
+	// The instance lookups are bounded.
+	if large.instancesCalls != maxDumpInstanceLookups || !dump[0].InstancesTruncated || dump[0].Services != 200 {
+		t.Fatalf("expected %d lookups and a truncated count, got %d lookups and %+v",
+			maxDumpInstanceLookups, large.instancesCalls, dump[0])
+	}
+	// The endpoint counters are asked for their counts.
+	if counting.instancesCalls != 0 || dump[1].Instances != 7 || dump[1].InstancesTruncated {
+		t.Fatalf("expected the endpoint counts without lookups, got %d lookups and %+v", counting.instancesCalls, dump[1])
+	}
+	// The registries with an open circuit are not called.
+	if open.instancesCalls != 0 || !strings.Contains(dump[2].Error, ErrCircuitOpen.Error()) {
+		t.Fatalf("expected the open circuit to be reported without lookups, got %d lookups and %+v", open.instancesCalls, dump[2])
+	}
+}
+
+func TestRegistryStats(t *testing.T) {
+	aggregateCtl := buildMockControllerForMultiCluster()
+	aggregateCtl.AddRegistry(countingRegistry{
+		Simple: serviceregistry.Simple{
+			ProviderID: serviceregistry.Kubernetes,
+			ClusterID:  "cluster-3",
+			Controller: &mock.Controller{},
+		},
+		count: 42,
+	})
+
+	stats := aggregateCtl.RegistryStats()
+	if len(stats) != 3 {
+		t.Fatalf("expected 3 registries, got %d", len(stats))
+	}
+	expected := []RegistryStat{
+		{ClusterID: "cluster-1", Provider: "mockAdapter1", ServiceCount: 1, Synced: true},
+		{ClusterID: "cluster-2", Provider: "mockAdapter2", ServiceCount: 2, Synced: true},
+		// Counted without listing the services.
+		{ClusterID: "cluster-3", Provider: serviceregistry.Kubernetes, ServiceCount: 42, Synced: true},
+	}
+	for i, stat := range stats {
+		if stat != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], stat)
+		}
+	}
+
+	discovery2.ServicesError = errors.New("mock Services() error")
+	if stat := aggregateCtl.RegistryStats()[1]; stat.Error == nil || stat.ServiceCount != 0 {
+		t.Fatalf("expected the error of cluster-2 to be reported, got %+v", stat)
+	}
+	// Reading the stats does not record the result of the registries.
+	if err := aggregateCtl.registries[1].lastError(); err != nil {
+		t.Fatalf("expected the stats to leave the last error of cluster-2 unset, got %v", err)
+	}
+
+	// Once listed, the registries report the count of their last listing.
+	discovery2.ServicesError = nil
+	// Cluster-3 fails the listing, cluster-2 is listed regardless.
+	_, _ = aggregateCtl.Services()
+	discovery2.ServicesError = errors.New("mock Services() error")
+	if stat := aggregateCtl.RegistryStats()[1]; stat.Error != nil || stat.ServiceCount != 2 {
+		t.Fatalf("expected the count of the last listing of cluster-2, got %+v", stat)
+	}
+	discovery2.ServicesError = nil
+}
+
+func TestContributingClusters(t *testing.T) {
+	aggregateCtl := buildMockControllerForMultiCluster()
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.External,
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{mock.HelloService.Hostname: mock.HelloService}, 1),
+		Controller:       &mock.Controller{},
+	})
+
+	clusters, err := aggregateCtl.ContributingClusters(mock.HelloService.Hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"External", "cluster-1", "cluster-2"}; !reflect.DeepEqual(clusters, want) {
+		t.Errorf("ContributingClusters(hello) = %v, want %v", clusters, want)
+	}
+	clusters, err = aggregateCtl.ContributingClusters(mock.WorldService.Hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"cluster-2"}; !reflect.DeepEqual(clusters, want) {
+		t.Errorf("ContributingClusters(world) = %v, want %v", clusters, want)
+	}
+	if clusters, err = aggregateCtl.ContributingClusters("unknown.default.svc.cluster.local"); err != nil || clusters != nil {
+		t.Errorf("ContributingClusters(unknown) = %v, %v, want none", clusters, err)
+	}
+
+	discovery2.GetServiceError = errors.New("mock GetService() error")
+	clusters, err = aggregateCtl.ContributingClusters(mock.HelloService.Hostname)
+	if err == nil {
+		t.Error("expected the failing registry to be reported")
+	}
+	if want := []string{"External", "cluster-1"}; !reflect.DeepEqual(clusters, want) {
+		t.Errorf("ContributingClusters(hello) = %v, want %v", clusters, want)
+	}
+}
+
+func TestClusterAddresses(t *testing.T) {
+	aggregateCtl := buildMockControllerForMultiCluster()
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID: serviceregistry.External,
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{
+			"db.example.com": mock.MakeService("db.example.com", "10.3.0.0"),
+		}, 1),
+		Controller: &mock.Controller{},
+	})
+
+	addresses, err := aggregateCtl.ClusterAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ServiceClusterAddresses{
+		{
+			Hostname:    mock.HelloService.Hostname,
+			ClusterVIPs: map[string]string{"cluster-1": "10.1.1.0", "cluster-2": "10.1.2.0"},
+		},
+		{
+			Hostname:    mock.WorldService.Hostname,
+			ClusterVIPs: map[string]string{"cluster-2": mock.WorldService.Address},
+		},
+	}
+	if !reflect.DeepEqual(addresses, want) {
+		t.Errorf("ClusterAddresses() = %+v, want %+v", addresses, want)
+	}
+
+	discovery2.ServicesError = errors.New("mock Services() error")
+	addresses, err = aggregateCtl.ClusterAddresses()
+	if err == nil {
+		t.Error("expected the failing registry to be reported")
+	}
+	if len(addresses) != 1 || !reflect.DeepEqual(addresses[0].ClusterVIPs, map[string]string{"cluster-1": "10.1.1.0"}) {
+		t.Errorf("expected the addresses of cluster-1 only, got %+v", addresses)
+	}
+}
+
+func TestClusterAddressesExternal(t *testing.T) {
+	aggregateCtl := NewController(Options{})
+	services := make(map[string]*model.Service)
+	for _, cluster := range []string{"cluster-1", "cluster-2"} {
+		svc := mock.MakeService("gateway.istio-system.svc.cluster.local", "10.2.0.0")
+		svc.Attributes.ClusterExternalAddresses = map[string][]string{cluster: {cluster + ".example.com"}}
+		services[cluster] = svc
+		aggregateCtl.AddRegistry(serviceregistry.Simple{
+			ClusterID:        cluster,
+			ProviderID:       serviceregistry.Kubernetes,
+			ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{svc.Hostname: svc}, 1),
+			Controller:       &mock.Controller{},
+		})
+	}
+	if _, err := aggregateCtl.Services(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The registry updates the external addresses of its service in place.
+	svc := services["cluster-2"]
+	svc.Mutex.Lock()
+	svc.Attributes.ClusterExternalAddresses = map[string][]string{"cluster-2": {"1.2.3.4"}}
+	svc.Mutex.Unlock()
+
+	addresses, err := aggregateCtl.ClusterAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ServiceClusterAddresses{{
+		Hostname:    svc.Hostname,
+		ClusterVIPs: map[string]string{"cluster-1": "10.2.0.0", "cluster-2": "10.2.0.0"},
+		ClusterExternalAddresses: map[string][]string{
+			"cluster-1": {"cluster-1.example.com"},
+			"cluster-2": {"1.2.3.4"},
+		},
+	}}
+	if !reflect.DeepEqual(addresses, want) {
+		t.Errorf("ClusterAddresses() = %+v, want %+v", addresses, want)
+	}
+}
+
+func TestContributingClustersOfGroup(t *testing.T) {
+	group := buildMockControllerForMultiCluster()
+	aggregateCtl := NewController(Options{})
+	aggregateCtl.AddRegistry(NewGroup("region-1", group))
+
+	clusters, err := aggregateCtl.ContributingClusters(mock.HelloService.Hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"cluster-1", "cluster-2"}; !reflect.DeepEqual(clusters, want) {
+		t.Errorf("ContributingClusters(hello) = %v, want %v", clusters, want)
+	}
+}
+
+func TestHealthStatus(t *testing.T) {
+	aggregateCtl := buildMockControllerForMultiCluster()
+	aggregateCtl.registries[0].recordEvent()
+	discovery2.ServicesError = errors.New("mock Services() error")
+
+	health := aggregateCtl.HealthStatus()
+	if len(health) != 2 {
+		t.Fatalf("expected the health of 2 registries, got %d", len(health))
+	}
+	if h := health[0]; h.ClusterID != "cluster-1" || !h.Synced || h.ServiceCount != 1 || h.LastError != "" || h.LastEventTime == nil {
+		t.Fatalf("unexpected health of cluster-1 %+v", h)
+	}
+	if h := health[1]; h.ClusterID != "cluster-2" || h.LastError == "" || h.LastEventTime != nil {
+		t.Fatalf("unexpected health of cluster-2 %+v", h)
+	}
+
+	// The error of the last failing lookup is reported until a call succeeds.
+	discovery2.ServicesError = nil
+	discovery2.GetServiceError = errors.New("mock GetService() error")
+	_, _ = aggregateCtl.GetService(mock.WorldService.Hostname)
+	// Reading the health is read-only, the error being reported again.
+	for i := 0; i < 2; i++ {
+		if h := aggregateCtl.HealthStatus()[1]; h.LastError != "mock GetService() error" || h.ServiceCount != 2 {
+			t.Fatalf("unexpected health of cluster-2 %+v", h)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"istio.io/pkg/log"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+)
+
+// EndpointDelta is the change of the instances of a service in a cluster.
+type EndpointDelta struct {
+	Hostname host.Name
+	// ClusterID is the cluster of the registry the instances changed in.
+	ClusterID string
+	Added     []*model.ServiceInstance
+	Removed   []*model.ServiceInstance
+	// Updated holds the current instances whose endpoint changed, e.g. its labels or weight.
+	Updated []*model.ServiceInstance
+}
+
+// deltaKey identifies the instances of a service in a registry. Registries are keyed by identity
+// rather than by cluster ID, so that the registries without one do not overwrite each other.
+type deltaKey struct {
+	hostname host.Name
+	registry *registryEntry
+}
+
+// instanceKey identifies an instance of a service: its endpoint on a service port.
+type instanceKey struct {
+	port         int
+	address      string
+	endpointPort uint32
+}
+
+// endpointSnapshots holds, by service and registry, the instances last delivered to a delta handler.
+type endpointSnapshots struct {
+	mu        sync.Mutex
+	instances map[deltaKey]map[instanceKey]*model.ServiceInstance
+	// listings counts, by service and registry, the listings started, and applied is the number
+	// of the last listing applied, so that a listing completing after a later one is dropped.
+	listings map[deltaKey]uint64
+	applied  map[deltaKey]uint64
+	// equal is Options.InstanceEqual, nil to compare the endpoints.
+	equal func(a, b *model.ServiceInstance) bool
+}
+
+// AppendEndpointDeltaHandler notifies f of the instances added, removed and updated in each
+// cluster for the given hostnames, for controllers updating endpoints incrementally. On each
+// instance event of a registry for one of the hostnames, the instances of the service in the
+// registry, on all its ports, are listed, as filtered by InstancesByPort, and compared with those
+// last delivered for the registry; the first delta of a registry reports all its instances as
+// added. No delta is delivered if nothing changed, as decided by Options.InstanceEqual for the
+// instances still present.
+//
+// The instances last delivered for each watched service and registry are held in memory, which is
+// why the deltas are only computed for the subscribed hostnames.
+func (c *Controller) AppendEndpointDeltaHandler(hostnames []host.Name, f func(EndpointDelta)) error {
+	subscribed := make(map[host.Name]struct{}, len(hostnames))
+	for _, hostname := range hostnames {
+		subscribed[hostname] = struct{}{}
+	}
+	snapshots := &endpointSnapshots{
+		instances: make(map[deltaKey]map[instanceKey]*model.ServiceInstance),
+		listings:  make(map[deltaKey]uint64),
+		applied:   make(map[deltaKey]uint64),
+		equal:     c.opts.InstanceEqual,
+	}
+
+	h := &handlerRegistration{}
+	for _, r := range c.registryEntries() {
+		r := r
+		if err := r.AppendInstanceHandler(func(si *model.ServiceInstance, event model.Event) {
+			if !h.active() {
+				return
+			}
+			if _, ok := subscribed[si.Service.Hostname]; !ok {
+				return
+			}
+			r.recordEvent()
+			svc := si.Service
+			c.dispatch(h, fmt.Sprintf("%s/%p", svc.Hostname, r), func() {
+				key := deltaKey{hostname: svc.Hostname, registry: r}
+				listing := snapshots.startListing(key)
+				current, err := c.registryEndpoints(r, svc)
+				if err != nil {
+					log.Warnf("Failed to compute endpoint delta of %s in cluster %s: %v", svc.Hostname, r.Cluster(), err)
+					return
+				}
+				if delta, ok := snapshots.update(key, listing, current); ok {
+					f(delta)
+				}
+			})
+		}); err != nil {
+			h.deactivate()
+			log.Infof("Fail to append endpoint delta handler to adapter %s", r.Provider())
+			return err
+		}
+	}
+	return nil
+}
+
+// registryEndpoints lists the instances of the service in the registry, on all its ports, keyed
+// by endpoint. They go through the circuit breaker and the filters of InstancesByPort, and have the
+// cluster ID of the registry stamped, so that the deltas match the instances served.
+func (c *Controller) registryEndpoints(r *registryEntry, svc *model.Service) (map[instanceKey]*model.ServiceInstance, error) {
+	current := make(map[instanceKey]*model.ServiceInstance)
+	if c.namespaceExcluded(svc.Attributes.Namespace) {
+		return current, nil
+	}
+	for _, port := range svc.Ports {
+		instances, err := registryInstances(r, svc, port.Port, nil)
+		r.recordResult(err)
+		if err != nil {
+			return nil, err
+		}
+		if instances = c.filterInstances(instances); c.excludedNamespaces != nil {
+			instances = c.filterExcludedInstances(instances)
+		}
+		for _, si := range c.stampClusterID(r, instances) {
+			current[instanceKey{port: port.Port, address: si.Endpoint.Address, endpointPort: si.Endpoint.EndpointPort}] = si
+		}
+	}
+	return current, nil
+}
+
+// startListing returns the number of a new listing of the instances of the service in the
+// registry, to pass to update once listed.
+func (s *endpointSnapshots) startListing(key deltaKey) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listings[key]++
+	return s.listings[key]
+}
+
+// update returns the delta of the current instances of the service in the registry with the
+// previous ones, if any changed, sorted by port and address. The listing is dropped if a later
+// listing was applied already: the registries are listed outside of the lock, so concurrent
+// events may complete out of order.
+func (s *endpointSnapshots) update(key deltaKey, listing uint64,
+	current map[instanceKey]*model.ServiceInstance) (EndpointDelta, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if listing <= s.applied[key] {
+		return EndpointDelta{}, false
+	}
+	s.applied[key] = listing
+
+	previous := s.instances[key]
+	delta := EndpointDelta{Hostname: key.hostname, ClusterID: key.registry.Cluster()}
+	for _, k := range sortedInstanceKeys(current) {
+		prev, ok := previous[k]
+		if !ok {
+			delta.Added = append(delta.Added, current[k])
+		} else if s.changed(prev, current[k]) {
+			delta.Updated = append(delta.Updated, current[k])
+		} else {
+			// Keep comparing with the instance last delivered, so that changes each found equal
+			// do not add up unnoticed.
+			current[k] = prev
+		}
+	}
+	if len(current) == 0 {
+		delete(s.instances, key)
+	} else {
+		s.instances[key] = current
+	}
+	for _, k := range sortedInstanceKeys(previous) {
+		if _, ok := current[k]; !ok {
+			delta.Removed = append(delta.Removed, previous[k])
+		}
+	}
+	changed := len(delta.Added) > 0 || len(delta.Removed) > 0 || len(delta.Updated) > 0
+	return delta, changed
+}
+
+func sortedInstanceKeys(instances map[instanceKey]*model.ServiceInstance) []instanceKey {
+	keys := make([]instanceKey, 0, len(instances))
+	for k := range instances {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].port != keys[j].port {
+			return keys[i].port < keys[j].port
+		}
+		if keys[i].address != keys[j].address {
+			return keys[i].address < keys[j].address
+		}
+		return keys[i].endpointPort < keys[j].endpointPort
+	})
+	return keys
+}
+
+// changed returns true if the instance changed since it was last delivered.
+func (s *endpointSnapshots) changed(prev, current *model.ServiceInstance) bool {
+	if s.equal != nil {
+		return !s.equal(prev, current)
+	}
+	return endpointChanged(prev.Endpoint, current.Endpoint)
+}
+
+// endpointChanged returns true if the endpoints differ, ignoring their cached Envoy representation.
+func endpointChanged(a, b *model.IstioEndpoint) bool {
+	ac, bc := *a, *b
+	ac.EnvoyEndpoint, bc.EnvoyEndpoint = nil, nil
+	return !reflect.DeepEqual(ac, bc)
+}
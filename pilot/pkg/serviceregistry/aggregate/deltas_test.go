@@ -0,0 +1,231 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
+)
+
+// endpointsDiscovery is a service discovery returning the instances it is set with.
+type endpointsDiscovery struct {
+	model.ServiceDiscovery
+	mu        sync.Mutex
+	instances []*model.ServiceInstance
+}
+
+func (d *endpointsDiscovery) set(instances ...*model.ServiceInstance) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.instances = instances
+}
+
+func (d *endpointsDiscovery) InstancesByPort(svc *model.Service, port int, _ labels.Collection) ([]*model.ServiceInstance, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var out []*model.ServiceInstance
+	for _, si := range d.instances {
+		if si.Service.Hostname == svc.Hostname && si.ServicePort.Port == port {
+			out = append(out, si)
+		}
+	}
+	return out, nil
+}
+
+func TestEndpointDeltas(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	other := mock.MakeService("world.default.svc.cluster.local", "10.2.0.0")
+	newInstance := func(svc *model.Service, address string, weight uint32) *model.ServiceInstance {
+		return &model.ServiceInstance{
+			Service:     svc,
+			ServicePort: svc.Ports[0],
+			Endpoint:    &model.IstioEndpoint{Address: address, EndpointPort: 8080, LbWeight: weight},
+		}
+	}
+
+	discovery1, discovery2 := &endpointsDiscovery{}, &endpointsDiscovery{}
+	controller1, controller2 := &fakeController{}, &fakeController{}
+	aggregateCtl := NewController(Options{})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{ClusterID: "cluster-1", ServiceDiscovery: discovery1, Controller: controller1})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{ClusterID: "cluster-2", ServiceDiscovery: discovery2, Controller: controller2})
+
+	var deltas []EndpointDelta
+	if err := aggregateCtl.AppendEndpointDeltaHandler([]host.Name{svc.Hostname}, func(d EndpointDelta) {
+		deltas = append(deltas, d)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	addresses := func(instances []*model.ServiceInstance) []string {
+		var out []string
+		for _, si := range instances {
+			out = append(out, si.Endpoint.Address)
+		}
+		return out
+	}
+	expectDelta := func(cluster string, added, removed, updated []string) {
+		t.Helper()
+		if len(deltas) != 1 {
+			t.Fatalf("expected a single delta, got %d", len(deltas))
+		}
+		d := deltas[0]
+		deltas = nil
+		if d.Hostname != svc.Hostname || d.ClusterID != cluster {
+			t.Fatalf("expected a delta for %s in %s, got %s in %s", svc.Hostname, cluster, d.Hostname, d.ClusterID)
+		}
+		if !reflect.DeepEqual(addresses(d.Added), added) || !reflect.DeepEqual(addresses(d.Removed), removed) ||
+			!reflect.DeepEqual(addresses(d.Updated), updated) {
+			t.Fatalf("expected added %v, removed %v, updated %v, got %v, %v, %v",
+				added, removed, updated, addresses(d.Added), addresses(d.Removed), addresses(d.Updated))
+		}
+	}
+
+	// Add.
+	a, b := newInstance(svc, "10.0.0.1", 1), newInstance(svc, "10.0.0.2", 1)
+	discovery1.set(a, b)
+	controller1.instanceEvent(a, model.EventAdd)
+	expectDelta("cluster-1", []string{"10.0.0.1", "10.0.0.2"}, nil, nil)
+
+	// The deltas are per cluster.
+	c := newInstance(svc, "10.0.1.1", 1)
+	discovery2.set(c)
+	controller2.instanceEvent(c, model.EventAdd)
+	expectDelta("cluster-2", []string{"10.0.1.1"}, nil, nil)
+
+	// Update.
+	b2 := newInstance(svc, "10.0.0.2", 5)
+	discovery1.set(a, b2)
+	controller1.instanceEvent(b2, model.EventUpdate)
+	expectDelta("cluster-1", nil, nil, []string{"10.0.0.2"})
+
+	// Remove.
+	discovery1.set(b2)
+	controller1.instanceEvent(a, model.EventDelete)
+	expectDelta("cluster-1", nil, []string{"10.0.0.1"}, nil)
+
+	// No delta is delivered if nothing changed, nor for the hostnames not subscribed to.
+	controller1.instanceEvent(b2, model.EventUpdate)
+	o := newInstance(other, "10.0.2.1", 1)
+	discovery1.set(b2, o)
+	controller1.instanceEvent(o, model.EventAdd)
+	if len(deltas) != 0 {
+		t.Fatalf("expected no delta, got %v", deltas)
+	}
+}
+
+func TestEndpointDeltasInstanceEqual(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	newInstance := func(network string, weight uint32) *model.ServiceInstance {
+		return &model.ServiceInstance{
+			Service:     svc,
+			ServicePort: svc.Ports[0],
+			Endpoint:    &model.IstioEndpoint{Address: "10.0.0.1", EndpointPort: 8080, Network: network, LbWeight: weight},
+		}
+	}
+
+	discovery, ctl := &endpointsDiscovery{}, &fakeController{}
+	// Only the network of the endpoints matters, weight changes are not pushed.
+	aggregateCtl := NewController(Options{InstanceEqual: func(a, b *model.ServiceInstance) bool {
+		return a.Endpoint.Network == b.Endpoint.Network
+	}})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{ClusterID: "cluster-1", ServiceDiscovery: discovery, Controller: ctl})
+
+	var deltas []EndpointDelta
+	if err := aggregateCtl.AppendEndpointDeltaHandler([]host.Name{svc.Hostname}, func(d EndpointDelta) {
+		deltas = append(deltas, d)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	update := func(si *model.ServiceInstance) {
+		discovery.set(si)
+		ctl.instanceEvent(si, model.EventUpdate)
+	}
+
+	update(newInstance("network-1", 1))
+	if len(deltas) != 1 || len(deltas[0].Added) != 1 {
+		t.Fatalf("expected the instance to be added, got %v", deltas)
+	}
+	deltas = nil
+
+	// Suppressed: the instances are equal.
+	update(newInstance("network-1", 5))
+	update(newInstance("network-1", 10))
+	if len(deltas) != 0 {
+		t.Fatalf("expected no delta for equal instances, got %v", deltas)
+	}
+
+	// Emitted: the instances differ.
+	update(newInstance("network-2", 10))
+	if len(deltas) != 1 || len(deltas[0].Updated) != 1 || deltas[0].Updated[0].Endpoint.Network != "network-2" {
+		t.Fatalf("expected the instance to be updated, got %v", deltas)
+	}
+}
+
+func TestEndpointDeltasFiltered(t *testing.T) {
+	svc := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	newInstance := func(address string) *model.ServiceInstance {
+		return &model.ServiceInstance{
+			Service:     svc,
+			ServicePort: svc.Ports[0],
+			Endpoint:    &model.IstioEndpoint{Address: address, EndpointPort: 8080},
+		}
+	}
+
+	// Two registries without cluster ID, whose snapshots must not overwrite each other.
+	discovery1, discovery2 := &endpointsDiscovery{}, &endpointsDiscovery{}
+	controller1, controller2 := &fakeController{}, &fakeController{}
+	aggregateCtl := NewController(Options{InstanceFilter: func(si *model.ServiceInstance) bool {
+		return si.Endpoint.Address != "10.0.0.9"
+	}})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{ProviderID: serviceregistry.External,
+		ServiceDiscovery: discovery1, Controller: controller1})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{ProviderID: serviceregistry.Mock,
+		ServiceDiscovery: discovery2, Controller: controller2})
+
+	var deltas []EndpointDelta
+	if err := aggregateCtl.AppendEndpointDeltaHandler([]host.Name{svc.Hostname}, func(d EndpointDelta) {
+		deltas = append(deltas, d)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	a, filtered := newInstance("10.0.0.1"), newInstance("10.0.0.9")
+	discovery1.set(a, filtered)
+	controller1.instanceEvent(a, model.EventAdd)
+	if len(deltas) != 1 || len(deltas[0].Added) != 1 || deltas[0].Added[0].Endpoint.Address != "10.0.0.1" {
+		t.Fatalf("expected only the instance passing the filter to be added, got %v", deltas)
+	}
+	deltas = nil
+
+	b := newInstance("10.0.0.2")
+	discovery2.set(b)
+	controller2.instanceEvent(b, model.EventAdd)
+	if len(deltas) != 1 || len(deltas[0].Added) != 1 || len(deltas[0].Removed) != 0 {
+		t.Fatalf("expected the instance of the second registry to be added alone, got %v", deltas)
+	}
+	deltas = nil
+
+	// The snapshot of the first registry is intact: an unchanged listing delivers no delta.
+	controller1.instanceEvent(a, model.EventUpdate)
+	if len(deltas) != 0 {
+		t.Fatalf("expected no delta, got %v", deltas)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"sort"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
+	"istio.io/pkg/log"
+)
+
+// registrySnapshot is an immutable view of the registries, published by setRegistries on each
+// change for the lookups to read without locking.
+type registrySnapshot struct {
+	registries []*registryEntry
+	// weighted holds the registries ordered by descending weight for the first-hit lookups, nil
+	// when no registry has a weight.
+	weighted []*registryEntry
+	// single is the only registry when exactly one is configured, served by the direct lookups.
+	single *registryEntry
+}
+
+// emptySnapshot is the snapshot of a controller without registries.
+var emptySnapshot = &registrySnapshot{}
+
+// setRegistries replaces the registries, publishing a new snapshot of them. The caller must hold
+// the write lock. The slice must not be modified afterwards, the readers holding on to it.
+func (c *Controller) setRegistries(registries []*registryEntry) {
+	previous := len(c.registries)
+	c.registries = registries
+	snapshot := &registrySnapshot{
+		registries: registries,
+		weighted:   byWeight(registries),
+	}
+	if len(registries) == 1 {
+		snapshot.single = registries[0]
+	}
+	c.snapshot.Store(snapshot)
+	c.recordRegistryCount(previous, len(registries))
+}
+
+// loadSnapshot returns the last snapshot of the registries, without locking.
+func (c *Controller) loadSnapshot() *registrySnapshot {
+	if snapshot, ok := c.snapshot.Load().(*registrySnapshot); ok {
+		return snapshot
+	}
+	return emptySnapshot
+}
+
+// byWeight returns the registries ordered by descending weight, keeping the registries of equal
+// weight in order, or nil if no registry has a weight.
+func byWeight(registries []*registryEntry) []*registryEntry {
+	weighted := false
+	for _, r := range registries {
+		if r.weight != 0 {
+			weighted = true
+			break
+		}
+	}
+	if !weighted {
+		return nil
+	}
+	out := append([]*registryEntry(nil), registries...)
+	sort.SliceStable(out, func(i, j int) bool { return out[i].weight > out[j].weight })
+	return out
+}
+
+// directRegistry returns the registry the lookups can be delegated to directly, skipping the
+// iteration over the registries and the merge of their results: the only registry when exactly
+// one is configured, unless it is a group of clusters or an option alters the results of the
+// registries. It returns nil if the lookups must take the general path.
+func (c *Controller) directRegistry() *registryEntry {
+	r := c.loadSnapshot().single
+	if r == nil || isGroup(r) {
+		return nil
+	}
+	if c.limiter != nil || c.excludedNamespaces != nil || c.opts.ClusterIDNormalizer != nil ||
+		c.opts.HostnameRewriter != nil || c.opts.CaseInsensitiveHostnames || c.opts.DedupInstances ||
+		c.opts.ServiceEntryPrecedence || c.opts.GetServiceTimeout > 0 ||
+		c.opts.EmptyClusterIDPolicy != UnmergedEmptyClusterID {
+		return nil
+	}
+	return r
+}
+
+// directServices lists the services of a single registry without cluster ID, as services does.
+func (c *Controller) directServices(r *registryEntry) ([]*model.Service, error) {
+	defer func(start time.Time) {
+		mergeDuration.Record(time.Since(start).Seconds())
+	}(time.Now())
+	svcs, err := c.registryServices(r)
+	r.recordResult(err)
+	if err != nil {
+		if c.opts.StrictMode {
+			return nil, registryError(r, err)
+		}
+		return make([]*model.Service, 0), registriesError(1, 1, appendRegistryError(nil, r, err))
+	}
+	recordRegistryServiceCount(r, len(svcs))
+	return append(make([]*model.Service, 0, len(svcs)), svcs...), nil
+}
+
+// directGetService looks a hostname up in a single registry, as getService does: the services
+// of cluster registries are copied, with the networks of the registry recorded, the others
+// returned as is.
+func (c *Controller) directGetService(r *registryEntry, hostname host.Name) (*model.Service, error) {
+	service, err := c.registryService(r, hostname)
+	r.recordResult(err)
+	if err != nil {
+		if c.opts.StrictMode {
+			return nil, registryError(r, err)
+		}
+		return nil, registriesError(1, 1, multierror.Append(nil, err))
+	}
+	if service == nil || !mergedByCluster(r) {
+		return service, nil
+	}
+	service.Mutex.RLock()
+	out := service.DeepCopy()
+	service.Mutex.RUnlock()
+	setClusterNetworks(out, r.Cluster(), registryNetworks(r))
+	return out, nil
+}
+
+// directInstancesByPort retrieves the instances of a service from a single registry, as
+// instancesByPort does.
+func (c *Controller) directInstancesByPort(r *registryEntry, svc *model.Service, port int,
+	labels labels.Collection) ([]*model.ServiceInstance, error) {
+	instances, err := registryInstances(r, svc, port, labels)
+	r.recordResult(err)
+	if err != nil {
+		log.Warnf("get service %s instance from registry %s/%s failed: %v", svc.Hostname, r.Provider(), r.Cluster(), err)
+		if c.opts.StrictMode {
+			return nil, registryError(r, err)
+		}
+		return nil, registriesError(1, 1, appendRegistryError(nil, r, err))
+	}
+	if instances = c.filterInstances(instances); len(instances) == 0 {
+		return nil, nil
+	}
+	return c.stampClusterID(r, instances), nil
+}
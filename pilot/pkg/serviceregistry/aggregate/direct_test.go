@@ -0,0 +1,199 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pkg/config/host"
+)
+
+func newSingleRegistryController(opts Options, provider serviceregistry.ProviderID, clusterID string) (*Controller, *mock.ServiceDiscovery) {
+	discovery := mock.NewDiscovery(map[host.Name]*model.Service{
+		mock.HelloService.Hostname: mock.HelloService,
+		mock.WorldService.Hostname: mock.WorldService,
+	}, 2)
+	ctl := NewController(opts)
+	ctl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       provider,
+		ClusterID:        clusterID,
+		ServiceDiscovery: discovery,
+		Controller:       &mock.Controller{},
+	})
+	return ctl, discovery
+}
+
+func TestDirectRegistry(t *testing.T) {
+	ctl, _ := newSingleRegistryController(Options{}, serviceregistry.Kubernetes, "cluster-1")
+	if ctl.directRegistry() == nil {
+		t.Fatal("expected the single registry to be served directly")
+	}
+	if ctl, _ := newSingleRegistryController(Options{DedupInstances: true}, serviceregistry.Kubernetes, "cluster-1"); ctl.directRegistry() != nil {
+		t.Fatal("expected the options altering the results to disable the direct lookups")
+	}
+
+	ctl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-2",
+		ServiceDiscovery: mock.NewDiscovery(nil, 1),
+		Controller:       &mock.Controller{},
+	})
+	if ctl.directRegistry() != nil {
+		t.Fatal("expected two registries not to be served directly")
+	}
+	ctl.DeleteRegistry("cluster-2")
+	if ctl.directRegistry() == nil {
+		t.Fatal("expected the remaining registry to be served directly")
+	}
+	ctl.DeleteRegistry("cluster-1")
+	if ctl.directRegistry() != nil {
+		t.Fatal("expected no registry to be served directly")
+	}
+}
+
+func TestDirectLookupsMatchGeneralPath(t *testing.T) {
+	for _, provider := range []serviceregistry.ProviderID{serviceregistry.Kubernetes, serviceregistry.External} {
+		clusterID := "cluster-1"
+		if provider == serviceregistry.External {
+			clusterID = ""
+		}
+		ctl, discovery := newSingleRegistryController(Options{}, provider, clusterID)
+		all := ctl.registryEntries()
+
+		direct, err := ctl.GetService(mock.HelloService.Hostname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		general, _ := ctl.getIndexedService(all, mock.HelloService.Hostname)
+		if !reflect.DeepEqual(direct, general) {
+			t.Fatalf("%s: GetService() = %v, expected %v", provider, direct, general)
+		}
+		if provider == serviceregistry.Kubernetes && direct == mock.HelloService {
+			t.Fatalf("%s: expected GetService() to return a copy", provider)
+		}
+
+		instances, err := ctl.InstancesByPort(mock.HelloService, 80, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, _ := ctl.instancesByPort(all, mock.HelloService, 80, nil)
+		if !reflect.DeepEqual(instances, expected) {
+			t.Fatalf("%s: InstancesByPort() = %v, expected %v", provider, instances, expected)
+		}
+
+		svcs, err := ctl.Services()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedSvcs, _ := ctl.services(nil)
+		if len(svcs) != len(expectedSvcs) {
+			t.Fatalf("%s: Services() = %v, expected %v", provider, svcs, expectedSvcs)
+		}
+
+		// Failures are reported as by the general path.
+		discovery.GetServiceError = errors.New("mock GetService error")
+		discovery.InstancesError = errors.New("mock InstancesByPort error")
+		if _, err := ctl.GetService(mock.HelloService.Hostname); !errors.Is(err, ErrAllRegistriesFailed) {
+			t.Fatalf("%s: expected GetService() to fail with ErrAllRegistriesFailed, got %v", provider, err)
+		}
+		_, err = ctl.InstancesByPort(mock.HelloService, 80, nil)
+		_, expectedErr := ctl.instancesByPort(all, mock.HelloService, 80, nil)
+		if err == nil || err.Error() != expectedErr.Error() {
+			t.Fatalf("%s: InstancesByPort() error = %v, expected %v", provider, err, expectedErr)
+		}
+	}
+}
+
+func BenchmarkSingleRegistry(b *testing.B) {
+	ctl, _ := newSingleRegistryController(Options{}, serviceregistry.Kubernetes, "cluster-1")
+	all := ctl.registryEntries()
+	hostnames := []host.Name{mock.HelloService.Hostname, mock.WorldService.Hostname}
+
+	b.Run("GetService/direct", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			_, _ = ctl.GetService(hostnames[n%len(hostnames)])
+		}
+	})
+	b.Run("GetService/loop", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			_, _ = ctl.getIndexedService(all, hostnames[n%len(hostnames)])
+		}
+	})
+	b.Run("InstancesByPort/direct", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			_, _ = ctl.InstancesByPort(mock.HelloService, 80, nil)
+		}
+	})
+	b.Run("InstancesByPort/loop", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			_, _ = ctl.instancesByPort(all, mock.HelloService, 80, nil)
+		}
+	})
+}
+
+func TestRegistrySnapshot(t *testing.T) {
+	var zero Controller
+	if registries := zero.GetRegistries(); len(registries) != 0 {
+		t.Fatalf("expected no registries, got %v", registries)
+	}
+
+	ctl, _ := newSingleRegistryController(Options{}, serviceregistry.Kubernetes, "cluster-1")
+	before := ctl.registryEntries()
+	ctl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-2",
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{mock.HelloService.Hostname: mock.HelloService}, 1),
+		Controller:       &mock.Controller{},
+	})
+	if len(before) != 1 || len(ctl.registryEntries()) != 2 {
+		t.Fatalf("expected the earlier snapshot to be left unchanged, got %d then %d registries",
+			len(before), len(ctl.registryEntries()))
+	}
+	if ctl.directRegistry() != nil {
+		t.Fatal("expected no direct registry with 2 registries")
+	}
+
+	// The lookups read the snapshots while the registries change.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			_, _ = ctl.Services()
+			_, _ = ctl.GetService(mock.HelloService.Hostname)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		ctl.DeleteRegistry("cluster-2")
+		ctl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        "cluster-2",
+			ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{mock.HelloService.Hostname: mock.HelloService}, 1),
+			Controller:       &mock.Controller{},
+		})
+	}
+	<-done
+	if len(ctl.GetRegistries()) != 2 {
+		t.Fatalf("expected 2 registries, got %d", len(ctl.GetRegistries()))
+	}
+}
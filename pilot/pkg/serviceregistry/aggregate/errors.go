@@ -0,0 +1,84 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+
+	"istio.io/istio/pilot/pkg/serviceregistry"
+)
+
+// RegistryError is the error returned by a registry of the aggregate, identifying the registry.
+type RegistryError struct {
+	ClusterID string
+	Provider  serviceregistry.ProviderID
+	Err       error
+}
+
+func (e *RegistryError) Error() string {
+	return fmt.Sprintf("registry %s/%s: %v", e.Provider, e.ClusterID, e.Err)
+}
+
+func (e *RegistryError) Unwrap() error {
+	return e.Err
+}
+
+// registryError returns the error returned by the registry as a *RegistryError.
+func registryError(r *registryEntry, err error) error {
+	return &RegistryError{ClusterID: r.Cluster(), Provider: r.Provider(), Err: err}
+}
+
+// appendRegistryError appends the error returned by the registry to errs, formatting the
+// resulting multierror with the errors grouped by cluster.
+func appendRegistryError(errs error, r *registryEntry, err error) error {
+	merr := multierror.Append(errs, registryError(r, err))
+	merr.ErrorFormat = formatErrorsByCluster
+	return merr
+}
+
+// formatErrorsByCluster formats errors grouped under their cluster ID, in the order the clusters
+// first appear. Errors not returned by a registry are listed first.
+func formatErrorsByCluster(errs []error) string {
+	var clusters []string
+	byCluster := make(map[string][]string)
+	var others []string
+	for _, err := range errs {
+		re, ok := err.(*RegistryError)
+		if !ok {
+			others = append(others, err.Error())
+			continue
+		}
+		if _, ok := byCluster[re.ClusterID]; !ok {
+			clusters = append(clusters, re.ClusterID)
+		}
+		byCluster[re.ClusterID] = append(byCluster[re.ClusterID], fmt.Sprintf("%s: %v", re.Provider, re.Err))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d errors occurred:", len(errs))
+	for _, msg := range others {
+		fmt.Fprintf(&b, "\n\t* %s", msg)
+	}
+	for _, cluster := range clusters {
+		fmt.Fprintf(&b, "\n\tcluster %q:", cluster)
+		for _, msg := range byCluster[cluster] {
+			fmt.Fprintf(&b, "\n\t\t* %s", msg)
+		}
+	}
+	return b.String()
+}
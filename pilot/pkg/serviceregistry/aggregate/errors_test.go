@@ -0,0 +1,135 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pkg/config/host"
+)
+
+func TestErrorsGroupedByCluster(t *testing.T) {
+	newDiscovery := func(err string) *mock.ServiceDiscovery {
+		d := mock.NewDiscovery(map[host.Name]*model.Service{mock.HelloService.Hostname: mock.HelloService}, 1)
+		if err != "" {
+			d.ServicesError = errors.New(err)
+			d.InstancesError = errors.New(err)
+		}
+		return d
+	}
+	ctl := NewController(Options{})
+	for _, r := range []struct {
+		provider serviceregistry.ProviderID
+		cluster  string
+		err      string
+	}{
+		{serviceregistry.Kubernetes, "cluster-1", "connection refused"},
+		{serviceregistry.Kubernetes, "cluster-2", ""},
+		{serviceregistry.Kubernetes, "cluster-3", "unauthorized"},
+		{serviceregistry.Mock, "cluster-1", "timeout"},
+	} {
+		ctl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       r.provider,
+			ClusterID:        r.cluster,
+			ServiceDiscovery: newDiscovery(r.err),
+			Controller:       &mock.Controller{},
+		})
+	}
+
+	expected := `3 errors occurred:
+	cluster "cluster-1":
+		* Kubernetes: connection refused
+		* Mock: timeout
+	cluster "cluster-3":
+		* Kubernetes: unauthorized`
+
+	_, err := ctl.Services()
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected Services() error:\n%s\ngot:\n%v", expected, err)
+	}
+	var re *RegistryError
+	if !errors.As(err, &re) || re.ClusterID != "cluster-1" || re.Provider != serviceregistry.Kubernetes {
+		t.Fatalf("expected the error of the registry of cluster-1, got %v", re)
+	}
+
+	// Errors are only returned by InstancesByPort when no instance is found.
+	ctl.DeleteRegistry("cluster-2")
+	_, err = ctl.InstancesByPort(mock.HelloService, 80, nil)
+	if !errors.Is(err, ErrAllRegistriesFailed) || err.Error() != ErrAllRegistriesFailed.Error()+": "+expected {
+		t.Fatalf("expected InstancesByPort() error:\n%s\ngot:\n%v", expected, err)
+	}
+}
+
+func TestStrictMode(t *testing.T) {
+	newController := func(opts Options) *Controller {
+		ctl := NewController(opts)
+		for i, failure := range []string{"", "first failure", "second failure"} {
+			d := mock.NewDiscovery(map[host.Name]*model.Service{mock.HelloService.Hostname: mock.HelloService}, 1)
+			if failure != "" {
+				d.ServicesError = errors.New(failure)
+				d.GetServiceError = errors.New(failure)
+				d.InstancesError = errors.New(failure)
+			}
+			ctl.AddRegistry(serviceregistry.Simple{
+				ProviderID:       serviceregistry.Kubernetes,
+				ClusterID:        fmt.Sprintf("cluster-%d", i+1),
+				ServiceDiscovery: d,
+				Controller:       &mock.Controller{},
+			})
+		}
+		return ctl
+	}
+	expectFirstFailure := func(t *testing.T, err error) {
+		t.Helper()
+		var re *RegistryError
+		if !errors.As(err, &re) || re.ClusterID != "cluster-2" || re.Err.Error() != "first failure" {
+			t.Fatalf("expected the first failure, of cluster-2, got %v", err)
+		}
+	}
+
+	// Best effort by default: the results of cluster-1 are returned.
+	ctl := newController(Options{})
+	if svcs, err := ctl.Services(); len(svcs) == 0 || err == nil {
+		t.Fatalf("expected partial results, got %v, %v", svcs, err)
+	}
+	if svc, err := ctl.GetService(mock.HelloService.Hostname); svc == nil || err == nil {
+		t.Fatalf("expected partial results, got %v, %v", svc, err)
+	}
+	if instances, err := ctl.InstancesByPort(mock.HelloService, 80, nil); len(instances) == 0 || err != nil {
+		t.Fatalf("expected partial results, got %v, %v", instances, err)
+	}
+
+	ctl = newController(Options{StrictMode: true})
+	svcs, err := ctl.Services()
+	if svcs != nil {
+		t.Fatalf("expected no services, got %v", svcs)
+	}
+	expectFirstFailure(t, err)
+	svc, err := ctl.GetService(mock.HelloService.Hostname)
+	if svc != nil {
+		t.Fatalf("expected no service, got %v", svc)
+	}
+	expectFirstFailure(t, err)
+	instances, err := ctl.InstancesByPort(mock.HelloService, 80, nil)
+	if instances != nil {
+		t.Fatalf("expected no instances, got %v", instances)
+	}
+	expectFirstFailure(t, err)
+}
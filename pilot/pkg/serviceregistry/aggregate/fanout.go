@@ -0,0 +1,54 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"sync"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// fanOutResult is the result of the call to a registry of a concurrent fan-out.
+type fanOutResult struct {
+	services  []*model.Service
+	instances []*model.ServiceInstance
+	err       error
+}
+
+// fanOut calls each registry concurrently, Options.FanOutConcurrency at most at a time, and
+// returns the results in registry order, for the caller to merge them as if the registries had
+// been called in order. It returns nil if the registries must be called in order instead: when
+// the fan-out is not concurrent, there is a single registry, or the calls are rate limited.
+func (c *Controller) fanOut(registries []*registryEntry, call func(*registryEntry) fanOutResult) []fanOutResult {
+	if c.opts.FanOutConcurrency <= 1 || len(registries) <= 1 || c.limiter != nil {
+		return nil
+	}
+	results := make([]fanOutResult, len(registries))
+	sem := make(chan struct{}, c.opts.FanOutConcurrency)
+	var wg sync.WaitGroup
+	for i, r := range registries {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, r *registryEntry) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = call(r)
+		}(i, r)
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,121 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
+)
+
+// barrierDiscovery answers once all the registries sharing the barrier were called, failing if
+// they are not called concurrently.
+type barrierDiscovery struct {
+	*mock.ServiceDiscovery
+	barrier *sync.WaitGroup
+	err     error
+}
+
+func (d *barrierDiscovery) wait() error {
+	d.barrier.Done()
+	done := make(chan struct{})
+	go func() {
+		d.barrier.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return d.err
+	case <-time.After(5 * time.Second):
+		return errors.New("registries not called concurrently")
+	}
+}
+
+func (d *barrierDiscovery) Services() ([]*model.Service, error) {
+	if err := d.wait(); err != nil {
+		return nil, err
+	}
+	return d.ServiceDiscovery.Services()
+}
+
+func (d *barrierDiscovery) InstancesByPort(svc *model.Service, port int, labels labels.Collection) ([]*model.ServiceInstance, error) {
+	if err := d.wait(); err != nil {
+		return nil, err
+	}
+	return d.ServiceDiscovery.InstancesByPort(svc, port, labels)
+}
+
+func TestFanOutConcurrency(t *testing.T) {
+	const clusters = 4
+	barrier := &sync.WaitGroup{}
+	ctl := NewController(Options{FanOutConcurrency: clusters})
+	for i := 1; i <= clusters; i++ {
+		hello := mock.MakeService(mock.HelloService.Hostname, fmt.Sprintf("10.1.0.%d", i))
+		discovery := &barrierDiscovery{
+			ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{hello.Hostname: hello}, 1),
+			barrier:          barrier,
+		}
+		if i == clusters {
+			discovery.err = errors.New("mock API server unreachable")
+		}
+		ctl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        fmt.Sprintf("cluster-%d", i),
+			ServiceDiscovery: discovery,
+			Controller:       &mock.Controller{},
+		})
+	}
+
+	barrier.Add(clusters)
+	services, err := ctl.Services()
+	if err == nil || !strings.Contains(err.Error(), "mock API server unreachable") {
+		t.Fatalf("Services() error = %v, expected the error of cluster-%d", err, clusters)
+	}
+	if len(services) != 1 {
+		t.Fatalf("expected the merged service, got %v", services)
+	}
+	want := map[string]string{"cluster-1": "10.1.0.1", "cluster-2": "10.1.0.2", "cluster-3": "10.1.0.3"}
+	if !reflect.DeepEqual(services[0].ClusterVIPs, want) {
+		t.Fatalf("expected the cluster VIPs %v, got %v", want, services[0].ClusterVIPs)
+	}
+	// The first registry in order provides the defaults of the merged service.
+	if services[0].Address != "10.1.0.1" {
+		t.Fatalf("expected the address of cluster-1, got %s", services[0].Address)
+	}
+
+	barrier.Add(clusters)
+	instances, err := ctl.InstancesByPort(services[0], 80, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != clusters-1 {
+		t.Fatalf("expected the instances of %d clusters, got %d", clusters-1, len(instances))
+	}
+	for i, si := range instances {
+		if cluster := fmt.Sprintf("cluster-%d", i+1); si.Endpoint.Locality.ClusterID != cluster {
+			t.Fatalf("expected instance %d from %s, got %s", i, cluster, si.Endpoint.Locality.ClusterID)
+		}
+	}
+}
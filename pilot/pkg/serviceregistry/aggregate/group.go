@@ -0,0 +1,113 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+)
+
+// GroupProvider is the provider ID of the registries wrapping a nested aggregate controller.
+const GroupProvider serviceregistry.ProviderID = "Group"
+
+// NewGroup wraps an aggregate controller, holding a group of registries (e.g. the clusters of a
+// region), so that it can be added as a registry of another aggregate controller. The name of the
+// group is used as its cluster ID, to look it up or delete it.
+//
+// The services of a group are already merged across its clusters: the parent merges the per
+// cluster VIPs of the groups rather than keying them by group, and proxies are always looked up
+// in the group, which matches them against its own clusters.
+func NewGroup(name string, group *Controller) serviceregistry.Instance {
+	atomic.StoreInt32(&group.grouped, 1)
+	return serviceregistry.Simple{
+		ProviderID:       GroupProvider,
+		ClusterID:        name,
+		ServiceDiscovery: group,
+		Controller:       group,
+	}
+}
+
+// isGroup returns true if the registry wraps a nested aggregate controller.
+func isGroup(r serviceregistry.Instance) bool {
+	return r.Provider() == GroupProvider
+}
+
+// groupController returns the nested aggregate controller of a group registry, nil if the
+// registry is not a group.
+func groupController(r serviceregistry.Instance) *Controller {
+	if !isGroup(r) {
+		return nil
+	}
+	simple, ok := r.(serviceregistry.Simple)
+	if !ok {
+		return nil
+	}
+	group, _ := simple.ServiceDiscovery.(*Controller)
+	return group
+}
+
+// groupServiceSources returns the per cluster sources of a service merged by a group, in cluster order.
+func groupServiceSources(s *model.Service) []serviceSource {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+	sources := make([]serviceSource, 0, len(s.ClusterVIPs))
+	for cluster, address := range s.ClusterVIPs {
+		sources = append(sources, serviceSource{
+			cluster:           cluster,
+			service:           s,
+			address:           address,
+			networks:          strings.Join(s.Attributes.ClusterNetworks[cluster], ","),
+			externalAddresses: externalAddressesFingerprint(s),
+		})
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].cluster < sources[j].cluster })
+	return sources
+}
+
+// mergeExternalAddresses merges the per cluster external addresses, ports and networks of the
+// service into out, keeping those out already has for a cluster.
+func mergeExternalAddresses(out, service *model.Service) {
+	for cluster, addrs := range service.Attributes.ClusterExternalAddresses {
+		if _, ok := out.Attributes.ClusterExternalAddresses[cluster]; ok {
+			continue
+		}
+		if out.Attributes.ClusterExternalAddresses == nil {
+			out.Attributes.ClusterExternalAddresses = make(map[string][]string)
+		}
+		out.Attributes.ClusterExternalAddresses[cluster] = addrs
+	}
+	for cluster, ports := range service.Attributes.ClusterExternalPorts {
+		if _, ok := out.Attributes.ClusterExternalPorts[cluster]; ok {
+			continue
+		}
+		if out.Attributes.ClusterExternalPorts == nil {
+			out.Attributes.ClusterExternalPorts = make(map[string]map[uint32]uint32)
+		}
+		out.Attributes.ClusterExternalPorts[cluster] = ports
+	}
+	for cluster, networks := range service.Attributes.ClusterNetworks {
+		if _, ok := out.Attributes.ClusterNetworks[cluster]; ok {
+			continue
+		}
+		if out.Attributes.ClusterNetworks == nil {
+			out.Attributes.ClusterNetworks = make(map[string][]string)
+		}
+		out.Attributes.ClusterNetworks[cluster] = networks
+	}
+}
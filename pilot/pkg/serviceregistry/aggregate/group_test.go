@@ -0,0 +1,99 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"reflect"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pkg/config/host"
+)
+
+// The aggregate controller can be wrapped as the registry of another aggregate controller.
+var _ serviceregistry.Instance = NewGroup("group", &Controller{})
+
+func TestNestedGroups(t *testing.T) {
+	hostname := host.Name("hello.default.svc.cluster.local")
+	newGroup := func(name string, addresses map[string]string) serviceregistry.Instance {
+		group := NewController(Options{})
+		for cluster, address := range addresses {
+			group.AddRegistry(serviceregistry.Simple{
+				ProviderID: serviceregistry.Kubernetes,
+				ClusterID:  cluster,
+				ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{
+					hostname: mock.MakeService(hostname, address),
+				}, 1),
+				Controller: &mock.Controller{},
+			})
+		}
+		return NewGroup(name, group)
+	}
+
+	aggregateCtl := NewController(Options{})
+	aggregateCtl.AddRegistry(newGroup("us", map[string]string{"cluster-1": "10.1.0.0", "cluster-2": "10.2.0.0"}))
+	aggregateCtl.AddRegistry(newGroup("eu", map[string]string{"cluster-3": "10.3.0.0"}))
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID: serviceregistry.External,
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{
+			mock.ExtHTTPService.Hostname: mock.ExtHTTPService,
+		}, 1),
+		Controller: &mock.Controller{},
+	})
+
+	svcs, err := aggregateCtl.Services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(svcs) != 2 {
+		t.Fatalf("expected 2 services, got %d", len(svcs))
+	}
+	var merged *model.Service
+	for _, s := range svcs {
+		if s.Hostname == hostname {
+			merged = s
+		}
+	}
+	expected := map[string]string{"cluster-1": "10.1.0.0", "cluster-2": "10.2.0.0", "cluster-3": "10.3.0.0"}
+	if merged == nil || !reflect.DeepEqual(merged.ClusterVIPs, expected) {
+		t.Fatalf("expected the service merged across groups with ClusterVIPs %v, got %v", expected, merged)
+	}
+
+	if svc, err := aggregateCtl.GetService(hostname); err != nil || svc == nil {
+		t.Fatalf("GetService() = %v, %v", svc, err)
+	}
+
+	instances, err := aggregateCtl.InstancesByPort(merged, 80, nil)
+	if err != nil || len(instances) != 3 {
+		t.Fatalf("expected the instances of the 3 clusters, got %v, %v", instances, err)
+	}
+
+	// Proxies are matched against the clusters of the groups.
+	node := &model.Proxy{
+		IPAddresses: []string{"10.3.1.0"},
+		Metadata:    &model.NodeMetadata{ClusterID: "cluster-3"},
+	}
+	instances, err = aggregateCtl.GetProxyServiceInstances(node)
+	if err != nil || len(instances) == 0 {
+		t.Fatalf("expected the proxy to be found in group eu, got %v, %v", instances, err)
+	}
+
+	aggregateCtl.DeleteRegistry("us")
+	if svc, _ := aggregateCtl.GetService(hostname); svc == nil || svc.Address != "10.3.0.0" {
+		t.Fatalf("expected the service of group eu, got %v", svc)
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"istio.io/pkg/log"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+)
+
+// handlerRegistration tracks a handler appended to all the registries through the aggregate
+// controller. Registries do not support removing handlers, so when appending fails on one of
+// the registries the registration is deactivated instead: the copies of the handler already
+// appended to the other registries become no-ops. This keeps registration all or nothing, and
+// makes retrying a failed registration idempotent since the stale copies never fire.
+type handlerRegistration struct {
+	inactive int32
+
+	// hashLock protects hashes
+	hashLock sync.Mutex
+	// hashes holds, by registry and hostname, the hash of the service last delivered to the handler.
+	hashes map[serviceHashKey]uint64
+}
+
+// serviceHashKey identifies the services delivered by a registry for a hostname.
+type serviceHashKey struct {
+	registry *registryEntry
+	hostname host.Name
+}
+
+func (h *handlerRegistration) active() bool {
+	return atomic.LoadInt32(&h.inactive) == 0
+}
+
+func (h *handlerRegistration) deactivate() {
+	atomic.StoreInt32(&h.inactive, 1)
+}
+
+// serviceChanged returns false if the service of the event is identical to the one last delivered
+// to the handler for the hostname by the registry, recording its hash otherwise. The service of the
+// event is hashed rather than the merged service looked up, sparing the registries a lookup on
+// every event. Deletions are always delivered.
+func serviceChanged(h *handlerRegistration, r *registryEntry, svc *model.Service, event model.Event) bool {
+	key := serviceHashKey{registry: r, hostname: svc.Hostname}
+	if event == model.EventDelete {
+		h.hashLock.Lock()
+		delete(h.hashes, key)
+		h.hashLock.Unlock()
+		return true
+	}
+	sum, err := hashService(svc)
+	if err != nil {
+		return true
+	}
+
+	h.hashLock.Lock()
+	defer h.hashLock.Unlock()
+	if last, ok := h.hashes[key]; ok && last == sum {
+		return false
+	}
+	if h.hashes == nil {
+		h.hashes = make(map[serviceHashKey]uint64)
+	}
+	h.hashes[key] = sum
+	return true
+}
+
+// hashService hashes the serialized service, whose maps are serialized with sorted keys.
+func hashService(svc *model.Service) (uint64, error) {
+	svc.Mutex.RLock()
+	b, err := json.Marshal(svc)
+	svc.Mutex.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(b)
+	return h.Sum64(), nil
+}
+
+// runHandler executes a handler, waiting for a slot if the number of concurrent handlers is bounded.
+func (c *Controller) runHandler(handler func()) {
+	if c.handlerSem != nil {
+		c.handlerSem <- struct{}{}
+		defer func() { <-c.handlerSem }()
+	}
+	handler()
+}
+
+// recoverHandler recovers from a panic of a handler delivering an event of the registry, logging
+// it along with the stack, so that a buggy handler does not crash the goroutine of the registry,
+// which keeps delivering the following events. It must be deferred by the handler invocation.
+func recoverHandler(r *registryEntry, kind string, event model.Event) {
+	if p := recover(); p != nil {
+		handlerPanics.With(clusterTag.Value(r.Cluster())).Increment()
+		log.Errorf("%s handler panicked on %s event from cluster %q (provider %s): %v\n%s",
+			kind, event, r.Cluster(), r.Provider(), p, debug.Stack())
+	}
+}
+
+// pendingEvent is an event buffered while the handlers are paused, coalesced with the
+// later events of the same handler and key.
+type pendingEvent struct {
+	handler *handlerRegistration
+	key     string
+}
+
+// PauseHandlers buffers the events delivered to the handlers appended through the aggregate
+// until ResumeHandlers is called, e.g. to bracket a bulk reconfiguration such as attaching
+// several clusters. Pauses nest: events are released once every pause has been resumed.
+func (c *Controller) PauseHandlers() {
+	c.pauseLock.Lock()
+	defer c.pauseLock.Unlock()
+	c.paused++
+}
+
+// ResumeHandlers ends a pause started by PauseHandlers. Once no pause is left, the buffered
+// events are delivered: a single event per handler and hostname (or endpoint, or workload), the
+// latest one, in the order they were first buffered. Resuming handlers which are not paused is a
+// no-op.
+func (c *Controller) ResumeHandlers() {
+	c.pauseLock.Lock()
+	if c.paused == 0 {
+		c.pauseLock.Unlock()
+		return
+	}
+	c.paused--
+	if c.paused > 0 {
+		c.pauseLock.Unlock()
+		return
+	}
+	order, pending := c.pendingOrder, c.pending
+	c.pendingOrder, c.pending = nil, nil
+	c.pauseLock.Unlock()
+
+	for _, e := range order {
+		if e.handler.active() {
+			c.runHandler(pending[e])
+		}
+	}
+}
+
+// dispatch runs the handler invocation, or buffers it under the key if the handlers are paused.
+func (c *Controller) dispatch(h *handlerRegistration, key string, handler func()) {
+	c.pauseLock.Lock()
+	if c.paused > 0 {
+		e := pendingEvent{handler: h, key: key}
+		if c.pending == nil {
+			c.pending = make(map[pendingEvent]func())
+		}
+		if _, ok := c.pending[e]; !ok {
+			c.pendingOrder = append(c.pendingOrder, e)
+		}
+		c.pending[e] = handler
+		c.pauseLock.Unlock()
+		return
+	}
+	c.pauseLock.Unlock()
+	c.runHandler(handler)
+}
+
+// ServiceSelector selects the services whose events are delivered to a handler appended with
+// AppendSelectedServiceHandler: those matching any of the hostnames, or in any of the namespaces.
+// An empty selector selects all the services.
+type ServiceSelector struct {
+	// Hostnames are the hostnames selected, which may be wildcards (e.g. *.example.com).
+	Hostnames []host.Name
+	// Namespaces are the namespaces whose services are selected.
+	Namespaces []string
+}
+
+// matches returns true if the selector selects the service.
+func (s ServiceSelector) matches(svc *model.Service) bool {
+	if len(s.Hostnames) == 0 && len(s.Namespaces) == 0 {
+		return true
+	}
+	for _, h := range s.Hostnames {
+		if h.Matches(svc.Hostname) {
+			return true
+		}
+	}
+	for _, ns := range s.Namespaces {
+		if svc.Attributes.Namespace == ns {
+			return true
+		}
+	}
+	return false
+}
+
+// AppendServiceHandler implements a service catalog operation
+// The panics of the handler are recovered and logged, not crashing the registry delivering the event.
+func (c *Controller) AppendServiceHandler(f func(*model.Service, model.Event)) error {
+	return c.appendServiceHandler(ServiceSelector{}, f)
+}
+
+// AppendSelectedServiceHandler appends a service handler receiving the events of the services
+// selected only, e.g. for a gateway controller watching a few hostnames, so that the events of
+// the other services neither invoke it nor are buffered for it while the handlers are paused.
+// It is otherwise the same as AppendServiceHandler, including for the delete events of
+// PruneOrphanedServices.
+func (c *Controller) AppendSelectedServiceHandler(selector ServiceSelector, f func(*model.Service, model.Event)) error {
+	return c.appendServiceHandler(selector, f)
+}
+
+// appendServiceHandler appends the handler of the services selected to all the registries.
+func (c *Controller) appendServiceHandler(selector ServiceSelector, f func(*model.Service, model.Event)) error {
+	h := &handlerRegistration{}
+	for _, r := range c.registryEntries() {
+		r := r
+		if err := r.AppendServiceHandler(func(svc *model.Service, event model.Event) {
+			if !h.active() {
+				return
+			}
+			r.recordEvent()
+			c.updateHostIndex(r, c.rewriteHostname(r, svc.Hostname), event)
+			if event == model.EventDelete {
+				c.clearHostnameConflicts(c.rewriteHostname(r, svc.Hostname))
+			}
+			c.scheduleWarm()
+			if !selector.matches(svc) {
+				return
+			}
+			if c.opts.SuppressUnchangedServiceEvents && !serviceChanged(h, r, svc, event) {
+				suppressedPushes.Increment()
+				return
+			}
+			c.dispatch(h, string(svc.Hostname), func() {
+				defer recoverHandler(r, "service", event)
+				f(svc, event)
+			})
+		}); err != nil {
+			h.deactivate()
+			log.Infof("Fail to append service handler to adapter %s", r.Provider())
+			return err
+		}
+	}
+
+	c.handlersLock.Lock()
+	c.serviceHandlers = append(c.serviceHandlers, serviceHandler{registration: h, selector: selector, f: f})
+	c.handlersLock.Unlock()
+	return nil
+}
+
+// AppendInstanceHandler implements a service instance catalog operation
+// The panics of the handler are recovered and logged, not crashing the registry delivering the event.
+func (c *Controller) AppendInstanceHandler(f func(*model.ServiceInstance, model.Event)) error {
+	h := &handlerRegistration{}
+	for _, r := range c.registryEntries() {
+		r := r
+		if err := r.AppendInstanceHandler(func(si *model.ServiceInstance, event model.Event) {
+			if !h.active() {
+				return
+			}
+			r.recordEvent()
+			c.dispatch(h, instanceEventKey(si), func() {
+				defer recoverHandler(r, "instance", event)
+				f(si, event)
+			})
+		}); err != nil {
+			h.deactivate()
+			log.Infof("Fail to append instance handler to adapter %s", r.Provider())
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Controller) AppendWorkloadHandler(f func(*model.WorkloadInstance, model.Event)) error {
+	h := &handlerRegistration{}
+	for _, r := range c.registryEntries() {
+		r := r
+		if err := r.AppendWorkloadHandler(func(wi *model.WorkloadInstance, event model.Event) {
+			if !h.active() {
+				return
+			}
+			r.recordEvent()
+			c.dispatch(h, workloadKey(wi), func() {
+				defer recoverHandler(r, "workload", event)
+				f(wi, event)
+			})
+		}); err != nil {
+			h.deactivate()
+			log.Infof("Fail to append workload handler to adapter %s", r.Provider())
+			return err
+		}
+	}
+	return nil
+}
+
+// instanceEventKey identifies an instance by hostname and endpoint address and port, so that the
+// events of the different endpoints of a service are not coalesced while the handlers are paused.
+func instanceEventKey(si *model.ServiceInstance) string {
+	if si.Endpoint == nil {
+		return string(si.Service.Hostname)
+	}
+	return string(si.Service.Hostname) + "/" +
+		net.JoinHostPort(si.Endpoint.Address, strconv.FormatUint(uint64(si.Endpoint.EndpointPort), 10))
+}
+
+// workloadKey identifies a workload instance by namespace and address.
+func workloadKey(wi *model.WorkloadInstance) string {
+	if wi.Endpoint == nil {
+		return wi.Namespace
+	}
+	return wi.Namespace + "/" + wi.Endpoint.Address
+}
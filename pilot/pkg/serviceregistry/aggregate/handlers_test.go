@@ -0,0 +1,407 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pkg/config/host"
+)
+
+// fakeController is a registry controller recording its handlers so that tests can fire events.
+type fakeController struct {
+	mock.Controller
+	appendErr        error
+	serviceHandlers  []func(*model.Service, model.Event)
+	instanceHandlers []func(*model.ServiceInstance, model.Event)
+}
+
+func (c *fakeController) AppendServiceHandler(f func(*model.Service, model.Event)) error {
+	if c.appendErr != nil {
+		return c.appendErr
+	}
+	c.serviceHandlers = append(c.serviceHandlers, f)
+	return nil
+}
+
+func (c *fakeController) AppendInstanceHandler(f func(*model.ServiceInstance, model.Event)) error {
+	if c.appendErr != nil {
+		return c.appendErr
+	}
+	c.instanceHandlers = append(c.instanceHandlers, f)
+	return nil
+}
+
+func (c *fakeController) serviceEvent(svc *model.Service, event model.Event) {
+	for _, f := range c.serviceHandlers {
+		f(svc, event)
+	}
+}
+
+func (c *fakeController) instanceEvent(si *model.ServiceInstance, event model.Event) {
+	for _, f := range c.instanceHandlers {
+		f(si, event)
+	}
+}
+
+func TestAppendServiceHandlerAllOrNothing(t *testing.T) {
+	controllers := []*fakeController{{}, {appendErr: errors.New("mock append error")}, {}}
+	aggregateCtl := NewController(Options{})
+	for i, ctl := range controllers {
+		aggregateCtl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        string(rune('a' + i)),
+			ServiceDiscovery: mock.NewDiscovery(nil, 2),
+			Controller:       ctl,
+		})
+	}
+
+	calls := 0
+	if err := aggregateCtl.AppendServiceHandler(func(*model.Service, model.Event) { calls++ }); err == nil {
+		t.Fatal("expected AppendServiceHandler to fail")
+	}
+	controllers[0].serviceEvent(mock.HelloService, model.EventAdd)
+	if calls != 0 {
+		t.Fatalf("a handler which failed to be appended to all registries must not be called, got %d calls", calls)
+	}
+
+	// Retrying once the registry recovered delivers each event once.
+	controllers[1].appendErr = nil
+	if err := aggregateCtl.AppendServiceHandler(func(*model.Service, model.Event) { calls++ }); err != nil {
+		t.Fatalf("AppendServiceHandler() encountered unexpected error: %v", err)
+	}
+	for _, ctl := range controllers {
+		ctl.serviceEvent(mock.HelloService, model.EventAdd)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 calls, got %d", calls)
+	}
+}
+
+func TestAppendInstanceHandlerAllOrNothing(t *testing.T) {
+	controllers := []*fakeController{{}, {appendErr: errors.New("mock append error")}}
+	aggregateCtl := NewController(Options{})
+	for _, ctl := range controllers {
+		aggregateCtl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ServiceDiscovery: mock.NewDiscovery(nil, 2),
+			Controller:       ctl,
+		})
+	}
+
+	calls := 0
+	if err := aggregateCtl.AppendInstanceHandler(func(*model.ServiceInstance, model.Event) { calls++ }); err == nil {
+		t.Fatal("expected AppendInstanceHandler to fail")
+	}
+	controllers[0].instanceEvent(&model.ServiceInstance{Service: mock.HelloService}, model.EventAdd)
+	if calls != 0 {
+		t.Fatalf("a handler which failed to be appended to all registries must not be called, got %d calls", calls)
+	}
+}
+
+func TestMaxConcurrentHandlers(t *testing.T) {
+	controllers := []*fakeController{{}, {}, {}}
+	aggregateCtl := NewController(Options{MaxConcurrentHandlers: 1})
+	for _, ctl := range controllers {
+		aggregateCtl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ServiceDiscovery: mock.NewDiscovery(nil, 2),
+			Controller:       ctl,
+		})
+	}
+
+	var running, maxRunning int32
+	if err := aggregateCtl.AppendServiceHandler(func(*model.Service, model.Event) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+	}); err != nil {
+		t.Fatalf("AppendServiceHandler() encountered unexpected error: %v", err)
+	}
+
+	// Fire events from all clusters at once.
+	wg := sync.WaitGroup{}
+	for _, ctl := range controllers {
+		wg.Add(1)
+		go func(ctl *fakeController) {
+			defer wg.Done()
+			ctl.serviceEvent(mock.HelloService, model.EventUpdate)
+		}(ctl)
+	}
+	wg.Wait()
+	if maxRunning != 1 {
+		t.Fatalf("expected handlers to be serialized, got %d running concurrently", maxRunning)
+	}
+}
+
+func TestPauseHandlers(t *testing.T) {
+	controller1, controller2 := &fakeController{}, &fakeController{}
+	aggregateCtl := NewController(Options{})
+	for i, ctl := range []*fakeController{controller1, controller2} {
+		aggregateCtl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        string(rune('a' + i)),
+			ServiceDiscovery: mock.NewDiscovery(nil, 2),
+			Controller:       ctl,
+		})
+	}
+
+	type call struct {
+		hostname string
+		event    model.Event
+	}
+	var calls []call
+	if err := aggregateCtl.AppendServiceHandler(func(svc *model.Service, event model.Event) {
+		calls = append(calls, call{string(svc.Hostname), event})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Resuming without a pause is a no-op.
+	aggregateCtl.ResumeHandlers()
+
+	aggregateCtl.PauseHandlers()
+	aggregateCtl.PauseHandlers()
+	controller1.serviceEvent(mock.HelloService, model.EventAdd)
+	controller1.serviceEvent(mock.WorldService, model.EventAdd)
+	controller2.serviceEvent(mock.HelloService, model.EventUpdate)
+	controller1.serviceEvent(mock.WorldService, model.EventDelete)
+	aggregateCtl.ResumeHandlers()
+	if len(calls) != 0 {
+		t.Fatalf("expected no events while paused, got %v", calls)
+	}
+
+	aggregateCtl.ResumeHandlers()
+	expected := []call{
+		{string(mock.HelloService.Hostname), model.EventUpdate},
+		{string(mock.WorldService.Hostname), model.EventDelete},
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected coalesced events %v, got %v", expected, calls)
+	}
+
+	// Once resumed, events are delivered right away.
+	controller2.serviceEvent(mock.WorldService, model.EventAdd)
+	if len(calls) != 3 {
+		t.Fatalf("expected 3 events, got %v", calls)
+	}
+	aggregateCtl.ResumeHandlers()
+	if len(calls) != 3 {
+		t.Fatalf("expected no more events after an extra resume, got %v", calls)
+	}
+}
+
+func TestPauseHandlersInstances(t *testing.T) {
+	ctl := &fakeController{}
+	aggregateCtl := NewController(Options{})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-1",
+		ServiceDiscovery: mock.NewDiscovery(nil, 2),
+		Controller:       ctl,
+	})
+
+	type call struct {
+		address string
+		event   model.Event
+	}
+	var calls []call
+	if err := aggregateCtl.AppendInstanceHandler(func(si *model.ServiceInstance, event model.Event) {
+		calls = append(calls, call{si.Endpoint.Address, event})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	instance := func(address string) *model.ServiceInstance {
+		return &model.ServiceInstance{
+			Service:  mock.HelloService,
+			Endpoint: &model.IstioEndpoint{Address: address, EndpointPort: 8080},
+		}
+	}
+	aggregateCtl.PauseHandlers()
+	ctl.instanceEvent(instance("10.0.0.1"), model.EventAdd)
+	ctl.instanceEvent(instance("10.0.0.2"), model.EventUpdate)
+	ctl.instanceEvent(instance("10.0.0.1"), model.EventUpdate)
+	aggregateCtl.ResumeHandlers()
+
+	// The events are coalesced per endpoint, not per hostname.
+	expected := []call{
+		{"10.0.0.1", model.EventUpdate},
+		{"10.0.0.2", model.EventUpdate},
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected coalesced events %v, got %v", expected, calls)
+	}
+}
+
+func TestSuppressUnchangedServiceEvents(t *testing.T) {
+	hello := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	services := map[host.Name]*model.Service{hello.Hostname: hello}
+	discovery := &incrementalDiscovery{ServiceDiscovery: mock.NewDiscovery(services, 2)}
+	ctl, ctl2 := &fakeController{}, &fakeController{}
+	aggregateCtl := NewController(Options{SuppressUnchangedServiceEvents: true})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-1",
+		ServiceDiscovery: discovery,
+		Controller:       ctl,
+	})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-2",
+		ServiceDiscovery: discovery,
+		Controller:       ctl2,
+	})
+
+	var events []model.Event
+	if err := aggregateCtl.AppendServiceHandler(func(_ *model.Service, event model.Event) {
+		events = append(events, event)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctl.serviceEvent(hello, model.EventAdd)
+	// The service is unchanged, the update is suppressed.
+	ctl.serviceEvent(hello, model.EventUpdate)
+	if !reflect.DeepEqual(events, []model.Event{model.EventAdd}) {
+		t.Fatalf("expected the unchanged update to be suppressed, got %v", events)
+	}
+
+	updated := mock.MakeService(hello.Hostname, "10.1.0.1")
+	services[updated.Hostname] = updated
+	ctl.serviceEvent(updated, model.EventUpdate)
+	ctl.serviceEvent(updated, model.EventDelete)
+	ctl.serviceEvent(updated, model.EventAdd)
+	expected := []model.Event{model.EventAdd, model.EventUpdate, model.EventDelete, model.EventAdd}
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("expected events %v, got %v", expected, events)
+	}
+
+	// The copies of the other clusters are compared with their own previous copy.
+	ctl2.serviceEvent(updated, model.EventAdd)
+	ctl2.serviceEvent(updated, model.EventUpdate)
+	expected = append(expected, model.EventAdd)
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("expected events %v, got %v", expected, events)
+	}
+	if discovery.getServiceCalls != 0 || discovery.servicesCalls != 0 {
+		t.Fatalf("expected the events to be compared without calling the registries, got %d GetService and %d Services calls",
+			discovery.getServiceCalls, discovery.servicesCalls)
+	}
+}
+
+func TestAppendSelectedServiceHandler(t *testing.T) {
+	hello := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	gateway := mock.MakeService("ingress.istio-system.svc.cluster.local", "10.2.0.0")
+	gateway.Attributes.Namespace = "istio-system"
+	external := mock.MakeService("api.example.com", "10.3.0.0")
+	ctl := &fakeController{}
+	aggregateCtl := NewController(Options{})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-1",
+		ServiceDiscovery: mock.NewDiscovery(nil, 2),
+		Controller:       ctl,
+	})
+
+	var selected []host.Name
+	selector := ServiceSelector{Hostnames: []host.Name{"*.example.com"}, Namespaces: []string{"istio-system"}}
+	if err := aggregateCtl.AppendSelectedServiceHandler(selector, func(svc *model.Service, _ model.Event) {
+		selected = append(selected, svc.Hostname)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	all := 0
+	if err := aggregateCtl.AppendSelectedServiceHandler(ServiceSelector{}, func(*model.Service, model.Event) {
+		all++
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, svc := range []*model.Service{hello, gateway, external} {
+		ctl.serviceEvent(svc, model.EventAdd)
+	}
+	if want := []host.Name{gateway.Hostname, external.Hostname}; !reflect.DeepEqual(selected, want) {
+		t.Fatalf("expected the events of %v, got %v", want, selected)
+	}
+	if all != 3 {
+		t.Fatalf("expected the empty selector to select all the services, got %d events", all)
+	}
+	// The events of the services not selected still update the hostname index.
+	if _, ok := aggregateCtl.hostIndex[hello.Hostname]; !ok {
+		t.Fatal("expected the hostname of the service not selected to be indexed")
+	}
+}
+
+func TestPanickingHandlerRecovered(t *testing.T) {
+	ctl := &fakeController{}
+	aggregateCtl := NewController(Options{})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-1",
+		ServiceDiscovery: mock.NewDiscovery(nil, 2),
+		Controller:       ctl,
+	})
+
+	if err := aggregateCtl.AppendServiceHandler(func(*model.Service, model.Event) { panic("buggy service handler") }); err != nil {
+		t.Fatal(err)
+	}
+	if err := aggregateCtl.AppendInstanceHandler(func(*model.ServiceInstance, model.Event) { panic("buggy instance handler") }); err != nil {
+		t.Fatal(err)
+	}
+	var serviceCalls, instanceCalls int32
+	if err := aggregateCtl.AppendServiceHandler(func(*model.Service, model.Event) { atomic.AddInt32(&serviceCalls, 1) }); err != nil {
+		t.Fatal(err)
+	}
+	if err := aggregateCtl.AppendInstanceHandler(func(*model.ServiceInstance, model.Event) { atomic.AddInt32(&instanceCalls, 1) }); err != nil {
+		t.Fatal(err)
+	}
+
+	// The events are delivered from the goroutine of the registry, which must survive the panics
+	// and keep delivering the following events.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, event := range []model.Event{model.EventAdd, model.EventUpdate} {
+			ctl.serviceEvent(mock.HelloService, event)
+			ctl.instanceEvent(&model.ServiceInstance{Service: mock.HelloService}, event)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the events to be delivered")
+	}
+	if got := atomic.LoadInt32(&serviceCalls); got != 2 {
+		t.Errorf("expected the service handler after the panicking one to be called twice, got %d calls", got)
+	}
+	if got := atomic.LoadInt32(&instanceCalls); got != 2 {
+		t.Errorf("expected the instance handler after the panicking one to be called twice, got %d calls", got)
+	}
+}
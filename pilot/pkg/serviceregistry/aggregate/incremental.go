@@ -0,0 +1,157 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"sync/atomic"
+
+	"istio.io/pkg/log"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+)
+
+// serviceListKey identifies a service in the cached services of a registry: ServiceEntries of
+// different namespaces may declare the same hostname.
+type serviceListKey struct {
+	hostname  host.Name
+	namespace string
+}
+
+func serviceListKeyOf(s *model.Service) serviceListKey {
+	return serviceListKey{hostname: s.Hostname, namespace: s.Attributes.Namespace}
+}
+
+// serviceListCache holds the services of a registry, in the order the registry listed them,
+// the services added later being appended.
+type serviceListCache struct {
+	services []*model.Service
+	// index holds the position of each hostname and namespace in services.
+	index map[serviceListKey]int
+}
+
+func newServiceListCache(services []*model.Service) *serviceListCache {
+	cache := &serviceListCache{
+		services: append([]*model.Service(nil), services...),
+		index:    make(map[serviceListKey]int, len(services)),
+	}
+	for i, s := range cache.services {
+		cache.index[serviceListKeyOf(s)] = i
+	}
+	return cache
+}
+
+// update sets the service of the hostname and namespace, removing it if nil.
+func (l *serviceListCache) update(key serviceListKey, s *model.Service) {
+	i, ok := l.index[key]
+	switch {
+	case s != nil && ok:
+		l.services[i] = s
+	case s != nil:
+		l.index[key] = len(l.services)
+		l.services = append(l.services, s)
+	case ok:
+		l.services = append(l.services[:i:i], l.services[i+1:]...)
+		delete(l.index, key)
+		for j := i; j < len(l.services); j++ {
+			l.index[serviceListKeyOf(l.services[j])] = j
+		}
+	}
+}
+
+// watchServices appends the service handler maintaining the cached services of the registry,
+// with Options.IncrementalServices. Until it is appended, the registry is listed on each call.
+// The ServiceEntry registries are always listed: they accept service handlers but never invoke them.
+func (c *Controller) watchServices(r *registryEntry) {
+	if !c.opts.IncrementalServices || isServiceEntryRegistry(r) {
+		return
+	}
+	if err := r.AppendServiceHandler(func(svc *model.Service, event model.Event) {
+		r.dirtyLock.Lock()
+		if r.dirty == nil {
+			r.dirty = make(map[serviceListKey]model.Event)
+		}
+		r.dirty[serviceListKeyOf(svc)] = event
+		r.dirtyLock.Unlock()
+	}); err != nil {
+		log.Warnf("Failed to watch the services of registry %s/%s, listing them on each call: %v",
+			r.Provider(), r.Cluster(), err)
+		return
+	}
+	atomic.StoreInt32(&r.watched, 1)
+}
+
+// takeDirty returns the last event of each service received since the previous call.
+func (r *registryEntry) takeDirty() map[serviceListKey]model.Event {
+	r.dirtyLock.Lock()
+	defer r.dirtyLock.Unlock()
+	dirty := r.dirty
+	r.dirty = nil
+	return dirty
+}
+
+// registryServices lists the services of the registry, from its cache with
+// Options.IncrementalServices: the registry is listed the first time, then only the hostnames of
+// the events received since are looked up. A failure drops the cache, the registry being listed
+// again, as it is when the lookup returns the service of another namespace. The slice returned must not be modified. The registry is not called while
+// its circuit is open.
+func (c *Controller) registryServices(r *registryEntry) ([]*model.Service, error) {
+	if err := r.circuitError(); err != nil {
+		return nil, err
+	}
+	if atomic.LoadInt32(&r.watched) == 0 {
+		return r.Services()
+	}
+	r.cacheLock.Lock()
+	defer r.cacheLock.Unlock()
+
+	// The events received while refreshing are kept for the next refresh.
+	dirty := r.takeDirty()
+	if r.serviceCache == nil {
+		svcs, err := r.Services()
+		if err != nil {
+			return nil, err
+		}
+		r.serviceCache = newServiceListCache(svcs)
+		return r.serviceCache.services, nil
+	}
+	if len(dirty) > 0 {
+		// Copy on write: the previous slice may still be read by the callers of earlier refreshes.
+		r.serviceCache.services = append([]*model.Service(nil), r.serviceCache.services...)
+	}
+	for key, event := range dirty {
+		if event == model.EventDelete {
+			r.serviceCache.update(key, nil)
+			continue
+		}
+		svc, err := r.GetService(key.hostname)
+		if err != nil {
+			r.serviceCache = nil
+			return nil, err
+		}
+		if svc != nil && serviceListKeyOf(svc) != key {
+			// The hostname is shared across namespaces, only a listing returns all the services.
+			svcs, err := r.Services()
+			if err != nil {
+				r.serviceCache = nil
+				return nil, err
+			}
+			r.serviceCache = newServiceListCache(svcs)
+			return r.serviceCache.services, nil
+		}
+		r.serviceCache.update(key, svc)
+	}
+	return r.serviceCache.services, nil
+}
@@ -0,0 +1,272 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"errors"
+	"sort"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pkg/config/host"
+)
+
+// incrementalDiscovery counts the calls listing and looking up the services.
+type incrementalDiscovery struct {
+	*mock.ServiceDiscovery
+	servicesCalls   int
+	getServiceCalls int
+}
+
+func (d *incrementalDiscovery) Services() ([]*model.Service, error) {
+	d.servicesCalls++
+	return d.ServiceDiscovery.Services()
+}
+
+func (d *incrementalDiscovery) GetService(hostname host.Name) (*model.Service, error) {
+	d.getServiceCalls++
+	return d.ServiceDiscovery.GetService(hostname)
+}
+
+func TestIncrementalServices(t *testing.T) {
+	services1 := map[host.Name]*model.Service{
+		mock.HelloService.Hostname: mock.MakeService("hello.default.svc.cluster.local", "10.1.0.1"),
+	}
+	services2 := map[host.Name]*model.Service{
+		mock.HelloService.Hostname: mock.MakeService("hello.default.svc.cluster.local", "10.1.0.2"),
+		mock.WorldService.Hostname: mock.MakeService("world.default.svc.cluster.local", "10.2.0.2"),
+	}
+	discovery1 := &incrementalDiscovery{ServiceDiscovery: mock.NewDiscovery(services1, 1)}
+	discovery2 := &incrementalDiscovery{ServiceDiscovery: mock.NewDiscovery(services2, 1)}
+	controller1, controller2 := &fakeController{}, &fakeController{}
+
+	ctl := NewController(Options{IncrementalServices: true})
+	ctl.AddRegistry(serviceregistry.Simple{
+		ProviderID: serviceregistry.Kubernetes, ClusterID: "cluster-1", ServiceDiscovery: discovery1, Controller: controller1,
+	})
+	ctl.AddRegistry(serviceregistry.Simple{
+		ProviderID: serviceregistry.Kubernetes, ClusterID: "cluster-2", ServiceDiscovery: discovery2, Controller: controller2,
+	})
+
+	expectServices := func(want map[host.Name]map[string]string) {
+		t.Helper()
+		services, err := ctl.Services()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[host.Name]map[string]string)
+		for _, s := range services {
+			got[s.Hostname] = s.ClusterVIPs
+		}
+		if len(got) != len(want) {
+			t.Fatalf("Services() = %v, want %v", got, want)
+		}
+		for hostname, vips := range want {
+			if len(got[hostname]) != len(vips) {
+				t.Fatalf("Services() = %v, want %v", got, want)
+			}
+			for cluster, vip := range vips {
+				if got[hostname][cluster] != vip {
+					t.Fatalf("Services() = %v, want %v", got, want)
+				}
+			}
+		}
+	}
+	expectCalls := func(services1, getService1, services2, getService2 int) {
+		t.Helper()
+		if discovery1.servicesCalls != services1 || discovery1.getServiceCalls != getService1 ||
+			discovery2.servicesCalls != services2 || discovery2.getServiceCalls != getService2 {
+			t.Fatalf("expected %d/%d Services/GetService calls in cluster-1 and %d/%d in cluster-2, got %d/%d and %d/%d",
+				services1, getService1, services2, getService2,
+				discovery1.servicesCalls, discovery1.getServiceCalls, discovery2.servicesCalls, discovery2.getServiceCalls)
+		}
+	}
+
+	// The registries are listed once.
+	expectServices(map[host.Name]map[string]string{
+		mock.HelloService.Hostname: {"cluster-1": "10.1.0.1", "cluster-2": "10.1.0.2"},
+		mock.WorldService.Hostname: {"cluster-2": "10.2.0.2"},
+	})
+	expectServices(map[host.Name]map[string]string{
+		mock.HelloService.Hostname: {"cluster-1": "10.1.0.1", "cluster-2": "10.1.0.2"},
+		mock.WorldService.Hostname: {"cluster-2": "10.2.0.2"},
+	})
+	expectCalls(1, 0, 1, 0)
+
+	// Only the hostnames of the events are looked up again, the deleted services being dropped.
+	services1[mock.HelloService.Hostname] = mock.MakeService("hello.default.svc.cluster.local", "10.1.0.11")
+	controller1.serviceEvent(services1[mock.HelloService.Hostname], model.EventUpdate)
+	services1[mock.WorldService.Hostname] = mock.MakeService("world.default.svc.cluster.local", "10.2.0.1")
+	controller1.serviceEvent(services1[mock.WorldService.Hostname], model.EventAdd)
+	delete(services2, mock.WorldService.Hostname)
+	controller2.serviceEvent(mock.WorldService, model.EventDelete)
+	expectServices(map[host.Name]map[string]string{
+		mock.HelloService.Hostname: {"cluster-1": "10.1.0.11", "cluster-2": "10.1.0.2"},
+		mock.WorldService.Hostname: {"cluster-1": "10.2.0.1"},
+	})
+	expectCalls(1, 2, 1, 0)
+
+	// A failing lookup drops the cache, the registry being listed again.
+	controller2.serviceEvent(mock.HelloService, model.EventUpdate)
+	discovery2.GetServiceError = errors.New("mock GetService() error")
+	if _, err := ctl.Services(); err == nil {
+		t.Fatal("expected the failure of cluster-2 to be reported")
+	}
+	discovery2.GetServiceError = nil
+	expectServices(map[host.Name]map[string]string{
+		mock.HelloService.Hostname: {"cluster-1": "10.1.0.11", "cluster-2": "10.1.0.2"},
+		mock.WorldService.Hostname: {"cluster-1": "10.2.0.1"},
+	})
+	expectCalls(1, 2, 2, 1)
+}
+
+func TestIncrementalServicesUnwatchedRegistry(t *testing.T) {
+	discovery := &incrementalDiscovery{ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{
+		mock.HelloService.Hostname: mock.HelloService,
+	}, 1)}
+	ctl := NewController(Options{IncrementalServices: true})
+	ctl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-1",
+		ServiceDiscovery: discovery,
+		Controller:       &fakeController{appendErr: errors.New("mock append error")},
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, err := ctl.Services(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if discovery.servicesCalls != 2 {
+		t.Fatalf("expected the registry without handler to be listed on each call, got %d calls", discovery.servicesCalls)
+	}
+}
+
+func TestIncrementalServicesServiceEntryRegistry(t *testing.T) {
+	discovery := &incrementalDiscovery{ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{
+		mock.HelloService.Hostname: mock.HelloService,
+	}, 1)}
+	controller := &fakeController{}
+	ctl := NewController(Options{IncrementalServices: true})
+	ctl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.External,
+		ServiceDiscovery: discovery,
+		Controller:       controller,
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, err := ctl.Services(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if discovery.servicesCalls != 2 || len(controller.serviceHandlers) != 0 {
+		t.Fatalf("expected the ServiceEntry registry to be listed on each call, got %d calls and %d handlers",
+			discovery.servicesCalls, len(controller.serviceHandlers))
+	}
+}
+
+// sharedHostnameDiscovery lists services sharing hostnames across namespaces, looking up by
+// hostname the first one listed, like the ServiceEntry store.
+type sharedHostnameDiscovery struct {
+	*mock.ServiceDiscovery
+	services []*model.Service
+}
+
+func (d *sharedHostnameDiscovery) Services() ([]*model.Service, error) {
+	return d.services, nil
+}
+
+func (d *sharedHostnameDiscovery) GetService(hostname host.Name) (*model.Service, error) {
+	for _, s := range d.services {
+		if s.Hostname == hostname {
+			return s, nil
+		}
+	}
+	return nil, nil
+}
+
+func TestIncrementalServicesSharedHostname(t *testing.T) {
+	inNamespace := func(namespace, address string) *model.Service {
+		s := mock.MakeService("shared.example.com", address)
+		s.Attributes.Namespace = namespace
+		return s
+	}
+	a, b := inNamespace("a", "10.0.0.1"), inNamespace("b", "10.0.0.2")
+	discovery := &sharedHostnameDiscovery{ServiceDiscovery: mock.NewDiscovery(nil, 1), services: []*model.Service{a, b}}
+	controller := &fakeController{}
+	ctl := NewController(Options{IncrementalServices: true})
+	ctl.AddRegistry(serviceregistry.Simple{
+		ProviderID: serviceregistry.Mock, ServiceDiscovery: discovery, Controller: controller,
+	})
+
+	expectAddresses := func(want ...string) {
+		t.Helper()
+		services, err := ctl.Services()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, s := range services {
+			got = append(got, s.Address)
+		}
+		sort.Strings(got)
+		if len(got) != len(want) {
+			t.Fatalf("Services() addresses = %v, want %v", got, want)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("Services() addresses = %v, want %v", got, want)
+			}
+		}
+	}
+
+	// Both namespaces are kept, not collapsed into one service.
+	expectAddresses("10.0.0.1", "10.0.0.2")
+
+	// The update of one namespace, which the lookup by hostname cannot return, relists the registry.
+	b = inNamespace("b", "10.0.0.3")
+	discovery.services = []*model.Service{a, b}
+	controller.serviceEvent(b, model.EventUpdate)
+	expectAddresses("10.0.0.1", "10.0.0.3")
+
+	// The deletion of one namespace keeps the other.
+	discovery.services = []*model.Service{a}
+	controller.serviceEvent(b, model.EventDelete)
+	expectAddresses("10.0.0.1")
+}
+
+func TestServiceListCacheUpdate(t *testing.T) {
+	a, b, c := mock.MakeService("a", ""), mock.MakeService("b", ""), mock.MakeService("c", "")
+	cache := newServiceListCache([]*model.Service{a, b, c})
+	cache.update(serviceListKey{hostname: "b"}, nil)
+	cache.update(serviceListKey{hostname: "d"}, mock.MakeService("d", ""))
+	cache.update(serviceListKey{hostname: "a"}, mock.MakeService("a", "10.0.0.1"))
+
+	var hostnames []string
+	for i, s := range cache.services {
+		hostnames = append(hostnames, string(s.Hostname))
+		if cache.index[serviceListKeyOf(s)] != i {
+			t.Fatalf("expected %s at %d in the index, got %d", s.Hostname, i, cache.index[serviceListKeyOf(s)])
+		}
+	}
+	if !sort.StringsAreSorted(hostnames) || len(hostnames) != 3 || hostnames[1] != "c" {
+		t.Fatalf("expected a, c, d, got %v", hostnames)
+	}
+	if cache.services[0].Address != "10.0.0.1" {
+		t.Fatal("expected a to be updated")
+	}
+}
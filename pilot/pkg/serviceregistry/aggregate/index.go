@@ -0,0 +1,128 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"sync/atomic"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+)
+
+// hostIndex maps hostnames to the registries holding a service with that hostname. It is
+// maintained from the service events delivered to the service handlers of the aggregate, and
+// lets single hostname lookups skip the registries known not to hold the hostname.
+//
+// Only registries which delivered at least one service event, and whose services were seeded
+// into the index from a full listing, are indexed: the events only tell about the hostnames
+// changed since the registry synced, and registries not notifying about services (e.g.
+// ServiceEntry stores) would never see their index updated. The other registries are always
+// queried.
+type hostIndex map[host.Name]map[*registryEntry]struct{}
+
+// updateHostIndex records a service event delivered by the registry in the hostname index.
+func (c *Controller) updateHostIndex(r *registryEntry, hostname host.Name, event model.Event) {
+	hostname = c.hostnameKey(hostname)
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+
+	if event == model.EventDelete {
+		if entries := c.hostIndex[hostname]; entries != nil {
+			delete(entries, r)
+			if len(entries) == 0 {
+				delete(c.hostIndex, hostname)
+			}
+		}
+		atomic.StoreInt32(&r.indexed, 1)
+		return
+	}
+	if c.hostIndex == nil {
+		c.hostIndex = make(hostIndex)
+	}
+	entries := c.hostIndex[hostname]
+	if entries == nil {
+		entries = make(map[*registryEntry]struct{})
+		c.hostIndex[hostname] = entries
+	}
+	entries[r] = struct{}{}
+	atomic.StoreInt32(&r.indexed, 1)
+}
+
+// seedHostIndex records the hostnames of the full listing of the services of the registry in the
+// hostname index, the first time the registry is listed. The events delivered since keep the
+// index current; a listing racing with an event may leave a stale hostname behind, which only
+// costs a lookup.
+func (c *Controller) seedHostIndex(r *registryEntry, services []*model.Service) {
+	if atomic.LoadInt32(&r.seeded) == 1 {
+		return
+	}
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+	if r.seeded == 1 {
+		return
+	}
+	if c.hostIndex == nil {
+		c.hostIndex = make(hostIndex)
+	}
+	for _, s := range services {
+		hostname := c.hostnameKey(c.rewriteHostname(r, s.Hostname))
+		entries := c.hostIndex[hostname]
+		if entries == nil {
+			entries = make(map[*registryEntry]struct{})
+			c.hostIndex[hostname] = entries
+		}
+		entries[r] = struct{}{}
+	}
+	atomic.StoreInt32(&r.seeded, 1)
+}
+
+// indexTrusted returns true if the index of the registry is complete, see hostIndex.
+func indexTrusted(r *registryEntry) bool {
+	return atomic.LoadInt32(&r.indexed) == 1 && atomic.LoadInt32(&r.seeded) == 1
+}
+
+// unindexRegistry removes a deleted registry from the hostname index. The registry is marked
+// seeded, so that a listing racing with the deletion does not index it again.
+func (c *Controller) unindexRegistry(r *registryEntry) {
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+	atomic.StoreInt32(&r.seeded, 1)
+
+	for hostname, entries := range c.hostIndex {
+		delete(entries, r)
+		if len(entries) == 0 {
+			delete(c.hostIndex, hostname)
+		}
+	}
+}
+
+// registriesForHostname filters the registries possibly holding the hostname: the registries
+// indexed for the hostname, and the registries whose index is not trusted yet. All registries are
+// returned if the hostname is not in the index.
+func (c *Controller) registriesForHostname(registries []*registryEntry, hostname host.Name) []*registryEntry {
+	c.indexLock.RLock()
+	defer c.indexLock.RUnlock()
+	entries, ok := c.hostIndex[c.hostnameKey(hostname)]
+	if !ok {
+		return registries
+	}
+	out := make([]*registryEntry, 0, len(entries))
+	for _, r := range registries {
+		if _, ok := entries[r]; ok || !indexTrusted(r) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
@@ -0,0 +1,242 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"fmt"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
+)
+
+// countingDiscovery counts the GetService and InstancesByPort calls made to a service discovery.
+type countingDiscovery struct {
+	model.ServiceDiscovery
+	getServiceCalls int
+	instancesCalls  int
+}
+
+func (d *countingDiscovery) InstancesByPort(svc *model.Service, port int, labels labels.Collection) ([]*model.ServiceInstance, error) {
+	d.instancesCalls++
+	return d.ServiceDiscovery.InstancesByPort(svc, port, labels)
+}
+
+func (d *countingDiscovery) GetService(hostname host.Name) (*model.Service, error) {
+	d.getServiceCalls++
+	return d.ServiceDiscovery.GetService(hostname)
+}
+
+func TestGetServiceUsesHostIndex(t *testing.T) {
+	hello := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	world := mock.MakeService("world.default.svc.cluster.local", "10.2.0.0")
+
+	discovery1 := &countingDiscovery{ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{hello.Hostname: hello}, 1)}
+	discovery2 := &countingDiscovery{ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{world.Hostname: world}, 1)}
+	// An unindexed registry never delivering service events.
+	discovery3 := &countingDiscovery{ServiceDiscovery: mock.NewDiscovery(nil, 1)}
+	controller1, controller2 := &fakeController{}, &fakeController{}
+
+	aggregateCtl := NewController(Options{})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-1",
+		ServiceDiscovery: discovery1,
+		Controller:       controller1,
+	})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-2",
+		ServiceDiscovery: discovery2,
+		Controller:       controller2,
+	})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.External,
+		ServiceDiscovery: discovery3,
+		Controller:       &mock.Controller{},
+	})
+	if err := aggregateCtl.AppendServiceHandler(func(*model.Service, model.Event) {}); err != nil {
+		t.Fatal(err)
+	}
+	controller1.serviceEvent(hello, model.EventAdd)
+	controller2.serviceEvent(world, model.EventAdd)
+	// The index of the registries is trusted once seeded by a full listing.
+	if _, err := aggregateCtl.Services(); err != nil {
+		t.Fatal(err)
+	}
+
+	resetCalls := func() {
+		discovery1.getServiceCalls, discovery2.getServiceCalls, discovery3.getServiceCalls = 0, 0, 0
+	}
+	expectCalls := func(c1, c2, c3 int) {
+		t.Helper()
+		if discovery1.getServiceCalls != c1 || discovery2.getServiceCalls != c2 || discovery3.getServiceCalls != c3 {
+			t.Fatalf("expected GetService calls %d/%d/%d, got %d/%d/%d", c1, c2, c3,
+				discovery1.getServiceCalls, discovery2.getServiceCalls, discovery3.getServiceCalls)
+		}
+	}
+
+	svc, err := aggregateCtl.GetService(hello.Hostname)
+	if err != nil || svc == nil || svc.Hostname != hello.Hostname {
+		t.Fatalf("GetService(%s) = %v, %v", hello.Hostname, svc, err)
+	}
+	expectCalls(1, 0, 1)
+
+	// Unindexed hostnames are looked up in all registries.
+	resetCalls()
+	if svc, _ := aggregateCtl.GetService("unknown.default.svc.cluster.local"); svc != nil {
+		t.Fatalf("expected no service, got %v", svc)
+	}
+	expectCalls(1, 1, 1)
+
+	// Once deleted, the hostname is no longer indexed for the registry.
+	resetCalls()
+	controller2.serviceEvent(world, model.EventDelete)
+	controller1.serviceEvent(world, model.EventAdd)
+	if svc, _ := aggregateCtl.GetService(world.Hostname); svc == nil {
+		t.Fatalf("expected %s to be found by the full scan fallback", world.Hostname)
+	}
+	// The index points to cluster-1, which does not hold the service: fallback to a full scan.
+	expectCalls(2, 1, 2)
+
+	// Deleted registries are removed from the index.
+	aggregateCtl.DeleteRegistry("cluster-1")
+	aggregateCtl.indexLock.RLock()
+	defer aggregateCtl.indexLock.RUnlock()
+	if len(aggregateCtl.hostIndex) != 0 {
+		t.Fatalf("expected the index to be empty, got %v", aggregateCtl.hostIndex)
+	}
+}
+
+func TestInstancesByPortUsesHostIndex(t *testing.T) {
+	hello := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	world := mock.MakeService("world.default.svc.cluster.local", "10.2.0.0")
+
+	discovery1 := &countingDiscovery{ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{hello.Hostname: hello}, 1)}
+	discovery2 := &countingDiscovery{ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{world.Hostname: world}, 1)}
+	controller1, controller2 := &fakeController{}, &fakeController{}
+
+	aggregateCtl := NewController(Options{})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-1",
+		ServiceDiscovery: discovery1,
+		Controller:       controller1,
+	})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-2",
+		ServiceDiscovery: discovery2,
+		Controller:       controller2,
+	})
+	if err := aggregateCtl.AppendServiceHandler(func(*model.Service, model.Event) {}); err != nil {
+		t.Fatal(err)
+	}
+	controller1.serviceEvent(hello, model.EventAdd)
+	controller2.serviceEvent(world, model.EventAdd)
+
+	expectCalls := func(c1, c2 int) {
+		t.Helper()
+		if discovery1.instancesCalls != c1 || discovery2.instancesCalls != c2 {
+			t.Fatalf("expected InstancesByPort calls %d/%d, got %d/%d", c1, c2,
+				discovery1.instancesCalls, discovery2.instancesCalls)
+		}
+		discovery1.instancesCalls, discovery2.instancesCalls = 0, 0
+	}
+
+	// The registries are not trusted to be indexed by their events alone: cluster-2 may hold
+	// hello although it only notified about world.
+	if instances, err := aggregateCtl.InstancesByPort(hello, 80, nil); err != nil || len(instances) == 0 {
+		t.Fatalf("InstancesByPort() = %v, %v", instances, err)
+	}
+	expectCalls(1, 1)
+	if _, err := aggregateCtl.Services(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The single-cluster services are only looked up in their cluster.
+	instances, err := aggregateCtl.InstancesByPort(hello, 80, nil)
+	if err != nil || len(instances) == 0 {
+		t.Fatalf("InstancesByPort() = %v, %v", instances, err)
+	}
+	expectCalls(1, 0)
+	instances, err = aggregateCtl.InstancesByPort(world, 80, nil)
+	if err != nil || len(instances) == 0 {
+		t.Fatalf("InstancesByPort() = %v, %v", instances, err)
+	}
+	expectCalls(0, 1)
+
+	// Unindexed services are looked up in all clusters.
+	unknown := mock.MakeService("unknown.default.svc.cluster.local", "10.3.0.0")
+	if instances, _ := aggregateCtl.InstancesByPort(unknown, 80, nil); len(instances) != 0 {
+		t.Fatalf("expected no instance, got %v", instances)
+	}
+	expectCalls(1, 1)
+
+	// A stale index falls back to all the clusters.
+	controller2.serviceEvent(world, model.EventDelete)
+	controller1.serviceEvent(world, model.EventAdd)
+	instances, err = aggregateCtl.InstancesByPort(world, 80, nil)
+	if err != nil || len(instances) == 0 {
+		t.Fatalf("InstancesByPort() = %v, %v", instances, err)
+	}
+	expectCalls(2, 1)
+}
+
+func BenchmarkInstancesByPortSingleCluster(b *testing.B) {
+	aggregateCtl := NewController(Options{})
+	var controllers []*fakeController
+	var services []*model.Service
+	for c := 0; c < 20; c++ {
+		svc := mock.MakeService(host.Name(fmt.Sprintf("svc-%d.default.svc.cluster.local", c)), fmt.Sprintf("10.%d.0.1", c))
+		controller := &fakeController{}
+		aggregateCtl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        fmt.Sprintf("cluster-%d", c),
+			ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{svc.Hostname: svc}, 2),
+			Controller:       controller,
+		})
+		controllers = append(controllers, controller)
+		services = append(services, svc)
+	}
+	if err := aggregateCtl.AppendServiceHandler(func(*model.Service, model.Event) {}); err != nil {
+		b.Fatal(err)
+	}
+
+	// Fanning out to every cluster, without index.
+	b.Run("fanout", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			_, _ = aggregateCtl.InstancesByPort(services[n%len(services)], 80, nil)
+		}
+	})
+
+	for i, controller := range controllers {
+		controller.serviceEvent(services[i], model.EventAdd)
+	}
+	if _, err := aggregateCtl.Services(); err != nil {
+		b.Fatal(err)
+	}
+	// Querying the owning cluster only.
+	b.Run("indexed", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			_, _ = aggregateCtl.InstancesByPort(services[n%len(services)], 80, nil)
+		}
+	})
+}
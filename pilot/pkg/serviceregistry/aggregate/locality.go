@@ -0,0 +1,51 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+)
+
+// locateProxy returns the instance synthesized for a proxy found in no registry, from the labels
+// and locality of its workload as located by the first registry knowing one of its IPs, nil if
+// none does. The instance has no service port: it is only meant to carry the locality and labels
+// of the proxy, its service being an empty placeholder in the namespace of the proxy.
+func (c *Controller) locateProxy(registries []*registryEntry, node *model.Proxy) *model.ServiceInstance {
+	for _, r := range registries {
+		locator, ok := r.Instance.(serviceregistry.WorkloadLocator)
+		if !ok {
+			continue
+		}
+		for _, ip := range node.IPAddresses {
+			wlLabels, locality, found := locator.LocateWorkload(ip)
+			if !found {
+				continue
+			}
+			si := &model.ServiceInstance{
+				Service: &model.Service{
+					Attributes: model.ServiceAttributes{Namespace: node.ConfigNamespace},
+				},
+				Endpoint: &model.IstioEndpoint{
+					Address:  ip,
+					Labels:   wlLabels,
+					Locality: locality,
+				},
+			}
+			return c.stampClusterID(r, []*model.ServiceInstance{si})[0]
+		}
+	}
+	return nil
+}
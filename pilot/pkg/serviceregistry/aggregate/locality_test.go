@@ -0,0 +1,95 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"reflect"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pkg/config/labels"
+)
+
+// locatorRegistry locates the workloads of the given IPs.
+type locatorRegistry struct {
+	serviceregistry.Simple
+	workloads map[string]labels.Instance
+}
+
+func (r locatorRegistry) LocateWorkload(ip string) (labels.Instance, model.Locality, bool) {
+	wlLabels, ok := r.workloads[ip]
+	return wlLabels, model.Locality{Label: "region1/zone1"}, ok
+}
+
+func TestLocalityFallback(t *testing.T) {
+	newController := func(opts Options) *Controller {
+		ctl := NewController(opts)
+		ctl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        "cluster-1",
+			ServiceDiscovery: mock.NewDiscovery(nil, 1),
+			Controller:       &mock.Controller{},
+		})
+		ctl.AddRegistry(locatorRegistry{
+			Simple: serviceregistry.Simple{
+				ProviderID:       serviceregistry.Kubernetes,
+				ClusterID:        "cluster-2",
+				ServiceDiscovery: mock.NewDiscovery(nil, 1),
+				Controller:       &mock.Controller{},
+			},
+			workloads: map[string]labels.Instance{"10.9.0.2": {"app": "legacy"}},
+		})
+		return ctl
+	}
+	vm := &model.Proxy{
+		ID:              "vm-1",
+		IPAddresses:     []string{"10.9.0.1", "10.9.0.2"},
+		ConfigNamespace: "legacy",
+		Metadata:        &model.NodeMetadata{ClusterID: "cluster-1"},
+	}
+
+	if instances, _ := newController(Options{}).GetProxyServiceInstances(vm); len(instances) != 0 {
+		t.Fatalf("expected no instance without the fallback, got %v", instances)
+	}
+
+	// The registry of another cluster than the one of the proxy locates it.
+	instances, err := newController(Options{LocalityFallback: true}).GetProxyServiceInstances(vm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 {
+		t.Fatalf("expected the instance locating the proxy, got %v", instances)
+	}
+	si := instances[0]
+	if si.ServicePort != nil || si.Service == nil || si.Service.Attributes.Namespace != "legacy" {
+		t.Fatalf("expected a placeholder service in the namespace of the proxy, without port, got %+v", si)
+	}
+	want := model.Locality{Label: "region1/zone1", ClusterID: "cluster-2"}
+	if si.Endpoint.Address != "10.9.0.2" || si.Endpoint.Locality != want ||
+		!reflect.DeepEqual(si.Endpoint.Labels, labels.Instance{"app": "legacy"}) {
+		t.Fatalf("expected the endpoint located in cluster-2, got %+v", si.Endpoint)
+	}
+	// The consumers of the proxy instances, such as the push, copy them.
+	if cp := si.DeepCopy(); cp.ServicePort != nil || !reflect.DeepEqual(cp.Endpoint, si.Endpoint) {
+		t.Fatalf("expected a copy without port of the instance, got %+v", cp)
+	}
+
+	unknown := &model.Proxy{ID: "vm-2", IPAddresses: []string{"10.9.0.3"}, Metadata: &model.NodeMetadata{}}
+	if instances, _ := newController(Options{LocalityFallback: true}).GetProxyServiceInstances(unknown); len(instances) != 0 {
+		t.Fatalf("expected no instance for a proxy no registry locates, got %v", instances)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"sync"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// maxProxyLookupFailures is the number of failed proxy lookups retained for debugging.
+const maxProxyLookupFailures = 64
+
+// ProxyLookupResult describes a GetProxyServiceInstances call which found no instance.
+type ProxyLookupResult struct {
+	ProxyID     string    `json:"proxyID"`
+	ClusterID   string    `json:"clusterID,omitempty"`
+	IPAddresses []string  `json:"ipAddresses,omitempty"`
+	Time        time.Time `json:"time"`
+	// Error is the error returned by the lookup, empty if the registries found no instance.
+	Error string `json:"error,omitempty"`
+}
+
+// proxyLookupFailures is a fixed size ring buffer of the most recent failed proxy lookups.
+type proxyLookupFailures struct {
+	mu      sync.Mutex
+	entries []ProxyLookupResult
+	// next is the position of the next entry to overwrite once the buffer is full.
+	next int
+}
+
+func (f *proxyLookupFailures) record(node *model.Proxy, err error) {
+	result := ProxyLookupResult{
+		ProxyID:     node.ID,
+		ClusterID:   nodeClusterID(node),
+		IPAddresses: append([]string(nil), node.IPAddresses...),
+		Time:        time.Now(),
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.entries) < maxProxyLookupFailures {
+		f.entries = append(f.entries, result)
+		return
+	}
+	f.entries[f.next] = result
+	f.next = (f.next + 1) % maxProxyLookupFailures
+}
+
+func (f *proxyLookupFailures) list() []ProxyLookupResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]ProxyLookupResult, 0, len(f.entries))
+	out = append(out, f.entries[f.next:]...)
+	out = append(out, f.entries[:f.next]...)
+	return out
+}
+
+// RecentProxyLookupFailures returns the most recent GetProxyServiceInstances calls which returned
+// no instance or an error, oldest first, each identified by the ID of the proxy. Only the last
+// few failures are retained.
+func (c *Controller) RecentProxyLookupFailures() []ProxyLookupResult {
+	return c.proxyLookupFailures.list()
+}
@@ -0,0 +1,54 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"fmt"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+)
+
+func TestRecentProxyLookupFailures(t *testing.T) {
+	aggregateCtl := buildMockController()
+
+	// Successful lookups are not recorded.
+	found := &model.Proxy{ID: "found", IPAddresses: []string{mock.HelloInstanceV0}}
+	if instances, err := aggregateCtl.GetProxyServiceInstances(found); err != nil || len(instances) == 0 {
+		t.Fatalf("GetProxyServiceInstances() = %v, %v", instances, err)
+	}
+	if failures := aggregateCtl.RecentProxyLookupFailures(); len(failures) != 0 {
+		t.Fatalf("expected no failure, got %v", failures)
+	}
+
+	for i := 0; i < maxProxyLookupFailures+2; i++ {
+		node := &model.Proxy{ID: fmt.Sprintf("missing-%d", i), IPAddresses: []string{"1.1.1.1"}}
+		if _, err := aggregateCtl.GetProxyServiceInstances(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	failures := aggregateCtl.RecentProxyLookupFailures()
+	if len(failures) != maxProxyLookupFailures {
+		t.Fatalf("expected %d failures, got %d", maxProxyLookupFailures, len(failures))
+	}
+	// The oldest failures were evicted.
+	if failures[0].ProxyID != "missing-2" || failures[len(failures)-1].ProxyID != fmt.Sprintf("missing-%d", maxProxyLookupFailures+1) {
+		t.Fatalf("unexpected failures order: first %s, last %s", failures[0].ProxyID, failures[len(failures)-1].ProxyID)
+	}
+	if failures[0].IPAddresses[0] != "1.1.1.1" || failures[0].Error != "" {
+		t.Fatalf("unexpected failure %+v", failures[0])
+	}
+}
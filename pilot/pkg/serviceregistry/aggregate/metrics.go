@@ -0,0 +1,175 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"context"
+	"sync/atomic"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+
+	"istio.io/pkg/log"
+	"istio.io/pkg/monitoring"
+)
+
+var (
+	clusterTag = monitoring.MustCreateLabel("cluster")
+	outcomeTag = monitoring.MustCreateLabel("outcome")
+
+	suppressedPushes = monitoring.NewSum(
+		"pilot_aggregate_suppressed_pushes_total",
+		"Total service events not delivered to handlers because the merged service was unchanged.",
+	)
+
+	mergeHostnames = monitoring.NewGauge(
+		"pilot_aggregate_merge_hostname_count",
+		"Number of hostnames merged across clusters by the last sampled service listing.",
+	)
+
+	mergeClustersPerHostname = monitoring.NewDistribution(
+		"pilot_aggregate_merge_clusters_per_hostname",
+		"Number of clusters contributing to each hostname merged by the sampled service listings.",
+		[]float64{1, 2, 3, 5, 10, 20, 50, 100},
+	)
+
+	registryRestarts = monitoring.NewSum(
+		"pilot_registry_restarts_total",
+		"Total restarts of registries whose Run returned while the aggregate was still running.",
+		monitoring.WithLabels(clusterTag),
+	)
+
+	handlerPanics = monitoring.NewSum(
+		"pilot_aggregate_handler_panics_total",
+		"Total panics of the handlers appended through the aggregate, recovered to protect the registries.",
+		monitoring.WithLabels(clusterTag),
+	)
+
+	circuitOpens = monitoring.NewSum(
+		"pilot_registry_circuit_open_total",
+		"Total openings of the circuit of registries skipped after consecutive failures.",
+		monitoring.WithLabels(clusterTag),
+	)
+
+	servicesMerged = monitoring.NewSum(
+		"pilot_aggregate_services_merged_total",
+		"Total services merged across clusters by the service listings of the aggregate, each "+
+			"merged hostname counting once per listing.",
+	)
+
+	mergeDuration = monitoring.NewDistribution(
+		"pilot_aggregate_merge_duration_seconds",
+		"Duration of the service listings of the aggregate, from querying the registries to "+
+			"merging their services, if any.",
+		[]float64{.001, .005, .01, .05, .1, .5, 1, 5},
+	)
+
+	staleServices = monitoring.NewSum(
+		"pilot_aggregate_stale_services_served_total",
+		"Total service listings for which all the registries failed, served the services of the last "+
+			"successful listing as per Options.ServeStaleOnError.",
+	)
+
+	fanoutRegistries = monitoring.NewGauge(
+		"pilot_aggregate_fanout_registries",
+		"Number of registries queried by each fan-out lookup (e.g. Services, InstancesByPort) of the "+
+			"top level aggregate, an estimate of the cost of the lookups. A group counts as one registry.",
+	)
+
+	proxyLookups = monitoring.NewSum(
+		"pilot_aggregate_proxy_lookup_total",
+		"Total GetProxyServiceInstances lookups by outcome: matched on the first registry searched "+
+			"(first), on a later one (later), after the CLUSTER_ID filter skipped registries "+
+			"(skipped), located by Options.LocalityFallback (fallback), or no instance found "+
+			"without (empty) or with (error) registry errors.",
+		monitoring.WithLabels(outcomeTag),
+	)
+
+	// The service count of the registries is recorded through OpenCensus directly: the series of
+	// a deleted registry must be dropped, which istio.io/pkg/monitoring does not support.
+	registryClusterKey      = tag.MustNewKey("cluster")
+	registryServicesMeasure = stats.Int64(
+		"pilot_registry_service_count",
+		"Number of services of each registry, as of the last service listing of the aggregate. "+
+			"The registries without cluster ID are labeled by provider.",
+		stats.UnitDimensionless,
+	)
+	registryServicesView = &view.View{
+		Name:        registryServicesMeasure.Name(),
+		Description: "Number of services of each registry, as of the last service listing of the aggregate.",
+		Measure:     registryServicesMeasure,
+		TagKeys:     []tag.Key{registryClusterKey},
+		Aggregation: view.LastValue(),
+	}
+
+	// The outcomes are created once, keeping the lookups from allocating labels.
+	proxyLookupFirst    = proxyLookups.With(outcomeTag.Value("first"))
+	proxyLookupLater    = proxyLookups.With(outcomeTag.Value("later"))
+	proxyLookupSkipped  = proxyLookups.With(outcomeTag.Value("skipped"))
+	proxyLookupFallback = proxyLookups.With(outcomeTag.Value("fallback"))
+	proxyLookupEmpty    = proxyLookups.With(outcomeTag.Value("empty"))
+	proxyLookupError    = proxyLookups.With(outcomeTag.Value("error"))
+)
+
+func init() {
+	monitoring.MustRegister(suppressedPushes)
+	monitoring.MustRegister(mergeHostnames)
+	monitoring.MustRegister(mergeClustersPerHostname)
+	monitoring.MustRegister(registryRestarts)
+	monitoring.MustRegister(handlerPanics)
+	monitoring.MustRegister(circuitOpens)
+	monitoring.MustRegister(servicesMerged)
+	monitoring.MustRegister(mergeDuration)
+	monitoring.MustRegister(staleServices)
+	monitoring.MustRegister(fanoutRegistries)
+	monitoring.MustRegister(proxyLookups)
+	if err := view.Register(registryServicesView); err != nil {
+		panic(err)
+	}
+}
+
+// registryLabel returns the cluster label of the per registry metrics: the cluster ID of the
+// registry, or its provider if it has none.
+func registryLabel(r *registryEntry) string {
+	if cluster := r.Cluster(); cluster != "" {
+		return cluster
+	}
+	return string(r.Provider())
+}
+
+// recordRegistryServiceCount records the number of services of the registry, also kept on the
+// registry to be recorded again by resetRegistryServiceCounts.
+func recordRegistryServiceCount(r *registryEntry, count int) {
+	atomic.StoreInt64(&r.serviceCount, int64(count))
+	_ = stats.RecordWithTags(context.Background(),
+		[]tag.Mutator{tag.Upsert(registryClusterKey, registryLabel(r))}, registryServicesMeasure.M(int64(count)))
+}
+
+// resetRegistryServiceCounts drops the service count series of the deleted registries. OpenCensus
+// cannot delete the row of a tag value, so the view is registered again, dropping all its rows,
+// and the counts of the remaining registries listed already are recorded again.
+func resetRegistryServiceCounts(registries []*registryEntry) {
+	view.Unregister(registryServicesView)
+	if err := view.Register(registryServicesView); err != nil {
+		log.Warnf("Failed to reset the registry service counts: %v", err)
+		return
+	}
+	for _, r := range registries {
+		if count := atomic.LoadInt64(&r.serviceCount); count >= 0 {
+			recordRegistryServiceCount(r, int(count))
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"sort"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+)
+
+// serviceHandler is a service handler appended through the aggregate.
+type serviceHandler struct {
+	registration *handlerRegistration
+	selector     ServiceSelector
+	f            func(*model.Service, model.Event)
+}
+
+// PruneOrphanedServices recomputes the merged services and, for the hostnames merged previously
+// but no longer present in any registry (e.g. the services of a deleted cluster), delivers a
+// delete event to the service handlers appended through the aggregate. The pruned hostnames are
+// returned, sorted. Nothing is pruned if a registry fails to list its services, as its services
+// would wrongly appear orphaned.
+func (c *Controller) PruneOrphanedServices() ([]host.Name, error) {
+	// The cache is updated in place by filtered listings, copy it.
+	c.mergeLock.Lock()
+	previous := make(map[host.Name]*model.Service, len(c.mergedServices))
+	for hostname, ms := range c.mergedServices {
+		previous[hostname] = ms.service
+	}
+	c.mergeLock.Unlock()
+
+	svcs, err := c.Services()
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[host.Name]struct{}, len(svcs))
+	for _, s := range svcs {
+		present[c.serviceKey(s)] = struct{}{}
+	}
+
+	var pruned []*model.Service
+	for hostname, svc := range previous {
+		if _, ok := present[hostname]; !ok {
+			pruned = append(pruned, svc)
+		}
+	}
+	sort.Slice(pruned, func(i, j int) bool { return pruned[i].Hostname < pruned[j].Hostname })
+
+	c.handlersLock.RLock()
+	handlers := c.serviceHandlers
+	c.handlersLock.RUnlock()
+
+	out := make([]host.Name, 0, len(pruned))
+	for _, svc := range pruned {
+		svc := svc
+		out = append(out, svc.Hostname)
+		for _, sh := range handlers {
+			if !sh.selector.matches(svc) {
+				continue
+			}
+			f := sh.f
+			c.dispatch(sh.registration, string(svc.Hostname), func() { f(svc, model.EventDelete) })
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,105 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pkg/config/host"
+)
+
+func TestPruneOrphanedServices(t *testing.T) {
+	hello := mock.MakeService("hello.default.svc.cluster.local", "10.1.0.0")
+	world := mock.MakeService("world.default.svc.cluster.local", "10.2.0.0")
+	discovery1 := mock.NewDiscovery(map[host.Name]*model.Service{hello.Hostname: hello, world.Hostname: world}, 1)
+
+	aggregateCtl := NewController(Options{})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-1",
+		ServiceDiscovery: discovery1,
+		Controller:       &mock.Controller{},
+	})
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-2",
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{hello.Hostname: hello}, 1),
+		Controller:       &mock.Controller{},
+	})
+
+	var deleted []host.Name
+	if err := aggregateCtl.AppendServiceHandler(func(svc *model.Service, event model.Event) {
+		if event == model.EventDelete {
+			deleted = append(deleted, svc.Hostname)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := aggregateCtl.Services(); err != nil {
+		t.Fatal(err)
+	}
+	if pruned, err := aggregateCtl.PruneOrphanedServices(); err != nil || len(pruned) != 0 {
+		t.Fatalf("expected nothing to prune, got %v, %v", pruned, err)
+	}
+
+	// Nothing is pruned while a registry fails.
+	discovery1.ServicesError = errors.New("mock Services error")
+	if pruned, err := aggregateCtl.PruneOrphanedServices(); err == nil || len(pruned) != 0 {
+		t.Fatalf("expected the prune to fail, got %v, %v", pruned, err)
+	}
+	discovery1.ServicesError = nil
+
+	// world is only served by cluster-1.
+	aggregateCtl.DeleteRegistry("cluster-1")
+	pruned, err := aggregateCtl.PruneOrphanedServices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pruned, []host.Name{world.Hostname}) || !reflect.DeepEqual(deleted, pruned) {
+		t.Fatalf("expected %s to be pruned, got %v and delete events for %v", world.Hostname, pruned, deleted)
+	}
+	if pruned, _ := aggregateCtl.PruneOrphanedServices(); len(pruned) != 0 {
+		t.Fatalf("expected nothing left to prune, got %v", pruned)
+	}
+}
+
+func TestPruneOrphanedServicesAllClusters(t *testing.T) {
+	orphan := mock.MakeService("orphan.default.svc.cluster.local", "10.3.0.0")
+	aggregateCtl := buildMockController()
+	aggregateCtl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-1",
+		ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{orphan.Hostname: orphan}, 1),
+		Controller:       &mock.Controller{},
+	})
+	if _, err := aggregateCtl.Services(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the last cluster is deleted, its services are pruned once.
+	aggregateCtl.DeleteRegistry("cluster-1")
+	if pruned, err := aggregateCtl.PruneOrphanedServices(); err != nil || len(pruned) != 1 {
+		t.Fatalf("expected a pruned service, got %v, %v", pruned, err)
+	}
+	if pruned, _ := aggregateCtl.PruneOrphanedServices(); len(pruned) != 0 {
+		t.Fatalf("expected nothing left to prune, got %v", pruned)
+	}
+}
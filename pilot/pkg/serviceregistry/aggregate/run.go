@@ -0,0 +1,155 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"istio.io/pkg/log"
+
+	"istio.io/istio/pilot/pkg/serviceregistry"
+)
+
+const (
+	// defaultRestartBackoff is the delay before restarting a registry whose Run returned, doubled
+	// on each successive restart up to defaultMaxRestartBackoff.
+	defaultRestartBackoff    = time.Second
+	defaultMaxRestartBackoff = time.Minute
+)
+
+// runRegistry runs the registry until stop is closed or the registry is deleted. A registry added
+// with RegistryOptions.RestartOnExit whose Run returns before then has stopped watching its
+// cluster, so it is restarted with a capped exponential backoff rather than leaving the cluster
+// silently unwatched. For the other registries, Run returning is a normal completion.
+func (c *Controller) runRegistry(r *registryEntry, stop <-chan struct{}) {
+	registryStop := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+		case <-r.stop:
+		}
+		close(registryStop)
+	}()
+
+	backoff, maxBackoff := c.restartBackoff, c.maxRestartBackoff
+	if backoff <= 0 {
+		backoff = defaultRestartBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxRestartBackoff
+	}
+	for {
+		atomic.StoreInt32(&r.running, 1)
+		r.Run(registryStop)
+		atomic.StoreInt32(&r.running, 0)
+		select {
+		case <-registryStop:
+			return
+		default:
+		}
+		if !r.restartOnExit {
+			return
+		}
+
+		log.Warnf("Registry for the cluster %s stopped running, restarting in %v", r.Cluster(), backoff)
+		registryRestarts.With(clusterTag.Value(r.Cluster())).Increment()
+		select {
+		case <-registryStop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// RegistryRunState returns whether the Run method of the registry of the cluster, started by the
+// aggregate, is executing: it is not before Run started the registry, once the registry stopped
+// or its Run returned, nor while a registry whose Run returned early waits to be restarted. False is returned for ok
+// if there is no registry for the cluster. It is intended for tests asserting the lifecycle of the
+// registries without sleeping.
+func (c *Controller) RegistryRunState(clusterID string) (running bool, ok bool) {
+	clusterID = c.normalizeClusterID(clusterID)
+	for _, r := range c.registryEntries() {
+		if c.normalizeClusterID(r.Cluster()) == clusterID {
+			return atomic.LoadInt32(&r.running) == 1, true
+		}
+	}
+	return false, false
+}
+
+// syncPollInterval is the interval at which AddRegistryAndWait checks whether the registry synced.
+const syncPollInterval = 100 * time.Millisecond
+
+// AddRegistryAndWait adds the registry, starts it if the aggregate is running, and waits until it
+// has synced, so that orchestration code can add clusters one at a time, knowing each is live
+// before proceeding. A registry added before Run is started by Run, the wait then only ending
+// once Run is called, or on timeout. On timeout, an error wrapping ErrRegistryTimeout naming the
+// cluster is returned, the registry being kept: it may still sync later.
+func (c *Controller) AddRegistryAndWait(registry serviceregistry.Instance, timeout time.Duration) error {
+	r, stop, err := c.addRegistry(registry, RegistryOptions{})
+	if err != nil {
+		return err
+	}
+	if stop != nil {
+		c.running.Add(1)
+		go func() {
+			defer c.running.Done()
+			c.runRegistry(r, stop)
+		}()
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(syncPollInterval)
+	defer ticker.Stop()
+	for !r.HasSynced() {
+		select {
+		case <-deadline.C:
+			return fmt.Errorf("%w: %s/%s not synced after %v", ErrRegistryTimeout, r.Provider(), r.Cluster(), timeout)
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// Close shuts the registries down gracefully: the registries implementing
+// serviceregistry.Drainer are first drained, so that they stop advertising new endpoints, then,
+// after Options.DrainGracePeriod, all the registries are stopped and Close waits for the
+// registries started by Run to return. The background merge of the services is stopped first.
+// Close must not be called while Run is starting the registries.
+func (c *Controller) Close() {
+	registries := c.registryEntries()
+	drained := false
+	for _, r := range registries {
+		if drainer, ok := r.Instance.(serviceregistry.Drainer); ok {
+			drainer.Drain()
+			drained = true
+		}
+	}
+	if drained && c.opts.DrainGracePeriod > 0 {
+		time.Sleep(c.opts.DrainGracePeriod)
+	}
+	c.stopWarm()
+	for _, r := range registries {
+		r.stopOnce.Do(func() { close(r.stop) })
+	}
+	c.running.Wait()
+	log.Info("Registry Aggregator closed")
+}
@@ -0,0 +1,291 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+)
+
+// flakyRunRegistry is a registry whose Run returns immediately for its first failures runs.
+type flakyRunRegistry struct {
+	serviceregistry.Simple
+	failures int32
+	runs     int32
+	stopped  chan struct{}
+}
+
+func (r *flakyRunRegistry) Run(stop <-chan struct{}) {
+	if atomic.AddInt32(&r.runs, 1) <= r.failures {
+		return
+	}
+	<-stop
+	close(r.stopped)
+}
+
+func newFlakyRunRegistry(clusterID string, failures int32) *flakyRunRegistry {
+	return &flakyRunRegistry{
+		Simple: serviceregistry.Simple{
+			ClusterID:        clusterID,
+			ServiceDiscovery: mock.NewDiscovery(nil, 1),
+			Controller:       &mock.Controller{},
+		},
+		failures: failures,
+		stopped:  make(chan struct{}),
+	}
+}
+
+func TestRunRestartsRegistries(t *testing.T) {
+	registry := newFlakyRunRegistry("cluster-1", 3)
+	ctl := NewController(Options{})
+	ctl.restartBackoff, ctl.maxRestartBackoff = time.Millisecond, 4*time.Millisecond
+	if err := ctl.AddRegistryWithOptions(registry, RegistryOptions{RestartOnExit: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		ctl.Run(stop)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&registry.runs) < 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the registry to be restarted 3 times, got %d runs", atomic.LoadInt32(&registry.runs))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(stop)
+	<-done
+	select {
+	case <-registry.stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the registry to be stopped")
+	}
+	// The registry stayed up once running, so it must not be restarted again.
+	if runs := atomic.LoadInt32(&registry.runs); runs != 4 {
+		t.Fatalf("expected 4 runs, got %d", runs)
+	}
+}
+
+func TestRunStopsRestartingDeletedRegistries(t *testing.T) {
+	registry := newFlakyRunRegistry("cluster-1", 1)
+	ctl := NewController(Options{})
+	ctl.restartBackoff = time.Hour
+	if err := ctl.AddRegistryWithOptions(registry, RegistryOptions{RestartOnExit: true}); err != nil {
+		t.Fatal(err)
+	}
+	entry := ctl.registryEntries()[0]
+
+	done := make(chan struct{})
+	go func() {
+		ctl.runRegistry(entry, make(chan struct{}))
+		close(done)
+	}()
+
+	// The registry is waiting for its restart, which deleting it must cancel.
+	ctl.DeleteRegistry("cluster-1")
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the restarts of the deleted registry to stop")
+	}
+	if runs := atomic.LoadInt32(&registry.runs); runs != 1 {
+		t.Fatalf("expected 1 run, got %d", runs)
+	}
+}
+
+func TestRunCompletesRegistriesNotRestarted(t *testing.T) {
+	registry := newFlakyRunRegistry("cluster-1", 1)
+	ctl := NewController(Options{})
+	ctl.restartBackoff = time.Millisecond
+	ctl.AddRegistry(registry)
+	entry := ctl.registryEntries()[0]
+
+	done := make(chan struct{})
+	go func() {
+		ctl.runRegistry(entry, make(chan struct{}))
+		close(done)
+	}()
+
+	// Run returning is a normal completion for a registry not added with RestartOnExit.
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the registry whose Run returned not to be restarted")
+	}
+	if runs := atomic.LoadInt32(&registry.runs); runs != 1 {
+		t.Fatalf("expected 1 run, got %d", runs)
+	}
+	if running, _ := ctl.RegistryRunState("cluster-1"); running {
+		t.Fatal("expected the registry not to be running")
+	}
+}
+
+// drainingRegistry records when it is drained and stopped.
+type drainingRegistry struct {
+	serviceregistry.Simple
+	mu      sync.Mutex
+	drained time.Time
+	stopped time.Time
+}
+
+func (r *drainingRegistry) Drain() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.drained = time.Now()
+}
+
+func (r *drainingRegistry) Run(stop <-chan struct{}) {
+	<-stop
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopped = time.Now()
+}
+
+func TestClose(t *testing.T) {
+	draining := &drainingRegistry{Simple: serviceregistry.Simple{ClusterID: "cluster-1", Controller: &mock.Controller{}}}
+	plain := newFlakyRunRegistry("cluster-2", 0)
+	ctl := NewController(Options{DrainGracePeriod: 50 * time.Millisecond})
+	ctl.AddRegistry(draining)
+	ctl.AddRegistry(plain)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go ctl.Run(stop)
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&plain.runs) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the registries to be started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctl.Close()
+	// Close waits for the registries to stop.
+	select {
+	case <-plain.stopped:
+	default:
+		t.Fatal("expected the registry not implementing Drain to be stopped")
+	}
+	draining.mu.Lock()
+	defer draining.mu.Unlock()
+	if draining.drained.IsZero() || draining.stopped.IsZero() {
+		t.Fatalf("expected the registry to be drained and stopped, drained at %v, stopped at %v", draining.drained, draining.stopped)
+	}
+	if gap := draining.stopped.Sub(draining.drained); gap < 50*time.Millisecond {
+		t.Fatalf("expected the registry to be stopped after the grace period, stopped %v after draining", gap)
+	}
+}
+
+// syncOnRunRegistry is a registry synced once it runs.
+type syncOnRunRegistry struct {
+	serviceregistry.Simple
+	synced int32
+}
+
+func (r *syncOnRunRegistry) Run(stop <-chan struct{}) {
+	atomic.StoreInt32(&r.synced, 1)
+	<-stop
+}
+
+func (r *syncOnRunRegistry) HasSynced() bool {
+	return atomic.LoadInt32(&r.synced) == 1
+}
+
+func TestAddRegistryAndWait(t *testing.T) {
+	newRegistry := func(clusterID string) *syncOnRunRegistry {
+		return &syncOnRunRegistry{Simple: serviceregistry.Simple{
+			ClusterID:        clusterID,
+			ServiceDiscovery: mock.NewDiscovery(nil, 1),
+			Controller:       &mock.Controller{},
+		}}
+	}
+	ctl := NewController(Options{})
+
+	// Not running: the registry is not started, so it does not sync.
+	err := ctl.AddRegistryAndWait(newRegistry("cluster-1"), 10*time.Millisecond)
+	if !errors.Is(err, ErrRegistryTimeout) || !strings.Contains(err.Error(), "cluster-1") {
+		t.Fatalf("expected a timeout naming cluster-1, got %v", err)
+	}
+	if len(ctl.GetRegistries()) != 1 {
+		t.Fatal("expected the registry to be kept on timeout")
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		ctl.Run(stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+		ctl.Close()
+	}()
+
+	// Running: the registry is started and waited for.
+	registry := newRegistry("cluster-2")
+	if err := ctl.AddRegistryAndWait(registry, 5*time.Second); err != nil {
+		t.Fatalf("AddRegistryAndWait() encountered unexpected error: %v", err)
+	}
+	if !registry.HasSynced() {
+		t.Fatal("expected the registry to be synced")
+	}
+}
+
+func TestRegistryRunState(t *testing.T) {
+	registry := newFlakyRunRegistry("cluster-1", 0)
+	ctl := NewController(Options{})
+	ctl.AddRegistry(registry)
+
+	if _, ok := ctl.RegistryRunState("cluster-2"); ok {
+		t.Fatal("expected no registry for cluster-2")
+	}
+	if running, ok := ctl.RegistryRunState("cluster-1"); !ok || running {
+		t.Fatalf("expected the registry not to run before Run, got %v, %v", running, ok)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		ctl.Run(stop)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for running, _ := ctl.RegistryRunState("cluster-1"); !running; running, _ = ctl.RegistryRunState("cluster-1") {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the registry to run")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(stop)
+	<-done
+	ctl.Close()
+	if running, ok := ctl.RegistryRunState("cluster-1"); !ok || running {
+		t.Fatalf("expected the registry to be stopped, got %v, %v", running, ok)
+	}
+}
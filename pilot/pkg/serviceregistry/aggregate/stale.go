@@ -0,0 +1,79 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/pkg/log"
+)
+
+// lastServices holds the result of the last Services() call during which no registry failed.
+type lastServices struct {
+	mu       sync.Mutex
+	services []*model.Service
+	updated  time.Time
+	// stale is set while Services serves the services recorded, all the registries failing.
+	stale bool
+}
+
+// serveStale records the services of a successful listing, and returns the last services
+// recorded, without error, instead of the result of a listing for which all the registries
+// failed. The staleness is reported by ServingStale, logged and counted by a metric rather than
+// returned as an error: the callers, such as the push context, drop the services listed along
+// with an error.
+func (c *Controller) serveStale(services []*model.Service, err error) ([]*model.Service, error) {
+	l := &c.lastServices
+	if err == nil {
+		l.mu.Lock()
+		l.services = services
+		l.updated = time.Now()
+		l.stale = false
+		l.mu.Unlock()
+		return services, nil
+	}
+	if !errors.Is(err, ErrAllRegistriesFailed) {
+		return services, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.services == nil {
+		return services, err
+	}
+	log.Warnf("All the registries failed to list their services, serving those listed at %v: %v", l.updated, err)
+	staleServices.Increment()
+	l.stale = true
+	// The slice is copied, the caller may modify it.
+	stale := make([]*model.Service, len(l.services))
+	copy(stale, l.services)
+	return stale, nil
+}
+
+// ServingStale returns true if the last Services call served the services of an earlier listing,
+// all the registries failing, along with the time those services were listed. See
+// Options.ServeStaleOnError.
+func (c *Controller) ServingStale() (lastUpdated time.Time, stale bool) {
+	l := &c.lastServices
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.stale {
+		return time.Time{}, false
+	}
+	return l.updated, true
+}
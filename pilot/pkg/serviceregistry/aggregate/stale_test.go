@@ -0,0 +1,97 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"errors"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pkg/config/host"
+)
+
+func TestServeStaleOnError(t *testing.T) {
+	for _, serveStale := range []bool{false, true} {
+		discovery1 := mock.NewDiscovery(map[host.Name]*model.Service{mock.HelloService.Hostname: mock.HelloService}, 1)
+		discovery2 := mock.NewDiscovery(map[host.Name]*model.Service{mock.WorldService.Hostname: mock.WorldService}, 1)
+		ctl := NewController(Options{ServeStaleOnError: serveStale})
+		for i, d := range []*mock.ServiceDiscovery{discovery1, discovery2} {
+			ctl.AddRegistry(serviceregistry.Simple{
+				ProviderID:       serviceregistry.Kubernetes,
+				ClusterID:        []string{"cluster-1", "cluster-2"}[i],
+				ServiceDiscovery: d,
+				Controller:       &mock.Controller{},
+			})
+		}
+		if svcs, err := ctl.Services(); err != nil || len(svcs) != 2 {
+			t.Fatalf("Services() = %v, %v", svcs, err)
+		}
+
+		// A partial failure returns the services of the other registries.
+		discovery1.ServicesError = errors.New("mock Services error")
+		svcs, err := ctl.Services()
+		if err == nil || len(svcs) != 1 {
+			t.Fatalf("expected the services of cluster-2 and an error, got %v, %v", svcs, err)
+		}
+		if _, stale := ctl.ServingStale(); stale {
+			t.Fatal("expected a partial failure not to be served stale")
+		}
+
+		// All the registries failing serves the services last listed without failure.
+		discovery2.ServicesError = errors.New("mock Services error")
+		svcs, err = ctl.Services()
+		if !serveStale {
+			if len(svcs) != 0 || !errors.Is(err, ErrAllRegistriesFailed) {
+				t.Fatalf("expected no stale service and ErrAllRegistriesFailed, got %v, %v", svcs, err)
+			}
+			if _, stale := ctl.ServingStale(); stale {
+				t.Fatal("expected no stale service to be served")
+			}
+			continue
+		}
+		// The stale services are returned without error, so that the push context keeps them.
+		if err != nil || len(svcs) != 2 {
+			t.Fatalf("expected the 2 stale services without error, got %v, %v", svcs, err)
+		}
+		if updated, stale := ctl.ServingStale(); !stale || updated.IsZero() {
+			t.Fatalf("expected stale services to be reported, got %v, %v", updated, stale)
+		}
+
+		// A successful listing is served again once the registries recover.
+		discovery1.ServicesError = nil
+		discovery2.ServicesError = nil
+		if svcs, err := ctl.Services(); err != nil || len(svcs) != 2 {
+			t.Fatalf("Services() = %v, %v", svcs, err)
+		}
+		if _, stale := ctl.ServingStale(); stale {
+			t.Fatal("expected the services to be fresh once the registries recovered")
+		}
+	}
+
+	// There is nothing stale to serve before a successful listing.
+	discovery := mock.NewDiscovery(nil, 1)
+	discovery.ServicesError = errors.New("mock Services error")
+	ctl := NewController(Options{ServeStaleOnError: true})
+	ctl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.External,
+		ServiceDiscovery: discovery,
+		Controller:       &mock.Controller{},
+	})
+	if svcs, err := ctl.Services(); len(svcs) != 0 || !errors.Is(err, ErrAllRegistriesFailed) {
+		t.Fatalf("expected no service and ErrAllRegistriesFailed, got %v, %v", svcs, err)
+	}
+}
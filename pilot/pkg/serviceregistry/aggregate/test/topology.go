@@ -0,0 +1,44 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package test provides helpers for testing against the aggregate controller.
+package test
+
+import (
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/aggregate"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+)
+
+// NewController builds an aggregate controller with a fake, empty, registry for each descriptor,
+// in order, so that its TopologySnapshot matches the descriptors.
+func NewController(opts aggregate.Options, topology []aggregate.RegistryDescriptor) (*aggregate.Controller, error) {
+	ctl := aggregate.NewController(opts)
+	for _, d := range topology {
+		registry := serviceregistry.Simple{
+			ProviderID:       d.Provider,
+			ClusterID:        d.ClusterID,
+			ServiceDiscovery: mock.NewDiscovery(nil, 1),
+			Controller:       &mock.Controller{},
+		}
+		if err := ctl.AddRegistryWithOptions(registry, aggregate.RegistryOptions{
+			Tags:          d.Tags,
+			Authoritative: d.Authoritative,
+			Weight:        d.Weight,
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return ctl, nil
+}
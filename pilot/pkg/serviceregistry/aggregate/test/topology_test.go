@@ -0,0 +1,43 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"reflect"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/aggregate"
+)
+
+func TestNewController(t *testing.T) {
+	topology := []aggregate.RegistryDescriptor{
+		{ClusterID: "cluster-1", Provider: serviceregistry.Kubernetes, Tags: map[string]string{"region": "us-east"}},
+		{ClusterID: "cluster-2", Provider: serviceregistry.Kubernetes, Authoritative: true},
+		{Provider: serviceregistry.External},
+	}
+	ctl, err := NewController(aggregate.Options{}, topology)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ctl.TopologySnapshot(); !reflect.DeepEqual(got, topology) {
+		t.Fatalf("expected the topology %v, got %v", topology, got)
+	}
+
+	ctl.DeleteRegistry("cluster-1")
+	if got := ctl.TopologySnapshot(); !reflect.DeepEqual(got, topology[1:]) {
+		t.Fatalf("expected the topology %v, got %v", topology[1:], got)
+	}
+}
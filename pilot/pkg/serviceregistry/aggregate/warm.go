@@ -0,0 +1,80 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"sync"
+	"time"
+
+	"istio.io/pkg/log"
+)
+
+// servicesWarmer recomputes the merged services in the background after they are invalidated,
+// so that the next Services() call finds them already merged.
+type servicesWarmer struct {
+	mu sync.Mutex
+	// timer fires the pending recompute, nil if none is pending.
+	timer *time.Timer
+	// stopped is set once the controller is stopped or closed, no recompute starting afterwards.
+	stopped bool
+	// running tracks the recompute in progress, waited for by stop.
+	running sync.WaitGroup
+}
+
+// scheduleWarm schedules a recompute of the merged services after Options.WarmServicesDelay,
+// unless one is already pending: the invalidations within the delay share a single recompute.
+func (c *Controller) scheduleWarm() {
+	if c.opts.WarmServicesDelay <= 0 {
+		return
+	}
+	w := &c.warmer
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped || w.timer != nil {
+		return
+	}
+	w.timer = time.AfterFunc(c.opts.WarmServicesDelay, c.warmServices)
+}
+
+func (c *Controller) warmServices() {
+	w := &c.warmer
+	w.mu.Lock()
+	w.timer = nil
+	if w.stopped {
+		w.mu.Unlock()
+		return
+	}
+	w.running.Add(1)
+	w.mu.Unlock()
+	defer w.running.Done()
+
+	if _, err := c.services(nil); err != nil {
+		log.Debugf("Failed to warm the merged services: %v", err)
+	}
+}
+
+// stopWarm cancels the pending recompute and waits for the one in progress, if any. No
+// recompute is scheduled afterwards.
+func (c *Controller) stopWarm() {
+	w := &c.warmer
+	w.mu.Lock()
+	w.stopped = true
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	w.mu.Unlock()
+	w.running.Wait()
+}
@@ -0,0 +1,140 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+	"istio.io/istio/pkg/config/host"
+)
+
+const warmDelay = 20 * time.Millisecond
+
+// servicesCountingDiscovery counts the Services calls made to a service discovery.
+type servicesCountingDiscovery struct {
+	*mock.ServiceDiscovery
+	calls int32
+}
+
+func (d *servicesCountingDiscovery) Services() ([]*model.Service, error) {
+	atomic.AddInt32(&d.calls, 1)
+	return d.ServiceDiscovery.Services()
+}
+
+func newWarmController(t *testing.T) (*Controller, []*servicesCountingDiscovery, []*fakeController) {
+	t.Helper()
+	ctl := NewController(Options{WarmServicesDelay: warmDelay})
+	var discoveries []*servicesCountingDiscovery
+	var controllers []*fakeController
+	for _, cluster := range []string{"cluster-1", "cluster-2"} {
+		d := &servicesCountingDiscovery{ServiceDiscovery: mock.NewDiscovery(map[host.Name]*model.Service{
+			mock.HelloService.Hostname: mock.HelloService,
+		}, 1)}
+		controller := &fakeController{}
+		ctl.AddRegistry(serviceregistry.Simple{
+			ProviderID:       serviceregistry.Kubernetes,
+			ClusterID:        cluster,
+			ServiceDiscovery: d,
+			Controller:       controller,
+		})
+		discoveries = append(discoveries, d)
+		controllers = append(controllers, controller)
+	}
+	if err := ctl.AppendServiceHandler(func(*model.Service, model.Event) {}); err != nil {
+		t.Fatal(err)
+	}
+	return ctl, discoveries, controllers
+}
+
+// waitServicesCalls waits for the registries to be listed the expected number of times,
+// then for the delay to pass without further listing, and resets the counts.
+func waitServicesCalls(t *testing.T, discoveries []*servicesCountingDiscovery, expected int32) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&discoveries[0].calls) < expected && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(5 * warmDelay)
+	for i, d := range discoveries {
+		if calls := atomic.SwapInt32(&d.calls, 0); calls != expected {
+			t.Fatalf("expected %d Services calls to cluster-%d, got %d", expected, i+1, calls)
+		}
+	}
+}
+
+func TestWarmServices(t *testing.T) {
+	ctl, discoveries, controllers := newWarmController(t)
+	defer ctl.Close()
+
+	// Adding the registries invalidates the merged services once.
+	waitServicesCalls(t, discoveries, 1)
+	ctl.mergeLock.Lock()
+	warmed := ctl.mergedServices[mock.HelloService.Hostname]
+	ctl.mergeLock.Unlock()
+	if warmed == nil || len(warmed.service.ClusterVIPs) != 2 {
+		t.Fatalf("expected the merged service to be warm, got %v", warmed)
+	}
+
+	// A burst of events is coalesced into a single merge.
+	for i := 0; i < 5; i++ {
+		for _, controller := range controllers {
+			controller.serviceEvent(mock.HelloService, model.EventUpdate)
+		}
+	}
+	waitServicesCalls(t, discoveries, 1)
+
+	// The merged services are reused by Services().
+	svcs, err := ctl.Services()
+	if err != nil || len(svcs) != 1 || svcs[0] != warmed.service {
+		t.Fatalf("expected Services() to return the warm service, got %v, %v", svcs, err)
+	}
+}
+
+func TestWarmServicesStopped(t *testing.T) {
+	ctl, discoveries, controllers := newWarmController(t)
+	ctl.restartBackoff = time.Hour
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		ctl.Run(stop)
+		close(done)
+	}()
+	waitServicesCalls(t, discoveries, 1)
+
+	// No merge is pending once the controller is stopped...
+	controllers[0].serviceEvent(mock.HelloService, model.EventUpdate)
+	close(stop)
+	<-done
+	waitServicesCalls(t, discoveries, 0)
+
+	// ... nor scheduled afterwards.
+	controllers[0].serviceEvent(mock.HelloService, model.EventUpdate)
+	waitServicesCalls(t, discoveries, 0)
+	ctl.Close()
+}
+
+func TestWarmServicesClosed(t *testing.T) {
+	ctl, discoveries, controllers := newWarmController(t)
+	waitServicesCalls(t, discoveries, 1)
+
+	controllers[0].serviceEvent(mock.HelloService, model.EventUpdate)
+	ctl.Close()
+	waitServicesCalls(t, discoveries, 0)
+}
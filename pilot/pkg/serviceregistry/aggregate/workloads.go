@@ -0,0 +1,128 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"fmt"
+
+	"istio.io/pkg/log"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+)
+
+// workloadRegistration is the registration of the workload of a proxy: the registry which
+// registered it, and the proxy registered, identifying the connection of the proxy.
+type workloadRegistration struct {
+	owner *registryEntry
+	proxy *model.Proxy
+}
+
+// RegisterWorkload registers the workload of a proxy connecting without a pre-created
+// WorkloadEntry, e.g. a VM through istio-agent, with its owning registry: the registry of the
+// cluster the proxy is bound to by its CLUSTER_ID metadata, or else the first registry without
+// cluster ID (e.g. ServiceEntry), implementing serviceregistry.WorkloadRegistry. The proxy is then
+// looked up in that registry first by GetProxyServiceInstances. An error wrapping
+// ErrNoWorkloadRegistry is returned if there is no such registry. Registering a proxy again, e.g.
+// as it reconnects, replaces its previous registration.
+func (c *Controller) RegisterWorkload(proxy *model.Proxy) error {
+	var candidates []*registryEntry
+	for _, r := range c.weightedRegistries() {
+		if _, ok := r.Instance.(serviceregistry.WorkloadRegistry); ok {
+			candidates = append(candidates, r)
+		}
+	}
+	owner := c.boundRegistry(candidates, proxy)
+	if owner == nil {
+		for _, r := range candidates {
+			if r.Cluster() == "" {
+				owner = r
+				break
+			}
+		}
+	}
+	if owner == nil {
+		return fmt.Errorf("%w: proxy %s in cluster %q", ErrNoWorkloadRegistry, proxy.ID, nodeClusterID(proxy))
+	}
+	err := owner.Instance.(serviceregistry.WorkloadRegistry).RegisterWorkload(proxy)
+	owner.recordResult(err)
+	if err != nil {
+		return registryError(owner, err)
+	}
+	c.workloadLock.Lock()
+	if c.workloadOwners == nil {
+		c.workloadOwners = make(map[string]workloadRegistration)
+	}
+	previous, ok := c.workloadOwners[proxy.ID]
+	c.workloadOwners[proxy.ID] = workloadRegistration{owner: owner, proxy: proxy}
+	c.workloadLock.Unlock()
+	if ok && previous.owner != owner {
+		// The previous owner still holds the workload, the new owner registered it anew.
+		if err := previous.owner.Instance.(serviceregistry.WorkloadRegistry).UnregisterWorkload(previous.proxy); err != nil {
+			log.Warnf("Failed to unregister the previous workload of proxy %s: %v", proxy.ID, err)
+		}
+	}
+	log.Debugf("Registered the workload of proxy %s with registry %s/%s", proxy.ID, owner.Provider(), owner.Cluster())
+	return nil
+}
+
+// UnregisterWorkload removes the workload registered by RegisterWorkload for the proxy, e.g. once
+// it disconnected. It is a no-op if the workload of the proxy was not registered, or was registered
+// again since by another connection of the proxy, i.e. with another *model.Proxy.
+func (c *Controller) UnregisterWorkload(proxy *model.Proxy) error {
+	c.workloadLock.Lock()
+	registration, ok := c.workloadOwners[proxy.ID]
+	if !ok || registration.proxy != proxy {
+		c.workloadLock.Unlock()
+		return nil
+	}
+	delete(c.workloadOwners, proxy.ID)
+	c.workloadLock.Unlock()
+	owner := registration.owner
+	err := owner.Instance.(serviceregistry.WorkloadRegistry).UnregisterWorkload(proxy)
+	owner.recordResult(err)
+	if err != nil {
+		return registryError(owner, err)
+	}
+	return nil
+}
+
+// workloadOwner returns the registry which registered the workload of the proxy, nil if none did
+// or it is not among the registries.
+func (c *Controller) workloadOwner(registries []*registryEntry, proxy *model.Proxy) *registryEntry {
+	c.workloadLock.Lock()
+	owner := c.workloadOwners[proxy.ID].owner
+	c.workloadLock.Unlock()
+	if owner == nil {
+		return nil
+	}
+	for _, r := range registries {
+		if r == owner {
+			return owner
+		}
+	}
+	return nil
+}
+
+// forgetWorkloads drops the workloads registered by a deleted registry.
+func (c *Controller) forgetWorkloads(r *registryEntry) {
+	c.workloadLock.Lock()
+	defer c.workloadLock.Unlock()
+	for id, registration := range c.workloadOwners {
+		if registration.owner == r {
+			delete(c.workloadOwners, id)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"errors"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/mock"
+)
+
+// workloadRegistry registers the workloads of the proxies, finding them once registered.
+type workloadRegistry struct {
+	serviceregistry.Simple
+	registered map[string]bool
+}
+
+func newWorkloadRegistry(provider serviceregistry.ProviderID, clusterID string) *workloadRegistry {
+	return &workloadRegistry{
+		Simple: serviceregistry.Simple{
+			ProviderID:       provider,
+			ClusterID:        clusterID,
+			ServiceDiscovery: mock.NewDiscovery(nil, 1),
+			Controller:       &mock.Controller{},
+		},
+		registered: make(map[string]bool),
+	}
+}
+
+func (r *workloadRegistry) RegisterWorkload(proxy *model.Proxy) error {
+	r.registered[proxy.ID] = true
+	return nil
+}
+
+func (r *workloadRegistry) UnregisterWorkload(proxy *model.Proxy) error {
+	delete(r.registered, proxy.ID)
+	return nil
+}
+
+func (r *workloadRegistry) GetProxyServiceInstances(proxy *model.Proxy) ([]*model.ServiceInstance, error) {
+	if !r.registered[proxy.ID] {
+		return nil, nil
+	}
+	return []*model.ServiceInstance{{
+		Service:  mock.HelloService,
+		Endpoint: &model.IstioEndpoint{Address: proxy.IPAddresses[0]},
+	}}, nil
+}
+
+func TestRegisterWorkload(t *testing.T) {
+	entries := newWorkloadRegistry(serviceregistry.External, "")
+	remote := newWorkloadRegistry(serviceregistry.Kubernetes, "cluster-2")
+	ctl := NewController(Options{})
+	ctl.AddRegistry(serviceregistry.Simple{
+		ProviderID:       serviceregistry.Kubernetes,
+		ClusterID:        "cluster-1",
+		ServiceDiscovery: mock.NewDiscovery(nil, 1),
+		Controller:       &mock.Controller{},
+	})
+	ctl.AddRegistry(entries)
+	ctl.AddRegistry(remote)
+
+	vm := &model.Proxy{ID: "vm-1", IPAddresses: []string{"10.9.0.1"}, Metadata: &model.NodeMetadata{ClusterID: "cluster-1"}}
+	if instances, _ := ctl.GetProxyServiceInstances(vm); len(instances) != 0 {
+		t.Fatalf("expected no instance before the registration, got %v", instances)
+	}
+	// Cluster-1 cannot register workloads, the registry without cluster ID owns the workload.
+	if err := ctl.RegisterWorkload(vm); err != nil {
+		t.Fatal(err)
+	}
+	if !entries.registered[vm.ID] || remote.registered[vm.ID] {
+		t.Fatal("expected the workload to be registered by the registry without cluster ID")
+	}
+	instances, err := ctl.GetProxyServiceInstances(vm)
+	if err != nil || len(instances) != 1 || instances[0].Endpoint.Address != "10.9.0.1" {
+		t.Fatalf("expected the instance of the registered workload, got %v, %v", instances, err)
+	}
+
+	// The registry of the cluster of the proxy owns the workload when it can register it.
+	remoteVM := &model.Proxy{ID: "vm-2", IPAddresses: []string{"10.9.0.2"}, Metadata: &model.NodeMetadata{ClusterID: "cluster-2"}}
+	if err := ctl.RegisterWorkload(remoteVM); err != nil {
+		t.Fatal(err)
+	}
+	if !remote.registered[remoteVM.ID] || entries.registered[remoteVM.ID] {
+		t.Fatal("expected the workload to be registered by the registry of cluster-2")
+	}
+
+	if err := ctl.UnregisterWorkload(vm); err != nil {
+		t.Fatal(err)
+	}
+	if instances, _ := ctl.GetProxyServiceInstances(vm); len(instances) != 0 {
+		t.Fatalf("expected no instance once unregistered, got %v", instances)
+	}
+
+	// The disconnection of a previous connection of a proxy keeps the registration of the new one.
+	reconnected := &model.Proxy{ID: vm.ID, IPAddresses: vm.IPAddresses, Metadata: vm.Metadata}
+	if err := ctl.RegisterWorkload(vm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctl.RegisterWorkload(reconnected); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctl.UnregisterWorkload(vm); err != nil {
+		t.Fatal(err)
+	}
+	if !entries.registered[vm.ID] {
+		t.Fatal("expected the workload to stay registered by the new connection")
+	}
+	if err := ctl.UnregisterWorkload(reconnected); err != nil {
+		t.Fatal(err)
+	}
+	if entries.registered[vm.ID] {
+		t.Fatal("expected the workload to be unregistered by the new connection")
+	}
+
+	ctl.DeleteRegistry("cluster-2")
+	if owner := ctl.workloadOwner(ctl.registryEntries(), remoteVM); owner != nil || len(ctl.workloadOwners) != 0 {
+		t.Fatal("expected the workloads of the deleted registry to be forgotten")
+	}
+
+	empty := NewController(Options{})
+	if err := empty.RegisterWorkload(vm); !errors.Is(err, ErrNoWorkloadRegistry) {
+		t.Fatalf("RegisterWorkload() error = %v, expected ErrNoWorkloadRegistry", err)
+	}
+}
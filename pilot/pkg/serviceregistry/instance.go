@@ -16,6 +16,8 @@ package serviceregistry
 
 import (
 	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
 )
 
 // Instance of a service registry. A single service registry combines the capabilities of service discovery
@@ -31,6 +33,79 @@ type Instance interface {
 	Cluster() string
 }
 
+// ProxyIPLookup is optionally implemented by registries that index workloads by a single IP address.
+// It allows proxies with multiple IP addresses to be resolved one address at a time.
+type ProxyIPLookup interface {
+	// GetProxyServiceInstancesByIP lists service instances co-located with the given IP address.
+	GetProxyServiceInstancesByIP(ip string) ([]*model.ServiceInstance, error)
+}
+
+// ProxyRecognizer is optionally implemented by registries able to cheaply tell whether a proxy
+// belongs to them, without building its service instances.
+type ProxyRecognizer interface {
+	// HasProxy returns true if the proxy is known to the registry.
+	HasProxy(proxy *model.Proxy) bool
+}
+
+// WorkloadRegistry is optionally implemented by registries able to register the workload of a
+// proxy connecting without a pre-created WorkloadEntry (e.g. a VM through istio-agent), the
+// registry then finding the proxy in GetProxyServiceInstances.
+type WorkloadRegistry interface {
+	// RegisterWorkload registers the workload of the proxy.
+	RegisterWorkload(proxy *model.Proxy) error
+	// UnregisterWorkload removes the workload registered for the proxy, e.g. once it disconnected.
+	UnregisterWorkload(proxy *model.Proxy) error
+}
+
+// WorkloadLocator is optionally implemented by registries able to locate a workload by IP, even
+// when it backs no service, e.g. a VM outside of the mesh.
+type WorkloadLocator interface {
+	// LocateWorkload returns the labels and locality of the workload with the IP, false if the
+	// registry does not know the workload.
+	LocateWorkload(ip string) (labels.Instance, model.Locality, bool)
+}
+
+// ServiceCounter is optionally implemented by registries able to count their services without
+// listing them.
+type ServiceCounter interface {
+	// ServiceCount returns the number of services in the registry.
+	ServiceCount() (int, error)
+}
+
+// HostnameLister is optionally implemented by registries able to list the hostnames of their
+// services without building the services.
+type HostnameLister interface {
+	// Hostnames returns the hostnames of the services in the registry.
+	Hostnames() ([]host.Name, error)
+}
+
+// EndpointCounter is optionally implemented by registries able to count the endpoints of their
+// services without building the service instances.
+type EndpointCounter interface {
+	// EndpointCounts returns the number of endpoints of each service of the registry, by hostname.
+	EndpointCounts() (map[host.Name]int, error)
+}
+
+// TrustDomainProvider is optionally implemented by registries knowing the trust domain of the
+// workloads of their cluster, e.g. to assemble the trust bundles of multi-cluster mTLS.
+type TrustDomainProvider interface {
+	// TrustDomain returns the trust domain of the cluster of the registry.
+	TrustDomain() string
+}
+
+// NetworkProvider is optionally implemented by registries knowing the networks the endpoints of
+// their cluster are on, e.g. from the mesh networks configuration.
+type NetworkProvider interface {
+	Networks() []string
+}
+
+// Drainer is optionally implemented by registries able to stop advertising new endpoints ahead of
+// being stopped, for a graceful shutdown.
+type Drainer interface {
+	// Drain stops the registry from accepting or advertising new endpoints.
+	Drain()
+}
+
 var _ Instance = &Simple{}
 
 // Simple Instance implementation, where fields are set individually.
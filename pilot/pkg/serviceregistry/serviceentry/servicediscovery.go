@@ -23,14 +23,19 @@ import (
 	"istio.io/pkg/log"
 
 	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/networking/util"
 	"istio.io/istio/pilot/pkg/serviceregistry"
 	"istio.io/istio/pkg/config/constants"
 	"istio.io/istio/pkg/config/host"
 	"istio.io/istio/pkg/config/labels"
 	"istio.io/istio/pkg/config/schema/gvk"
+	"istio.io/istio/pkg/spiffe"
 )
 
-var _ serviceregistry.Instance = &ServiceEntryStore{}
+var (
+	_ serviceregistry.Instance         = &ServiceEntryStore{}
+	_ serviceregistry.WorkloadRegistry = &ServiceEntryStore{}
+)
 
 // instancesKey acts as a key to identify all instances for a given hostname/namespace pair
 // This is mostly used as an index
@@ -70,6 +75,8 @@ type ServiceEntryStore struct { // nolint:golint
 	instances map[instancesKey]map[configKey][]*model.ServiceInstance
 	// workload instances from kubernetes pods - map of ip -> workload instance
 	workloadInstancesByIP map[string]*model.WorkloadInstance
+	// workloads registered by connected proxies - map of proxy id -> registration
+	registeredWorkloads map[string]workloadRegistration
 	// seWithSelectorByNamespace keeps track of ServiceEntries with selectors, keyed by namespaces
 	seWithSelectorByNamespace map[string][]servicesWithEntry
 	changeMutex               sync.RWMutex
@@ -86,6 +93,7 @@ func NewServiceDiscovery(configController model.ConfigStoreCache, store model.Is
 		ip2instance:           map[string][]*model.ServiceInstance{},
 		instances:             map[instancesKey]map[configKey][]*model.ServiceInstance{},
 		workloadInstancesByIP: map[string]*model.WorkloadInstance{},
+		registeredWorkloads:   map[string]workloadRegistration{},
 		refreshIndexes:        true,
 	}
 	if configController != nil {
@@ -337,6 +345,100 @@ func (s *ServiceEntryStore) WorkloadInstanceHandler(si *model.WorkloadInstance,
 	s.edsUpdate(instances)
 }
 
+// workloadRegistration is the registration of the workload of a connected proxy. The proxy
+// identifies the connection, a reconnecting proxy being registered again with a new one.
+type workloadRegistration struct {
+	proxy *model.Proxy
+	// instance is the workload instance created by the registration, nil if the IP of the proxy
+	// was already known from another source, e.g. a pod or a WorkloadEntry.
+	instance *model.WorkloadInstance
+}
+
+// RegisterWorkload registers the workload of a proxy connecting without a WorkloadEntry, e.g. a VM,
+// as a workload instance selected by the ServiceEntries of its namespace, the same way as the pods
+// of the kubernetes registries. No instance is created if its IP is already known from another
+// source. Registering the proxy again, e.g. as it reconnects, replaces its previous registration.
+func (s *ServiceEntryStore) RegisterWorkload(proxy *model.Proxy) error {
+	wi, err := proxyWorkloadInstance(proxy)
+	if err != nil {
+		return err
+	}
+	s.storeMutex.Lock()
+	previous := s.registeredWorkloads[proxy.ID]
+	if previous.instance != nil && s.workloadInstancesByIP[previous.instance.Endpoint.Address] != previous.instance {
+		// Replaced since by another source.
+		previous.instance = nil
+	}
+	if existing, exists := s.workloadInstancesByIP[wi.Endpoint.Address]; exists && existing != previous.instance {
+		s.registeredWorkloads[proxy.ID] = workloadRegistration{proxy: proxy}
+		s.storeMutex.Unlock()
+		log.Debugf("Skip registering proxy %s, workload %s already known", proxy.ID, wi.Endpoint.Address)
+		return nil
+	}
+	s.registeredWorkloads[proxy.ID] = workloadRegistration{proxy: proxy, instance: wi}
+	s.storeMutex.Unlock()
+
+	if previous.instance != nil && previous.instance.Endpoint.Address != wi.Endpoint.Address {
+		s.WorkloadInstanceHandler(previous.instance, model.EventDelete)
+	}
+	s.WorkloadInstanceHandler(wi, model.EventAdd)
+	return nil
+}
+
+// UnregisterWorkload removes the workload registered by RegisterWorkload for the proxy. It is a
+// no-op if the proxy was registered again since, by another connection, or if the workload
+// instance was not created by the registration.
+func (s *ServiceEntryStore) UnregisterWorkload(proxy *model.Proxy) error {
+	s.storeMutex.Lock()
+	registration, exists := s.registeredWorkloads[proxy.ID]
+	if !exists || registration.proxy != proxy {
+		s.storeMutex.Unlock()
+		return nil
+	}
+	delete(s.registeredWorkloads, proxy.ID)
+	wi := registration.instance
+	owned := wi != nil && s.workloadInstancesByIP[wi.Endpoint.Address] == wi
+	s.storeMutex.Unlock()
+	if !owned {
+		return nil
+	}
+
+	s.WorkloadInstanceHandler(wi, model.EventDelete)
+	return nil
+}
+
+// proxyWorkloadInstance converts the proxy to the workload instance registered for it.
+func proxyWorkloadInstance(proxy *model.Proxy) (*model.WorkloadInstance, error) {
+	if len(proxy.IPAddresses) == 0 {
+		return nil, fmt.Errorf("proxy %s has no IP address", proxy.ID)
+	}
+	if proxy.ConfigNamespace == "" {
+		return nil, fmt.Errorf("proxy %s has no namespace", proxy.ID)
+	}
+	meta := proxy.Metadata
+	if meta == nil {
+		meta = &model.NodeMetadata{}
+	}
+	var sa string
+	if meta.ServiceAccount != "" {
+		sa = spiffe.MustGenSpiffeURI(proxy.ConfigNamespace, meta.ServiceAccount)
+	}
+	return &model.WorkloadInstance{
+		Namespace: proxy.ConfigNamespace,
+		Endpoint: &model.IstioEndpoint{
+			Address:        proxy.IPAddresses[0],
+			Labels:         meta.Labels,
+			ServiceAccount: sa,
+			Network:        meta.Network,
+			Locality: model.Locality{
+				Label:     util.LocalityToString(proxy.Locality),
+				ClusterID: meta.ClusterID,
+			},
+			TLSMode: model.IstioMutualTLSModeLabel,
+		},
+	}, nil
+}
+
 func (s *ServiceEntryStore) Provider() serviceregistry.ProviderID {
 	return serviceregistry.External
 }
@@ -653,6 +653,116 @@ func TestServiceDiscoveryWorkloadInstance(t *testing.T) {
 	})
 }
 
+func TestServiceDiscoveryRegisterWorkload(t *testing.T) {
+	store, sd, events, stopFn := initServiceDiscovery()
+	defer stopFn()
+
+	// A proxy without WorkloadEntry, selected by the `selector` SE
+	proxy := &model.Proxy{
+		ID:              "vm.selector",
+		Type:            model.SidecarProxy,
+		IPAddresses:     []string{"2.2.2.2"},
+		ConfigNamespace: selector.Name,
+		Metadata: &model.NodeMetadata{
+			Labels:         map[string]string{"app": "wle"},
+			ServiceAccount: "default",
+		},
+	}
+
+	createConfigs([]*model.Config{selector}, store, t)
+	expectEvents(t, events, Event{kind: "xds"})
+
+	t.Run("register workload", func(t *testing.T) {
+		if err := sd.RegisterWorkload(proxy); err != nil {
+			t.Fatalf("RegisterWorkload() failed: %v", err)
+		}
+		instances := []*model.ServiceInstance{
+			makeInstanceWithServiceAccount(selector, "2.2.2.2", 444,
+				selector.Spec.(*networking.ServiceEntry).Ports[0], map[string]string{"app": "wle"}, "default"),
+			makeInstanceWithServiceAccount(selector, "2.2.2.2", 445,
+				selector.Spec.(*networking.ServiceEntry).Ports[1], map[string]string{"app": "wle"}, "default"),
+		}
+		expectProxyInstances(t, sd, instances, "2.2.2.2")
+		expectServiceInstances(t, sd, selector, 0, instances)
+		expectEvents(t, events, Event{kind: "eds", host: "selector.com", namespace: selector.Namespace, endpoints: 2})
+	})
+
+	t.Run("unregister workload", func(t *testing.T) {
+		if err := sd.UnregisterWorkload(proxy); err != nil {
+			t.Fatalf("UnregisterWorkload() failed: %v", err)
+		}
+		instances := []*model.ServiceInstance{}
+		expectProxyInstances(t, sd, instances, "2.2.2.2")
+		expectServiceInstances(t, sd, selector, 0, instances)
+		expectEvents(t, events, Event{kind: "eds", host: "selector.com", namespace: selector.Namespace, endpoints: 0})
+	})
+
+	t.Run("reconnected workload", func(t *testing.T) {
+		if err := sd.RegisterWorkload(proxy); err != nil {
+			t.Fatalf("RegisterWorkload() failed: %v", err)
+		}
+		expectEvents(t, events, Event{kind: "eds", host: "selector.com", namespace: selector.Namespace, endpoints: 2})
+
+		// The previous connection closes after the proxy reconnected, its registration is kept
+		reconnected := *proxy
+		if err := sd.RegisterWorkload(&reconnected); err != nil {
+			t.Fatalf("RegisterWorkload() failed: %v", err)
+		}
+		if err := sd.UnregisterWorkload(proxy); err != nil {
+			t.Fatalf("UnregisterWorkload() failed: %v", err)
+		}
+		instances := []*model.ServiceInstance{
+			makeInstanceWithServiceAccount(selector, "2.2.2.2", 444,
+				selector.Spec.(*networking.ServiceEntry).Ports[0], map[string]string{"app": "wle"}, "default"),
+			makeInstanceWithServiceAccount(selector, "2.2.2.2", 445,
+				selector.Spec.(*networking.ServiceEntry).Ports[1], map[string]string{"app": "wle"}, "default"),
+		}
+		expectProxyInstances(t, sd, instances, "2.2.2.2")
+
+		if err := sd.UnregisterWorkload(&reconnected); err != nil {
+			t.Fatalf("UnregisterWorkload() failed: %v", err)
+		}
+		expectProxyInstances(t, sd, []*model.ServiceInstance{}, "2.2.2.2")
+		expectEvents(t, events, Event{kind: "eds", host: "selector.com", namespace: selector.Namespace, endpoints: 0})
+	})
+
+	t.Run("workload known from another source", func(t *testing.T) {
+		pod := &model.WorkloadInstance{
+			Namespace: selector.Name,
+			Endpoint: &model.IstioEndpoint{
+				Address:        "2.2.2.2",
+				Labels:         map[string]string{"app": "wle"},
+				ServiceAccount: spiffe.MustGenSpiffeURI(selector.Name, "default"),
+				TLSMode:        model.IstioMutualTLSModeLabel,
+			},
+		}
+		callInstanceHandlers([]*model.WorkloadInstance{pod}, sd, model.EventAdd, t)
+		expectEvents(t, events, Event{kind: "eds", host: "selector.com", namespace: selector.Namespace, endpoints: 2})
+
+		// The proxy of the pod is not registered, nor is the pod removed as it disconnects
+		if err := sd.RegisterWorkload(proxy); err != nil {
+			t.Fatalf("RegisterWorkload() failed: %v", err)
+		}
+		if err := sd.UnregisterWorkload(proxy); err != nil {
+			t.Fatalf("UnregisterWorkload() failed: %v", err)
+		}
+		instances := []*model.ServiceInstance{
+			makeInstanceWithServiceAccount(selector, "2.2.2.2", 444,
+				selector.Spec.(*networking.ServiceEntry).Ports[0], map[string]string{"app": "wle"}, "default"),
+			makeInstanceWithServiceAccount(selector, "2.2.2.2", 445,
+				selector.Spec.(*networking.ServiceEntry).Ports[1], map[string]string{"app": "wle"}, "default"),
+		}
+		expectProxyInstances(t, sd, instances, "2.2.2.2")
+		expectServiceInstances(t, sd, selector, 0, instances)
+	})
+
+	t.Run("proxy without address", func(t *testing.T) {
+		if err := sd.RegisterWorkload(&model.Proxy{ID: "noip", ConfigNamespace: selector.Name}); err == nil {
+			t.Fatalf("RegisterWorkload() of a proxy without IP address succeeded")
+		}
+	})
+}
+
 func expectProxyInstances(t *testing.T, sd *ServiceEntryStore, expected []*model.ServiceInstance, ip string) {
 	t.Helper()
 	// The system is eventually consistent, so add some retries
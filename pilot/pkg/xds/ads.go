@@ -163,6 +163,7 @@ func (s *DiscoveryServer) receiveThread(con *Connection, reqChannel chan *discov
 			}
 			defer func() {
 				s.removeCon(con.ConID)
+				s.unregisterWorkload(con.node)
 				if s.InternalGen != nil {
 					s.InternalGen.OnDisconnect(con)
 				}
@@ -493,6 +494,34 @@ func (s *DiscoveryServer) initConnection(node *core.Node, con *Connection) error
 	return nil
 }
 
+// registerWorkload registers the workload of a sidecar without any service instance, e.g. a VM
+// connecting without a WorkloadEntry, with the WorkloadRegistry. Failures are logged only, the
+// proxy still being served the configuration of its namespace. The registration is per connection:
+// the proxy registered is the one of the connection, unregistered once it closes.
+func (s *DiscoveryServer) registerWorkload(proxy *model.Proxy) {
+	if s.WorkloadRegistry == nil || proxy.Type != model.SidecarProxy {
+		return
+	}
+	if instances, err := s.Env.ServiceDiscovery.GetProxyServiceInstances(proxy); err != nil || len(instances) > 0 {
+		// Known to the registries already, e.g. a pod, or unknown whether it is.
+		return
+	}
+	if err := s.WorkloadRegistry.RegisterWorkload(proxy); err != nil {
+		adsLog.Warnf("ADS: failed to register the workload of %s: %v", proxy.ID, err)
+	}
+}
+
+// unregisterWorkload removes the workload registered by registerWorkload for the proxy, if any and
+// not registered again since by a new connection of the proxy.
+func (s *DiscoveryServer) unregisterWorkload(proxy *model.Proxy) {
+	if s.WorkloadRegistry == nil || proxy == nil {
+		return
+	}
+	if err := s.WorkloadRegistry.UnregisterWorkload(proxy); err != nil {
+		adsLog.Warnf("ADS: failed to unregister the workload of %s: %v", proxy.ID, err)
+	}
+}
+
 // initProxy initializes the Proxy from node.
 func (s *DiscoveryServer) initProxy(node *core.Node) (*model.Proxy, error) {
 	meta, err := model.ParseMetadata(node.Metadata)
@@ -506,7 +535,10 @@ func (s *DiscoveryServer) initProxy(node *core.Node) (*model.Proxy, error) {
 	// Update the config namespace associated with this proxy
 	proxy.ConfigNamespace = model.GetProxyConfigNamespace(proxy)
 
+	// Register the workload before computing the service instances, for the first push to include them.
+	s.registerWorkload(proxy)
 	if err = s.setProxyState(proxy, s.globalPushContext()); err != nil {
+		s.unregisterWorkload(proxy)
 		return nil, err
 	}
 
@@ -118,7 +118,12 @@ func (s *DiscoveryServer) InitDebug(mux *http.ServeMux, sctl *aggregate.Controll
 	s.addDebugHandler(mux, "/debug/syncz", "Synchronization status of all Envoys connected to this Pilot instance", s.Syncz)
 	s.addDebugHandler(mux, "/debug/config_distribution", "Version status of all Envoys connected to this Pilot instance", s.distributedVersions)
 
-	s.addDebugHandler(mux, "/debug/registryz", "Debug support for registry", s.registryz)
+	s.addDebugHandler(mux, "/debug/registryz", "Debug support for registry, or with ?health=true the health of the registries of each cluster",
+		s.registryzHandler(sctl))
+	s.addDebugHandler(mux, "/debug/registry_orderz", "Order in which the registries are probed to resolve a hostname",
+		s.RegistryOrderHandler(sctl))
+	s.addDebugHandler(mux, "/debug/clustervipz", "Per cluster VIPs and external addresses of the services merged across clusters",
+		s.ClusterVIPsHandler(sctl))
 	s.addDebugHandler(mux, "/debug/endpointz", "Debug support for endpoints", s.endpointz)
 	s.addDebugHandler(mux, "/debug/endpointShardz", "Info about the endpoint shards", s.endpointShardz)
 	s.addDebugHandler(mux, "/debug/configz", "Debug support for config", s.configz)
@@ -208,6 +213,26 @@ func (s *DiscoveryServer) registryz(w http.ResponseWriter, req *http.Request) {
 	_, _ = fmt.Fprintln(w, "{}]")
 }
 
+// registryzHandler serves registryz, or with health=true the health of the registries of the
+// aggregate controller, to tell which cluster is lagging or disconnected.
+func (s *DiscoveryServer) registryzHandler(sctl *aggregate.Controller) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		_ = req.ParseForm()
+		if req.Form.Get("health") != "true" {
+			s.registryz(w, req)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		out, err := json.MarshalIndent(sctl.HealthStatus(), "", "  ")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = fmt.Fprintf(w, "unable to marshal registry health: %v", err)
+			return
+		}
+		_, _ = w.Write(out)
+	}
+}
+
 // Dumps info about the endpoint shards, tracked using the new direct interface.
 // Legacy registry provides are synced to the new data structure as well, during
 // the full push.
@@ -558,6 +583,42 @@ func (s *DiscoveryServer) InjectTemplateHandler(webhook *inject.Webhook) func(ht
 	}
 }
 
+// RegistryOrderHandler dumps the registries of the aggregate controller in the order they are
+// probed to resolve a hostname, by descending weight, the first registry having a hostname
+// providing its service.
+func (s *DiscoveryServer) RegistryOrderHandler(sctl *aggregate.Controller) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		out, err := json.MarshalIndent(sctl.ResolutionOrder(), "", "  ")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = fmt.Fprintf(w, "unable to marshal registry order: %v", err)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		_, _ = w.Write(out)
+	}
+}
+
+// ClusterVIPsHandler dumps, by hostname, the per cluster VIPs and external addresses of the
+// services merged by the aggregate controller, to verify the split horizon EDS data.
+func (s *DiscoveryServer) ClusterVIPsHandler(sctl *aggregate.Controller) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		addresses, err := sctl.ClusterAddresses()
+		if err != nil {
+			// The addresses of the registries which did not fail are still dumped.
+			adsLog.Warnf("clustervipz: %v", err)
+		}
+		out, err := json.MarshalIndent(addresses, "", "  ")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = fmt.Fprintf(w, "unable to marshal cluster VIPs: %v", err)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		_, _ = w.Write(out)
+	}
+}
+
 // PushStatusHandler dumps the last PushContext
 func (s *DiscoveryServer) PushStatusHandler(w http.ResponseWriter, req *http.Request) {
 	if model.LastPushStatus == nil {
@@ -127,6 +127,10 @@ type DiscoveryServer struct {
 	// InternalGen is notified of connect/disconnect/nack on all connections
 	InternalGen *InternalGen
 
+	// WorkloadRegistry, if set, registers the workloads of the sidecars connecting without any
+	// service instance, and removes them once they disconnect.
+	WorkloadRegistry serviceregistry.WorkloadRegistry
+
 	// serverReady indicates caches have been synced up and server is ready to process requests.
 	serverReady bool
 }